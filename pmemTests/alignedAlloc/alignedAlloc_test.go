@@ -0,0 +1,66 @@
+// +build pmemTest
+
+// This test allocates aligned persistent memory buffers using PnewAligned()
+// and verifies that they are still aligned after a restart. It is run only if
+// a flag 'pmemTest' is specified. This test need to be run two times to test
+// the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const dataFile = "./datafile"
+
+var (
+	aligns = []uintptr{64, 512, 4096, 8192}
+	sizes  = []uintptr{24, 3000, 50000}
+)
+
+type rootObj struct {
+	bufs [12]unsafe.Pointer
+}
+
+func TestPmemAlignedAlloc(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		r := pnew(rootObj)
+		i := 0
+		for _, align := range aligns {
+			for _, size := range sizes {
+				p := runtime.PnewAligned(size, align)
+				*(*uintptr)(p) = align
+				runtime.PersistRange(p, unsafe.Sizeof(align))
+				r.bufs[i] = p
+				i++
+			}
+		}
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		runtime.SetRoot(unsafe.Pointer(r))
+		return
+	}
+
+	runtime.GC()
+	r := (*rootObj)(rootPtr)
+	i := 0
+	for _, align := range aligns {
+		for _, size := range sizes {
+			p := r.bufs[i]
+			i++
+			if uintptr(p)%align != 0 {
+				t.Fatalf("Buffer of size %d not aligned to %d after restart", size, align)
+			}
+			if *(*uintptr)(p) != align || !runtime.IsObjectStart(p) {
+				t.Fatalf("Buffer of size %d with alignment %d not recovered", size, align)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// +build pmemTest
+
+// This test appends records to a persistent append-only log, and uses the
+// fault injection harness to simulate a crash while a record is appended. It
+// verifies that the records appended before the crash are found after a
+// restart, and that the torn record is not. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+)
+
+const (
+	dataFile  = "./datafile"
+	logName   = "log"
+	recordMax = 256
+	numRecs   = 1000
+)
+
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record %d", i))
+}
+
+func TestPmemAppendLog(t *testing.T) {
+	if _, err := runtime.PmemInit(dataFile); err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	first := runtime.GetNamedRoot(logName) == nil
+	l, err := runtime.NewPmemLog(logName, recordMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first {
+		for i := 0; i < numRecs; i++ {
+			if _, err := l.Append(record(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Crash after the record is persisted, but before the tail of the log
+		// is advanced
+		if err := runtime.PmemFaultInject(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.Append(record(numRecs)); err != nil {
+			t.Fatal(err)
+		}
+		_, _, image := runtime.PmemFaultInjectStop()
+		f, err := os.OpenFile(dataFile, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(image, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return
+	}
+	defer os.Remove(dataFile)
+
+	n := 0
+	l.Iterate(func(seq uint64, data []byte) bool {
+		if seq != uint64(n) || !bytes.Equal(data, record(n)) {
+			t.Fatalf("record %d has sequence number %d and data %q", n, seq, data)
+		}
+		n++
+		return true
+	})
+	if n != numRecs {
+		t.Fatalf("found %d records after a restart, expected %d", n, numRecs)
+	}
+	if seq, err := l.Append(record(n)); seq != numRecs || err != nil {
+		t.Fatalf("Append returned %d, %v after a restart", seq, err)
+	}
+}
@@ -0,0 +1,56 @@
+// +build pmemTest
+
+// This test verifies that persistent counters do not return a value twice
+// across restarts. The first run creates a counter, and increments it one at a
+// time and in batches. The second run checks that the counter is found with
+// the last value reserved in the first run, and that it continues from there.
+// It is run only if a flag 'pmemTest' is specified. This test need to be run
+// two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+const (
+	dataFile    = "./datafile"
+	counterName = "sequence"
+	count       = 100
+	batch       = 50
+)
+
+func TestPmemCounter(t *testing.T) {
+	_, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	c, err := runtime.NewPmemCounter(counterName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Value() == 0 {
+		for i := 1; i <= count; i++ {
+			if v := c.Next(); v != uint64(i) {
+				t.Fatalf("Next returned %d, expected %d", v, i)
+			}
+		}
+		if v := c.NextBatch(batch); v != count+1 {
+			t.Fatalf("NextBatch returned %d, expected %d", v, count+1)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	if v := c.Value(); v != count+batch {
+		t.Fatalf("Counter has value %d after a restart, expected %d", v, count+batch)
+	}
+	if v := c.Next(); v != count+batch+1 {
+		t.Fatalf("Next returned %d after a restart, expected %d", v, count+batch+1)
+	}
+}
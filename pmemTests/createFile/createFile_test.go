@@ -0,0 +1,85 @@
+// +build pmemTest
+
+// This test verifies that PmemInit() creates the persistent memory file if it
+// does not exist, and that the new file is sized to hold the persistent memory
+// heap. The file is removed at the start of each run, so every run is a
+// first-time initialization. It also verifies, in a child process, that a file
+// that cannot be created is reported. It is run only if a flag 'pmemTest' is
+// specified. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// A file in a directory that does not exist cannot be created
+	badFile = "./nodir/datafile"
+
+	childEnv = "PMEM_CREATE_FILE_CHILD"
+)
+
+func TestPmemCreateFile(t *testing.T) {
+	if os.Getenv(childEnv) != "" {
+		_, err := runtime.PmemInit(badFile)
+		if err == nil || !strings.Contains(err.Error(), "Creating persistent memory file failed") {
+			t.Fatalf("PmemInit returned %v for a file that cannot be created", err)
+		}
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemCreateFile")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+
+	os.Remove(dataFile)
+	defer os.Remove(dataFile)
+	root, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if root != nil {
+		t.Fatal("new persistent memory file has a root")
+	}
+	fi, err := os.Stat(dataFile)
+	if err != nil {
+		t.Fatal("persistent memory file was not created: ", err)
+	}
+	hdrSize := fi.Size()
+	if hdrSize == 0 {
+		t.Fatal("persistent memory file was not extended to hold its header")
+	}
+
+	// The file grows by an arena when the first object is allocated
+	x := (*[2]uint64)(runtime.Pnew([2]uint64{}))
+	x[0] = uint64(time.Now().UnixNano())
+	x[1] = ^x[0]
+	runtime.PersistRange(unsafe.Pointer(x), 16)
+	if fi, err = os.Stat(dataFile); err != nil || fi.Size() <= hdrSize {
+		t.Fatalf("persistent memory file did not grow from %d bytes", hdrSize)
+	}
+	var pattern [16]byte
+	binary.LittleEndian.PutUint64(pattern[:8], x[0])
+	binary.LittleEndian.PutUint64(pattern[8:], x[1])
+	data, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, pattern[:]) {
+		t.Fatal("allocated object not found in the persistent memory file")
+	}
+}
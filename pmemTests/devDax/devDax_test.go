@@ -0,0 +1,75 @@
+// +build pmemTest
+
+// This test uses a device dax character device as the persistent memory
+// medium. The path of the device is read from the PMEM_DEVDAX_PATH environment
+// variable, and the test is skipped if it is not set. The contents of the
+// device are overwritten. The first run initializes the device and allocates
+// a list of objects. The second run checks that the list is found, and clears
+// the header of the device so that the test can be run again. It is run only
+// if a flag 'pmemTest' is specified. This test need to be run two times to
+// test the recovery path. E.g:
+// PMEM_DEVDAX_PATH=/dev/dax0.0 ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// PMEM_DEVDAX_PATH=/dev/dax0.0 ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	pathEnv  = "PMEM_DEVDAX_PATH"
+	numNodes = 1000
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+func TestPmemDevDax(t *testing.T) {
+	path := os.Getenv(pathEnv)
+	if path == "" {
+		t.Skip(pathEnv + " is not set")
+	}
+	rootPtr, err := runtime.PmemInit(path)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		var head *node
+		for i := 0; i < numNodes; i++ {
+			n := pnew(node)
+			n.val, n.next = i, head
+			runtime.PersistRange(unsafe.Pointer(n), unsafe.Sizeof(*n))
+			head = n
+		}
+		if err := runtime.SetRoot(unsafe.Pointer(head)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	i := numNodes - 1
+	for n := (*node)(rootPtr); n != nil; n = n.next {
+		if n.val != i {
+			t.Fatalf("Node %d has value %d after a restart", numNodes-1-i, n.val)
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("%d nodes missing after a restart", i+1)
+	}
+
+	// Clear the header so that the next run initializes the device again
+	base, _, _ := runtime.PmemBounds()
+	hdr := (*[4096]byte)(unsafe.Pointer(base))
+	for j := range hdr {
+		hdr[j] = 0
+	}
+	runtime.PersistRange(unsafe.Pointer(base), uintptr(len(hdr)))
+}
@@ -0,0 +1,92 @@
+// +build pmemTest
+
+// This test verifies that ephemeral roots survive an unclean shutdown, and are
+// removed by PmemClose(). The first run registers an ephemeral root and a named
+// root, and exits without calling PmemClose(). The second run checks that both
+// roots are found, calls PmemClose(), and checks in a child process that only
+// the named root is found when the file is reopened. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	childEnv = "PMEM_EPHEMERAL_ROOTS_CHILD"
+)
+
+type cache struct {
+	hits int
+}
+
+func TestPmemEphemeralRoots(t *testing.T) {
+	_, statErr := os.Stat(dataFile)
+	if _, err := runtime.PmemInit(dataFile); err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if os.Getenv(childEnv) != "" {
+		// Reopened after a clean shutdown
+		if runtime.PmemEphemeralRootsFound() {
+			t.Fatal("ephemeral root found after a clean shutdown")
+		}
+		if runtime.GetNamedRoot("cache") != nil {
+			t.Fatal("ephemeral root not removed by PmemClose")
+		}
+		if c := (*cache)(runtime.GetNamedRoot("data")); c == nil || c.hits != 2 {
+			t.Fatal("named root not found after a clean shutdown")
+		}
+		return
+	}
+
+	if statErr != nil {
+		if runtime.PmemEphemeralRootsFound() {
+			t.Fatal("ephemeral root found in a new file")
+		}
+		c := pnew(cache)
+		c.hits = 1
+		runtime.PersistObject(unsafe.Pointer(c))
+		if err := runtime.SetEphemeralRoot("cache", unsafe.Pointer(c)); err != nil {
+			t.Fatal(err)
+		}
+		d := pnew(cache)
+		d.hits = 2
+		runtime.PersistObject(unsafe.Pointer(d))
+		if err := runtime.SetNamedRoot("data", unsafe.Pointer(d)); err != nil {
+			t.Fatal(err)
+		}
+		// Exit without calling PmemClose()
+		return
+	}
+
+	// Remove the file so that the test can be run again
+	defer os.Remove(dataFile)
+	if !runtime.PmemEphemeralRootsFound() {
+		t.Fatal("ephemeral root not found after an unclean shutdown")
+	}
+	if c := (*cache)(runtime.GetNamedRoot("cache")); c == nil || c.hits != 1 {
+		t.Fatal("ephemeral root not recovered after an unclean shutdown")
+	}
+	if err := runtime.PmemClose(); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GetNamedRoot("cache") != nil {
+		t.Fatal("ephemeral root found after PmemClose")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemEphemeralRoots")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,84 @@
+// +build pmemTest
+
+// This test verifies the epoch of the persistent memory file. The first run
+// checks that a new file is at epoch 1, and records the epoch in the root
+// object. The second run checks that the epoch is one more than the recorded
+// epoch. It then starts a child process that opens the file read-only, which
+// does not change the epoch, and another one that initializes the file, which
+// the second run sees as a new epoch of the file it is using. It is run only
+// if a flag 'pmemTest' is specified. This test need to be run two times to
+// test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	childEnv = "PMEM_EPOCH_CHILD"
+)
+
+func runChild(t *testing.T, mode string) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemEpoch")
+	cmd.Env = append(os.Environ(), childEnv+"="+mode)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+}
+
+func TestPmemEpoch(t *testing.T) {
+	switch os.Getenv(childEnv) {
+	case "readonly":
+		if _, err := runtime.PmemOpenReadOnly(dataFile); err != nil {
+			t.Fatal(err)
+		}
+		return
+	case "init":
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if runtime.PmemEpoch() != 0 {
+		t.Fatal("Epoch is set before initialization")
+	}
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		if e := runtime.PmemEpoch(); e != 1 {
+			t.Fatalf("New file is at epoch %d", e)
+		}
+		x := pnew(uint64)
+		*x = runtime.PmemEpoch()
+		runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+		if err := runtime.SetRoot(unsafe.Pointer(x)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	recorded := *(*uint64)(rootPtr)
+	if e := runtime.PmemEpoch(); e != recorded+1 {
+		t.Fatalf("File is at epoch %d after a restart, recorded epoch %d", e, recorded)
+	}
+	runChild(t, "readonly")
+	if e := runtime.PmemEpoch(); e != recorded+1 {
+		t.Fatalf("File opened read-only moved to epoch %d", e)
+	}
+	runChild(t, "init")
+	if e := runtime.PmemEpoch(); e != recorded+2 {
+		t.Fatalf("File initialized by another process is at epoch %d", e)
+	}
+}
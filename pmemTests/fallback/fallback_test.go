@@ -0,0 +1,65 @@
+// +build pmemTest
+
+// This test verifies that persistent memory allocations fall back to volatile
+// memory before persistent memory is initialized, if the fallback is enabled.
+// Objects are allocated before initialization and after an initialization
+// that fails, and are checked to be volatile. Objects allocated after
+// persistent memory is initialized are checked to be persistent. It is run
+// only if a flag 'pmemTest' is specified. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const dataFile = "./datafile"
+
+type node struct {
+	val  int
+	next *node
+}
+
+var sink *node
+
+// allocAll allocates objects using each allocation function, and checks
+// whether they are in persistent memory
+func allocAll(t *testing.T, persistent bool) {
+	sink = pnew(node)
+	ptrs := map[string]unsafe.Pointer{
+		"pnew":       unsafe.Pointer(sink),
+		"pmake":      unsafe.Pointer(&pmake([]*node, 16)[0]),
+		"Pnew":       runtime.Pnew(node{}),
+		"PmakeSlice": runtime.PmakeSlice(0, 4096, 4096),
+	}
+	for name, p := range ptrs {
+		if p == nil {
+			t.Fatalf("%s returned nil", name)
+		}
+		if runtime.IsPmem(p) != persistent {
+			t.Errorf("%s allocated an object in persistent memory: %v, want %v",
+				name, !persistent, persistent)
+		}
+	}
+}
+
+func TestPmemFallback(t *testing.T) {
+	runtime.PmemAllowFallback(true)
+	allocAll(t, false)
+
+	// The initialization fails, as the directory is not a file
+	if _, err := runtime.PmemInit("."); err == nil {
+		t.Fatal("Pmem initialization succeeded with a directory")
+	}
+	allocAll(t, false)
+
+	if _, err := runtime.PmemInit(dataFile); err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	defer os.Remove(dataFile)
+	allocAll(t, true)
+}
@@ -0,0 +1,89 @@
+// +build pmemTest
+
+// This test uses the fault injection harness to simulate a crash while a
+// transaction is committed, and verifies that the data updated within the
+// transaction is consistent after a restart. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const dataFile = "./datafile"
+
+// The two values updated by the transaction are in different cache lines, so
+// that the device can crash after only one of them is flushed.
+type rootObj struct {
+	a [8]uint64
+	b [8]uint64
+}
+
+// update sets the values in 'r' to 'v' within a transaction
+func update(t *testing.T, r *rootObj, v uint64) {
+	tx, err := runtime.PTxBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Log(unsafe.Pointer(&r.a[0]), 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Log(unsafe.Pointer(&r.b[0]), 8); err != nil {
+		t.Fatal(err)
+	}
+	r.a[0] = v
+	r.b[0] = v
+	tx.Commit()
+}
+
+func TestPmemFaultInject(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		r := pnew(rootObj)
+		runtime.SetRoot(unsafe.Pointer(r))
+
+		// The first transaction allocates the undo log buffer. Count the
+		// flushes done by the next one.
+		update(t, r, 1)
+		if err := runtime.PmemFaultInject(-1); err != nil {
+			t.Fatal(err)
+		}
+		update(t, r, 2)
+		flushes, _, _ := runtime.PmemFaultInjectStop()
+
+		// Crash the device before the last two flushes of the commit. Only one
+		// of the two values is flushed, and the undo log is still valid.
+		if err := runtime.PmemFaultInject(flushes - 2); err != nil {
+			t.Fatal(err)
+		}
+		update(t, r, 3)
+		_, _, image := runtime.PmemFaultInjectStop()
+
+		// Replace the file contents with the contents of the crashed device.
+		// The file is not truncated as it is still mapped.
+		f, err := os.OpenFile(dataFile, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(image, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return
+	}
+
+	r := (*rootObj)(rootPtr)
+	if r.a[0] != r.b[0] || (r.a[0] != 2 && r.a[0] != 3) {
+		t.Fatalf("Inconsistent state (%d, %d) after a crash during commit", r.a[0], r.b[0])
+	}
+}
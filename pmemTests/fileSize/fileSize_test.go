@@ -0,0 +1,94 @@
+// +build pmemTest
+
+// This test verifies the file size computed by PmemFileSizeFor(). The first run
+// creates a file with a reserved region and the computed size as the maximum
+// size, and allocates objects until the file is full. It checks that the file
+// grew to the computed size and provides at least the requested usable space.
+// The second run checks that the objects are found. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile     = "./datafile"
+	reservedSize = 1 << 20
+	usableSize   = 100 << 20
+	objSize      = 1 << 20
+)
+
+type root struct {
+	objs [][]byte
+}
+
+func TestPmemFileSize(t *testing.T) {
+	if runtime.PmemFileSizeFor(0, reservedSize) != 0 || runtime.PmemFileSizeFor(usableSize, -1) != 0 {
+		t.Fatal("File size computed for invalid arguments")
+	}
+	size := runtime.PmemFileSizeFor(usableSize, reservedSize)
+	if size < usableSize+reservedSize {
+		t.Fatalf("File size %d is smaller than the usable size %d", size, usableSize)
+	}
+
+	_, statErr := os.Stat(dataFile)
+	region, err := runtime.PmemInitOpts(runtime.PmemOptions{
+		Fname:        dataFile,
+		ReservedSize: reservedSize,
+		MaxSize:      uintptr(size),
+	})
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if os.IsNotExist(statErr) {
+		r := pnew(root)
+		r.objs = pmake([][]byte, 0, 2*usableSize/objSize)
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		for len(r.objs) < cap(r.objs) {
+			p := runtime.PmakeSlice(byte(0), objSize, objSize)
+			if p == nil {
+				break
+			}
+			r.objs = append(r.objs, (*[objSize]byte)(p)[:])
+		}
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		runtime.PersistRange(unsafe.Pointer(&r.objs[0]),
+			uintptr(len(r.objs))*unsafe.Sizeof(r.objs[0]))
+
+		var stats runtime.PmemStats
+		runtime.ReadPmemStats(&stats)
+		if stats.TotalBytes != uint64(size) {
+			t.Fatalf("File size is %d, computed %d", stats.TotalBytes, size)
+		}
+		if usable := stats.TotalBytes - stats.MetadataBytes; usable < usableSize {
+			t.Fatalf("File has %d usable bytes, requested %d", usable, usableSize)
+		}
+		if n := len(r.objs); n < usableSize/objSize*9/10 {
+			t.Fatalf("Only %d objects allocated", n)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	r := (*root)(region.Root())
+	if r == nil || len(r.objs) == 0 {
+		t.Fatal("Root not found in the file")
+	}
+	for _, b := range r.objs {
+		if len(b) != objSize {
+			t.Fatal("Object not found after a restart")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// +build pmemTest
+
+// This test verifies that a persistent memory file that was truncated after it
+// was last used is rejected when it is reopened. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times. The first run
+// creates the persistent memory file, and the second run truncates it and
+// checks that PmemInit() fails. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const dataFile = "./datafile"
+
+func TestPmemFileTooSmall(t *testing.T) {
+	fi, err := os.Stat(dataFile)
+	if err != nil {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		// Allocate an object so that the file holds an arena
+		runtime.SetRoot(unsafe.Pointer(pnew(int)))
+		return
+	}
+
+	// Remove the file so that the test can be run again
+	defer os.Remove(dataFile)
+	size := fi.Size() / 2
+	if err := os.Truncate(dataFile, size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.PmemInit(dataFile); !errors.Is(err, runtime.ErrPmemFileTooSmall) {
+		t.Fatalf("PmemInit returned %v, expected %v", err, runtime.ErrPmemFileTooSmall)
+	}
+	// The file is not extended
+	if fi, err := os.Stat(dataFile); err != nil || fi.Size() != size {
+		t.Fatalf("file size changed to %d by PmemInit", fi.Size())
+	}
+}
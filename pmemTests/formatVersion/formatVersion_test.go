@@ -0,0 +1,73 @@
+// +build pmemTest
+
+// This test verifies that a persistent memory file created with a different
+// format version is rejected when it is reopened. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times. The first run
+// creates the persistent memory file, and the second run changes the format
+// version stored in its header and checks that PmemInit() fails. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// Offsets of the format version and the header checksum in the header
+	versionOffset = 24
+	crcOffset     = 32
+
+	// The version written to the file header
+	badVersion = 99
+)
+
+func TestPmemFormatVersion(t *testing.T) {
+	if _, err := os.Stat(dataFile); err != nil {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		return
+	}
+
+	// Change the version and update the checksum so that the header is not
+	// reported as corrupt.
+	f, err := os.OpenFile(dataFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hdr [crcOffset + 4]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	oldCRC := crc32.Checksum(hdr[:crcOffset], crc32.MakeTable(crc32.Castagnoli))
+	if binary.LittleEndian.Uint32(hdr[crcOffset:]) != oldCRC {
+		t.Fatal("Header checksum is not a CRC32C checksum of the header fields")
+	}
+	binary.LittleEndian.PutUint32(hdr[versionOffset:], badVersion)
+	newCRC := crc32.Checksum(hdr[:crcOffset], crc32.MakeTable(crc32.Castagnoli))
+	binary.LittleEndian.PutUint32(hdr[crcOffset:], newCRC)
+	if _, err := f.WriteAt(hdr[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Remove the file so that the test can be run again
+	defer os.Remove(dataFile)
+
+	_, err = runtime.PmemInit(dataFile)
+	if !errors.Is(err, runtime.ErrPmemVersionMismatch) {
+		t.Fatalf("PmemInit returned %v, expected %v", err, runtime.ErrPmemVersionMismatch)
+	}
+	if !strings.Contains(err.Error(), "file version 99") {
+		t.Fatalf("Error message %q does not include the file version", err)
+	}
+}
@@ -0,0 +1,71 @@
+// +build pmemTest
+
+// This test verifies that a persistent memory file whose arena has free pages
+// can be opened after a garbage collection cycle has completed. The first run
+// allocates large objects, and drops every other one so that the garbage
+// collector frees their pages. The second run runs a full GC cycle before
+// initializing persistent memory, and checks the objects that are reachable
+// from the root. It is run only if a flag 'pmemTest' is specified. This test
+// need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numObjs  = 16
+	objSize  = 64 << 10
+)
+
+type rootObj struct {
+	objs [numObjs][]byte
+}
+
+// Holds unreachable persistent objects so that they are heap allocated
+var garbage []byte
+
+func TestPmemGcBeforeInit(t *testing.T) {
+	_, statErr := os.Stat(dataFile)
+	if os.IsNotExist(statErr) {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		r := pnew(rootObj)
+		for i := range r.objs {
+			r.objs[i] = pmake([]byte, objSize)
+			r.objs[i][0] = byte(i)
+			runtime.PersistRange(unsafe.Pointer(&r.objs[i][0]), 1)
+			garbage = pmake([]byte, objSize)
+		}
+		garbage = nil
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		return
+	}
+	defer os.Remove(dataFile)
+
+	runtime.GC()
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	r := (*rootObj)(rootPtr)
+	if r == nil {
+		t.Fatal("Root object not found")
+	}
+	for i := range r.objs {
+		if len(r.objs[i]) != objSize || r.objs[i][0] != byte(i) {
+			t.Fatalf("Object %d not recovered", i)
+		}
+	}
+}
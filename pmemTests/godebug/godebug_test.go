@@ -0,0 +1,87 @@
+// +build pmemTest
+
+// This test verifies the GODEBUG options for persistent memory debugging. A
+// child process is started with pmemverbose=1, pmemcheck=1 and pmemfence=0.
+// It allocates and frees persistent memory objects with PmemTraceHeapBits()
+// enabled, and the parent checks that the span allocations and frees, the
+// arena mappings, and the logged heap type bits were printed.
+// The child is started in both runs, so that the arena mappings are printed
+// both when the heap grows and when an existing file is opened. It is run only
+// if a flag 'pmemTest' is specified. This test need to be run two times to
+// test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	childEnv = "PMEM_GODEBUG_CHILD"
+	numObjs  = 1000
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+var sink *node
+
+func TestPmemGodebug(t *testing.T) {
+	if os.Getenv(childEnv) != "" {
+		rootPtr, err := runtime.PmemInit(dataFile)
+		if err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		if rootPtr == nil {
+			x := pnew(int)
+			if err := runtime.SetRoot(unsafe.Pointer(x)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runtime.PmemTraceHeapBits(true)
+		for i := 0; i < numObjs; i++ {
+			sink = pnew(node)
+			sink.val = i
+		}
+		runtime.PmemTraceHeapBits(false)
+		sink = nil
+		for i := 0; i < 4; i++ {
+			b := pmake([]byte, 1<<20)
+			runtime.PersistRange(unsafe.Pointer(&b[0]), 1)
+		}
+		runtime.GC()
+		runtime.GC()
+		return
+	}
+
+	created := false
+	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
+		created = true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemGodebug")
+	cmd.Env = append(os.Environ(), childEnv+"=1",
+		"GODEBUG=pmemverbose=1,pmemcheck=1,pmemfence=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+	for _, s := range []string{"pmem: span alloc", "pmem: span free", "pmem: arena mapped",
+		"pmem: heap bits"} {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("%q not printed by the child process", s)
+		}
+	}
+	if !created {
+		os.Remove(dataFile)
+	}
+}
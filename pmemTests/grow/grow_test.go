@@ -0,0 +1,71 @@
+// +build pmemTest
+
+// This test verifies that the arenas added using PmemGrow are found after a
+// restart. The first run grows the persistent memory file before allocating
+// anything in the new space, and records the size of the file in the root
+// object. The second run checks that the file has the same size, and that
+// objects can be allocated in it. It is run only if a flag 'pmemTest' is
+// specified. This test need to be run two times to test the recovery path.
+// E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	growSize = 256 << 20
+)
+
+type root struct {
+	totalBytes uint64
+}
+
+func TestPmemGrow(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	var stats runtime.PmemStats
+	if rootPtr == nil {
+		r := pnew(root)
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadPmemStats(&stats)
+		before := stats.TotalBytes
+		if err := runtime.PmemGrow(growSize); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadPmemStats(&stats)
+		if stats.TotalBytes < before+growSize {
+			t.Fatalf("File grew from %d to %d bytes", before, stats.TotalBytes)
+		}
+		r.totalBytes = stats.TotalBytes
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		return
+	}
+	defer os.Remove(dataFile)
+
+	r := (*root)(rootPtr)
+	runtime.ReadPmemStats(&stats)
+	if stats.TotalBytes != r.totalBytes {
+		t.Fatalf("File size is %d bytes after a restart, was %d", stats.TotalBytes, r.totalBytes)
+	}
+	arenas := runtime.PmemArenasMapped()
+	for i := 0; i < 8; i++ {
+		b := pmake([]byte, 16<<20)
+		t.Logf("%p", b)
+	}
+	if runtime.PmemArenasMapped() != arenas {
+		t.Error("File grew to allocate objects in the space added by PmemGrow")
+	}
+}
@@ -0,0 +1,55 @@
+// +build pmemTest
+
+// This test verifies that a corrupted persistent memory header is detected
+// when the file is reopened. It is run only if a flag 'pmemTest' is specified.
+// This test need to be run two times. The first run creates the persistent
+// memory file, and the second run corrupts one byte of its header and checks
+// that PmemInit() fails. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// Offset of a header byte that is covered by the header checksum. The
+	// first 8 bytes of the header store the magic constant, and the next 8
+	// bytes store the header size.
+	corruptOffset = 8
+)
+
+func TestPmemHeaderCRC(t *testing.T) {
+	if _, err := os.Stat(dataFile); err != nil {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		return
+	}
+
+	f, err := os.OpenFile(dataFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], corruptOffset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b[:], corruptOffset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Remove the file so that the test can be run again
+	defer os.Remove(dataFile)
+
+	if _, err := runtime.PmemInit(dataFile); err != runtime.ErrPmemHeaderCorrupt {
+		t.Fatalf("PmemInit returned %v, expected %v", err, runtime.ErrPmemHeaderCorrupt)
+	}
+}
@@ -0,0 +1,77 @@
+// +build pmemTest
+
+// This test maps the persistent memory file using huge pages, and verifies that
+// objects allocated across several arenas are recovered. The span and heap
+// type bitmaps are laid out using the runtime page size, so they do not depend
+// on the page size the arenas are mapped with. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile     = "./datafile"
+	hugePageSize = 2 << 20
+	numNodes     = 1000
+)
+
+type node struct {
+	val  int
+	data []byte
+	next *node
+}
+
+func TestPmemHugePages(t *testing.T) {
+	region, err := runtime.PmemInitOpts(runtime.PmemOptions{
+		Fname:     dataFile,
+		HugePages: true,
+	})
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	var ps runtime.PmemStats
+	runtime.ReadPmemStats(&ps)
+	if ps.MapPageSize != hugePageSize && ps.MapPageSize != uint64(os.Getpagesize()) {
+		t.Fatalf("Invalid map page size %d", ps.MapPageSize)
+	}
+	t.Logf("arenas mapped using %d byte pages", ps.MapPageSize)
+
+	head := (*node)(region.Root())
+	if head == nil {
+		// Spread the list over several arenas
+		for i := numNodes; i > 0; i-- {
+			n := pnew(node)
+			n.val = i
+			n.data = pmake([]byte, 128<<10)
+			n.data[len(n.data)-1] = byte(i)
+			n.next = head
+			head = n
+		}
+		runtime.PersistRange(unsafe.Pointer(head), unsafe.Sizeof(*head))
+		if err := runtime.SetRoot(unsafe.Pointer(head)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	runtime.GC()
+	i := 1
+	for n := head; n != nil; n = n.next {
+		if n.val != i || n.data[len(n.data)-1] != byte(i) {
+			t.Fatalf("Node %d not recovered", i)
+		}
+		i++
+	}
+	if i != numNodes+1 {
+		t.Fatalf("List has %d nodes, expected %d", i-1, numNodes)
+	}
+}
@@ -0,0 +1,105 @@
+// +build pmemTest
+
+// This test verifies that a persistent memory file whose initialization was
+// interrupted is initialized again when it is reopened. A child process
+// creates the file, and the header is changed to look like the first run
+// crashed after the magic constant was persisted but before the header
+// checksum was. Another child process checks that the file cannot be opened
+// read-only, and the test then checks that PmemInit() initializes the file
+// again. The file is removed at the start of each run. It is run only if a
+// flag 'pmemTest' is specified. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// Offsets of the header checksum and the initialization state in the
+	// header
+	crcOffset       = 32
+	initStateOffset = 36
+
+	// The initialization state of a header being initialized
+	initOngoing = 1
+
+	childEnv = "PMEM_INCOMPLETE_INIT_CHILD"
+)
+
+func runChild(t *testing.T, mode string) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemIncompleteInit")
+	cmd.Env = append(os.Environ(), childEnv+"="+mode)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+}
+
+func TestPmemIncompleteInit(t *testing.T) {
+	switch os.Getenv(childEnv) {
+	case "create":
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		return
+	case "readonly":
+		if _, err := runtime.PmemOpenReadOnly(dataFile); err != runtime.ErrPmemIncompleteInit {
+			t.Fatalf("PmemOpenReadOnly returned %v, expected %v", err,
+				runtime.ErrPmemIncompleteInit)
+		}
+		return
+	}
+
+	os.Remove(dataFile)
+	defer os.Remove(dataFile)
+	runChild(t, "create")
+
+	// Simulate a crash after the magic constant was persisted
+	f, err := os.OpenFile(dataFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hdr [initStateOffset + 4]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(hdr[crcOffset:], 0)
+	binary.LittleEndian.PutUint32(hdr[initStateOffset:], initOngoing)
+	if _, err := f.WriteAt(hdr[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	runChild(t, "readonly")
+
+	root, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if root != nil {
+		t.Fatal("partially initialized file has a root")
+	}
+	x := pnew(int)
+	*x = 1
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+	if err := runtime.SetRoot(unsafe.Pointer(x)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := binary.LittleEndian.Uint32(b[initStateOffset:]); s == initOngoing {
+		t.Fatal("initialization state not updated after the file was initialized again")
+	}
+}
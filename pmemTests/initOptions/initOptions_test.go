@@ -0,0 +1,110 @@
+// +build pmemTest
+
+// This test initializes persistent memory using PmemInitOpts(). The first run
+// checks that options that cannot be used together are rejected, and creates
+// the file with a reserved region and a maximum size. The second run opens the
+// file read-only using the options, and checks that the root and the reserved
+// region are found. It is run only if a flag 'pmemTest' is specified. This test
+// need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile     = "./datafile"
+	reservedSize = 1000
+	maxSize      = 256 << 20
+	magic        = 0x2545F4914F6CDD1D
+)
+
+type data struct {
+	magic int
+	next  *data
+}
+
+func TestPmemInitOptions(t *testing.T) {
+	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
+		createFile(t)
+		return
+	}
+
+	// Remove the file so that the test can be run again
+	defer os.Remove(dataFile)
+	region, err := runtime.PmemInitOpts(runtime.PmemOptions{
+		Fname:    dataFile,
+		ReadOnly: true,
+	})
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	d := (*data)(region.Root())
+	if d == nil || d.magic != magic || d.next == nil || d.next.magic != magic {
+		t.Fatal("Root not found in the file")
+	}
+	if _, n := runtime.PmemReservedRegion(); n != reservedSize {
+		t.Fatalf("Reserved region size is %d, expected %d", n, reservedSize)
+	}
+	if runtime.Pnew(data{}) != nil {
+		t.Fatal("Allocation succeeded in a read-only file")
+	}
+}
+
+func createFile(t *testing.T) {
+	invalid := []runtime.PmemOptions{
+		{},
+		{Fname: dataFile, SyncMode: -1},
+		{Fname: dataFile, ReadOnly: true, ReservedSize: reservedSize},
+		{Fname: dataFile, ReadOnly: true, MaxSize: maxSize},
+		{Fname: dataFile, ReadOnly: true, SyncMode: runtime.PmemSyncForce},
+		{Fname: dataFile, ReservedSize: maxSize - 4096, MaxSize: maxSize},
+	}
+	for _, opts := range invalid {
+		if _, err := runtime.PmemInitOpts(opts); err == nil {
+			t.Fatalf("Initialization with options %+v succeeded", opts)
+		}
+	}
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Fatal("File created using invalid options")
+	}
+
+	region, err := runtime.PmemInitOpts(runtime.PmemOptions{
+		Fname:        dataFile,
+		ReservedSize: reservedSize,
+		MaxSize:      maxSize,
+	})
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if region.Name() != dataFile || region.Root() != nil {
+		t.Fatal("Unexpected region for a new file")
+	}
+	if _, err := runtime.PmemInitOpts(runtime.PmemOptions{Fname: dataFile}); err == nil {
+		t.Fatal("Persistent memory initialized twice")
+	}
+	if _, n := runtime.PmemReservedRegion(); n != reservedSize {
+		t.Fatalf("Reserved region size is %d, expected %d", n, reservedSize)
+	}
+
+	// The file cannot grow beyond maxSize
+	if runtime.PmakeSlice(byte(0), 2*maxSize, 2*maxSize) != nil {
+		t.Fatal("Allocation beyond the maximum file size succeeded")
+	}
+
+	d := pnew(data)
+	d.magic = magic
+	d.next = pnew(data)
+	d.next.magic = magic
+	runtime.PersistObject(unsafe.Pointer(d.next))
+	runtime.PersistObject(unsafe.Pointer(d))
+	if err := runtime.SetRoot(unsafe.Pointer(d)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+// +build pmemTest
+
+// This test verifies concurrent and repeated persistent memory initialization.
+// The first run initializes a new file from several goroutines at once, checks
+// that exactly one of them succeeds, and sets a root object. The second run
+// initializes the file from several goroutines with a reserved region size
+// that does not match the file, which fails, and then initializes it again
+// with the right size and checks that the root object is found. It is run only
+// if a flag 'pmemTest' is specified. This test need to be run two times to
+// test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile     = "./datafile"
+	reservedSize = 1 << 20
+	numInits     = 8
+	magic        = 0x1badcafe
+)
+
+type root struct {
+	magic int
+}
+
+// initAll initializes persistent memory from 'numInits' goroutines using
+// 'opts', and returns the error of each of them
+func initAll(opts runtime.PmemOptions) []error {
+	errs := make([]error, numInits)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = runtime.PmemInitOpts(opts)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestPmemInitRetry(t *testing.T) {
+	_, statErr := os.Stat(dataFile)
+	if os.IsNotExist(statErr) {
+		succeeded := 0
+		for _, err := range initAll(runtime.PmemOptions{Fname: dataFile, ReservedSize: reservedSize}) {
+			switch err {
+			case nil:
+				succeeded++
+			case runtime.ErrPmemAlreadyInit:
+			default:
+				t.Fatal("Pmem initialization failed with error ", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("%d concurrent initializations succeeded", succeeded)
+		}
+		if _, err := runtime.PmemInit(dataFile); err != runtime.ErrPmemAlreadyInit {
+			t.Fatal("Initialized persistent memory twice, error ", err)
+		}
+		r := pnew(root)
+		r.magic = magic
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	mismatched := 0
+	for _, err := range initAll(runtime.PmemOptions{Fname: dataFile, ReservedSize: 2 * reservedSize}) {
+		switch err {
+		case runtime.ErrPmemReservedSize:
+			mismatched++
+		case runtime.ErrPmemAlreadyInit:
+		default:
+			t.Fatal("Unexpected initialization error ", err)
+		}
+	}
+	if mismatched == 0 {
+		t.Fatal("Initialization with a mismatched reserved region size did not fail")
+	}
+	if runtime.PmemEpoch() != 0 {
+		t.Fatal("Persistent memory is initialized after a failed initialization")
+	}
+
+	if _, err := runtime.PmemInitOpts(runtime.PmemOptions{Fname: dataFile, ReservedSize: reservedSize}); err != nil {
+		t.Fatal("Pmem initialization failed after a failed initialization, error ", err)
+	}
+	r := (*root)(runtime.GetRoot())
+	if r == nil || r.magic != magic {
+		t.Fatal("Root object not found after a failed initialization")
+	}
+	if e := runtime.PmemEpoch(); e != 2 {
+		t.Fatalf("File is at epoch %d after the second run", e)
+	}
+}
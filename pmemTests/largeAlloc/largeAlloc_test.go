@@ -0,0 +1,85 @@
+// +build pmemTest
+
+// This test allocates objects that are larger than a single heap arena (64MB)
+// in persistent memory and verifies that they can be recovered. It is run only
+// if a flag 'pmemTest' is specified. This test need to be run two times to test
+// the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// Number of elements in each large object. Each large object is larger
+	// than one heap arena.
+	numElems = 10 << 20
+)
+
+type elem struct {
+	ptr *int
+	val int
+}
+
+type rootObj struct {
+	data  []byte // 80MB pointer-free object
+	elems []elem // 160MB object containing pointers
+}
+
+func TestPmemLargeAlloc(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		r := pnew(rootObj)
+		r.data = pmake([]byte, 8*numElems)
+		r.elems = pmake([]elem, numElems)
+		for i := 0; i < numElems; i += 4096 {
+			r.data[i] = byte(i)
+			p := pnew(int)
+			*p = i
+			r.elems[i].ptr = p
+			r.elems[i].val = i
+		}
+		runtime.SetRoot(unsafe.Pointer(r))
+	} else {
+		// Run a full GC cycle
+		runtime.GC()
+		r := (*rootObj)(rootPtr)
+		if len(r.data) != 8*numElems || len(r.elems) != numElems {
+			t.Fatal("Recovered object has invalid length")
+		}
+		if !runtime.IsObjectStart(unsafe.Pointer(&r.elems[0])) {
+			t.Fatal("Recovered object is not a valid object")
+		}
+		// The large object spans multiple heap arenas. Make sure the runtime
+		// can resolve the arena metadata of an address in each of them.
+		for i := 0; i < numElems; i += 1 << 20 {
+			addr := unsafe.Pointer(&r.elems[i])
+			if !runtime.InPmem(uintptr(addr)) {
+				t.Fatal("Recovered object is not in persistent memory")
+			}
+			if err := runtime.SetRoot(addr); err != nil {
+				t.Fatal("Setting root within the recovered object failed")
+			}
+		}
+		runtime.SetRoot(rootPtr)
+		for i := 0; i < numElems; i += 4096 {
+			if r.data[i] != byte(i) {
+				t.Fatal("Data mismatch at index ", i)
+			}
+			if r.elems[i].val != i || *r.elems[i].ptr != i {
+				t.Fatal("Element mismatch at index ", i)
+			}
+		}
+	}
+}
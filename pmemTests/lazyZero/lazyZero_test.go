@@ -0,0 +1,138 @@
+// +build pmemTest
+
+// This test verifies that persistent memory that held objects freed before a
+// restart is cleared before it is allocated again. The first run fills small
+// and large objects with a non-zero pattern, keeps one small object of each
+// span reachable from the root, and lets the garbage collector free the other
+// objects. The second run allocates objects of the same sizes and checks that
+// they are zeroed. A child process started by the first run also checks that
+// objects allocated in a new file that was filled with garbage before it was
+// initialized are zeroed. It is run only if a flag 'pmemTest' is specified.
+// This test need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile  = "./datafile"
+	staleFile = "./stalefile"
+	staleSize = 256 << 20
+	childEnv  = "PMEM_LAZY_ZERO_CHILD"
+	numSmall  = 4096
+	largeSize = 1 << 20
+	numLarge  = 8
+	pattern   = 0xa5
+)
+
+type small [64]byte
+
+type root struct {
+	keep []*small
+}
+
+func fill(b []byte) {
+	for i := range b {
+		b[i] = pattern
+	}
+	runtime.PersistRange(unsafe.Pointer(&b[0]), uintptr(len(b)))
+}
+
+func checkZero(t *testing.T, what string, b []byte) {
+	for i, v := range b {
+		if v != 0 {
+			t.Fatalf("%s allocated with byte %d set to %#x", what, i, v)
+		}
+	}
+}
+
+// allocAndCheck allocates small and large objects and checks that they are
+// zeroed
+func allocAndCheck(t *testing.T) {
+	for i := 0; i < numSmall; i++ {
+		checkZero(t, "small object", pnew(small)[:])
+	}
+	for i := 0; i < numLarge; i++ {
+		checkZero(t, "large object", pmake([]byte, largeSize))
+	}
+}
+
+// runStaleChild fills a file with garbage and starts a child process that
+// initializes persistent memory in it
+func runStaleChild(t *testing.T) {
+	f, err := os.Create(staleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(staleFile)
+	garbage := bytes.Repeat([]byte{pattern}, largeSize)
+	for n := 0; n < staleSize; n += len(garbage) {
+		if _, err := f.Write(garbage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemLazyZero")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+}
+
+func TestPmemLazyZero(t *testing.T) {
+	if os.Getenv(childEnv) != "" {
+		if _, err := runtime.PmemInit(staleFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		allocAndCheck(t)
+		return
+	}
+
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		runStaleChild(t)
+		r := pnew(root)
+		r.keep = pmake([]*small, 0, numSmall/64)
+		for i := 0; i < numSmall; i++ {
+			s := pnew(small)
+			fill(s[:])
+			if i%64 == 0 {
+				r.keep = append(r.keep, s)
+			}
+		}
+		for i := 0; i < numLarge; i++ {
+			fill(pmake([]byte, largeSize))
+		}
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		runtime.PersistRange(unsafe.Pointer(&r.keep[0]), uintptr(len(r.keep))*8)
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		runtime.GC()
+		return
+	}
+	defer os.Remove(dataFile)
+
+	r := (*root)(rootPtr)
+	for _, s := range r.keep {
+		if s[0] != pattern {
+			t.Fatal("reachable object not found after a restart")
+		}
+	}
+	allocAndCheck(t)
+}
@@ -0,0 +1,71 @@
+// +build pmemTest
+
+// This test verifies that persistent memory objects leaked in a previous run
+// are reported by PmemCheckLeaks() after a restart. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// The size of the leaked object. This is a large object size that is not
+	// used by anything else in the test, so that it can be identified after
+	// a restart.
+	leakSize = 3 << 20
+
+	pattern = 0xa5
+)
+
+type rootObj struct {
+	live []byte
+}
+
+// Keeps the leaked object reachable only from volatile memory
+var leaked []byte
+
+func TestPmemCheckLeaks(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		r := pnew(rootObj)
+		r.live = pmake([]byte, leakSize+4096)
+		leaked = pmake([]byte, leakSize)
+		for i := range leaked {
+			leaked[i] = pattern
+		}
+		runtime.PersistRange(unsafe.Pointer(&leaked[0]), leakSize)
+		runtime.SetRoot(unsafe.Pointer(r))
+		return
+	}
+
+	r := (*rootObj)(rootPtr)
+	live := uintptr(unsafe.Pointer(&r.live[0]))
+	found := false
+	for _, l := range runtime.PmemCheckLeaks() {
+		if l.Addr == live || l.Addr == uintptr(rootPtr) {
+			t.Fatal("Object reachable from the root reported as leaked")
+		}
+		if l.Size < leakSize || l.Size >= leakSize+4096 {
+			continue
+		}
+		b := (*[leakSize]byte)(unsafe.Pointer(l.Addr))
+		if b[0] == pattern && b[leakSize-1] == pattern {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Object leaked in the previous run not reported")
+	}
+}
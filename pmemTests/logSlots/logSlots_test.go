@@ -0,0 +1,92 @@
+// +build pmemTest
+
+// This test verifies that the number of arena log slots set using
+// PmemOptions.LogSlots is stored in the persistent memory file. The first run
+// creates the file with 4 log slots. The second run checks that child
+// processes cannot reopen the file expecting 2 log slots, but can reopen it
+// without setting the count, and then reopens it with 4 log slots. It is run
+// only if a flag 'pmemTest' is specified. This test need to be run two times
+// to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	childEnv = "PMEM_LOG_SLOTS_CHILD"
+	numSlots = 4
+	numElems = 1 << 16
+)
+
+func runChild(t *testing.T, slots int) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemLogSlots")
+	cmd.Env = append(os.Environ(), childEnv+"="+strconv.Itoa(slots))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+}
+
+func TestPmemLogSlots(t *testing.T) {
+	if v := os.Getenv(childEnv); v != "" {
+		slots, _ := strconv.Atoi(v)
+		region, err := runtime.PmemInitOpts(runtime.PmemOptions{Fname: dataFile, LogSlots: slots})
+		switch slots {
+		case 0:
+			if err != nil || region.Root() == nil {
+				t.Fatalf("reopening without a log slot count failed: %v", err)
+			}
+		default:
+			if err != runtime.ErrPmemLogSlots {
+				t.Fatalf("PmemInitOpts returned %v, expected %v", err, runtime.ErrPmemLogSlots)
+			}
+		}
+		return
+	}
+
+	_, err := runtime.PmemInitOpts(runtime.PmemOptions{Fname: dataFile, LogSlots: -1})
+	if err == nil {
+		t.Fatal("PmemInitOpts accepted a negative log slot count")
+	}
+
+	if _, err := os.Stat(dataFile); err == nil {
+		runChild(t, 2)
+		runChild(t, 0)
+	}
+
+	region, err := runtime.PmemInitOpts(runtime.PmemOptions{Fname: dataFile, LogSlots: numSlots})
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if region.Root() == nil {
+		a := pmake([]int, numElems)
+		for i := range a {
+			a[i] = i
+		}
+		runtime.PersistRange(unsafe.Pointer(&a[0]), numElems*8)
+		if err := runtime.SetRoot(unsafe.Pointer(&a[0])); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	a := (*[numElems]int)(region.Root())
+	for i := range a {
+		if a[i] != i {
+			t.Fatalf("a[%d] = %d after a restart", i, a[i])
+		}
+	}
+	if errs := runtime.PmemVerify(); len(errs) != 0 {
+		t.Errorf("persistent memory heap inconsistent: %v", errs)
+	}
+}
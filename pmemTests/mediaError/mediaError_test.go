@@ -0,0 +1,110 @@
+// +build pmemTest
+
+// This test verifies that an access to persistent memory that the kernel
+// reports using a SIGBUS signal raises a PmemMediaError panic. A bad block of
+// a persistent memory device is simulated by truncating the persistent memory
+// file below an object while it is mapped. A child process checks that the
+// panic can be recovered from and describes the faulting address, and another
+// child process checks that the panic is reported if it is not recovered. The
+// file is removed at the start of each run. It is run only if a flag
+// 'pmemTest' is specified. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	objSize  = 1 << 20
+
+	// The offset in the object that is read after the file is truncated
+	readOffset = 3 * 4096
+
+	childEnv = "PMEM_MEDIA_ERROR_CHILD"
+)
+
+var (
+	marker = []byte("pmem media error test marker")
+	sink   byte
+)
+
+// badObject allocates a persistent memory object and truncates the persistent
+// memory file at the start of the object. It returns the object and its file
+// offset.
+func badObject(t *testing.T) ([]byte, int) {
+	if _, err := runtime.PmemInit(dataFile); err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	b := pmake([]byte, objSize)
+	copy(b, marker)
+	runtime.PersistRange(unsafe.Pointer(&b[0]), uintptr(len(marker)))
+
+	data, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := bytes.Index(data, marker)
+	if off < 0 || off%os.Getpagesize() != 0 {
+		t.Fatalf("object found at file offset %d", off)
+	}
+	if err := os.Truncate(dataFile, int64(off)); err != nil {
+		t.Fatal(err)
+	}
+	return b, off
+}
+
+func TestPmemMediaError(t *testing.T) {
+	switch os.Getenv(childEnv) {
+	case "recover":
+		b, off := badObject(t)
+		defer func() {
+			e, ok := recover().(*runtime.PmemMediaError)
+			if !ok {
+				t.Fatal("access to a truncated object did not raise a PmemMediaError")
+			}
+			addr := uintptr(unsafe.Pointer(&b[readOffset]))
+			if e.Addr() != addr || e.Offset() != uintptr(off+readOffset) ||
+				e.Object() != uintptr(unsafe.Pointer(&b[0])) {
+				t.Fatalf("got address %#x, offset %#x, object %#x for a fault at "+
+					"%#x, file offset %#x", e.Addr(), e.Offset(), e.Object(), addr,
+					off+readOffset)
+			}
+		}()
+		sink = b[readOffset]
+		t.Fatal("access to a truncated object did not fault")
+	case "crash":
+		b, _ := badObject(t)
+		sink = b[readOffset]
+		return
+	}
+
+	os.Remove(dataFile)
+	defer os.Remove(dataFile)
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemMediaError")
+	cmd.Env = append(os.Environ(), childEnv+"=recover")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+
+	os.Remove(dataFile)
+	cmd = exec.Command(os.Args[0], "-test.run=TestPmemMediaError")
+	cmd.Env = append(os.Environ(), childEnv+"=crash")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("child process did not crash after a media error")
+	}
+	if !strings.Contains(string(out), "persistent memory media error at address") {
+		t.Fatalf("media error not reported:\n%s", out)
+	}
+}
@@ -0,0 +1,64 @@
+// +build pmemTest
+
+// This test verifies that named application roots can be found after a
+// restart. It is run only if a flag 'pmemTest' is specified. This test need to
+// be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numRoots = 8
+)
+
+type obj struct {
+	id  int
+	val *int
+}
+
+func TestPmemNamedRoots(t *testing.T) {
+	if runtime.SetNamedRoot("root0", nil) == nil {
+		t.Fatal("Named root set before persistent memory initialization")
+	}
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		// The application root is used only to detect the second run
+		runtime.SetRoot(unsafe.Pointer(pnew(int)))
+		for i := 0; i < numRoots; i++ {
+			o := pnew(obj)
+			o.id = i
+			o.val = pnew(int)
+			*o.val = i * i
+			err := runtime.SetNamedRoot(fmt.Sprintf("root%d", i), unsafe.Pointer(o))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	// Run a full GC cycle
+	runtime.GC()
+	for i := 0; i < numRoots; i++ {
+		o := (*obj)(runtime.GetNamedRoot(fmt.Sprintf("root%d", i)))
+		if o == nil {
+			t.Fatalf("Named root %d not found", i)
+		}
+		if o.id != i || *o.val != i*i {
+			t.Fatalf("Named root %d is corrupted", i)
+		}
+	}
+}
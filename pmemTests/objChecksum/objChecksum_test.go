@@ -0,0 +1,78 @@
+// +build pmemTest
+
+// This test allocates objects using PnewChecked() in the first run, and
+// verifies in the second run that they still match their checksums, that an
+// update that is persisted using PersistObject() updates the checksum, and
+// that corruption of an object is detected. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	listLen  = 100
+)
+
+type node struct {
+	val  [8]int
+	next *node
+}
+
+func TestPmemObjectChecksum(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		var head *node
+		for i := 0; i < listLen; i++ {
+			n := (*node)(runtime.PnewChecked(node{}))
+			n.val[i%8] = i
+			n.next = head
+			runtime.PersistObject(unsafe.Pointer(n))
+			head = n
+		}
+		if err := runtime.SetRoot(unsafe.Pointer(head)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	runtime.GC()
+	i := listLen - 1
+	for n := (*node)(rootPtr); n != nil; n = n.next {
+		if n.val[i%8] != i || !runtime.PmemVerifyObject(unsafe.Pointer(n)) {
+			t.Fatalf("node %d does not match its checksum after a restart", i)
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("found %d nodes, expected %d", listLen-1-i, listLen)
+	}
+
+	head := (*node)(rootPtr)
+	head.val[0]++
+	runtime.PersistObject(unsafe.Pointer(head))
+	if !runtime.PmemVerifyObject(unsafe.Pointer(head)) {
+		t.Fatal("checksum not updated after a restart")
+	}
+
+	// Simulate a media error that corrupts a byte of the object
+	b := (*byte)(unsafe.Pointer(&head.val[5]))
+	*b ^= 0x10
+	if runtime.PmemVerifyObject(unsafe.Pointer(head)) {
+		t.Fatal("corrupted object matches its checksum")
+	}
+}
@@ -0,0 +1,76 @@
+// +build pmemTest
+
+// This test verifies that an object graph built in volatile memory and copied
+// to persistent memory using PmemPersist() is found after a restart. The first
+// run builds a cyclic list of nodes in volatile memory, copies it, and sets the
+// copy as the root. The second run runs the garbage collector, and checks the
+// list. It is run only if a flag 'pmemTest' is specified. This test need to be
+// run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numNodes = 1000
+)
+
+type node struct {
+	val  int
+	name string
+	data []byte
+	next *node
+}
+
+func TestPmemPersistCopy(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		var first, last *node
+		for i := 0; i < numNodes; i++ {
+			n := &node{val: i, name: strconv.Itoa(i), data: make([]byte, i)}
+			if first == nil {
+				first = n
+			} else {
+				last.next = n
+			}
+			last = n
+		}
+		last.next = first
+		x := runtime.PmemPersist(unsafe.Pointer(first))
+		if x == nil {
+			t.Fatal("PmemPersist failed")
+		}
+		if err := runtime.SetRoot(x); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	runtime.GC()
+	runtime.GC()
+	first := (*node)(rootPtr)
+	n := first
+	for i := 0; i < numNodes; i++ {
+		if n.val != i || n.name != strconv.Itoa(i) || len(n.data) != i {
+			t.Fatalf("node %d not found after a restart", i)
+		}
+		n = n.next
+	}
+	if n != first {
+		t.Fatal("list is not cyclic after a restart")
+	}
+}
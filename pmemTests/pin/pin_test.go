@@ -0,0 +1,149 @@
+// +build pmemTest
+
+// This test verifies that objects pinned using PmemPin() stay pinned across a
+// restart, and that the arena holding them is not relocated. The first run
+// pins an object reachable from the root, and checks that pins are cleared
+// when objects are unpinned or freed by the garbage collector. The second run
+// first starts a child process that maps the address of the pinned object
+// before it initializes persistent memory, and checks that the initialization
+// fails instead of relocating the arena. It then checks that the object is
+// still pinned. It is run only if a flag 'pmemTest' is specified. This test
+// need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	addrFile = "./pinaddr"
+	childEnv = "PMEM_PIN_CHILD"
+
+	mapFixedNoReplace = 0x100000
+)
+
+type root struct {
+	pinned   *[64]int
+	unpinned *[64]int
+}
+
+func checkStats(t *testing.T, objects, spans uint64) {
+	var ps runtime.PmemStats
+	runtime.ReadPmemStats(&ps)
+	if ps.PinnedObjects != objects || ps.PinnedSpans != spans {
+		t.Fatalf("found %d pinned objects in %d spans, expected %d in %d",
+			ps.PinnedObjects, ps.PinnedSpans, objects, spans)
+	}
+}
+
+var sink *[64]int
+
+// pinGarbage pins an object that is not reachable once it returns
+func pinGarbage(t *testing.T) {
+	sink = pnew([64]int)
+	if err := runtime.PmemPin(unsafe.Pointer(sink)); err != nil {
+		t.Fatal(err)
+	}
+	sink = nil
+}
+
+// blockedChild maps a page at the address of the pinned object before
+// persistent memory is initialized
+func blockedChild(t *testing.T, addr uintptr) {
+	page := addr &^ uintptr(os.Getpagesize()-1)
+	p, _, errno := syscall.Syscall6(syscall.SYS_MMAP, page, uintptr(os.Getpagesize()),
+		syscall.PROT_READ, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|mapFixedNoReplace,
+		^uintptr(0), 0)
+	if errno != 0 || p != page {
+		t.Skip("cannot map the address of the pinned object")
+	}
+	if _, err := runtime.PmemInit(dataFile); err != runtime.ErrPmemPinned {
+		t.Fatalf("PmemInit returned %v, expected %v", err, runtime.ErrPmemPinned)
+	}
+}
+
+func TestPmemPin(t *testing.T) {
+	if v := os.Getenv(childEnv); v != "" {
+		addr, _ := strconv.ParseUint(v, 16, 64)
+		blockedChild(t, uintptr(addr))
+		return
+	}
+
+	if b, err := ioutil.ReadFile(addrFile); err == nil {
+		cmd := exec.Command(os.Args[0], "-test.run=TestPmemPin")
+		cmd.Env = append(os.Environ(), childEnv+"="+string(b))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("child process failed: %v\n%s", err, out)
+		}
+	}
+
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		r := pnew(root)
+		r.pinned = pnew([64]int)
+		r.unpinned = pnew([64]int)
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := runtime.PmemPin(unsafe.Pointer(&r.pinned[1])); err == nil {
+			t.Fatal("pinned a pointer into the middle of an object")
+		}
+		for i := 0; i < 2; i++ {
+			if err := runtime.PmemPin(unsafe.Pointer(r.pinned)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := runtime.PmemPin(unsafe.Pointer(r.unpinned)); err != nil {
+			t.Fatal(err)
+		}
+		checkStats(t, 2, 1)
+		if err := runtime.PmemUnpin(unsafe.Pointer(r.unpinned)); err != nil {
+			t.Fatal(err)
+		}
+		if runtime.PmemIsPinned(unsafe.Pointer(r.unpinned)) {
+			t.Fatal("object still pinned after it was unpinned")
+		}
+
+		pinGarbage(t)
+		checkStats(t, 2, 1)
+		runtime.GC()
+		runtime.GC()
+		checkStats(t, 1, 1)
+
+		addr := strconv.FormatUint(uint64(uintptr(unsafe.Pointer(r.pinned))), 16)
+		if err := ioutil.WriteFile(addrFile, []byte(addr), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+	defer os.Remove(addrFile)
+
+	r := (*root)(rootPtr)
+	if !runtime.PmemIsPinned(unsafe.Pointer(r.pinned)) ||
+		runtime.PmemIsPinned(unsafe.Pointer(r.unpinned)) {
+		t.Fatal("pin state not restored after a restart")
+	}
+	checkStats(t, 1, 1)
+	if err := runtime.PmemUnpin(unsafe.Pointer(r.pinned)); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, 0, 0)
+}
@@ -0,0 +1,70 @@
+// +build pmemTest
+
+// This test verifies that the objects released to a PmemPool are kept across
+// restarts. The first run allocates objects from a pool, stores a value in
+// each of them, and releases them to the pool without keeping any reference
+// to them. The second run creates a pool of the same type and checks that Get
+// returns the released objects with their values, and then new zeroed
+// objects. It is run only if a flag 'pmemTest' is specified. This test need to
+// be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numObjs  = 1000
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+func TestPmemPoolFreeList(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	pool := runtime.PnewPool(node{})
+	if rootPtr == nil {
+		for i := 0; i < numObjs; i++ {
+			x := (*node)(pool.New())
+			x.val = i + 1
+			runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+			if err := pool.Put(unsafe.Pointer(x)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		x := pnew(int)
+		if err := runtime.SetRoot(unsafe.Pointer(x)); err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		runtime.GC()
+		return
+	}
+	defer os.Remove(dataFile)
+
+	runtime.GC()
+	seen := make([]bool, numObjs+1)
+	for i := 0; i < numObjs; i++ {
+		x := (*node)(pool.Get())
+		if x.val < 1 || x.val > numObjs || seen[x.val] {
+			t.Fatalf("Get returned an object with value %d after a restart", x.val)
+		}
+		seen[x.val] = true
+	}
+	if x := (*node)(pool.Get()); x == nil || x.val != 0 {
+		t.Fatal("Get of an empty pool did not return a new object")
+	}
+}
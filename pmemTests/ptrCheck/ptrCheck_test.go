@@ -0,0 +1,68 @@
+// +build pmemTest
+
+// This test verifies that PmemCheckPointers() detects pointers to volatile
+// memory that are made persistent. Pointers into persistent memory are
+// persisted while the check is enabled, and a child process checks that
+// persisting a pointer to a volatile object throws. It is run only if a flag
+// 'pmemTest' is specified. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	childEnv = "PMEM_PTR_CHECK_CHILD"
+)
+
+type node struct {
+	next *node
+	val  *int
+}
+
+var volatile *int
+
+func TestPmemPtrCheck(t *testing.T) {
+	defer os.Remove(dataFile)
+	if _, err := runtime.PmemInit(dataFile); err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	volatile = new(int)
+	n := pnew(node)
+	if err := runtime.SetRoot(unsafe.Pointer(n)); err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Getenv(childEnv) != "" {
+		runtime.PmemCheckPointers(true)
+		n.val = volatile
+		runtime.PersistObject(unsafe.Pointer(n))
+		return
+	}
+
+	// The check is disabled by default
+	n.val = volatile
+	runtime.PersistObject(unsafe.Pointer(n))
+
+	runtime.PmemCheckPointers(true)
+	n.next = pnew(node)
+	n.val = pnew(int)
+	runtime.PersistObject(unsafe.Pointer(n))
+	runtime.PersistRange(unsafe.Pointer(&n.val), unsafe.Sizeof(n.val))
+	runtime.PmemCheckPointers(false)
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemPtrCheck")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "pointer to volatile memory made persistent") {
+		t.Fatalf("persisting a pointer to volatile memory did not throw: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,116 @@
+// +build pmemTest
+
+// This test creates a persistent memory file in the first run, and opens it
+// using PmemOpenReadOnly() in the second run. It verifies that the roots and
+// the statistics of the file can be read, that allocations fail, and that the
+// file is not modified even if the garbage collector runs and objects in the
+// file are written to. It is run only if a flag 'pmemTest' is specified. This
+// test need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	listLen  = 1000
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+func fileHash(t *testing.T) []byte {
+	b, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func TestPmemReadOnly(t *testing.T) {
+	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			log.Fatal("Pmem initialization failed with error ", err)
+		}
+		var head *node
+		for i := listLen; i > 0; i-- {
+			n := pnew(node)
+			n.val = i
+			n.next = head
+			head = n
+		}
+		runtime.SetRoot(unsafe.Pointer(head))
+		runtime.SetNamedRoot("first", unsafe.Pointer(head))
+		return
+	}
+
+	if err := os.Chmod(dataFile, 0444); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dataFile, 0644)
+	before := fileHash(t)
+
+	region, err := runtime.PmemOpenReadOnly(dataFile)
+	if err != nil {
+		log.Fatal("Read-only open failed with error ", err)
+	}
+	root := (*node)(region.Root())
+	if root == nil || region.NamedRoot("first") != unsafe.Pointer(root) {
+		t.Fatal("Roots of the file are not found")
+	}
+	var ps runtime.PmemStats
+	region.ReadStats(&ps)
+	if ps.TotalBytes == 0 || ps.UsedBytes == 0 {
+		t.Fatalf("Unexpected statistics %+v", ps)
+	}
+
+	if runtime.Pnew(node{}) != nil {
+		t.Fatal("Allocation succeeded in a read-only file")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != runtime.ErrPmemReadOnly {
+				t.Fatalf("pnew panicked with %v, expected %v", r, runtime.ErrPmemReadOnly)
+			}
+		}()
+		t.Logf("%p", pnew(node))
+	}()
+	if runtime.SetRoot(nil) != runtime.ErrPmemReadOnly {
+		t.Fatal("SetRoot succeeded in a read-only file")
+	}
+	if _, err := runtime.PTxBegin(); err != runtime.ErrPmemReadOnly {
+		t.Fatal("PTxBegin succeeded in a read-only file")
+	}
+
+	runtime.GC()
+	i := 1
+	for n := root; n != nil; n = n.next {
+		if n.val != i {
+			t.Fatalf("List node %d has value %d", i, n.val)
+		}
+		// Writes to the objects are not stored in the file
+		n.val = -i
+		i++
+	}
+	if i != listLen+1 {
+		t.Fatalf("List has %d nodes, expected %d", i-1, listLen)
+	}
+	runtime.GC()
+	if !bytes.Equal(before, fileHash(t)) {
+		t.Fatal("Persistent memory file was modified")
+	}
+}
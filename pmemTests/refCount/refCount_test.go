@@ -0,0 +1,130 @@
+// +build pmemTest
+
+// This test verifies that the reference counts of objects allocated using
+// PnewRC() are persistent. The first run shares an object between two roots
+// and drops one of them, as if the application crashed between the two
+// PmemDecRef() calls. It also uses the fault injection harness to simulate a
+// crash while a second object is being released. The second run checks that
+// the first object still has one reference and is released when it is
+// dropped, and that the release of the second object was completed during
+// reconstruction. It is run only if a flag 'pmemTest' is specified. This test
+// need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	magic    = 0x5ca1ab1e
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+// record holds the address of an object that is released, as a pointer to
+// its slot must not be kept once it is freed
+type record struct {
+	addr uintptr
+}
+
+// newShared allocates a reference counted node that is referenced from the
+// roots 'names'
+func newShared(t *testing.T, names ...string) *node {
+	n := (*node)(runtime.PnewRC(node{}))
+	n.val = magic
+	n.next = pnew(node)
+	runtime.PersistRange(unsafe.Pointer(n), unsafe.Sizeof(*n))
+	for i, name := range names {
+		if i > 0 {
+			if err := runtime.PmemIncRef(unsafe.Pointer(n)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := runtime.SetNamedRoot(name, unsafe.Pointer(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+// drop removes the root 'name' to the reference counted node 'n'
+func drop(t *testing.T, name string, n *node) bool {
+	if err := runtime.SetNamedRoot(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	freed, err := runtime.PmemDecRef(unsafe.Pointer(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return freed
+}
+
+func TestPmemRefCount(t *testing.T) {
+	if _, err := runtime.PmemInit(dataFile); err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if a := (*node)(runtime.GetNamedRoot("a2")); a == nil {
+		a := newShared(t, "a1", "a2")
+		if drop(t, "a1", a) {
+			t.Fatal("object released while it is still referenced")
+		}
+
+		// Crash after the count of 'b' is persisted as zero, but before the
+		// object is released
+		b := newShared(t)
+		r := pnew(record)
+		r.addr = uintptr(unsafe.Pointer(b))
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		if err := runtime.SetNamedRoot("b", unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		if err := runtime.PmemFaultInject(1); err != nil {
+			t.Fatal(err)
+		}
+		if freed, err := runtime.PmemDecRef(unsafe.Pointer(b)); !freed || err != nil {
+			t.Fatalf("PmemDecRef returned %v, %v for the last reference", freed, err)
+		}
+		_, _, image := runtime.PmemFaultInjectStop()
+		f, err := os.OpenFile(dataFile, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(image, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return
+	}
+	defer os.Remove(dataFile)
+
+	r := (*record)(runtime.GetNamedRoot("b"))
+	if r == nil {
+		t.Fatal("record of the object being released not found")
+	}
+	if runtime.PmemRefCount(unsafe.Pointer(r.addr)) != 0 || runtime.IsObjectStart(unsafe.Pointer(r.addr)) {
+		t.Fatal("interrupted release not completed")
+	}
+
+	a := (*node)(runtime.GetNamedRoot("a2"))
+	if n := runtime.PmemRefCount(unsafe.Pointer(a)); n != 1 || a.val != magic || a.next == nil {
+		t.Fatalf("shared object has reference count %d and value %x after a restart", n, a.val)
+	}
+	addr := uintptr(unsafe.Pointer(a))
+	if !drop(t, "a2", a) {
+		t.Fatal("object not released when its last reference was dropped")
+	}
+	if runtime.IsObjectStart(unsafe.Pointer(addr)) {
+		t.Fatal("released object not freed")
+	}
+}
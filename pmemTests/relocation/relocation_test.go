@@ -0,0 +1,130 @@
+// +build pmemTest
+
+// This test verifies the behavior of PmemInit() when an arena cannot be mapped
+// at the address it was mapped at in the previous run. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times. The first run
+// creates a linked list in persistent memory. The second run reserves the
+// address of the list, checks in a child process that PmemInit() fails if
+// relocation is disabled, and then checks that the list is relocated and its
+// pointers are swizzled if relocation is allowed. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// The file in which the first run stores the address of the root object
+	addrFile = "./rootaddr"
+
+	// Set in the environment of the child process of the second run
+	childEnv = "PMEM_RELOCATION_CHILD"
+
+	listLen = 1000
+
+	mapFixedNoReplace = 0x100000
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+type rootObj struct {
+	head *node
+}
+
+func TestPmemRelocation(t *testing.T) {
+	if os.Getenv(childEnv) != "" {
+		blockRootAddr(t)
+		runtime.SetPmemRelocation(false)
+		_, err := runtime.PmemInit(dataFile)
+		if !errors.Is(err, runtime.ErrPmemRelocation) {
+			t.Fatalf("PmemInit returned %v, expected %v", err, runtime.ErrPmemRelocation)
+		}
+		return
+	}
+
+	if _, err := os.Stat(dataFile); err != nil {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		r := pnew(rootObj)
+		for i := listLen; i > 0; i-- {
+			n := pnew(node)
+			n.val = i
+			n.next = r.head
+			r.head = n
+		}
+		runtime.SetRoot(unsafe.Pointer(r))
+		addr := strconv.FormatUint(uint64(uintptr(unsafe.Pointer(r))), 16)
+		if err := ioutil.WriteFile(addrFile, []byte(addr), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	// Remove the files so that the test can be run again
+	defer os.Remove(dataFile)
+	defer os.Remove(addrFile)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPmemRelocation$")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Child process failed with error %v:\n%s", err, out)
+	}
+
+	oldAddr := blockRootAddr(t)
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil || uintptr(rootPtr) == oldAddr {
+		t.Fatalf("Root object not relocated from address %#x", oldAddr)
+	}
+	r := (*rootObj)(rootPtr)
+	i := 1
+	for n := r.head; n != nil; n = n.next {
+		if !runtime.InPmem(uintptr(unsafe.Pointer(n))) || n.val != i {
+			t.Fatalf("List node %d not swizzled correctly", i)
+		}
+		i++
+	}
+	if i != listLen+1 {
+		t.Fatalf("Relocated list has %d nodes, expected %d", i-1, listLen)
+	}
+}
+
+// blockRootAddr reserves the page that held the root object in the first run,
+// so that the arena holding it cannot be mapped at its previous address. It
+// returns the previous address of the root object.
+func blockRootAddr(t *testing.T) uintptr {
+	b, err := ioutil.ReadFile(addrFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := strconv.ParseUint(string(b), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := uintptr(addr) &^ uintptr(os.Getpagesize()-1)
+	p, _, errno := syscall.Syscall6(syscall.SYS_MMAP, page, uintptr(os.Getpagesize()),
+		syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|mapFixedNoReplace,
+		^uintptr(0), 0)
+	if errno != 0 || p != page {
+		t.Fatalf("Unable to reserve address %#x: %v", page, errno)
+	}
+	return uintptr(addr)
+}
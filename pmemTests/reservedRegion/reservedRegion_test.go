@@ -0,0 +1,100 @@
+// +build pmemTest
+
+// This test creates a persistent memory file with an application reserved
+// region whose size is not a multiple of the page size, and verifies that the
+// contents of the region and of the persistent memory heap survive a restart.
+// The second run also verifies, in a child process, that the file cannot be
+// reopened with a reserved region of a different size. It is run only if a
+// flag 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile     = "./datafile"
+	reservedSize = 100
+	listLen      = 1000
+
+	childEnv = "PMEM_RESERVED_REGION_CHILD"
+)
+
+type node struct {
+	val  int
+	next *node
+}
+
+func TestPmemReservedRegion(t *testing.T) {
+	if os.Getenv(childEnv) != "" {
+		runtime.SetPmemReservedSize(2 * reservedSize)
+		if _, err := runtime.PmemInit(dataFile); err != runtime.ErrPmemReservedSize {
+			t.Fatalf("PmemInit returned %v, expected %v", err, runtime.ErrPmemReservedSize)
+		}
+		return
+	}
+	if _, err := os.Stat(dataFile); err == nil {
+		cmd := exec.Command(os.Args[0], "-test.run=TestPmemReservedRegion")
+		cmd.Env = append(os.Environ(), childEnv+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("child process failed: %v\n%s", err, out)
+		}
+	}
+
+	// The size set in the second run matches the size stored in the file
+	runtime.SetPmemReservedSize(reservedSize)
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	addr, size := runtime.PmemReservedRegion()
+	if size != reservedSize {
+		t.Fatalf("Reserved region size is %d, expected %d", size, reservedSize)
+	}
+	region := (*[reservedSize]byte)(addr)
+	if runtime.InPmem(uintptr(addr)) || runtime.InPmem(uintptr(addr)+size-1) {
+		t.Fatal("Reserved region overlaps the persistent memory heap")
+	}
+
+	if rootPtr == nil {
+		for i := range region {
+			region[i] = byte(i + 1)
+		}
+		runtime.PersistRange(addr, size)
+		var head *node
+		for i := listLen; i > 0; i-- {
+			n := pnew(node)
+			n.val = i
+			n.next = head
+			head = n
+		}
+		runtime.SetRoot(unsafe.Pointer(head))
+		return
+	}
+
+	for i := range region {
+		if region[i] != byte(i+1) {
+			t.Fatalf("Byte %d of the reserved region is %d, expected %d", i, region[i], i+1)
+		}
+	}
+	runtime.GC()
+	i := 1
+	for n := (*node)(rootPtr); n != nil; n = n.next {
+		if n.val != i {
+			t.Fatalf("List node %d has value %d", i, n.val)
+		}
+		i++
+	}
+	if i != listLen+1 {
+		t.Fatalf("List has %d nodes, expected %d", i-1, listLen)
+	}
+}
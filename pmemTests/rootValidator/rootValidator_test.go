@@ -0,0 +1,95 @@
+// +build pmemTest
+
+// This test verifies the validation of the roots found after a restart. The
+// first run sets the root and two named roots, one of which holds an object
+// whose magic field is wrong, as if it was not completely written before a
+// crash. The second run registers validators that check the magic field, and
+// checks that only the corrupt root is rejected, and that it can be replaced.
+// It is run only if a flag 'pmemTest' is specified. This test need to be run
+// two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	magic    = 0x600dcafe
+)
+
+type header struct {
+	magic int
+}
+
+func newHeader(m int) unsafe.Pointer {
+	h := pnew(header)
+	h.magic = m
+	runtime.PersistRange(unsafe.Pointer(h), unsafe.Sizeof(*h))
+	return unsafe.Pointer(h)
+}
+
+func valid(ptr unsafe.Pointer) bool {
+	return (*header)(ptr).magic == magic
+}
+
+func TestPmemRootValidator(t *testing.T) {
+	_, statErr := os.Stat(dataFile)
+	firstRun := os.IsNotExist(statErr)
+	if !firstRun {
+		for _, name := range []string{"", "good", "bad", "missing"} {
+			if err := runtime.SetRootValidator(name, valid); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if err := runtime.SetRootValidator("", valid); err != runtime.ErrPmemAlreadyInit {
+		t.Fatal("Validator registered after initialization, error ", err)
+	}
+
+	if firstRun {
+		if err := runtime.SetRoot(newHeader(magic)); err != nil {
+			t.Fatal(err)
+		}
+		if err := runtime.SetNamedRoot("good", newHeader(magic)); err != nil {
+			t.Fatal(err)
+		}
+		if err := runtime.SetNamedRoot("bad", newHeader(magic+1)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	if rootPtr == nil || runtime.GetRoot() == nil || runtime.GetNamedRoot("good") == nil {
+		t.Fatal("Valid root rejected")
+	}
+	if runtime.GetNamedRoot("bad") != nil {
+		t.Fatal("Corrupt root not rejected")
+	}
+	if r := runtime.PmemRejectedRoots(); len(r) != 1 || r[0] != "bad" {
+		t.Fatal("Unexpected rejected roots ", r)
+	}
+
+	// Replacing the rejected root makes it available again
+	if err := runtime.SetNamedRoot("bad", newHeader(magic)); err != nil {
+		t.Fatal(err)
+	}
+	if p := runtime.GetNamedRoot("bad"); p == nil || !valid(p) {
+		t.Fatal("Replaced root not found")
+	}
+	if r := runtime.PmemRejectedRoots(); len(r) != 0 {
+		t.Fatal("Unexpected rejected roots ", r)
+	}
+}
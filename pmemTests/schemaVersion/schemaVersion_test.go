@@ -0,0 +1,91 @@
+// +build pmemTest
+
+// This test verifies the schema version of the application data stored in the
+// persistent memory file. The first run creates the file using PmemReopen()
+// with schema version 1. The second run reopens it expecting version 2, checks
+// that a migration is needed, and records version 2. Child processes then
+// check that the file cannot be reopened by an application that expects
+// version 1, and that no migration is needed for version 2. It is run only if
+// a flag 'pmemTest' is specified. This test need to be run two times to test
+// the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	childEnv = "PMEM_SCHEMA_VERSION_CHILD"
+)
+
+func runChild(t *testing.T, expected uint32) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestPmemSchemaVersion")
+	cmd.Env = append(os.Environ(), childEnv+"="+strconv.Itoa(int(expected)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v\n%s", err, out)
+	}
+}
+
+func TestPmemSchemaVersion(t *testing.T) {
+	if v := os.Getenv(childEnv); v != "" {
+		expected, _ := strconv.Atoi(v)
+		region, migrate, err := runtime.PmemReopen(dataFile, 0, uint32(expected))
+		switch expected {
+		case 1:
+			if err != runtime.ErrPmemSchemaNewer {
+				t.Fatalf("PmemReopen returned %v, expected %v", err, runtime.ErrPmemSchemaNewer)
+			}
+		case 2:
+			if err != nil || migrate || region.Schema() != 2 {
+				t.Fatalf("PmemReopen returned (%v, %v), schema version %d", migrate, err,
+					region.Schema())
+			}
+		}
+		return
+	}
+
+	region, migrate, err := runtime.PmemReopen(dataFile, 0, 2)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+	if region.Root() == nil {
+		// First run. Create the file as an older application would.
+		if v := region.Schema(); v != 2 || migrate {
+			t.Fatalf("new file has schema version %d, migration needed %v", v, migrate)
+		}
+		if err := runtime.PmemSetSchema(region, 1); err != nil {
+			t.Fatal(err)
+		}
+		x := pnew(int)
+		*x = 1
+		runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+		if err := runtime.SetRoot(unsafe.Pointer(x)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	if !migrate || region.Schema() != 1 {
+		t.Fatalf("file with schema version %d reopened, migration needed %v",
+			region.Schema(), migrate)
+	}
+	x := (*int)(region.Root())
+	*x = 2
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+	if err := runtime.PmemSetSchema(region, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	runChild(t, 1)
+	runChild(t, 2)
+}
@@ -0,0 +1,77 @@
+// +build pmemTest
+
+// This test verifies that the span bitmap entry of a new span is persisted
+// only after the heap type bits logged for the span. The first run allocates
+// large objects with pointers, and uses the fault injection harness to count
+// the flushes done by such an allocation and then to simulate a crash just
+// before the last flush of another one. The second run checks that the span
+// of the last object is not found in use, and that the spans found in use are
+// consistent with their logged type bits. It is run only if a flag 'pmemTest'
+// is specified. This test need to be run two times to test the recovery path.
+// E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numElems = 8192
+)
+
+func TestPmemSpanOrder(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		// Prevent background sweeping from flushing span bitmap entries
+		// while fault injection is active
+		defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+		a := pmake([]*int, numElems)
+		if err := runtime.SetRoot(unsafe.Pointer(&a[0])); err != nil {
+			t.Fatal(err)
+		}
+
+		// Count the flushes done to allocate an object of the same size
+		if err := runtime.PmemFaultInject(-1); err != nil {
+			t.Fatal(err)
+		}
+		c := pmake([]*int, numElems)
+		flushes, _, _ := runtime.PmemFaultInjectStop()
+		t.Logf("%p", &c[0])
+
+		// Lose the last flush of the allocation of 'b'
+		if err := runtime.PmemFaultInject(flushes - 1); err != nil {
+			t.Fatal(err)
+		}
+		b := pmake([]*int, numElems)
+		_, _, image := runtime.PmemFaultInjectStop()
+		t.Logf("%p", &b[0])
+		if err := ioutil.WriteFile(dataFile, image, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	var ps runtime.PmemStats
+	runtime.ReadPmemStats(&ps)
+	if ps.NumLargeSpans != 2 {
+		t.Errorf("found %d large spans after a crash, expected 2", ps.NumLargeSpans)
+	}
+	if errs := runtime.PmemVerify(); len(errs) != 0 {
+		t.Errorf("persistent memory heap inconsistent after a crash: %v", errs)
+	}
+}
@@ -0,0 +1,115 @@
+// +build pmemTest
+
+// This test allocates objects of several size classes, both small and large,
+// and verifies that the spans holding them are reconstructed after a restart.
+// It is run only if a flag 'pmemTest' is specified. This test need to be run
+// two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+
+	// Number of objects allocated for each object size
+	numObjs = 64
+)
+
+// Object sizes that cover tiny, small and large spans
+var objSizes = []int{8, 24, 48, 512, 4096, 20000, 40000, 1 << 20}
+
+type rootObj struct {
+	objs [][]byte
+}
+
+// Holds unreachable persistent objects so that they are heap allocated
+var garbage []byte
+
+func fill(b []byte, seed int) {
+	for i := range b {
+		b[i] = byte(seed + i)
+	}
+}
+
+func check(b []byte, seed int) bool {
+	for i := range b {
+		if b[i] != byte(seed+i) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPmemSpanRecovery(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		r := pnew(rootObj)
+		r.objs = pmake([][]byte, len(objSizes)*numObjs)
+		for i, size := range objSizes {
+			for j := 0; j < numObjs; j++ {
+				k := i*numObjs + j
+				r.objs[k] = pmake([]byte, size)
+				fill(r.objs[k], k)
+				// Interleave unreachable objects so that the recovered
+				// spans have free slots and free pages in between.
+				if j%2 == 1 {
+					garbage = pmake([]byte, size)
+				}
+			}
+		}
+		runtime.SetRoot(unsafe.Pointer(r))
+		return
+	}
+
+	// Run a full GC cycle
+	runtime.GC()
+	r := (*rootObj)(rootPtr)
+	if len(r.objs) != len(objSizes)*numObjs {
+		t.Fatal("Recovered root object has invalid length")
+	}
+	live := make(map[uintptr]int, len(r.objs))
+	for i, size := range objSizes {
+		for j := 0; j < numObjs; j++ {
+			k := i*numObjs + j
+			b := r.objs[k]
+			if len(b) != size || !check(b, k) {
+				t.Fatalf("Recovered object %d of size %d is corrupted", k, size)
+			}
+			p := unsafe.Pointer(&b[0])
+			if size >= 16 && !runtime.IsObjectStart(p) {
+				t.Fatalf("Recovered object %d of size %d is not allocated", k, size)
+			}
+			live[uintptr(p)] = size
+		}
+	}
+
+	// Memory freed by the GC and the free pages found during reconstruction
+	// must be reusable, and must not overlap any of the recovered objects.
+	for _, size := range objSizes {
+		for j := 0; j < numObjs; j++ {
+			b := pmake([]byte, size)
+			start := uintptr(unsafe.Pointer(&b[0]))
+			for p, sz := range live {
+				if start < p+uintptr(sz) && p < start+uintptr(size) {
+					t.Fatal("New allocation overlaps a recovered object")
+				}
+			}
+		}
+	}
+	for k, b := range r.objs {
+		if !check(b, k) {
+			t.Fatalf("Recovered object %d overwritten by a new allocation", k)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// +build pmemTest
+
+// This test verifies the allocation timestamps of persistent memory objects.
+// The first run allocates timestamped objects, links them from the root
+// object, and records the times before and after the allocations in it. The
+// second run checks that the age of each object is between the times since
+// the recorded times, and evicts the objects. It is run only if a flag 'pmemTest' is specified. This
+// test need to be run two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numObjs  = 100 // more than the entries of a new timestamp table
+)
+
+type entry struct {
+	val  int
+	next *entry
+}
+
+type root struct {
+	before int64 // wall-clock time before the objects were allocated
+	after  int64 // wall-clock time after the objects were allocated
+	head   *entry
+}
+
+func TestPmemTimed(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		t.Fatal("Pmem initialization failed with error ", err)
+	}
+
+	if rootPtr == nil {
+		r := pnew(root)
+		r.before = time.Now().UnixNano()
+		for i := 0; i < numObjs; i++ {
+			e := (*entry)(runtime.PnewTimed(entry{}))
+			if e == nil {
+				t.Fatal("PnewTimed failed")
+			}
+			e.val = i
+			e.next = r.head
+			runtime.PersistRange(unsafe.Pointer(e), unsafe.Sizeof(*e))
+			r.head = e
+		}
+		r.after = time.Now().UnixNano()
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := runtime.PmemObjectAge(unsafe.Pointer(r)); ok {
+			t.Error("Age reported for an object without a timestamp")
+		}
+		if n, err := runtime.PmemEvictOlderThan(int64(time.Hour), nil); n != 0 || err != nil {
+			t.Errorf("Evicted %d new objects, error %v", n, err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	r := (*root)(rootPtr)
+	now := time.Now().UnixNano()
+	minAge, maxAge := now-r.after, now-r.before
+	for e := r.head; e != nil; e = e.next {
+		age, ok := runtime.PmemObjectAge(unsafe.Pointer(e))
+		if !ok {
+			t.Fatal("Timestamp not found after a restart")
+		}
+		if age < minAge || age > maxAge {
+			t.Fatalf("Object allocated %v to %v ago reported %v old",
+				time.Duration(minAge), time.Duration(maxAge), time.Duration(age))
+		}
+	}
+
+	freed := 0
+	n, err := runtime.PmemEvictOlderThan(minAge, func(ptr unsafe.Pointer) {
+		if (*entry)(ptr).val >= numObjs {
+			t.Error("Evicted object is not an entry")
+		}
+		freed++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != numObjs || freed != numObjs {
+		t.Fatalf("Evicted %d objects, freed %d, want %d", n, freed, numObjs)
+	}
+	if _, ok := runtime.PmemObjectAge(unsafe.Pointer(r.head)); ok {
+		t.Error("Age reported for an evicted object")
+	}
+}
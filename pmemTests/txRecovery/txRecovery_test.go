@@ -0,0 +1,76 @@
+// +build pmemTest
+
+// This test verifies that updates made within a transaction that was not
+// committed are reverted after a restart. It is run only if a flag 'pmemTest'
+// is specified. This test need to be run two times to test the recovery path.
+// E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numElems = 37
+)
+
+type rootObj struct {
+	val   int
+	ptr   *int
+	bytes [numElems]byte
+}
+
+func TestPmemTxRecovery(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		r := pnew(rootObj)
+		r.val = 1
+		r.ptr = pnew(int)
+		*r.ptr = 42
+		for i := range r.bytes {
+			r.bytes[i] = byte(i)
+		}
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		runtime.SetRoot(unsafe.Pointer(r))
+
+		// Update the root object within a transaction that is never
+		// committed. This simulates a crash in the middle of the transaction.
+		tx, err := runtime.PTxBegin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Log(unsafe.Pointer(r), unsafe.Sizeof(*r)); err != nil {
+			t.Fatal(err)
+		}
+		r.val = 2
+		r.ptr = pnew(int)
+		*r.ptr = 13
+		for i := range r.bytes {
+			r.bytes[i] = 0xff
+		}
+		runtime.PersistRange(unsafe.Pointer(r), unsafe.Sizeof(*r))
+		return
+	}
+
+	// Run a full GC cycle
+	runtime.GC()
+	r := (*rootObj)(rootPtr)
+	if r.val != 1 || *r.ptr != 42 {
+		t.Fatal("Uncommitted transaction not reverted")
+	}
+	for i := range r.bytes {
+		if r.bytes[i] != byte(i) {
+			t.Fatalf("Byte %d of the logged range not restored", i)
+		}
+	}
+}
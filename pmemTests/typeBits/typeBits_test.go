@@ -0,0 +1,79 @@
+// +build pmemTest
+
+// This test verifies that the heap type bits of recovered spans are restored,
+// so that the garbage collector does not free objects that are referenced only
+// by pointers within recovered persistent memory objects. It is run only if a
+// flag 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	numNodes = 100000
+)
+
+type node struct {
+	key  int
+	val  *int
+	name []byte
+	next *node
+}
+
+// Holds the objects allocated after the restart so that they are not freed
+var churn []*int
+
+func TestPmemTypeBits(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		var head *node
+		for i := 0; i < numNodes; i++ {
+			n := pnew(node)
+			n.key = i
+			n.val = pnew(int)
+			*n.val = i
+			n.name = pmake([]byte, 16)
+			n.name[0] = byte(i)
+			n.next = head
+			head = n
+		}
+		runtime.SetRoot(unsafe.Pointer(head))
+		return
+	}
+
+	// If the type bits were not restored, the GC would free the objects
+	// referenced by the recovered nodes and the allocations below would reuse
+	// their memory.
+	runtime.GC()
+	for i := 0; i < numNodes; i++ {
+		p := pnew(int)
+		*p = -1
+		b := pmake([]byte, 16)
+		b[0] = 0xff
+		churn = append(churn, p)
+	}
+	runtime.GC()
+
+	count := 0
+	for n := (*node)(rootPtr); n != nil; n = n.next {
+		if *n.val != n.key || n.name[0] != byte(n.key) {
+			t.Fatalf("Object referenced by node %d was corrupted", n.key)
+		}
+		count++
+	}
+	if count != numNodes {
+		t.Fatalf("Recovered %d nodes, expected %d", count, numNodes)
+	}
+}
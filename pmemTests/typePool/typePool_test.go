@@ -0,0 +1,116 @@
+// +build pmemTest
+
+// This test allocates a linked list from two persistent memory object pools of
+// different types, and verifies that the heap type bits of the pool objects are
+// reconstructed after a restart. A pool allocates objects from spans that hold
+// objects of a single type, and the type bits of such a span are restored from
+// the type descriptor stored in the header.
+// It is run only if a flag 'pmemTest' is specified. This test need to be run
+// two times to test the recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	dataFile = "./datafile"
+	listLen  = 5000
+)
+
+type node struct {
+	val  int
+	next *node
+	data *leaf
+}
+
+// A type of the same size as node with a different pointer layout
+type leaf struct {
+	val  *[4]int
+	pad  int
+	next *leaf
+}
+
+type rootObj struct {
+	head *node
+}
+
+func TestPmemTypePool(t *testing.T) {
+	rootPtr, err := runtime.PmemInit(dataFile)
+	if err != nil {
+		log.Fatal("Pmem initialization failed with error ", err)
+	}
+	if rootPtr == nil {
+		nodePool := runtime.PnewPool(node{})
+		leafPool := runtime.PnewPool(leaf{})
+		r := pnew(rootObj)
+		for i := listLen; i > 0; i-- {
+			n := (*node)(nodePool.New())
+			n.val = i
+			n.data = (*leaf)(leafPool.New())
+			n.data.val = pnew([4]int)
+			n.data.val[0] = i
+			n.next = r.head
+			r.head = n
+		}
+		runtime.SetRoot(unsafe.Pointer(r))
+		return
+	}
+
+	if errs := runtime.PmemVerify(); errs != nil {
+		t.Fatalf("Reconstructed metadata is inconsistent: %v", errs)
+	}
+
+	// The leaves and the arrays they point to are reachable only through
+	// pointer fields of pool objects. If the type bits of the pool objects are
+	// not reconstructed, they are freed and overwritten by the allocations
+	// below.
+	runtime.GC()
+	for i := 0; i < listLen; i++ {
+		b := pnew([4]int)
+		b[0] = -1
+	}
+
+	r := (*rootObj)(rootPtr)
+	i := 1
+	for n := r.head; n != nil; n = n.next {
+		want := []unsafe.Pointer{unsafe.Pointer(&n.data)}
+		if n.next != nil {
+			want = []unsafe.Pointer{unsafe.Pointer(&n.next), unsafe.Pointer(&n.data)}
+		}
+		if ptrs := runtime.PmemPointers(unsafe.Pointer(n)); !equal(ptrs, want) {
+			t.Fatalf("Pointer fields of list node %d not reconstructed: got %v, expected %v",
+				i, ptrs, want)
+		}
+		want = []unsafe.Pointer{unsafe.Pointer(&n.data.val)}
+		if ptrs := runtime.PmemPointers(unsafe.Pointer(n.data)); !equal(ptrs, want) {
+			t.Fatalf("Pointer fields of leaf %d not reconstructed: got %v, expected %v",
+				i, ptrs, want)
+		}
+		if n.val != i || n.data.val[0] != i {
+			t.Fatalf("List node %d is corrupted", i)
+		}
+		i++
+	}
+	if i != listLen+1 {
+		t.Fatalf("Recovered list has %d nodes, expected %d", i-1, listLen)
+	}
+}
+
+func equal(a, b []unsafe.Pointer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
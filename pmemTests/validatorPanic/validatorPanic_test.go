@@ -0,0 +1,61 @@
+// +build pmemTest
+
+// This test verifies that persistent memory initialization fails for good if a
+// root validator panics. The first run sets the root. The second run registers
+// a validator that panics, and checks that PmemInit propagates the panic and
+// returns ErrPmemInitFailed when it is called again. It is run only if a flag
+// 'pmemTest' is specified. This test need to be run two times to test the
+// recovery path. E.g:
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 1
+// ~/go-pmem/bin/go test -tags="pmemTest" -run TestPmem # run 2
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const dataFile = "./datafile"
+
+type root struct {
+	magic int
+}
+
+// initPanics reports whether PmemInit panics
+func initPanics() (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+	runtime.PmemInit(dataFile)
+	return
+}
+
+func TestPmemValidatorPanic(t *testing.T) {
+	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
+		if _, err := runtime.PmemInit(dataFile); err != nil {
+			t.Fatal("Pmem initialization failed with error ", err)
+		}
+		r := pnew(root)
+		if err := runtime.SetRoot(unsafe.Pointer(r)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	defer os.Remove(dataFile)
+
+	if err := runtime.SetRootValidator("", func(ptr unsafe.Pointer) bool {
+		panic("invalid root")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !initPanics() {
+		t.Fatal("Panic in a root validator not propagated by PmemInit")
+	}
+	if _, err := runtime.PmemInit(dataFile); err != runtime.ErrPmemInitFailed {
+		t.Fatalf("PmemInit after a validator panic returned %v, expected %v", err,
+			runtime.ErrPmemInitFailed)
+	}
+}
@@ -727,6 +727,10 @@ func generateTrace(params *traceParams, consumer traceConsumer) error {
 			ctx.emitInstant(ev, "task start", "user event")
 		case trace.EvUserTaskEnd:
 			ctx.emitInstant(ev, "task end", "user event")
+		case trace.EvPmemAlloc:
+			ctx.emitInstant(ev, "pmem alloc", "")
+		case trace.EvPmemFree:
+			ctx.emitInstant(ev, "pmem free", "")
 		}
 		// Emit any counter updates.
 		ctx.emitThreadCounters(ev)
@@ -1061,6 +1065,20 @@ func (ctx *traceContext) emitInstant(ev *trace.Event, name, category string) {
 		}
 		arg = &Arg{ev.Args[0]}
 	}
+	if ev.Type == trace.EvPmemAlloc {
+		type Arg struct {
+			Size    uint64
+			NewSpan bool
+		}
+		arg = &Arg{ev.Args[0], ev.Args[1] != 0}
+	}
+	if ev.Type == trace.EvPmemFree {
+		type Arg struct {
+			Size uint64
+			Span bool
+		}
+		arg = &Arg{ev.Args[0], ev.Args[1] != 0}
+	}
 	ctx.emit(&traceviewer.Event{
 		Name:     name,
 		Category: category,
@@ -1058,7 +1058,9 @@ const (
 	EvUserTaskEnd       = 46 // end of task [timestamp, internal task id, stack]
 	EvUserRegion        = 47 // trace.WithRegion [timestamp, internal task id, mode(0:start, 1:end), stack, name string]
 	EvUserLog           = 48 // trace.Log [timestamp, internal id, key string id, stack, value string]
-	EvCount             = 49
+	EvPmemAlloc         = 49 // persistent memory allocation [timestamp, size, new span, stack]
+	EvPmemFree          = 50 // persistent memory free [timestamp, size, whole span, stack]
+	EvCount             = 51
 )
 
 var EventDescriptions = [EvCount]struct {
@@ -1117,4 +1119,6 @@ var EventDescriptions = [EvCount]struct {
 	EvUserTaskEnd:       {"UserTaskEnd", 1011, true, []string{"taskid"}, nil},
 	EvUserRegion:        {"UserRegion", 1011, true, []string{"taskid", "mode", "typeid"}, []string{"name"}},
 	EvUserLog:           {"UserLog", 1011, true, []string{"id", "keyid"}, []string{"category", "message"}},
+	EvPmemAlloc:         {"PmemAlloc", 1011, true, []string{"size", "newspan"}, nil},
+	EvPmemFree:          {"PmemFree", 1011, true, []string{"size", "span"}, nil},
 }
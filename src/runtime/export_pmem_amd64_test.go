@@ -0,0 +1,26 @@
+// +build linux
+
+package runtime
+
+import "unsafe"
+
+// PmemMemmoveNT copies 'n' bytes from 'src' to 'dst' using the non-temporal
+// store path of PmemMemmove, irrespective of the threshold and of whether the
+// runtime has mapped a persistent memory file.
+func PmemMemmoveNT(dst, src unsafe.Pointer, n uintptr) {
+	memmoveNTPersist(uintptr(dst), uintptr(src), n)
+}
+
+// PmemFlushRaw flushes and fences the given range irrespective of whether the
+// runtime has mapped a persistent memory file.
+func PmemFlushRaw(addr unsafe.Pointer, len uintptr) {
+	pmemFuncs.flush(uintptr(addr), len)
+	pmemFuncs.fence()
+}
+
+// PmemMemsetNT sets the 'n' bytes at 'addr' to 'c' using the non-temporal store
+// path of PmemMemset, irrespective of the threshold and of whether the runtime
+// has mapped a persistent memory file.
+func PmemMemsetNT(addr unsafe.Pointer, c byte, n uintptr) {
+	memsetNTPersist(uintptr(addr), c, n)
+}
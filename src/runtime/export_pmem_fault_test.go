@@ -0,0 +1,14 @@
+// +build pmemTest
+
+package runtime
+
+import (
+	"unsafe"
+)
+
+// PmemFileOffset returns the offset in the persistent memory file of the
+// persistent memory address 'p'.
+func PmemFileOffset(p unsafe.Pointer) uintptr {
+	off, _ := faultFileOffset(uintptr(p))
+	return off
+}
@@ -0,0 +1,116 @@
+// +build amd64
+
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// The state used to record the flush and fence operations in
+// PmemHeaderInitOrder
+var flushTrace struct {
+	events []string
+	base   uintptr
+	fields map[uintptr]string
+}
+
+func recordFlush(addr, len uintptr) {
+	if name, ok := flushTrace.fields[addr-flushTrace.base]; ok {
+		flushTrace.events = append(flushTrace.events, name)
+	}
+}
+
+func recordFence() {
+	flushTrace.events = append(flushTrace.events, "fence")
+}
+
+// PmemHeaderInitOrder initializes a persistent memory file header and an arena
+// header in volatile memory, and returns the sequence of flush and fence
+// operations done for each of them. A flush is recorded as the name of the
+// header field at which the flushed range starts, and a fence as "fence".
+func PmemHeaderInitOrder() (hdr, arena []string) {
+	ph := new(pHeader)
+	pa := new(pArena)
+	hdrFields := map[uintptr]string{
+		unsafe.Offsetof(ph.magic):         "magic",
+		unsafe.Offsetof(ph.hdrSize):       "hdrSize",
+		unsafe.Offsetof(ph.reservedSize):  "reservedSize",
+		unsafe.Offsetof(ph.formatVersion): "formatVersion",
+		unsafe.Offsetof(ph.logSlots):      "logSlots",
+		unsafe.Offsetof(ph.hdrCRC):        "hdrCRC",
+		unsafe.Offsetof(ph.initState):     "initState",
+		unsafe.Offsetof(ph.mappedSize):    "mappedSize",
+	}
+	arenaFields := map[uintptr]string{
+		unsafe.Offsetof(pa.magic): "magic",
+		unsafe.Offsetof(pa.size):  "size",
+	}
+
+	flush, fence, isPmem := pmemFuncs.flush, pmemFuncs.fence, pmemInfo.isPmem
+	pmemFuncs.flush, pmemFuncs.fence, pmemInfo.isPmem = recordFlush, recordFence, true
+
+	flushTrace.base = uintptr(unsafe.Pointer(ph))
+	flushTrace.fields = hdrFields
+	ph.init(0)
+	hdr, flushTrace.events = flushTrace.events, nil
+
+	flushTrace.base = uintptr(unsafe.Pointer(pa))
+	flushTrace.fields = arenaFields
+	pa.init(64<<20, 0, 0)
+	arena, flushTrace.events = flushTrace.events, nil
+
+	pmemFuncs.flush, pmemFuncs.fence, pmemInfo.isPmem = flush, fence, isPmem
+	flushTrace.fields = nil
+	return
+}
+
+// PmemMsyncCalls returns the number of msync() calls made to persist writes to
+// persistent memory.
+func PmemMsyncCalls() uint64 {
+	return atomic.Load64(&pmemInfo.msyncCalls)
+}
+
+// The state used to count the fences issued by persistent memory allocations
+// in PmemAllocFences
+var fenceCount struct {
+	m      *m
+	fences int
+}
+
+func countFlush(addr, len uintptr) {}
+
+func countFence() {
+	if getg().m == fenceCount.m {
+		fenceCount.fences++
+	}
+}
+
+// PmemAllocFences calls 'alloc' n times, and returns the largest number of
+// fences issued by the calling thread during a single call, and the total
+// number of fences issued. The runtime behaves as if the persistent memory
+// file is on a persistent memory device while the fences are counted.
+func PmemAllocFences(n int, alloc func()) (max, total int) {
+	LockOSThread()
+	defer UnlockOSThread()
+
+	flush, fence, isPmem := pmemFuncs.flush, pmemFuncs.fence, pmemInfo.isPmem
+	syncMode := atomic.Load(&pmemInfo.syncMode)
+	atomic.Store(&pmemInfo.syncMode, PmemSyncAuto)
+	fenceCount.m = getg().m
+	pmemFuncs.flush, pmemFuncs.fence, pmemInfo.isPmem = countFlush, countFence, true
+
+	for i := 0; i < n; i++ {
+		fenceCount.fences = 0
+		alloc()
+		if fenceCount.fences > max {
+			max = fenceCount.fences
+		}
+		total += fenceCount.fences
+	}
+
+	pmemFuncs.flush, pmemFuncs.fence, pmemInfo.isPmem = flush, fence, isPmem
+	atomic.Store(&pmemInfo.syncMode, syncMode)
+	fenceCount.m = nil
+	return
+}
@@ -0,0 +1,195 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"runtime/internal/sys"
+	"unsafe"
+)
+
+// PmemInUse returns the number of bytes in in-use persistent memory spans.
+func PmemInUse() uint64 {
+	return atomic.Load64(&pmemUsage.inUse)
+}
+
+// PmemGrowAddPending adds 'n' bytes to the bytes mapped that are not yet
+// reported to the grow callback, so that the next persistent memory
+// allocation invokes the callback.
+func PmemGrowAddPending(n uintptr) {
+	atomic.Xadduintptr(&pmemGrowth.pending, n)
+}
+
+// PmemGrowPending returns the number of bytes mapped that are not yet reported
+// to the grow callback.
+func PmemGrowPending() uintptr {
+	return atomic.Loaduintptr(&pmemGrowth.pending)
+}
+
+// PmemHeapBitsLogged reports whether the heap type bits logged in persistent
+// memory for the first 'n' bytes of the object at 'p' match the heap bitmap
+// used by the garbage collector. Spans that use the optimized type logging
+// store the type instead of the heap type bits, and are always reported as
+// matching.
+func PmemHeapBitsLogged(p unsafe.Pointer, n uintptr) bool {
+	x := uintptr(p)
+	if spanOfHeap(x).typIndex != 0 {
+		return true
+	}
+	ai := arenaIndex(x)
+	pa := (*pArena)(unsafe.Pointer(mheap_.arenas[ai.l1()][ai.l2()].pArena))
+	for i := uintptr(0); i < n; i += sys.PtrSize {
+		addr := x + i
+		shift := (addr / sys.PtrSize) & 3
+		live := heapBitsForAddr(addr).bits() & (bitPointer | bitScan)
+		logged := uint32(*(*uint8)(pmemHeapBitsAddr(addr, pa))) >> shift & (bitPointer | bitScan)
+		if live != logged {
+			return false
+		}
+	}
+	return true
+}
+
+// PmemArenaLog logs the 'size' bytes at 'addr' in the undo log of the
+// persistent memory arena that contains 'addr'.
+func PmemArenaLog(addr unsafe.Pointer, size uintptr) {
+	pArenaOf(uintptr(addr)).logEntry(addr, size)
+}
+
+// PmemArenaTryLog is like PmemArenaLog, but returns an error if the range
+// cannot be logged.
+func PmemArenaTryLog(addr unsafe.Pointer, size uintptr) error {
+	return pArenaOf(uintptr(addr)).tryLogEntry(addr, size)
+}
+
+// PmemArenaLogEntries returns the number of entries in the undo log of the
+// persistent memory arena that contains 'addr'.
+func PmemArenaLogEntries(addr unsafe.Pointer) int {
+	pa := pArenaOf(uintptr(addr))
+	lock(pa.logLock())
+	n := pa.numLogEntries
+	unlock(pa.logLock())
+	return n
+}
+
+// PmemArenaRevertLog reverts the undo log of the persistent memory arena that
+// contains 'addr'.
+func PmemArenaRevertLog(addr unsafe.Pointer) {
+	pArenaOf(uintptr(addr)).revertLog()
+}
+
+// PmemArenaCommitLog commits the undo log of the persistent memory arena that
+// contains 'addr'.
+func PmemArenaCommitLog(addr unsafe.Pointer) {
+	pArenaOf(uintptr(addr)).commitLog()
+}
+
+// PmemValidateSpanBitmap checks the span bitmap 'bitmap' as it is checked
+// before the spans in a persistent memory arena are reconstructed.
+func PmemValidateSpanBitmap(bitmap []uint32) error {
+	return validateSpanBitmap(bitmap, 0)
+}
+
+// PmemLayoutRuns returns the page runs that PmemDumpLayout writes for an arena
+// whose span bitmap is 'bitmap'
+func PmemLayoutRuns(bitmap []uint32) string {
+	return string(appendPageRuns(nil, bitmap))
+}
+
+// PmemFreePageRuns walks the span bitmap 'bitmap' as it is walked during
+// reconstruction, and returns the first page and the number of pages of each
+// run of free pages that is returned to the page allocator as one span.
+func PmemFreePageRuns(bitmap []uint32) (runs [][2]uintptr) {
+	for i := uintptr(0); i < uintptr(len(bitmap)); {
+		npages, free := nextSpanRun(bitmap, i)
+		if free {
+			runs = append(runs, [2]uintptr{i, npages})
+		}
+		i += npages
+	}
+	return
+}
+
+// PmemSpanTypIndex returns the index of the type that the span holding the
+// persistent memory object at 'p' is dedicated to, or 0 if it holds objects of
+// any type.
+func PmemSpanTypIndex(p unsafe.Pointer) int {
+	return spanOfHeap(uintptr(p)).typIndex
+}
+
+// PmemSetSizeLimit limits the growth of the persistent memory file to 'n' bytes
+// as if the device the file is on was full. A limit of 0 removes the limit. It
+// returns the size of the file that is currently mapped.
+func PmemSetSizeLimit(n uintptr) (mapped uintptr) {
+	systemstack(func() {
+		lock(&mheap_.lock)
+		pmemInfo.sizeLimit = n
+		mapped = pmemInfo.nextMapOffset
+		unlock(&mheap_.lock)
+	})
+	return
+}
+
+// PmemSetShortArenas enables or disables short arenas. See
+// PmemOptions.ShortArenas.
+func PmemSetShortArenas(enable bool) {
+	systemstack(func() {
+		lock(&mheap_.lock)
+		pmemInfo.shortArenas = enable
+		unlock(&mheap_.lock)
+	})
+}
+
+// PmemSpanLog returns the span bitmap entry of the span holding the persistent
+// memory object at 'p'.
+func PmemSpanLog(p unsafe.Pointer) *uint32 {
+	return spanLogAddr(spanOfHeap(uintptr(p)))
+}
+
+// PmemPageFree reports whether the page containing 'p' is free according to
+// the span bitmap of its persistent memory arena.
+func PmemPageFree(p uintptr) bool {
+	pa := pArenaOf(p)
+	return pa != nil && pa.pageFree(p)
+}
+
+// PmemSpanLogEncode returns the span bitmap value of a span with spanclass
+// 'spc' and 'npages' pages.
+func PmemSpanLogEncode(spc uint8, npages uintptr, large, needzero, optType bool) uint32 {
+	return spanLogEncode(spanClass(spc), npages, large, needzero, optType)
+}
+
+// PmemSpanLogDecode decodes the span bitmap value 'v'
+func PmemSpanLogDecode(v uint32) (spc uint8, npages uintptr, large, needzero, optType bool) {
+	c, npages, large, needzero, optType := spanLogDecode(v)
+	return uint8(c), npages, large, needzero, optType
+}
+
+// PmemSpanTypeLogLayout returns the offsets of the fields of a logged slice
+// span type, and the offset of its pointer mask
+func PmemSpanTypeLogLayout() (kind, size, ptrdata, mask uintptr) {
+	var tl spanTypeLog
+	return unsafe.Offsetof(tl.kind), unsafe.Offsetof(tl.size),
+		unsafe.Offsetof(tl.ptrdata), uintptr(tl.mask()) - uintptr(unsafe.Pointer(&tl))
+}
+
+// PmemSizeClassPages returns the number of pages of a span of size class 'sc'
+func PmemSizeClassPages(sc int) uintptr {
+	return uintptr(class_to_allocnpages[sc])
+}
+
+const (
+	PmemNumSizeClasses    = _NumSizeClasses
+	PmemMaxLargeSpanPages = maxLargeSpanPages
+)
+
+// PmemChecksumsUsed returns the number of used entries in the checksum table
+func PmemChecksumsUsed() int {
+	n := 0
+	lock(&pmemChecksums.lock)
+	for _, e := range checksumEntries(pmemChecksums.table) {
+		if e.off != 0 {
+			n++
+		}
+	}
+	unlock(&pmemChecksums.lock)
+	return n
+}
@@ -93,6 +93,20 @@ It is a comma-separated list of name=val pairs setting these named variables:
 	This should only be used as a temporary workaround to diagnose buggy code.
 	The real fix is to not store integers in pointer-typed locations.
 
+	pmemcheck: setting pmemcheck=1 checks the persistent memory metadata logged
+	for every persistent memory allocation and span free, and crashes the program
+	at the first inconsistency.
+
+	pmemfence: pmemfence=1 (the default) issues a fence after persistent memory
+	cache lines are flushed. Setting pmemfence=0 disables the fences, so writes to
+	persistent memory are no longer durable in order. This should only be used to
+	measure the cost of the fences.
+
+	pmemverbose: setting pmemverbose=1 causes the runtime to print every
+	persistent memory span allocation and free, and every persistent memory arena
+	mapping, to standard error. An arena mapping that fails is printed with the
+	requested size and the space left below the file size limit.
+
 	sbrk: setting sbrk=1 replaces the memory allocator and garbage collector
 	with a trivial allocator that obtains memory from the operating system and
 	never reclaims any memory.
@@ -1,4 +1,4 @@
-// +build pmemTest
+// +build pmemTest,amd64
 
 // This tests the garbage collector with respect to persistent memory. It is run
 // only if a flag 'pmemTest' is specified:
@@ -7,10 +7,17 @@
 package runtime_test
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 const (
@@ -94,3 +101,561 @@ func TestPmemGcRescan(t *testing.T) {
 		}
 	}
 }
+
+// TestPmemGcVolatilePointer checks that a volatile object is not freed while a
+// live persistent object points to it. Live persistent objects are traced like
+// volatile objects, using their heap type bits, so the pointer is followed even
+// if the persistent object is only reachable from a named root.
+func TestPmemGcVolatilePointer(t *testing.T) {
+	type V struct {
+		val [8]int
+	}
+	type P struct {
+		val   int
+		small *V
+		large []*V
+	}
+	var freed uint32
+	newV := func(val int) *V {
+		v := new(V)
+		v.val[7] = val
+		runtime.SetFinalizer(v, func(*V) { atomic.StoreUint32(&freed, 1) })
+		return v
+	}
+
+	p := pnew(P)
+	p.val = 42
+	p.small = newV(1)
+	p.large = pmake([]*V, 4096)
+	for i := range p.large {
+		p.large[i] = newV(i)
+	}
+	if err := runtime.SetNamedRoot("volatile", unsafe.Pointer(p)); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.SetNamedRoot("volatile", nil)
+	p = nil
+
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+	}
+	// Allow finalizers of freed objects to run
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadUint32(&freed) != 0 {
+		t.Fatal("volatile object referenced by a persistent object was freed")
+	}
+	p = (*P)(runtime.GetNamedRoot("volatile"))
+	if p.val != 42 || p.small.val[7] != 1 {
+		t.Fatal("corrupted heap")
+	}
+	for i, v := range p.large {
+		if v.val[7] != i {
+			t.Fatal("corrupted heap")
+		}
+	}
+}
+
+type cycleNode struct {
+	next *cycleNode
+	pad  [64 << 10]byte
+}
+
+// allocCycle allocates a cycle of two large persistent memory objects, and
+// returns their addresses without keeping them reachable.
+//go:noinline
+func allocCycle() (a, b uintptr) {
+	x, y := pnew(cycleNode), pnew(cycleNode)
+	x.next, y.next = y, x
+	return uintptr(unsafe.Pointer(x)), uintptr(unsafe.Pointer(y))
+}
+
+// TestPmemGcUnreachableCycle checks that the garbage collector reclaims a cycle
+// of persistent memory objects that is not reachable, and clears the span
+// bitmap entries of their spans.
+func TestPmemGcUnreachableCycle(t *testing.T) {
+	a, b := allocCycle()
+	if runtime.PmemPageFree(a) || runtime.PmemPageFree(b) {
+		t.Fatal("span of a new object not recorded in the span bitmap")
+	}
+	runtime.GC()
+	runtime.GC()
+	if !runtime.PmemPageFree(a) || !runtime.PmemPageFree(b) {
+		t.Fatal("unreachable cycle of persistent memory objects not reclaimed")
+	}
+}
+
+func TestPmemAssertNoLeaks(t *testing.T) {
+	type node struct {
+		val  int
+		next *node
+	}
+	root := pnew(node)
+	if err := runtime.SetRoot(unsafe.Pointer(root)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 'leaked' is reachable only through a volatile variable
+	leaked := pnew(node)
+	leaked.val = 42
+	addr := fmt.Sprintf("0x%x ", uintptr(unsafe.Pointer(leaked)))
+	err := runtime.PmemAssertNoLeaks()
+	if err == nil || !strings.Contains(err.Error(), addr) {
+		t.Fatalf("object at %s not reported as leaked: %v", addr, err)
+	}
+
+	root.next = leaked
+	err = runtime.PmemAssertNoLeaks()
+	if err != nil && strings.Contains(err.Error(), addr) {
+		t.Fatalf("object at %s reachable from the root reported as leaked: %v", addr, err)
+	}
+}
+
+func TestPmemCheckLeaks(t *testing.T) {
+	type node struct {
+		val  int
+		next *node
+	}
+	root := pnew(node)
+	if err := runtime.SetNamedRoot("leaks", unsafe.Pointer(root)); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.SetNamedRoot("leaks", nil)
+
+	leaked := pnew(node)
+	t.Logf("%p", leaked)
+	addr := uintptr(unsafe.Pointer(leaked))
+	isLeaked := func() bool {
+		for _, l := range runtime.PmemCheckLeaks() {
+			if l.Addr == addr {
+				return true
+			}
+		}
+		return false
+	}
+	if !isLeaked() {
+		t.Fatalf("object at 0x%x not reported as leaked", addr)
+	}
+	for _, l := range runtime.PmemCheckLeaks() {
+		if l.Addr == uintptr(unsafe.Pointer(root)) {
+			t.Fatal("named root reported as leaked")
+		}
+	}
+
+	root.next = leaked
+	if isLeaked() {
+		t.Fatalf("object at 0x%x reachable from a named root reported as leaked", addr)
+	}
+}
+
+// TestPmemRefTableNoLeaks checks that a reference counted object, which is
+// reachable only from the reference table, is not reported as leaked.
+func TestPmemRefTableNoLeaks(t *testing.T) {
+	p := runtime.PnewRC(int(0))
+	if p == nil {
+		t.Fatal("PnewRC failed")
+	}
+	defer runtime.PmemDecRef(p)
+	if err := runtime.PmemAssertNoLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPmemChecksumTableNoLeaks checks that the checksum table is not reported
+// as leaked. The table does not keep the checksummed object alive, so the
+// object is made reachable from a named root.
+func TestPmemChecksumTableNoLeaks(t *testing.T) {
+	p := runtime.PnewChecked(int(0))
+	if p == nil {
+		t.Fatal("PnewChecked failed")
+	}
+	if err := runtime.SetNamedRoot("checked", p); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.SetNamedRoot("checked", nil)
+	if err := runtime.PmemAssertNoLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPmemPinTableNoLeaks checks that the pin table is not reported as leaked
+func TestPmemPinTableNoLeaks(t *testing.T) {
+	p := pnew(int)
+	if err := runtime.SetNamedRoot("pinned", unsafe.Pointer(p)); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.SetNamedRoot("pinned", nil)
+	if err := runtime.PmemPin(unsafe.Pointer(p)); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.PmemUnpin(unsafe.Pointer(p))
+	if err := runtime.PmemAssertNoLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPmemTimeTableNoLeaks checks that a timestamped object, which is
+// reachable only from the timestamp table, is not reported as leaked.
+func TestPmemTimeTableNoLeaks(t *testing.T) {
+	if runtime.PnewTimed(int(0)) == nil {
+		t.Fatal("PnewTimed failed")
+	}
+	defer runtime.PmemEvictOlderThan(0, func(unsafe.Pointer) {})
+	if err := runtime.PmemAssertNoLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPmemPoolNoLeaks checks that an object released to a pool, which is
+// reachable only from the free list of the pool, is not reported as leaked.
+func TestPmemPoolNoLeaks(t *testing.T) {
+	type T struct {
+		val  int
+		next *T
+	}
+	pool := runtime.PnewPool(T{})
+	pool.Put(pool.New())
+	defer pool.Get()
+	if err := runtime.PmemAssertNoLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPmemNamedRoot(t *testing.T) {
+	type T struct {
+		val int
+		ptr *int
+	}
+	a := pnew(T)
+	a.ptr = pnew(int)
+	*a.ptr = 42
+	if err := runtime.SetNamedRoot("a", unsafe.Pointer(a)); err != nil {
+		t.Fatal(err)
+	}
+	addr := uintptr(unsafe.Pointer(a))
+	a = nil
+	runtime.GC()
+	r := (*T)(runtime.GetNamedRoot("a"))
+	if uintptr(unsafe.Pointer(r)) != addr || *r.ptr != 42 {
+		t.Fatal("named root not found or collected")
+	}
+
+	if err := runtime.SetNamedRoot("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GetNamedRoot("a") != nil {
+		t.Fatal("removed named root still found")
+	}
+
+	if runtime.SetNamedRoot("", unsafe.Pointer(r)) == nil {
+		t.Error("empty root name accepted")
+	}
+	if runtime.SetNamedRoot("v", unsafe.Pointer(new(int))) == nil {
+		t.Error("volatile address accepted as named root")
+	}
+
+	var names []string
+	defer func() {
+		for _, name := range names {
+			runtime.SetNamedRoot(name, nil)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("root%d", i)
+		if err := runtime.SetNamedRoot(name, unsafe.Pointer(r)); err != nil {
+			if i == 0 {
+				t.Fatal(err)
+			}
+			break
+		}
+		names = append(names, name)
+	}
+	if len(names) == 1000 {
+		t.Fatal("named root table is not bounded")
+	}
+	for _, name := range names {
+		if runtime.GetNamedRoot(name) != unsafe.Pointer(r) {
+			t.Fatalf("named root %s not found", name)
+		}
+	}
+}
+
+func TestPmemInitSecondFile(t *testing.T) {
+	if _, err := runtime.PmemInit(pmemFile + "2"); err != runtime.ErrPmemOtherFile {
+		os.Remove(pmemFile + "2")
+		t.Fatalf("second persistent memory file initialization returned %v, expected %v",
+			err, runtime.ErrPmemOtherFile)
+	}
+}
+
+// indexOf returns the index of the first occurrence of 's' in 'events'
+func indexOf(events []string, s string) int {
+	for i, e := range events {
+		if e == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPmemHeaderInitOrder(t *testing.T) {
+	hdr, arena := runtime.PmemHeaderInitOrder()
+
+	// The initialization state must be flushed first and last. The magic
+	// constant must be flushed and fenced after the other header fields, and
+	// the checksum after the magic constant.
+	if len(hdr) < 4 || hdr[0] != "initState" || hdr[1] != "fence" ||
+		hdr[len(hdr)-2] != "initState" || hdr[len(hdr)-1] != "fence" {
+		t.Fatalf("initialization state not persisted first and last: %v", hdr)
+	}
+	hdr = hdr[2 : len(hdr)-2]
+	magic := indexOf(hdr, "magic")
+	for _, f := range []string{"mappedSize", "hdrSize"} {
+		i := indexOf(hdr, f)
+		if i == -1 || magic < i || indexOf(hdr[i:magic], "fence") == -1 {
+			t.Errorf("%s not persisted before the header magic: %v", f, hdr)
+		}
+	}
+	crc := indexOf(hdr, "hdrCRC")
+	if magic == -1 || crc < magic || indexOf(hdr[magic:crc], "fence") == -1 ||
+		hdr[len(hdr)-1] != "fence" || crc != len(hdr)-2 {
+		t.Errorf("header checksum not persisted last: %v", hdr)
+	}
+
+	if len(arena) != 4 || arena[0] != "size" || arena[1] != "fence" ||
+		arena[2] != "magic" || arena[3] != "fence" {
+		t.Errorf("arena magic not persisted after the arena header: %v", arena)
+	}
+}
+
+func TestPmemSyncMode(t *testing.T) {
+	x := pnew(int)
+	// Prevent the compiler from allocating 'x' on the stack.
+	t.Logf("%p", x)
+
+	if err := runtime.PmemSetSyncMode(runtime.PmemSyncForce); err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.PmemSetSyncMode(runtime.PmemSyncAuto)
+	calls := runtime.PmemMsyncCalls()
+	*x = 1
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+	if runtime.PmemMsyncCalls() == calls {
+		t.Fatal("msync not used to persist writes in PmemSyncForce mode")
+	}
+
+	runtime.PmemSetSyncMode(runtime.PmemSyncNone)
+	calls = runtime.PmemMsyncCalls()
+	*x = 2
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+	if runtime.PmemMsyncCalls() != calls {
+		t.Fatal("msync used to persist writes in PmemSyncNone mode")
+	}
+
+	if runtime.PmemSetSyncMode(runtime.PmemSyncForce+1) == nil {
+		t.Fatal("invalid sync mode accepted")
+	}
+}
+
+func TestPmemFaultInject(t *testing.T) {
+	x := pnew([2]uint64)
+	t.Logf("%p", x)
+	x[0], x[1] = 1, 1
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+
+	// The device crashes after the first flush
+	if err := runtime.PmemFaultInject(1); err != nil {
+		t.Fatal(err)
+	}
+	x[0] = 2
+	runtime.PersistRange(unsafe.Pointer(&x[0]), 8)
+	x[1] = 2
+	runtime.PersistRange(unsafe.Pointer(&x[1]), 8)
+	flushes, ranges, image := runtime.PmemFaultInjectStop()
+
+	if flushes != 2 || len(ranges) != 2 || ranges[1].Addr != unsafe.Pointer(&x[1]) {
+		t.Fatalf("unexpected flushes recorded: %d %v", flushes, ranges)
+	}
+	off := runtime.PmemFileOffset(unsafe.Pointer(x))
+	v0 := binary.LittleEndian.Uint64(image[off:])
+	v1 := binary.LittleEndian.Uint64(image[off+8:])
+	if v0 != 2 || v1 != 1 {
+		t.Fatalf("simulated device has (%d, %d), expected (2, 1)", v0, v1)
+	}
+}
+
+func TestPmemPersistObject(t *testing.T) {
+	type T struct {
+		a   [5]uint64
+		ptr *int
+	}
+	// T is 48 bytes, which is a size class
+	x := pnew(T)
+	tiny := pnew(byte)
+	t.Logf("%p %p", x, tiny)
+
+	if err := runtime.PmemFaultInject(-1); err != nil {
+		t.Fatal(err)
+	}
+	runtime.PersistObject(unsafe.Pointer(x))
+	runtime.PersistField(unsafe.Pointer(x), unsafe.Pointer(&x.a[3]), 8)
+	runtime.PersistObject(unsafe.Pointer(tiny))
+	_, ranges, _ := runtime.PmemFaultInjectStop()
+
+	tinyBlock := unsafe.Pointer(uintptr(unsafe.Pointer(tiny)) &^ 15)
+	want := []runtime.MemRange{
+		{unsafe.Pointer(x), unsafe.Sizeof(*x)},
+		{unsafe.Pointer(&x.a[3]), 8},
+		{tinyBlock, 16},
+	}
+	if len(ranges) != len(want) {
+		t.Fatalf("flushed ranges %v, expected %v", ranges, want)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("flushed range %d is %v, expected %v", i, ranges[i], want[i])
+		}
+	}
+
+	shouldPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		f()
+	}
+	v := new(T)
+	b := pnew([16]byte)
+	t.Logf("%p %p", v, b)
+	shouldPanic("PersistObject of an interior pointer", func() {
+		runtime.PersistObject(unsafe.Pointer(&x.a[1]))
+	})
+	// A 16-byte object is not allocated by the tiny allocator
+	shouldPanic("PersistObject of an interior pointer of a 16-byte object", func() {
+		runtime.PersistObject(unsafe.Pointer(&b[8]))
+	})
+	shouldPanic("PersistObject of a volatile object", func() {
+		runtime.PersistObject(unsafe.Pointer(v))
+	})
+	shouldPanic("PersistField of a field beyond the object", func() {
+		runtime.PersistField(unsafe.Pointer(x), unsafe.Pointer(&x.ptr), 16)
+	})
+}
+
+func TestPmemSpanBitmapValidation(t *testing.T) {
+	const (
+		small = 2<<2 | 1           // size class 1, needzero
+		large = (67+5-4)<<3 | 1<<2 // 5 page noscan large span
+	)
+	if err := runtime.PmemValidateSpanBitmap([]uint32{small, 0, large, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		bitmap []uint32
+		page   string
+	}{
+		{[]uint32{small, 1}, "page 1 "},             // small span without a size class
+		{[]uint32{0, 0, large, 0}, "page 2 "},       // large span beyond the arena
+		{[]uint32{small, 0xfffffff8}, "page 1 "},    // implausible number of pages
+		{[]uint32{large, 0, 0, 0, 0, 3}, "page 5 "}, // torn small span entry
+	} {
+		err := runtime.PmemValidateSpanBitmap(tc.bitmap)
+		if !errors.Is(err, runtime.ErrPmemSpanLogCorrupt) {
+			t.Errorf("bitmap %v: got error %v, expected %v", tc.bitmap, err,
+				runtime.ErrPmemSpanLogCorrupt)
+		} else if !strings.Contains(err.Error(), tc.page) {
+			t.Errorf("bitmap %v: error %q does not report %q", tc.bitmap, err, tc.page)
+		}
+	}
+}
+
+func TestPmemSpanLogRoundTrip(t *testing.T) {
+	check := func(spc uint8, npages uintptr, large, needzero, optType bool) {
+		t.Helper()
+		v := runtime.PmemSpanLogEncode(spc, npages, large, needzero, optType)
+		if large {
+			// The optimized type log bit is not recorded for a large span
+			optType = false
+		}
+		gspc, gnpages, glarge, gneedzero, goptType := runtime.PmemSpanLogDecode(v)
+		if gspc != spc || gnpages != npages || glarge != large ||
+			gneedzero != needzero || goptType != optType {
+			t.Errorf("span (%d, %d, %v, %v, %v) encoded as %#x decoded as (%d, %d, %v, %v, %v)",
+				spc, npages, large, needzero, optType, v,
+				gspc, gnpages, glarge, gneedzero, goptType)
+		}
+	}
+	for _, needzero := range []bool{false, true} {
+		for _, optType := range []bool{false, true} {
+			for sc := 1; sc < runtime.PmemNumSizeClasses; sc++ {
+				npages := runtime.PmemSizeClassPages(sc)
+				check(uint8(sc<<1), npages, false, needzero, optType)
+				check(uint8(sc<<1|1), npages, false, needzero, optType)
+			}
+			for _, npages := range []uintptr{5, 6, 8, 100, 8192, 1 << 20,
+				runtime.PmemMaxLargeSpanPages} {
+				check(0, npages, true, needzero, optType)
+				check(1, npages, true, needzero, optType)
+			}
+		}
+	}
+
+	// The page count of the largest span that can be logged fills the 29
+	// bits above the flags, and one more page does not fit in a log entry.
+	if v := runtime.PmemSpanLogEncode(0, runtime.PmemMaxLargeSpanPages, true, false, false); v>>3 != 1<<29-1 {
+		t.Errorf("largest span encoded as %#x", v)
+	}
+	if v := runtime.PmemSpanLogEncode(0, runtime.PmemMaxLargeSpanPages+1, true, false, false); v != 0 {
+		t.Errorf("span larger than the maximum encoded as %#x, expected it to overflow", v)
+	}
+}
+
+// The layout of a logged slice span type is part of the persistent memory
+// file format
+func TestPmemSpanTypeLogLayout(t *testing.T) {
+	kind, size, ptrdata, mask := runtime.PmemSpanTypeLogLayout()
+	if kind != 8 || size != 16 || ptrdata != 24 || mask != 32 {
+		t.Errorf("logged type fields at offsets %d, %d, %d, mask at %d, expected 8, 16, 24, 32",
+			kind, size, ptrdata, mask)
+	}
+}
+
+func TestPmemFreePageRuns(t *testing.T) {
+	const (
+		small = 2<<2 | 1           // size class 1, one page
+		large = (67+5-4)<<3 | 1<<2 // 5 page noscan large span
+		N     = 1 << 14
+	)
+	// A checkerboard of live spans and free pages, followed by a long run of
+	// free pages at the end of the arena.
+	bitmap := make([]uint32, 0, 10*N+4096)
+	for i := 0; i < N; i++ {
+		if i%2 == 0 {
+			bitmap = append(bitmap, small, 0, 0, 0, 0)
+		} else {
+			bitmap = append(bitmap, large, 0, 0, 0, 0, 0, 0)
+		}
+	}
+	bitmap = append(bitmap, make([]uint32, 4096)...)
+
+	runs := runtime.PmemFreePageRuns(bitmap)
+	if len(runs) != N {
+		t.Fatalf("found %d free page runs, expected %d", len(runs), N)
+	}
+	for i, r := range runs[:N-1] {
+		want := uintptr(4)
+		if i%2 == 1 {
+			want = 2
+		}
+		if r[1] != want {
+			t.Fatalf("free page run %d at page %d has %d pages, expected %d",
+				i, r[0], r[1], want)
+		}
+	}
+	if last := runs[N-1]; last[1] != 2+4096 || last[0]+last[1] != uintptr(len(bitmap)) {
+		t.Fatalf("last free page run at page %d has %d pages, expected %d",
+			last[0], last[1], 2+4096)
+	}
+}
@@ -629,6 +629,7 @@ func mallocinit() {
 //
 // h must be locked.
 func (h *mheap) sysAlloc(n uintptr, memtype int) (v unsafe.Pointer, size uintptr) {
+	ask := n
 	if memtype == isPersistent {
 		// We need to add space for the persistent memory metadata
 		ms := metadataSize(n)
@@ -637,7 +638,7 @@ func (h *mheap) sysAlloc(n uintptr, memtype int) (v unsafe.Pointer, size uintptr
 		// If this is the first arena, we need to add the space occupied by the
 		// global header
 		if pmemInfo.nextMapOffset == 0 {
-			offset += pmemHeaderSize
+			offset += pmemInfo.hdrRegionSize
 		}
 
 		// Round up offset to page size
@@ -744,7 +745,23 @@ func (h *mheap) sysAlloc(n uintptr, memtype int) (v unsafe.Pointer, size uintptr
 	}
 
 	// Transition from Reserved to Prepared.
-	sysMap(v, size, &memstats.heap_sys, memtype)
+	if memtype == isPersistent {
+		if !sysMapPmem(v, size, &memstats.heap_sys) {
+			pmemVerboseMapFailed(size, pmemInfo.nextMapOffset)
+			// The file may still be able to grow by a shorter arena
+			short := shortArenaSize(ask, size)
+			if short == 0 || !sysMapPmem(v, short, &memstats.heap_sys) {
+				// The arena hints have moved past this region, so it
+				// is not reused.
+				sysFree(v, size, nil)
+				return nil, 0
+			}
+			sysFree(add(v, short), size-short, nil)
+			size = short
+		}
+	} else {
+		sysMap(v, size, &memstats.heap_sys, memtype)
+	}
 
 mapped:
 	// Create arena metadata.
@@ -907,7 +924,9 @@ func (c *mcache) nextFree(spc spanClass, metadata int) (v gclinkptr, s *mspan, s
 			println("runtime: s.allocCount=", s.allocCount, "s.nelems=", s.nelems)
 			throw("s.allocCount != s.nelems && freeIndex == s.nelems")
 		}
-		c.refill(spc, metadata)
+		if !c.refill(spc, metadata) {
+			return 0, nil, true
+		}
 		shouldhelpgc = true
 		s = c.alloc[memtype][spc][typeInd]
 
@@ -931,10 +950,19 @@ func (c *mcache) nextFree(spc spanClass, metadata int) (v gclinkptr, s *mspan, s
 // Small objects are allocated from the per-P cache's free lists.
 // Large objects (> 32 kB) are allocated straight from the heap.
 // The memtype parameter indicates if memory has to be allocated
-// from volatile heap or persistent heap.
+// from volatile heap or persistent heap. A persistent memory
+// allocation returns nil if the persistent memory heap cannot grow
+// to satisfy it.
 func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Pointer {
 	if memtype == isPersistent && pmemInfo.initState != initDone {
-		throw("Allocation before initializing persistent memory")
+		if atomic.Load(&pmemFallback) == 0 {
+			throw("Allocation before initializing persistent memory")
+		}
+		memtype = isNotPersistent
+	}
+	if memtype == isPersistent && pmemInfo.readOnly {
+		atomic.Xadd64(&pmemInfo.allocFailures, 1)
+		return nil
 	}
 
 	if gcphase == _GCmarktermination {
@@ -1085,11 +1113,17 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 			if v == 0 {
 				metadata := typInd<<1 | memtype
 				v, span, shouldhelpgc = c.nextFree(tinySpanClass, metadata)
+				if v == 0 {
+					return pmemAllocFailed(mp)
+				}
 				newSpan = true
 			}
 			x = unsafe.Pointer(v)
 			(*[2]uint64)(x)[0] = 0
 			(*[2]uint64)(x)[1] = 0
+			if memtype == isPersistent {
+				logTinyBlock(uintptr(v), true)
+			}
 			// See if we need to replace the existing tiny block with the new one
 			// based on amount of remaining free space.
 			if size < c.tinyoffset[memtype] || c.tiny[memtype] == 0 {
@@ -1118,6 +1152,9 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 			if v == 0 {
 				metadata := typInd<<1 | memtype
 				v, span, shouldhelpgc = c.nextFree(spc, metadata)
+				if v == 0 {
+					return pmemAllocFailed(mp)
+				}
 				newSpan = true
 			}
 			x = unsafe.Pointer(v)
@@ -1125,6 +1162,10 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 				memclrNoHeapPointers(unsafe.Pointer(v), size)
 				// TODO: persist this memclr
 			}
+			if memtype == isPersistent && spc == tinySpanClass {
+				// The block may have been a tiny block before
+				logTinyBlock(uintptr(v), false)
+			}
 		}
 	} else {
 		shouldhelpgc = true
@@ -1132,6 +1173,9 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 			// TODO: there might be a memclr inside this code path
 			span = largeAlloc(size, needzero, noscan, memtype)
 		})
+		if span == nil {
+			return pmemAllocFailed(mp)
+		}
 		span.freeindex = 1
 		span.allocCount = 1
 		x = unsafe.Pointer(span.base())
@@ -1140,9 +1184,6 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 	}
 
 	span.typIndex = typInd
-	if newSpan && memtype == isPersistent {
-		logSpanAlloc(span)
-	}
 
 	var scanSize uintptr
 	if !noscan {
@@ -1179,12 +1220,23 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 			scanSize = typ.ptrdata
 		}
 		c.local_scan += scanSize
-	} else if newSpan && memtype == isPersistent {
-		// Minor optimization: logSpanAlloc only calls a FlushRange(). If
-		// heap bits are logged for this span, then heapBitsSetType() will call
-		// a memory fence to ensure persistent memory writes are persisted.
-		// Otherwise explicitly call a memory fence function here.
-		Fence()
+	}
+
+	if memtype == isPersistent {
+		// logSpanAlloc() and logHeapBits() only record the metadata ranges
+		// they write. Flush them all and issue a single memory fence.
+		if newSpan {
+			// The logged heap type bits of a new span must be durable
+			// before the span is recorded in the span bitmap. Otherwise a
+			// crash could leave a span that is found in use on restart but
+			// whose type bits were never persisted.
+			pmemDrainDirty(mp)
+			logSpanAlloc(span)
+		}
+		pmemDrainDirty(mp)
+		if debug.pmemcheck != 0 {
+			pmemCheckAlloc(span, uintptr(x), scanSize, typ)
+		}
 	}
 
 	// Ensure that the stores above that initialize x to
@@ -1214,6 +1266,24 @@ func mallocgc(size uintptr, typ *_type, needzero bool, memtype int) unsafe.Point
 	mp.mallocing = 0
 	releasem(mp)
 
+	if memtype == isPersistent && atomic.Load(&pmemUsage.pending) != 0 {
+		// A persistent memory usage threshold was crossed while allocating
+		// this object. Run the callbacks now that the allocator has released
+		// its locks.
+		pmemUsageNotify()
+	}
+	if memtype == isPersistent && atomic.Loaduintptr(&pmemGrowth.pending) != 0 {
+		pmemGrowNotify()
+	}
+	if memtype == isPersistent {
+		if rate := atomic.Load(&pmemProf.rate); rate != 0 {
+			pmemProfileAlloc(uintptr(x), size, rate)
+		}
+		if trace.enabled {
+			tracePmemAlloc(size, newSpan)
+		}
+	}
+
 	if debug.allocfreetrace != 0 {
 		tracealloc(x, size, typ)
 	}
@@ -1258,6 +1328,13 @@ func largeAlloc(size uintptr, needzero bool, noscan bool, memtype int) *mspan {
 	if size&_PageMask != 0 {
 		npages++
 	}
+	if memtype == isPersistent && npages > maxLargeSpanPages {
+		// The allocation cannot be recorded in the persistent memory span
+		// bitmap, and hence cannot be recovered on restart.
+		print("runtime: persistent memory allocation of ", npages,
+			" pages, maximum span size is ", maxLargeSpanPages, " pages\n")
+		throw("persistent memory allocation too large")
+	}
 
 	// Deduct credit for this span allocation and sweep if
 	// necessary. mHeap_Alloc will also sweep npages, so this only
@@ -1267,6 +1344,9 @@ func largeAlloc(size uintptr, needzero bool, noscan bool, memtype int) *mspan {
 	spc := makeSpanClass(0, noscan)
 	s := mheap_.alloc(npages, spc, needzero, memtype)
 	if s == nil {
+		if memtype == isPersistent {
+			return nil
+		}
 		throw("out of memory")
 	}
 	// Put the large span in the mcentral swept list so that it's
@@ -1292,7 +1372,80 @@ func newobject(typ *_type) unsafe.Pointer {
 // 'persistent' argument. This due to some optimizations/checks that the go compiler
 // does. See cmd/compile/internal/ssa/gen/generic.rules
 func pnewobject(typ *_type) unsafe.Pointer {
-	return mallocgc(typ.size, typ, needZeroed, isPersistent)
+	p := mallocgc(typ.size, typ, needZeroed, isPersistent)
+	if p == nil {
+		panic(pmemAllocError())
+	}
+	return p
+}
+
+// Pnew allocates a zeroed object in persistent memory whose type is the dynamic
+// type of 'typ', and returns a pointer to it. The value of 'typ' is not used.
+// E.g.:
+//
+//	p := (*T)(runtime.Pnew(T{}))
+//
+// Unlike the pnew builtin, the object returned by Pnew is never allocated on
+// the stack. Pnew returns nil if there is no space left for the object in the
+// persistent memory file, whereas the pnew builtin panics with
+// ErrPmemOutOfSpace.
+func Pnew(typ interface{}) unsafe.Pointer {
+	t := efaceOf(&typ)._type
+	if t == nil {
+		panic(plainError("runtime: Pnew called with a nil type"))
+	}
+	return mallocgc(t.size, t, needZeroed, isPersistent)
+}
+
+// pnewSlot allocates a zeroed object of type 't' in persistent memory that is
+// not packed into a block with other objects by the tiny allocator, so that
+// the whole slot of the object belongs to it. It returns nil if there is no
+// space left for the object in the persistent memory file.
+func pnewSlot(t *_type) unsafe.Pointer {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		// The callers record the object in the persistent memory file, so it
+		// cannot be allocated in volatile memory (see PmemAllowFallback())
+		throw("Allocation before initializing persistent memory")
+	}
+	size := t.size
+	if t.ptrdata == 0 && size < maxTinySize {
+		size = maxTinySize
+	}
+	return mallocgc(size, t, needZeroed, isPersistent)
+}
+
+// PnewAligned allocates a zeroed buffer of at least 'size' bytes in persistent
+// memory whose address is a multiple of 'align', and returns a pointer to it.
+// 'align' has to be a power of two that is at most the runtime page size. The
+// buffer is not scanned by the garbage collector, so it must not hold the only
+// pointers to any object. It can be released using Pfree(). It returns nil if
+// there is no space left for the buffer in the persistent memory file.
+func PnewAligned(size, align uintptr) unsafe.Pointer {
+	if align == 0 || align&(align-1) != 0 || align > pageSize {
+		panic(plainError("runtime: invalid alignment passed to PnewAligned"))
+	}
+	return mallocgc(alignedAllocSize(size, align), nil, needZeroed, isPersistent)
+}
+
+// alignedAllocSize returns the smallest allocation size of at least 'size'
+// bytes for which the allocator returns an address aligned to 'align'. Spans
+// start at a page boundary, and the objects in a small object span are placed
+// at multiples of the size class from the start of the span. So the address of
+// an object is aligned if its size class is a multiple of 'align'. Large
+// objects are always page aligned.
+func alignedAllocSize(size, align uintptr) uintptr {
+	// The tiny allocator packs several objects into a single block
+	if size < maxTinySize {
+		size = maxTinySize
+	}
+	for size <= maxSmallSize {
+		c := roundupsize(size)
+		if c%align == 0 {
+			return c
+		}
+		size = c + 1
+	}
+	return size
 }
 
 //go:linkname reflect_unsafe_New reflect.unsafe_New
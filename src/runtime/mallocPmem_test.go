@@ -1,9 +1,23 @@
-// +build pmemTest
+// +build pmemTest,amd64
 
 package runtime_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"internal/trace"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	rtrace "runtime/trace"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -23,3 +37,1546 @@ func TestPmemTinyAlloc(t *testing.T) {
 		t.Fatal("no bytes allocated within the same 8-byte chunk")
 	}
 }
+
+func TestPmemIsObjectStart(t *testing.T) {
+	type T struct {
+		a, b, c, d int
+	}
+	small := pnew(T)
+	// Prevent the compiler from allocating 'small' on the stack.
+	t.Logf("%p", small)
+	if !runtime.IsObjectStart(unsafe.Pointer(small)) {
+		t.Error("small object base not recognized as an object start")
+	}
+	if runtime.IsObjectStart(unsafe.Pointer(&small.b)) {
+		t.Error("interior pointer of small object recognized as an object start")
+	}
+
+	large := pmake([]byte, 1<<20)
+	if !runtime.IsObjectStart(unsafe.Pointer(&large[0])) {
+		t.Error("large object base not recognized as an object start")
+	}
+	if runtime.IsObjectStart(unsafe.Pointer(&large[4096])) {
+		t.Error("interior pointer of large object recognized as an object start")
+	}
+
+	v := new(T)
+	t.Logf("%p", v)
+	if runtime.IsObjectStart(unsafe.Pointer(v)) {
+		t.Error("volatile object recognized as a persistent object start")
+	}
+}
+
+func TestPmemUsageThreshold(t *testing.T) {
+	// Bound the capacity of the heap, so that the threshold can be crossed
+	// by allocating a few MB
+	runtime.Pnew(0)
+	mapped := runtime.PmemSetSizeLimit(0)
+	runtime.PmemSetSizeLimit(mapped + 256<<20)
+	defer runtime.PmemSetSizeLimit(0)
+
+	capacity := uintptr(runtime.PmemInUse()) + runtime.PmemAvailable()
+	percent := int(uintptr(runtime.PmemInUse())*100/capacity) + 1
+	if percent > 90 {
+		t.Skipf("persistent memory heap is %d%% full", percent)
+	}
+	allocSize := int(capacity/100) + 64<<10
+	var calls int
+	var lastUsed, lastCapacity uintptr
+	// The threshold is crossed after the first allocation, and the usage has
+	// to drop below half the threshold before the callback can run again.
+	err := runtime.PmemAddUsageThreshold(percent, percent/2, func(used, c uintptr) {
+		lastUsed, lastCapacity = used, c
+		calls++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := pmake([]byte, allocSize)
+	if calls != 1 {
+		t.Fatalf("callback invoked %d times after crossing threshold, expected 1", calls)
+	}
+	if lastCapacity == 0 || uint64(lastUsed)*100 < uint64(lastCapacity)*uint64(percent) {
+		t.Errorf("invalid callback arguments: used %d, capacity %d", lastUsed, lastCapacity)
+	}
+	b := pmake([]byte, allocSize/2)
+	if calls != 1 {
+		t.Fatalf("callback invoked %d times without re-arming, expected 1", calls)
+	}
+	runtime.KeepAlive(a)
+	runtime.KeepAlive(b)
+
+	if err := runtime.PmemAddUsageThreshold(101, 0, func(used, c uintptr) {}); err == nil {
+		t.Error("threshold above 100% registered")
+	}
+}
+
+func TestPmemGrowCallback(t *testing.T) {
+	const allocSize = 16 << 20
+	var grown uintptr
+	runtime.SetPmemGrowCallback(func(newBytes uintptr) {
+		grown += newBytes
+	})
+	defer runtime.SetPmemGrowCallback(nil)
+
+	arenas := runtime.PmemArenasMapped()
+	var objs [][]byte
+	for i := 0; i < 32 && runtime.PmemArenasMapped() == arenas; i++ {
+		objs = append(objs, pmake([]byte, allocSize))
+	}
+	t.Logf("%p", objs)
+	if runtime.PmemArenasMapped() == arenas {
+		t.Fatal("persistent memory heap did not grow")
+	}
+	if grown == 0 {
+		t.Fatal("grow callback not invoked")
+	}
+
+	// Without a callback, the mapped bytes are not kept pending
+	runtime.SetPmemGrowCallback(nil)
+	arenas = runtime.PmemArenasMapped()
+	for i := 0; i < 32 && runtime.PmemArenasMapped() == arenas; i++ {
+		objs = append(objs, pmake([]byte, allocSize))
+	}
+	t.Logf("%p", objs)
+	if n := runtime.PmemGrowPending(); n != 0 {
+		t.Errorf("%d bytes pending without a grow callback", n)
+	}
+}
+
+func TestPmemGrow(t *testing.T) {
+	const growSize = 128 << 20
+	if err := runtime.PmemGrow(0); err == nil {
+		t.Error("PmemGrow accepted a size of 0")
+	}
+
+	var before, after runtime.PmemStats
+	runtime.ReadPmemStats(&before)
+	arenas := runtime.PmemArenasMapped()
+	if err := runtime.PmemGrow(growSize); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadPmemStats(&after)
+	if runtime.PmemArenasMapped() == arenas {
+		t.Fatal("no arena mapped by PmemGrow")
+	}
+	if after.TotalBytes < before.TotalBytes+growSize {
+		t.Errorf("file grew from %d to %d bytes, want at least %d more",
+			before.TotalBytes, after.TotalBytes, growSize)
+	}
+	if after.FreeBytes <= before.FreeBytes {
+		t.Errorf("free space did not grow: %d, was %d", after.FreeBytes, before.FreeBytes)
+	}
+
+	// The new space is used by allocations before the file grows again
+	arenas = runtime.PmemArenasMapped()
+	b := pmake([]byte, 16<<20)
+	if runtime.PmemArenasMapped() != arenas {
+		t.Error("file grew to allocate an object after PmemGrow")
+	}
+	runtime.KeepAlive(b)
+}
+
+func TestPmemPnew(t *testing.T) {
+	type T struct {
+		a, b uint64
+		p    *int
+	}
+	x := (*T)(runtime.Pnew(T{}))
+	if !runtime.InPmem(uintptr(unsafe.Pointer(x))) {
+		t.Fatal("Pnew returned a volatile memory address")
+	}
+	if x.a != 0 || x.b != 0 || x.p != nil {
+		t.Fatal("Pnew returned an object that is not zeroed")
+	}
+
+	// Write a pattern that is unlikely to be present in the file already, and
+	// check that it can be read back from the persistent memory file.
+	x.a = uint64(time.Now().UnixNano())
+	x.b = ^x.a
+	runtime.PersistRange(unsafe.Pointer(x), 16)
+	var pattern [16]byte
+	binary.LittleEndian.PutUint64(pattern[:8], x.a)
+	binary.LittleEndian.PutUint64(pattern[8:], x.b)
+	data, err := ioutil.ReadFile(pmemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, pattern[:]) {
+		t.Fatal("object allocated by Pnew not found in the persistent memory file")
+	}
+}
+
+func TestPmemIsPmem(t *testing.T) {
+	type T struct {
+		a [4]int
+		p *int
+	}
+	x := (*T)(runtime.Pnew(T{}))
+	if !runtime.IsPmem(unsafe.Pointer(x)) || !runtime.IsPmem(unsafe.Pointer(&x.p)) {
+		t.Error("IsPmem returned false for a persistent memory object")
+	}
+	v := new(T)
+	t.Logf("%p", v)
+	if runtime.IsPmem(unsafe.Pointer(v)) {
+		t.Error("IsPmem returned true for a volatile memory object")
+	}
+	if runtime.IsPmem(nil) {
+		t.Error("IsPmem returned true for nil")
+	}
+	addr, _ := runtime.PmemReservedRegion()
+	if runtime.IsPmem(addr) {
+		t.Error("IsPmem returned true for the reserved region")
+	}
+}
+
+func TestPmemPfree(t *testing.T) {
+	type T struct {
+		val int
+		ptr *int
+	}
+	// A garbage collection cycle would report the pointers to the freed
+	// objects that the test checks.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	x := pnew(T)
+	// Prevent the compiler from allocating 'x' on the stack.
+	t.Logf("%p", x)
+	x.val = 42
+	x.ptr = pnew(int)
+	addr := uintptr(unsafe.Pointer(x))
+	runtime.Pfree(unsafe.Pointer(x))
+	if y := (*T)(unsafe.Pointer(addr)); y.val != 0 || y.ptr != nil {
+		t.Fatal("object not cleared by Pfree")
+	}
+	if runtime.IsObjectStart(unsafe.Pointer(addr)) {
+		t.Fatal("slot of released object is still allocated")
+	}
+
+	// The checksum entry of an object is freed along with it
+	used := runtime.PmemChecksumsUsed()
+	runtime.Pfree(runtime.PnewChecked(int(0)))
+	if n := runtime.PmemChecksumsUsed(); n != used {
+		t.Fatalf("%d checksum entries used after the object was released, expected %d", n, used)
+	}
+
+	// The spans of released objects are returned to the heap right away
+	const size = 8 << 20
+	b := pmake([]byte, size)
+	inUse := runtime.PmemInUse()
+	runtime.Pfree(unsafe.Pointer(&b[0]))
+	if runtime.PmemInUse() > inUse-size {
+		t.Fatal("span of released large object not returned to the heap")
+	}
+
+	const n = 1024
+	objs := make([]uintptr, n)
+	for i := range objs {
+		p := pnew([1024]byte)
+		t.Logf("%p", p)
+		objs[i] = uintptr(unsafe.Pointer(p))
+	}
+	inUse = runtime.PmemInUse()
+	for _, p := range objs {
+		runtime.Pfree(unsafe.Pointer(p))
+	}
+	if runtime.PmemInUse() > inUse-n*1024/2 {
+		t.Fatal("spans of released small objects not returned to the heap")
+	}
+}
+
+func TestPmemStats(t *testing.T) {
+	var before, after runtime.PmemStats
+	runtime.ReadPmemStats(&before)
+
+	const N = 100
+	type T [6]uint64
+	objs := make([]*T, N)
+	for i := range objs {
+		objs[i] = pnew(T)
+	}
+	large := pmake([]byte, 1<<20)
+	runtime.ReadPmemStats(&after)
+	t.Logf("%p %p", objs[0], large)
+
+	if after.TotalBytes != after.MetadataBytes+after.UsedBytes+after.FreeBytes {
+		t.Errorf("heap sizes do not add up: total %d, metadata %d, used %d, free %d",
+			after.TotalBytes, after.MetadataBytes, after.UsedBytes, after.FreeBytes)
+	}
+	if after.LargestFreeBytes > after.FreeBytes || after.LargestFreeBytes%runtime.PageSize != 0 {
+		t.Errorf("largest free run is %d bytes, with %d free bytes", after.LargestFreeBytes,
+			after.FreeBytes)
+	}
+	if after.UsedBytes < before.UsedBytes+1<<20 {
+		t.Errorf("used bytes grew from %d to %d", before.UsedBytes, after.UsedBytes)
+	}
+	if after.NumLargeSpans <= before.NumLargeSpans || after.NumSpans <= before.NumSpans {
+		t.Error("large span allocation not counted")
+	}
+	if after.MapPageSize != uint64(os.Getpagesize()) {
+		t.Errorf("map page size is %d without huge pages, expected %d", after.MapPageSize,
+			os.Getpagesize())
+	}
+	for i := range after.BySize {
+		if after.BySize[i].Size != uint32(unsafe.Sizeof(T{})) {
+			continue
+		}
+		if after.BySize[i].Objects < before.BySize[i].Objects+N {
+			t.Errorf("objects of size %d grew from %d to %d", after.BySize[i].Size,
+				before.BySize[i].Objects, after.BySize[i].Objects)
+		}
+	}
+}
+
+func TestPmemMemStats(t *testing.T) {
+	b := pmake([]byte, 1<<20)
+
+	var ms runtime.MemStats
+	var ps runtime.PmemStats
+	runtime.ReadMemStats(&ms)
+	runtime.ReadPmemStats(&ps)
+	if ms.PmemSys != ps.TotalBytes {
+		t.Errorf("PmemSys is %d, expected %d", ms.PmemSys, ps.TotalBytes)
+	}
+	// The in-use bytes accounted when spans are allocated and freed must
+	// match the in-use bytes found by walking the spans.
+	if ms.PmemInuse != ps.UsedBytes {
+		t.Errorf("PmemInuse is %d, expected %d", ms.PmemInuse, ps.UsedBytes)
+	}
+	if ms.PmemAlloc < 1<<20 || ms.PmemAlloc > ms.PmemInuse {
+		t.Errorf("invalid PmemAlloc %d (PmemInuse %d)", ms.PmemAlloc, ms.PmemInuse)
+	}
+	if ms.PmemReleased > ms.PmemSys {
+		t.Errorf("PmemReleased %d exceeds PmemSys %d", ms.PmemReleased, ms.PmemSys)
+	}
+	if ms.HeapInuse == 0 || ms.HeapInuse+ms.PmemInuse > ms.HeapSys {
+		t.Errorf("invalid HeapInuse %d (PmemInuse %d, HeapSys %d)", ms.HeapInuse,
+			ms.PmemInuse, ms.HeapSys)
+	}
+	runtime.KeepAlive(b)
+}
+
+var markerSink *[8]uint64
+
+// allocMarker allocates a persistent memory object that holds a pattern that
+// is unlikely to be present in the file already, and returns the pattern. The
+// object is kept reachable through markerSink until the caller clears it.
+//go:noinline
+func allocMarker() []byte {
+	x := pnew([8]uint64)
+	for i := range x {
+		x[i] = uint64(time.Now().UnixNano()) ^ uint64(i)<<56
+	}
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+	markerSink = x
+	pattern := make([]byte, unsafe.Sizeof(*x))
+	for i := range x {
+		binary.LittleEndian.PutUint64(pattern[i*8:], x[i])
+	}
+	return pattern
+}
+
+func TestPmemZeroOnFree(t *testing.T) {
+	runtime.SetPmemZeroOnFree(true)
+	defer runtime.SetPmemZeroOnFree(false)
+
+	pattern := allocMarker()
+	data, err := ioutil.ReadFile(pmemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, pattern) {
+		t.Fatal("marker not found in the persistent memory file")
+	}
+
+	// The object is unreachable, so it is freed by the garbage collector
+	markerSink = nil
+	runtime.GC()
+	data, err = ioutil.ReadFile(pmemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, pattern) {
+		t.Fatal("contents of freed object found in the persistent memory file")
+	}
+}
+
+func TestPmemPnewAligned(t *testing.T) {
+	for _, align := range []uintptr{8, 64, 256, 4096, 8192} {
+		for _, size := range []uintptr{1, 100, 5000, 40000} {
+			p := runtime.PnewAligned(size, align)
+			if uintptr(p)%align != 0 {
+				t.Errorf("PnewAligned(%d, %d) returned unaligned address %p", size, align, p)
+			}
+			if !runtime.IsObjectStart(p) {
+				t.Errorf("PnewAligned(%d, %d) returned %p which is not an object start",
+					size, align, p)
+			}
+			runtime.Pfree(p)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("PnewAligned did not panic on an invalid alignment")
+		}
+	}()
+	runtime.PnewAligned(64, 48)
+}
+
+func TestPmemPointers(t *testing.T) {
+	type T struct {
+		a int
+		p *int
+		b [3]int
+		q *T
+		r *int
+	}
+	x := pnew(T)
+	x.p = pnew(int)
+	x.q = x
+	ptrs := runtime.PmemPointers(unsafe.Pointer(x))
+	if len(ptrs) != 2 || ptrs[0] != unsafe.Pointer(&x.p) || ptrs[1] != unsafe.Pointer(&x.q) {
+		t.Errorf("PmemPointers returned %v, expected [%p %p]", ptrs, &x.p, &x.q)
+	}
+
+	b := pmake([]byte, 64)
+	if ptrs := runtime.PmemPointers(unsafe.Pointer(&b[0])); ptrs != nil {
+		t.Errorf("PmemPointers returned %v for an object without pointers", ptrs)
+	}
+	v := &T{p: new(int)}
+	t.Logf("%p", v)
+	if ptrs := runtime.PmemPointers(unsafe.Pointer(v)); ptrs != nil {
+		t.Errorf("PmemPointers returned %v for a volatile object", ptrs)
+	}
+}
+
+func TestPmemPool(t *testing.T) {
+	type T struct {
+		val  int
+		next *T
+	}
+	type U struct {
+		val  int
+		next *U
+	}
+	pool := runtime.PnewPool(T{})
+	objs := make([]*T, 100)
+	for i := range objs {
+		objs[i] = (*T)(pool.New())
+	}
+	idx := runtime.PmemSpanTypIndex(unsafe.Pointer(objs[0]))
+	if idx == 0 {
+		t.Fatal("pool object not allocated from a dedicated span")
+	}
+	for i, x := range objs {
+		if !runtime.InPmem(uintptr(unsafe.Pointer(x))) {
+			t.Fatalf("pool object %d is not in persistent memory", i)
+		}
+		if got := runtime.PmemSpanTypIndex(unsafe.Pointer(x)); got != idx {
+			t.Fatalf("pool object %d allocated from span of type %d, expected %d", i, got, idx)
+		}
+	}
+	// Creating another pool of the same type uses the same type slot
+	x := (*T)(runtime.PnewPool(T{}).New())
+	if got := runtime.PmemSpanTypIndex(unsafe.Pointer(x)); got != idx {
+		t.Errorf("second pool allocated from span of type %d, expected %d", got, idx)
+	}
+	// Objects of a different type of the same size are not placed in the
+	// spans of the pool.
+	y := pnew(U)
+	t.Logf("%p", y)
+	if runtime.PmemSpanTypIndex(unsafe.Pointer(y)) == idx {
+		t.Error("object of a different type allocated from a pool span")
+	}
+}
+
+func TestPmemPoolGetPut(t *testing.T) {
+	type T struct {
+		val  [3]int
+		next *T
+	}
+	pool := runtime.PnewPool(T{})
+	objs := make([]*T, 200)
+	for i := range objs {
+		objs[i] = (*T)(pool.New())
+		objs[i].val[0] = i + 1
+		if err := pool.Put(unsafe.Pointer(objs[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.GC()
+	// Objects are returned in the reverse order they were put, and are not
+	// cleared.
+	for i := len(objs) - 1; i >= 0; i-- {
+		x := (*T)(pool.Get())
+		if x != objs[i] || x.val[0] != i+1 {
+			t.Fatalf("Get returned %p with value %d, expected %p with value %d", x, x.val[0],
+				objs[i], i+1)
+		}
+	}
+	x := (*T)(pool.Get())
+	if x == nil || x.val[0] != 0 || !runtime.InPmem(uintptr(unsafe.Pointer(x))) {
+		t.Fatal("Get of an empty pool did not return a new object")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Put of a volatile object did not panic")
+		}
+	}()
+	v := new(T)
+	t.Logf("%p", v)
+	pool.Put(unsafe.Pointer(v))
+}
+
+func TestPmemTraceEvents(t *testing.T) {
+	const N = 100
+	buf := new(bytes.Buffer)
+	if err := rtrace.Start(buf); err != nil {
+		t.Skipf("failed to start tracing: %v", err)
+	}
+	for i := 0; i < N; i++ {
+		runtime.Pfree(newPoolNode())
+	}
+	rtrace.Stop()
+
+	res, err := trace.Parse(buf, "")
+	if err != nil {
+		t.Fatalf("failed to parse trace: %v", err)
+	}
+	size := uint64(unsafe.Sizeof(poolNode{}))
+	allocs, frees := 0, 0
+	for _, ev := range res.Events {
+		switch ev.Type {
+		case trace.EvPmemAlloc:
+			if ev.Args[0] == size {
+				allocs++
+			}
+		case trace.EvPmemFree:
+			if ev.Args[0] == size && ev.Args[1] == 0 {
+				frees++
+			}
+		}
+	}
+	if allocs < N || frees < N {
+		t.Errorf("found %d allocation and %d free events, expected %d", allocs, frees, N)
+	}
+}
+
+func TestPmemSliceAt(t *testing.T) {
+	s := pmake([]int, 10)
+	for i := range s {
+		s[i] = i
+	}
+	p := unsafe.Pointer(&s[0])
+	r := *(*[]int)(runtime.PmemSliceAt(p, unsafe.Sizeof(s[0]), len(s)))
+	if len(r) != len(s) || cap(r) != len(s) || &r[0] != &s[0] || r[9] != 9 {
+		t.Fatalf("PmemSliceAt returned slice of length %d, capacity %d", len(r), cap(r))
+	}
+
+	mustPanic := func(what string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("PmemSliceAt did not panic for %s", what)
+			}
+		}()
+		f()
+	}
+	mustPanic("a length larger than the object", func() {
+		runtime.PmemSliceAt(p, unsafe.Sizeof(s[0]), 1<<20)
+	})
+	mustPanic("a negative length", func() {
+		runtime.PmemSliceAt(p, unsafe.Sizeof(s[0]), -1)
+	})
+	// A tiny object can be in the middle of its block, and its length is
+	// bounded by the end of the block
+	_, tiny := pnew(uint32), pnew(uint32)
+	t.Logf("%p", tiny)
+	n := (16 - int(uintptr(unsafe.Pointer(tiny))&15)) / 4
+	runtime.PmemSliceAt(unsafe.Pointer(tiny), 4, n)
+	mustPanic("a length beyond the end of a tiny block", func() {
+		runtime.PmemSliceAt(unsafe.Pointer(tiny), 4, n+1)
+	})
+	v := make([]int, 10)
+	t.Logf("%p", v)
+	mustPanic("a volatile object", func() {
+		runtime.PmemSliceAt(unsafe.Pointer(&v[0]), unsafe.Sizeof(v[0]), len(v))
+	})
+}
+
+type migrateNode struct {
+	val  int
+	name string
+	next *migrateNode
+	vals []int
+	elem *int
+}
+
+func TestPmemPersist(t *testing.T) {
+	const N = 100
+	// Build a volatile cyclic list whose nodes point into a shared slice
+	vals := make([]int, N)
+	var first, last *migrateNode
+	for i := 0; i < N; i++ {
+		vals[i] = i
+		n := &migrateNode{val: i, name: fmt.Sprint("node", i), vals: vals, elem: &vals[i]}
+		if first == nil {
+			first = n
+		} else {
+			last.next = n
+		}
+		last = n
+	}
+	last.next = first
+	big := make([]*migrateNode, 8192)
+	big[4000] = first
+
+	x := (*migrateNode)(runtime.PmemPersist(unsafe.Pointer(first)))
+	if x == nil {
+		t.Fatal("PmemPersist failed")
+	}
+	runtime.GC()
+	n := x
+	for i := 0; i < N; i++ {
+		for _, p := range []unsafe.Pointer{unsafe.Pointer(n), unsafe.Pointer(&n.vals[0]),
+			unsafe.Pointer(n.elem)} {
+			if !runtime.InPmem(uintptr(p)) {
+				t.Fatalf("node %d of the copy points to volatile memory", i)
+			}
+		}
+		if n.val != i || n.name != fmt.Sprint("node", i) || n.vals[i] != i || *n.elem != i ||
+			n.elem != &n.vals[i] || &n.vals[0] != &x.vals[0] {
+			t.Fatalf("node %d not copied correctly", i)
+		}
+		n = n.next
+	}
+	if n != x {
+		t.Fatal("cycle not preserved in the copy")
+	}
+
+	b := *(*[]*migrateNode)(runtime.PmemPersist(unsafe.Pointer(&big)))
+	t.Logf("%p", &big)
+	if !runtime.InPmem(uintptr(unsafe.Pointer(&b[0]))) || !runtime.InPmem(uintptr(unsafe.Pointer(b[4000]))) ||
+		b[4000].val != 0 || b[3999] != nil {
+		t.Error("large object not copied correctly")
+	}
+	if p := unsafe.Pointer(x); runtime.PmemPersist(p) != p {
+		t.Error("PmemPersist copied a persistent memory object")
+	}
+}
+
+func TestPmemMemmove(t *testing.T) {
+	const N = 1024
+	src := make([]byte, N)
+	for i := range src {
+		src[i] = byte(i*7 + 1)
+	}
+	dst := pnew([N + 128]byte)
+	t.Logf("%p", dst)
+	for _, off := range []int{0, 1, 8, 63, 64, 65} {
+		for _, n := range []int{0, 1, 63, 64, 65, 127, 200, 256, 1000, N} {
+			for i := range dst {
+				dst[i] = 0
+			}
+			runtime.PmemMemmoveNT(unsafe.Pointer(&dst[off]), unsafe.Pointer(&src[0]), uintptr(n))
+			if !bytes.Equal(dst[off:off+n], src[:n]) {
+				t.Fatalf("copy of %d bytes to offset %d differs from the source", n, off)
+			}
+			for i := range dst {
+				if (i < off || i >= off+n) && dst[i] != 0 {
+					t.Fatalf("copy of %d bytes to offset %d wrote byte %d", n, off, i)
+				}
+			}
+		}
+	}
+
+	// Overlapping copies in either direction
+	for i := range dst {
+		dst[i] = byte(i)
+	}
+	runtime.PmemMemmove(unsafe.Pointer(&dst[0]), unsafe.Pointer(&dst[100]), 500)
+	for i := 0; i < 500; i++ {
+		if dst[i] != byte(i+100) {
+			t.Fatalf("backward overlapping copy: byte %d is %d, expected %d", i, dst[i], byte(i+100))
+		}
+	}
+	for i := range dst {
+		dst[i] = byte(i)
+	}
+	runtime.PmemMemmove(unsafe.Pointer(&dst[100]), unsafe.Pointer(&dst[0]), 500)
+	for i := 0; i < 500; i++ {
+		if dst[i+100] != byte(i) {
+			t.Fatalf("forward overlapping copy: byte %d is %d, expected %d", i+100, dst[i+100], byte(i))
+		}
+	}
+}
+
+func TestPmemMemset(t *testing.T) {
+	const N = 1024
+	buf := pnew([N + 128]byte)
+	t.Logf("%p", buf)
+	for _, off := range []int{0, 1, 8, 63, 64, 65} {
+		for _, n := range []int{0, 1, 63, 64, 65, 127, 200, 256, 1000, N} {
+			for i := range buf {
+				buf[i] = 0
+			}
+			c := byte(n + off + 1)
+			runtime.PmemMemsetNT(unsafe.Pointer(&buf[off]), c, uintptr(n))
+			for i := range buf {
+				want := byte(0)
+				if i >= off && i < off+n {
+					want = c
+				}
+				if buf[i] != want {
+					t.Fatalf("memset of %d bytes at offset %d: byte %d is %d, expected %d",
+						n, off, i, buf[i], want)
+				}
+			}
+		}
+	}
+	runtime.PmemMemset(unsafe.Pointer(&buf[3]), 0xab, 500)
+	runtime.PmemClear(unsafe.Pointer(&buf[100]), 100)
+	for i := 3; i < 503; i++ {
+		want := byte(0xab)
+		if i >= 100 && i < 200 {
+			want = 0
+		}
+		if buf[i] != want {
+			t.Fatalf("byte %d is %d, expected %d", i, buf[i], want)
+		}
+	}
+
+	type T struct {
+		a int
+		p *int
+	}
+	x := pnew(T)
+	t.Logf("%p", x)
+	// A range with only nil pointers can be cleared
+	runtime.PmemClear(unsafe.Pointer(x), unsafe.Sizeof(*x))
+	x.p = pnew(int)
+	// Clearing a range that holds a pointer, even partly, panics
+	for _, n := range []uintptr{unsafe.Sizeof(*x), unsafe.Sizeof(x.a) + 1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("PmemClear of %d bytes holding a pointer did not panic", n)
+				}
+			}()
+			runtime.PmemClear(unsafe.Pointer(x), n)
+		}()
+	}
+	if x.p == nil {
+		t.Error("PmemClear cleared a pointer")
+	}
+	// Clearing the non-pointer field is allowed
+	x.a = 5
+	runtime.PmemClear(unsafe.Pointer(&x.a), unsafe.Sizeof(x.a))
+	if x.a != 0 {
+		t.Error("PmemClear did not clear the integer field")
+	}
+}
+
+func TestPmemOutOfSpace(t *testing.T) {
+	type block [1 << 20]byte
+	// Make sure that the file is mapped, as a limit of 0 means no limit
+	runtime.Pnew(block{})
+	mapped := runtime.PmemSetSizeLimit(0)
+	runtime.PmemSetSizeLimit(mapped)
+	defer runtime.PmemSetSizeLimit(0)
+
+	var ps runtime.PmemStats
+	runtime.ReadPmemStats(&ps)
+	failures := ps.AllocFailures
+
+	// Fill the persistent memory heap. The blocks are kept reachable, so that
+	// they are not reused.
+	var blocks []unsafe.Pointer
+	for {
+		p := runtime.Pnew(block{})
+		if p == nil {
+			break
+		}
+		blocks = append(blocks, p)
+		if len(blocks) > 1<<12 {
+			t.Fatal("persistent memory heap did not run out of space")
+		}
+	}
+	// The free pages left in the arenas may be fragmented, but the device space
+	// beyond the limit must not be counted.
+	if avail := runtime.PmemAvailable(); avail >= 64<<20 {
+		t.Errorf("PmemAvailable returned %d bytes after the heap ran out of space", avail)
+	}
+	if p := runtime.PmakeSlice(block{}, 1, 1); p != nil {
+		t.Error("PmakeSlice succeeded after the heap ran out of space")
+	}
+	// Small objects fail once the remaining spans are used up
+	var small []*[64]int
+	for {
+		p := (*[64]int)(runtime.Pnew([64]int{}))
+		if p == nil {
+			break
+		}
+		small = append(small, p)
+		if len(small) > 1<<20 {
+			t.Fatal("small object allocations did not run out of space")
+		}
+	}
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.Is(err, runtime.ErrPmemOutOfSpace) {
+				t.Errorf("pnew panicked with %v, expected ErrPmemOutOfSpace", err)
+			}
+		}()
+		x := pnew([64]int)
+		t.Logf("%p", x)
+	}()
+	// A pool cannot grow its free list any more
+	pool := runtime.PnewPool([64]int{})
+	put := 0
+	for _, p := range small {
+		err := pool.Put(unsafe.Pointer(p))
+		if err != nil {
+			if err != runtime.ErrPmemOutOfSpace {
+				t.Errorf("Put returned %v, expected ErrPmemOutOfSpace", err)
+			}
+			break
+		}
+		put++
+	}
+	if put == len(small) {
+		t.Error("Put did not fail after the heap ran out of space")
+	}
+	for i := 0; i < put; i++ {
+		pool.Get()
+	}
+	runtime.ReadPmemStats(&ps)
+	if ps.AllocFailures < failures+3 {
+		t.Errorf("%d allocation failures recorded, expected at least %d",
+			ps.AllocFailures-failures, 3)
+	}
+
+	// The heap can grow again once there is space on the device
+	runtime.PmemSetSizeLimit(0)
+	if runtime.PmemAvailable() < unsafe.Sizeof(block{}) {
+		t.Error("PmemAvailable does not count the free space on the device")
+	}
+	if runtime.Pnew(block{}) == nil {
+		t.Error("allocation failed after the size limit was removed")
+	}
+	runtime.KeepAlive(blocks)
+	runtime.KeepAlive(small)
+}
+
+func TestPmemShortArena(t *testing.T) {
+	// The heap asks for a 128 MB arena for the allocation, but the file can
+	// only grow by 96 MB
+	const size = 80 << 20
+	runtime.Pnew(0)
+	mapped := runtime.PmemSetSizeLimit(0)
+	runtime.PmemSetSizeLimit(mapped + 96<<20)
+	defer runtime.PmemSetSizeLimit(0)
+
+	if p := runtime.PmakeSlice(byte(0), size, size); p != nil {
+		t.Fatal("allocation succeeded in a short arena with short arenas disabled")
+	}
+	runtime.PmemSetShortArenas(true)
+	defer runtime.PmemSetShortArenas(false)
+	p := runtime.PmakeSlice(byte(0), size, size)
+	if p == nil {
+		t.Fatal("allocation failed with short arenas enabled")
+	}
+	if m := runtime.PmemSetSizeLimit(mapped + 96<<20); m != mapped+96<<20 {
+		t.Errorf("file grew by %d bytes, expected %d", m-mapped, 96<<20)
+	}
+	b := (*[size]byte)(p)
+	b[0], b[size-1] = 1, 1
+	runtime.PersistRange(p, size)
+	// Free the object now, so that the tests that follow do not sweep its
+	// span while they allocate
+	p, b = nil, nil
+	runtime.GC()
+}
+
+func TestPmemReservedTooLarge(t *testing.T) {
+	const maxSize = 256 << 20
+	for _, opts := range []runtime.PmemOptions{
+		{Fname: "unused", ReservedSize: maxSize - 4096, MaxSize: maxSize},
+		{Fname: "unused", ReservedSize: maxSize - 4096, MaxSize: maxSize, ShortArenas: true},
+		{Fname: "unused", MaxSize: 32 << 20},
+		{Fname: "unused", ReservedSize: ^uintptr(0) - 4096},
+	} {
+		if _, err := runtime.PmemInitOpts(opts); err != runtime.ErrPmemReservedTooLarge {
+			t.Errorf("PmemInitOpts(%+v) returned %v, expected %v", opts, err,
+				runtime.ErrPmemReservedTooLarge)
+		}
+	}
+	// The file can hold a reserved region as large as its first arena allows
+	reserved := maxSize - runtime.PmemFileSizeFor(64<<20, 0)
+	if _, err := runtime.PmemInitOpts(runtime.PmemOptions{Fname: "unused",
+		ReservedSize: uintptr(reserved), MaxSize: maxSize}); err == runtime.ErrPmemReservedTooLarge {
+		t.Errorf("PmemInitOpts rejected a reserved region of %d bytes", reserved)
+	}
+}
+
+func TestPmemCounter(t *testing.T) {
+	c, err := runtime.NewPmemCounter("test-counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Value(); v != 0 {
+		t.Fatalf("new counter has value %d", v)
+	}
+	if v := c.Next(); v != 1 {
+		t.Errorf("Next returned %d, expected 1", v)
+	}
+	if v := c.NextBatch(10); v != 2 {
+		t.Errorf("NextBatch returned %d, expected 2", v)
+	}
+	if v := c.Next(); v != 12 {
+		t.Errorf("Next returned %d after a batch, expected 12", v)
+	}
+
+	// Concurrent increments return unique values from the same counter
+	const goroutines, perG = 8, 1000
+	values := make(chan uint64, goroutines*perG)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := runtime.NewPmemCounter("test-counter")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < perG; j++ {
+				values <- c.Next()
+			}
+		}()
+	}
+	wg.Wait()
+	close(values)
+	seen := make(map[uint64]bool)
+	for v := range values {
+		if seen[v] || v <= 12 {
+			t.Fatalf("value %d returned twice", v)
+		}
+		seen[v] = true
+	}
+	if v := c.Value(); v != 12+goroutines*perG {
+		t.Errorf("counter has value %d, expected %d", v, 12+goroutines*perG)
+	}
+	runtime.SetNamedRoot("test-counter", nil)
+}
+
+func TestPmemVerify(t *testing.T) {
+	type T struct {
+		val  int
+		next *T
+	}
+	pool := runtime.PnewPool(T{})
+	x := (*T)(pool.New())
+	y := pnew(T)
+	z := runtime.PmakeSlice(make([]*T, 0), 100, 100)
+	large := runtime.Pnew([64 << 10]byte{})
+	if errs := runtime.PmemVerify(); errs != nil {
+		t.Fatalf("PmemVerify reported %v", errs)
+	}
+
+	// Mark the page after the first page of the large span as the start of a
+	// span, and set the optimized type log flag of the large span.
+	log := runtime.PmemSpanLog(large)
+	page := (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(log)) + 4))
+	old := *log
+	*page = old
+	*log = old | 2
+	errs := runtime.PmemVerify()
+	*page = 0
+	*log = old
+
+	want := map[string]uintptr{
+		"span bitmap entry is within another span":        uintptr(large) + 8192,
+		"optimized type log flag is set for a large span": uintptr(large),
+	}
+	if len(errs) != len(want) {
+		t.Errorf("PmemVerify reported %v, expected %d errors", errs, len(want))
+	}
+	for _, e := range errs {
+		if addr, ok := want[e.Desc]; !ok || addr != e.Addr {
+			t.Errorf("unexpected error %v", e)
+		}
+	}
+	if errs := runtime.PmemVerify(); errs != nil {
+		t.Errorf("PmemVerify reported %v after the span bitmap was restored", errs)
+	}
+	t.Logf("%p %p %p", x, y, z)
+}
+
+func TestPmemDumpSpans(t *testing.T) {
+	large := runtime.Pnew([64 << 10]byte{})
+	small := pnew([64]int)
+	dump := runtime.PmemDumpSpansString()
+	if !strings.HasPrefix(dump, "arena 0 addr=0x") {
+		t.Fatalf("span dump does not start with an arena line:\n%s", dump)
+	}
+	want := fmt.Sprintf("addr=%p large spanclass=1 npages=8 elemsize=65536 needzero=", large)
+	if !strings.Contains(dump, want) {
+		t.Errorf("span dump does not contain %q:\n%s", want, dump)
+	}
+	if !strings.Contains(dump, " small spanclass=") {
+		t.Errorf("span dump does not contain a small span:\n%s", dump)
+	}
+	var buf bytes.Buffer
+	runtime.PmemDumpSpans(&buf)
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("PmemDumpSpans output does not contain %q", want)
+	}
+	t.Logf("%p", small)
+}
+
+func TestPmemDumpLayout(t *testing.T) {
+	var buf bytes.Buffer
+	runtime.PmemDumpLayout(&buf)
+	if dump := buf.String(); !strings.HasPrefix(dump, "arena 0 addr=0x") ||
+		!strings.Contains(dump, "\nH ") || !strings.Contains(dump, "\nA ") {
+		t.Fatalf("unexpected layout dump:\n%s", dump)
+	}
+
+	const (
+		small = 2<<2 | 1           // size class 1, needzero
+		large = (67+5-4)<<3 | 1<<2 // 5 page noscan large span
+	)
+	// An invalid entry, such as a small span without a size class, is
+	// reported as one page
+	runs := runtime.PmemLayoutRuns([]uint32{small, small, 1, 0, 0, large, 0, 0, 0, 0, 1})
+	want := "A 2 2\nX 1\nF 2\nA 1 5\nX 1\n"
+	if runs != want {
+		t.Errorf("layout runs are\n%s\nexpected\n%s", runs, want)
+	}
+}
+
+var pmemFenceSink unsafe.Pointer
+
+// TestPmemAllocFences checks that a small persistent memory allocation issues
+// at most one fence, however many metadata ranges it writes, or two if it
+// allocates a new span with pointers.
+func TestPmemAllocFences(t *testing.T) {
+	type T struct {
+		p [6]*int
+	}
+	const N = 1000
+	for _, tc := range []struct {
+		name  string
+		alloc func()
+	}{
+		{"scan", func() { pmemFenceSink = unsafe.Pointer(pnew(T)) }},
+		{"slice", func() { pmemFenceSink = unsafe.Pointer(&pmake([]*int, 5)[0]) }},
+		{"noscan", func() { pmemFenceSink = unsafe.Pointer(pnew([200]byte)) }},
+	} {
+		max, total := runtime.PmemAllocFences(N, tc.alloc)
+		if max > 2 || max > 1 && tc.name == "noscan" {
+			t.Errorf("%s: an allocation issued %d fences", tc.name, max)
+		}
+		if total > N+N/10 {
+			t.Errorf("%s: %d allocations issued %d fences", tc.name, N, total)
+		}
+		t.Logf("%s: %.3f fences per allocation", tc.name, float64(total)/N)
+	}
+}
+
+func TestPmemSync(t *testing.T) {
+	x := pnew([8]uint64)
+	// Prevent the compiler from allocating 'x' on the stack.
+	t.Logf("%p", x)
+	for i := range x {
+		x[i] = uint64(time.Now().UnixNano()) ^ uint64(i)<<56
+	}
+	calls := runtime.PmemMsyncCalls()
+	if err := runtime.PmemSync(); err != nil {
+		t.Fatal(err)
+	}
+	// The test file is not on a persistent memory device, so the header
+	// region and each arena are synced using msync()
+	if n := runtime.PmemMsyncCalls() - calls; n < 2 {
+		t.Errorf("PmemSync made %d msync() calls, expected at least 2", n)
+	}
+
+	var pattern [64]byte
+	for i := range x {
+		binary.LittleEndian.PutUint64(pattern[i*8:], x[i])
+	}
+	data, err := ioutil.ReadFile(pmemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, pattern[:]) {
+		t.Error("object written before PmemSync not found in the persistent memory file")
+	}
+}
+
+func TestPmemOpStats(t *testing.T) {
+	x := pnew([64]byte)
+	t.Logf("%p", x)
+	runtime.SetPmemOpStats(true)
+	defer runtime.SetPmemOpStats(false)
+	runtime.ResetPmemOpStats()
+
+	const N = 10
+	for i := 0; i < N; i++ {
+		runtime.FlushRange(unsafe.Pointer(x), 64)
+	}
+	runtime.Fence()
+	runtime.PersistRange(unsafe.Pointer(x), 32)
+	runtime.PersistRanges([]runtime.MemRange{{unsafe.Pointer(x), 16}, {unsafe.Pointer(&x[32]), 16}})
+
+	// Other goroutines may persist writes concurrently
+	var s runtime.PmemOpStats
+	runtime.ReadPmemOpStats(&s)
+	if s.FlushCount < N+3 || s.FenceCount < 3 || s.BytesFlushed < N*64+64 || s.FlushCycles == 0 {
+		t.Errorf("got %d flushes, %d fences, %d bytes flushed, %d cycles", s.FlushCount,
+			s.FenceCount, s.BytesFlushed, s.FlushCycles)
+	}
+
+	runtime.SetPmemOpStats(false)
+	runtime.ResetPmemOpStats()
+	runtime.PersistRange(unsafe.Pointer(x), 64)
+	if runtime.ReadPmemOpStats(&s); s != (runtime.PmemOpStats{}) {
+		t.Errorf("statistics updated while disabled: %+v", s)
+	}
+}
+
+type profObject struct {
+	val [6]int
+	p   *int
+}
+
+var profSink *profObject
+
+//go:noinline
+func allocProfObject() *profObject {
+	return pnew(profObject)
+}
+
+func TestPmemProfile(t *testing.T) {
+	runtime.SetPmemProfileRate(1)
+	defer runtime.SetPmemProfileRate(0)
+
+	live := allocProfObject()
+	profSink = allocProfObject()
+	freed := uintptr(unsafe.Pointer(profSink))
+	profSink = nil
+	runtime.GC()
+
+	found := false
+	for _, r := range runtime.PmemProfile() {
+		switch r.Base {
+		case freed:
+			t.Error("reclaimed object found in the profile")
+		case uintptr(unsafe.Pointer(live)):
+			found = true
+			if r.Size < unsafe.Sizeof(*live) {
+				t.Errorf("record size is %d, expected at least %d", r.Size, unsafe.Sizeof(*live))
+			}
+			if fn := runtime.FuncForPC(r.Stack()[0]); fn == nil ||
+				!strings.HasSuffix(fn.Name(), ".allocProfObject") {
+				t.Errorf("record stack does not start in allocProfObject: %v", r.Stack())
+			}
+		}
+	}
+	if !found {
+		t.Fatal("allocation not found in the profile")
+	}
+
+	runtime.SetPmemProfileRate(0)
+	t.Logf("%p", allocProfObject())
+	if n := len(runtime.PmemProfile()); n != 0 {
+		t.Errorf("profile has %d records after it was disabled", n)
+	}
+	t.Logf("%p", live)
+}
+
+// BenchmarkPmemMemmove compares copying using non-temporal stores with copying
+// using memmove followed by a cache flush. It was used to choose the default
+// threshold of PmemMemmove.
+func BenchmarkPmemMemmove(b *testing.B) {
+	const N = 1 << 16
+	src := make([]byte, N)
+	dst := pnew([N]byte)
+	for _, n := range []int{64, 128, 256, 512, 1024, 4096, N} {
+		b.Run(fmt.Sprintf("nt/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				runtime.PmemMemmoveNT(unsafe.Pointer(&dst[0]), unsafe.Pointer(&src[0]), uintptr(n))
+			}
+		})
+		b.Run(fmt.Sprintf("flush/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				copy(dst[:n], src[:n])
+				runtime.PmemFlushRaw(unsafe.Pointer(&dst[0]), uintptr(n))
+			}
+		})
+	}
+}
+
+var pmemAllocSink [16]*[4]*int
+
+// BenchmarkPmemAlloc measures the throughput of small persistent memory
+// allocations made concurrently by several goroutines. Small objects are
+// allocated from spans cached in the per-P mcache, so the heap lock is taken
+// only when a span is allocated or the persistent memory heap grows.
+func BenchmarkPmemAlloc(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("goroutines=%d", n), func(b *testing.B) {
+			var wg sync.WaitGroup
+			for g := 0; g < n; g++ {
+				wg.Add(1)
+				go func(g int) {
+					for i := g; i < b.N; i += n {
+						pmemAllocSink[g] = pnew([4]*int)
+					}
+					wg.Done()
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+type poolNode struct {
+	val  [3]int
+	next *poolNode
+}
+
+var pmemPoolSink *poolNode
+
+// newPoolNode allocates a poolNode in persistent memory that is not referenced
+// by the sink, so that it can be released using Pfree()
+func newPoolNode() unsafe.Pointer {
+	pmemPoolSink = pnew(poolNode)
+	p := unsafe.Pointer(pmemPoolSink)
+	pmemPoolSink = nil
+	return p
+}
+
+// BenchmarkPmemPool compares reusing objects released to a PmemPool with
+// allocating new objects and releasing them using Pfree().
+func BenchmarkPmemPool(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		pool := runtime.PnewPool(poolNode{})
+		for i := 0; i < b.N; i++ {
+			x := pool.Get()
+			pool.Put(x)
+		}
+	})
+	b.Run("pnew", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			runtime.Pfree(newPoolNode())
+		}
+	})
+}
+
+type refNode struct {
+	val  int
+	next *refNode
+}
+
+func TestPmemRefCount(t *testing.T) {
+	x := (*refNode)(runtime.PnewRC(refNode{}))
+	if x == nil {
+		t.Fatal("PnewRC failed")
+	}
+	x.val = 1
+	x.next = pnew(refNode)
+	runtime.PersistRange(unsafe.Pointer(x), unsafe.Sizeof(*x))
+
+	// Share the object between two roots
+	for _, name := range []string{"ref1", "ref2"} {
+		if err := runtime.SetNamedRoot(name, unsafe.Pointer(x)); err != nil {
+			t.Fatal(err)
+		}
+		defer runtime.SetNamedRoot(name, nil)
+	}
+	if err := runtime.PmemIncRef(unsafe.Pointer(x)); err != nil {
+		t.Fatal(err)
+	}
+	if n := runtime.PmemRefCount(unsafe.Pointer(x)); n != 2 {
+		t.Fatalf("reference count is %d, expected 2", n)
+	}
+
+	runtime.SetNamedRoot("ref1", nil)
+	if freed, err := runtime.PmemDecRef(unsafe.Pointer(x)); freed || err != nil {
+		t.Fatalf("PmemDecRef returned %v, %v with one reference left", freed, err)
+	}
+	if x.val != 1 || x.next == nil {
+		t.Fatal("object released while it is still referenced")
+	}
+
+	runtime.SetNamedRoot("ref2", nil)
+	// A garbage collection cycle would report the pointer to the released
+	// object that the test checks.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	addr := uintptr(unsafe.Pointer(x))
+	if freed, err := runtime.PmemDecRef(unsafe.Pointer(x)); !freed || err != nil {
+		t.Fatalf("PmemDecRef returned %v, %v for the last reference", freed, err)
+	}
+	if y := (*refNode)(unsafe.Pointer(addr)); y.val != 0 || y.next != nil {
+		t.Fatal("object not cleared when its last reference was dropped")
+	}
+	if runtime.IsObjectStart(unsafe.Pointer(addr)) {
+		t.Fatal("object not released when its last reference was dropped")
+	}
+	if n := runtime.PmemRefCount(unsafe.Pointer(addr)); n != 0 {
+		t.Fatalf("released object has reference count %d", n)
+	}
+	if _, err := runtime.PmemDecRef(unsafe.Pointer(addr)); err == nil {
+		t.Fatal("PmemDecRef succeeded for a released object")
+	}
+	if err := runtime.PmemIncRef(unsafe.Pointer(pnew(int))); err == nil {
+		t.Fatal("PmemIncRef succeeded for an object that is not reference counted")
+	}
+}
+
+func TestPmemRefTableGrowth(t *testing.T) {
+	objs := make([]unsafe.Pointer, 200)
+	for i := range objs {
+		if objs[i] = runtime.PnewRC(int(0)); objs[i] == nil {
+			t.Fatal("PnewRC failed")
+		}
+		*(*int)(objs[i]) = i
+	}
+	runtime.GC()
+	for i, p := range objs {
+		if n := runtime.PmemRefCount(p); n != 1 || *(*int)(p) != i {
+			t.Fatalf("object %d has reference count %d and value %d", i, n, *(*int)(p))
+		}
+		if freed, err := runtime.PmemDecRef(p); !freed || err != nil {
+			t.Fatalf("PmemDecRef returned %v, %v", freed, err)
+		}
+	}
+}
+
+func TestPmemAppendLog(t *testing.T) {
+	const recordMax = 1000
+	l, err := runtime.NewPmemLog("plog", recordMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.SetNamedRoot("plog", nil)
+	if _, err := runtime.NewPmemLog("plog", recordMax+1); err == nil {
+		t.Fatal("log opened with a different maximum record size")
+	}
+	if _, err := l.Append(make([]byte, recordMax+1)); err == nil {
+		t.Fatal("record larger than the maximum record size appended")
+	}
+
+	// Append enough records to fill several chunks
+	const N = 500
+	for i := 0; i < N; i++ {
+		seq, err := l.Append(bytes.Repeat([]byte{byte(i)}, i%recordMax+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(i) {
+			t.Fatalf("record %d appended with sequence number %d", i, seq)
+		}
+	}
+	runtime.GC()
+
+	check := func(l *runtime.PLog) {
+		n := 0
+		l.Iterate(func(seq uint64, data []byte) bool {
+			if seq != uint64(n) || !bytes.Equal(data, bytes.Repeat([]byte{byte(n)}, n%recordMax+1)) {
+				t.Fatalf("record %d has sequence number %d and %d bytes", n, seq, len(data))
+			}
+			n++
+			return true
+		})
+		if n != N {
+			t.Fatalf("found %d records, expected %d", n, N)
+		}
+	}
+	check(l)
+
+	// A log opened again finds the same records
+	l2, err := runtime.NewPmemLog("plog", recordMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(l2)
+	if seq, err := l2.Append(nil); seq != N || err != nil {
+		t.Fatalf("Append returned %d, %v", seq, err)
+	}
+
+	n := 0
+	l2.Iterate(func(seq uint64, data []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Iterate continued after the callback returned false")
+	}
+}
+
+func TestPmemForEachSpan(t *testing.T) {
+	small := pnew([4]int)
+	large := pmake([]byte, 100<<10)
+	t.Logf("%p %p", small, &large[0])
+
+	var foundSmall, foundLarge bool
+	n := 0
+	runtime.PmemForEachSpan(func(base, npages uintptr, spc uint8, large bool) bool {
+		n++
+		end := base + npages*runtime.PageSize
+		if p := uintptr(unsafe.Pointer(small)); p >= base && p < end {
+			foundSmall = !large && spc>>1 != 0
+		}
+		// Allocating in the callback must not deadlock
+		_ = make([]byte, 1<<10)
+		return true
+	})
+	runtime.PmemForEachSpan(func(base, npages uintptr, spc uint8, l bool) bool {
+		if uintptr(unsafe.Pointer(&large[0])) == base {
+			foundLarge = l && spc>>1 == 0 && npages*runtime.PageSize >= 100<<10
+		}
+		return true
+	})
+	if !foundSmall || !foundLarge {
+		t.Fatalf("spans of the small (%v) or large (%v) object not found", foundSmall, foundLarge)
+	}
+
+	visited := 0
+	runtime.PmemForEachSpan(func(base, npages uintptr, spc uint8, large bool) bool {
+		visited++
+		return false
+	})
+	if n < 2 || visited != 1 {
+		t.Fatalf("visited %d of %d spans after stopping", visited, n)
+	}
+}
+
+type checkedObject struct {
+	val  [10]int
+	next *checkedObject
+}
+
+//go:noinline
+func allocChecked(n int) {
+	for i := 0; i < n; i++ {
+		x := (*checkedObject)(runtime.PnewChecked(checkedObject{}))
+		x.val[0] = i
+		runtime.PersistObject(unsafe.Pointer(x))
+	}
+}
+
+func TestPmemObjectChecksum(t *testing.T) {
+	x := (*checkedObject)(runtime.PnewChecked(checkedObject{}))
+	if x == nil {
+		t.Fatal("PnewChecked failed")
+	}
+	if !runtime.PmemVerifyObject(unsafe.Pointer(x)) {
+		t.Fatal("new object does not match its checksum")
+	}
+	x.val[3] = 3
+	x.next = pnew(checkedObject)
+	if runtime.PmemVerifyObject(unsafe.Pointer(x)) {
+		t.Fatal("modified object matches its old checksum")
+	}
+	runtime.PersistObject(unsafe.Pointer(x))
+	if !runtime.PmemVerifyObject(unsafe.Pointer(x)) {
+		t.Fatal("checksum not updated by PersistObject")
+	}
+	if runtime.PmemVerifyObject(unsafe.Pointer(x.next)) {
+		t.Fatal("object allocated using pnew has a checksum")
+	}
+
+	// Small objects without pointers are not packed into a tiny block
+	b := (*byte)(runtime.PnewChecked(byte(0)))
+	*b = 1
+	runtime.PersistObject(unsafe.Pointer(b))
+	if !runtime.PmemVerifyObject(unsafe.Pointer(b)) {
+		t.Fatal("small object does not match its checksum")
+	}
+
+	// The entries of objects freed by the garbage collector are cleared,
+	// and the table grows to hold more objects
+	used := runtime.PmemChecksumsUsed()
+	allocChecked(200)
+	if n := runtime.PmemChecksumsUsed(); n != used+200 {
+		t.Fatalf("%d checksum entries used after 200 allocations, expected %d", n, used+200)
+	}
+	runtime.GC()
+	runtime.GC()
+	if n := runtime.PmemChecksumsUsed(); n > used {
+		t.Fatalf("%d checksum entries used after the objects were freed, expected %d", n, used)
+	}
+	if !runtime.PmemVerifyObject(unsafe.Pointer(x)) || !runtime.PmemVerifyObject(unsafe.Pointer(b)) {
+		t.Fatal("live objects do not match their checksums after garbage collection")
+	}
+}
+
+func TestPmemBounds(t *testing.T) {
+	x := pnew([64]byte)
+	t.Logf("%p", x)
+	copy(x[:], "PmemBounds test marker")
+	runtime.PersistRange(unsafe.Pointer(x), 64)
+
+	base, start, end := runtime.PmemBounds()
+	p := uintptr(unsafe.Pointer(x))
+	if base == 0 || base >= start || start > p || p >= end {
+		t.Fatalf("object at %#x not within bounds %#x, %#x, %#x", p, base, start, end)
+	}
+	if reserved, n := runtime.PmemReservedRegion(); reserved != nil &&
+		uintptr(reserved) >= base && uintptr(reserved)+n > start {
+		t.Errorf("reserved region overlaps the managed region")
+	}
+
+	f, err := os.Open(pmemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 64)
+	if _, err := f.ReadAt(b, int64(p-base)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, x[:]) {
+		t.Errorf("object not found at file offset %#x", p-base)
+	}
+}
+
+func TestPmemTypeInfo(t *testing.T) {
+	type node struct {
+		val  int
+		next *node
+		data *[4]int
+	}
+	pool := runtime.PnewPool(node{})
+	p := pool.New()
+	kind, size, ptrdata, ok := runtime.PmemTypeInfo(p)
+	if !ok {
+		t.Fatal("type of a pool object not logged")
+	}
+	if reflect.Kind(kind) != reflect.Struct || size != unsafe.Sizeof(node{}) ||
+		ptrdata != unsafe.Offsetof(node{}.data)+unsafe.Sizeof(uintptr(0)) {
+		t.Errorf("pool object logged with kind %v, size %d, ptrdata %d",
+			reflect.Kind(kind), size, ptrdata)
+	}
+	if _, _, _, ok := runtime.PmemTypeInfo(unsafe.Pointer(uintptr(p) + 8)); !ok {
+		t.Error("type not found from an interior pointer")
+	}
+
+	// The heap type bits of a large object are logged for the object
+	large := pmake([]*int, 1<<16)
+	if _, _, _, ok := runtime.PmemTypeInfo(unsafe.Pointer(&large[0])); ok {
+		t.Error("type of a large object reported as logged for its span")
+	}
+	v := new(node)
+	if _, _, _, ok := runtime.PmemTypeInfo(unsafe.Pointer(v)); ok {
+		t.Error("type of a volatile object reported")
+	}
+}
@@ -75,7 +75,8 @@ func TestMemStats(t *testing.T) {
 		"PauseTotalNs": {le(1e11)}, "PauseNs": nil, "PauseEnd": nil,
 		"NumGC": {nz, le(1e9)}, "NumForcedGC": {nz, le(1e9)},
 		"GCCPUFraction": {le(0.99)}, "EnableGC": {eq(true)}, "DebugGC": {eq(false)},
-		"BySize": nil,
+		"PmemAlloc": {le(1e10)}, "PmemSys": {le(1e10)}, "PmemInuse": {le(1e10)},
+		"PmemReleased": {le(1e10)}, "BySize": nil,
 	}
 
 	rst := reflect.ValueOf(st).Elem()
@@ -98,8 +99,8 @@ func TestMemStats(t *testing.T) {
 		t.Fatalf("Bad sys value: %+v", *st)
 	}
 
-	if st.HeapIdle+st.HeapInuse != st.HeapSys {
-		t.Fatalf("HeapIdle(%d) + HeapInuse(%d) should be equal to HeapSys(%d), but isn't.", st.HeapIdle, st.HeapInuse, st.HeapSys)
+	if st.HeapIdle+st.HeapInuse+st.PmemInuse != st.HeapSys {
+		t.Fatalf("HeapIdle(%d) + HeapInuse(%d) + PmemInuse(%d) should be equal to HeapSys(%d), but isn't.", st.HeapIdle, st.HeapInuse, st.PmemInuse, st.HeapSys)
 	}
 
 	if lpe := st.PauseEnd[int(st.NumGC+255)%len(st.PauseEnd)]; st.LastGC != lpe {
@@ -137,7 +137,7 @@ func freemcache(c *mcache) {
 // memory requested is for persistent memory or volatile memory. The rest of the
 // bits contains the type index if this request is for allocation from a span
 // that is specially cached for a particular datatype.
-func (c *mcache) refill(spc spanClass, metadata int) {
+func (c *mcache) refill(spc spanClass, metadata int) bool {
 	memtype := metadata & 1
 	typIndex := metadata >> 1
 
@@ -158,6 +158,12 @@ func (c *mcache) refill(spc spanClass, metadata int) {
 	// Get a new cached span from the central lists.
 	s = mheap_.central[memtype][spc][typIndex].mcentral.cacheSpan(memtype)
 	if s == nil {
+		if memtype == isPersistent {
+			// The persistent memory heap cannot grow. The failure is
+			// reported to the application by mallocgc.
+			c.alloc[memtype][spc][typIndex] = &emptymspan
+			return false
+		}
 		throw("out of memory")
 	}
 
@@ -173,6 +179,7 @@ func (c *mcache) refill(spc spanClass, metadata int) {
 	}
 
 	c.alloc[memtype][spc][typIndex] = s
+	return true
 }
 
 func (c *mcache) releaseAll() {
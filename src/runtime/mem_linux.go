@@ -166,16 +166,8 @@ func sysReserve(v unsafe.Pointer, n uintptr) unsafe.Pointer {
 func sysMap(v unsafe.Pointer, n uintptr, sysStat *uint64, memtype int) {
 	mSysStatInc(sysStat, n)
 
-	var p unsafe.Pointer
-	var err int
-
-	if memtype == isPersistent {
-		p, pmemInfo.isPmem, err = mapFile(pmemInfo.fname, int(n), fileCreate,
-			_DEFAULT_FMODE, pmemInfo.nextMapOffset, v)
-	} else {
-		mapFlags := int32(_MAP_ANON | _MAP_FIXED | _MAP_PRIVATE)
-		p, err = mmap(v, n, _PROT_READ|_PROT_WRITE, mapFlags, -1, 0)
-	}
+	mapFlags := int32(_MAP_ANON | _MAP_FIXED | _MAP_PRIVATE)
+	p, err := mmap(v, n, _PROT_READ|_PROT_WRITE, mapFlags, -1, 0)
 
 	if err == _ENOMEM {
 		throw("runtime: out of memory")
@@ -712,6 +712,9 @@ func (s *pageAlloc) scavengeRangeLocked(ci chunkIdx, base, npages uint) uintptr
 	// Update global accounting only when not in test, otherwise
 	// the runtime's accounting will be wrong.
 	mSysStatInc(&memstats.heap_released, uintptr(npages)*pageSize)
+	if ha := mheap_.arenas[arenaIndex(addr).l1()][arenaIndex(addr).l2()]; ha != nil && ha.pArena != 0 {
+		mSysStatInc(&memstats.pmem_released, uintptr(npages)*pageSize)
+	}
 	return addr
 }
 
@@ -503,6 +503,10 @@ func (s *mspan) sweep(preserve bool) bool {
 		}
 	}
 
+	if s.memtype == isPersistent && atomic.Load(&pmemInfo.zeroOnFree) != 0 {
+		clearFreedObjects(s)
+	}
+
 	// Check for zombie objects.
 	if s.freeindex < s.nelems {
 		// Everything < freeindex is allocated and hence
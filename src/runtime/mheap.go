@@ -216,6 +216,8 @@ type mheap struct {
 	cachealloc            fixalloc // allocator for mcache*
 	specialfinalizeralloc fixalloc // allocator for specialfinalizer*
 	specialprofilealloc   fixalloc // allocator for specialprofile*
+	specialchecksumalloc  fixalloc // allocator for specialchecksum*
+	specialpinalloc       fixalloc // allocator for specialpin*
 	speciallock           mutex    // lock for special record allocators.
 	arenaHintAlloc        fixalloc // allocator for arenaHints
 
@@ -297,6 +299,10 @@ type heapArena struct {
 	zeroedBase uintptr
 
 	pArena uintptr // the pointer to the persistent memory arena header
+
+	// pLogLock protects the undo log of the persistent memory arena whose
+	// header is in this heap arena. See (*pArena).logLock().
+	pLogLock mutex
 }
 
 // arenaHint is a hint for where to grow the heap arenas. See
@@ -711,6 +717,8 @@ func (h *mheap) init() {
 	h.cachealloc.init(unsafe.Sizeof(mcache{}), nil, nil, &memstats.mcache_sys)
 	h.specialfinalizeralloc.init(unsafe.Sizeof(specialfinalizer{}), nil, nil, &memstats.other_sys)
 	h.specialprofilealloc.init(unsafe.Sizeof(specialprofile{}), nil, nil, &memstats.other_sys)
+	h.specialchecksumalloc.init(unsafe.Sizeof(specialchecksum{}), nil, nil, &memstats.other_sys)
+	h.specialpinalloc.init(unsafe.Sizeof(specialpin{}), nil, nil, &memstats.other_sys)
 	h.arenaHintAlloc.init(unsafe.Sizeof(arenaHint{}), nil, nil, &memstats.other_sys)
 
 	// Don't zero mspan allocations. Background sweeping can
@@ -1281,10 +1289,16 @@ HaveSpan:
 		// in the span since some of them might be scavenged.
 		sysUsed(unsafe.Pointer(base), nbytes)
 		mSysStatDec(&memstats.heap_released, scav)
+		if memtype == isPersistent {
+			mSysStatDec(&memstats.pmem_released, scav)
+		}
 	}
 	// Update stats.
 	mSysStatInc(sysStat, nbytes)
 	mSysStatDec(&memstats.heap_idle, nbytes)
+	if memtype == isPersistent {
+		pmemUsageAdd(int64(nbytes))
+	}
 
 	// Publish the span in various locations.
 
@@ -1327,9 +1341,6 @@ HaveSpan:
 func (h *mheap) grow(npage uintptr, memtype int) bool {
 	// We must grow the heap in whole palloc chunks.
 	ask := alignUp(npage, pallocChunkPages) * pageSize
-	if memtype == isPersistent {
-		//println("grow npage = ", npage, " ask (pages) = ", ask/pageSize)
-	}
 	var arenaPtr *pArena
 
 	shouldReserve := false
@@ -1347,7 +1358,9 @@ func (h *mheap) grow(npage uintptr, memtype int) bool {
 		av, asize := h.sysAlloc(ask, memtype)
 		trackAddr = uintptr(av)
 		if av == nil {
-			print("runtime: out of memory: cannot allocate ", ask, "-byte block (", memstats.heap_sys, " in use)\n")
+			if memtype == isNotPersistent {
+				print("runtime: out of memory: cannot allocate ", ask, "-byte block (", memstats.heap_sys, " in use)\n")
+			}
 			return false
 		}
 
@@ -1358,14 +1371,13 @@ func (h *mheap) grow(npage uintptr, memtype int) bool {
 			if pmemInfo.nextMapOffset == 0 {
 				// This is the first time heap growth. The first arena stores the
 				// global persistent memory header as well, so leave space for that
-				offset = pmemHeaderSize
+				offset = pmemInfo.hdrRegionSize
 			}
 			arenaPtr = (*pArena)(unsafe.Pointer(uintptr(av) + offset))
-			arenaPtr.size = asize
-			arenaPtr.mapAddr = uintptr(av)
-			arenaPtr.fileOffset = pmemInfo.nextMapOffset
-			arenaPtr.magic = hdrMagic // todo - replace this with sth like a checksum
-			PersistRange(unsafe.Pointer(arenaPtr), unsafe.Sizeof(*arenaPtr))
+			if pmemInfo.nextMapOffset < pmemInfo.staleSize {
+				arenaPtr.clearStaleArena(asize, uintptr(av), pmemInfo.nextMapOffset)
+			}
+			arenaPtr.init(asize, uintptr(av), pmemInfo.nextMapOffset)
 
 			// Increment the mapped size in persistent memory header
 			pmemHeader.mappedSize += (asize - offset)
@@ -1373,6 +1385,8 @@ func (h *mheap) grow(npage uintptr, memtype int) bool {
 
 			// Increment the next map offset
 			pmemInfo.nextMapOffset += asize
+			pmemGrowAdd(1, asize)
+			pmemVerboseArena(uintptr(av), asize, pmemInfo.nextMapOffset-asize)
 
 			for ai := arenaIndex(uintptr(av)); ai <= arenaIndex(uintptr(av)+asize-1); ai++ {
 				arena := mheap_.arenas[ai.l1()][ai.l2()]
@@ -1407,6 +1421,9 @@ func (h *mheap) grow(npage uintptr, memtype int) bool {
 		// just add directly to heap_released.
 		mSysStatInc(&memstats.heap_released, asize)
 		mSysStatInc(&memstats.heap_idle, asize)
+		if memtype == isPersistent {
+			mSysStatInc(&memstats.pmem_released, asize)
+		}
 
 		// Recalculate nBase.
 		// We know this won't overflow, because sysAlloc returned
@@ -1512,6 +1529,9 @@ func (h *mheap) freeSpanLocked(s *mspan, acctinuse, acctidle bool) {
 
 	if acctinuse {
 		mSysStatDec(&memstats.heap_inuse, s.npages*pageSize)
+		if s.memtype == isPersistent {
+			pmemUsageAdd(-int64(s.npages * pageSize))
+		}
 	}
 	if acctidle {
 		mSysStatInc(&memstats.heap_idle, s.npages*pageSize)
@@ -1523,6 +1543,13 @@ func (h *mheap) freeSpanLocked(s *mspan, acctinuse, acctidle bool) {
 	// not be done.
 	if s.memtype == isPersistent && pmemInfo.initState == initDone {
 		logSpanFree(s)
+		pmemVerboseSpan("free", s)
+		if debug.pmemcheck != 0 {
+			pmemCheckFree(s)
+		}
+		if trace.enabled {
+			tracePmemFree(s.npages*pageSize, true)
+		}
 	}
 
 	// Mark the space as free.
@@ -1683,6 +1710,8 @@ func (list *mSpanList) takeAll(other *mSpanList) {
 const (
 	_KindSpecialFinalizer = 1
 	_KindSpecialProfile   = 2
+	_KindSpecialChecksum  = 3
+	_KindSpecialPin       = 4
 	// Note: The finalizer special must be first because if we're freeing
 	// an object, a finalizer special will cause the freeing operation
 	// to abort, and we want to keep the other special records around
@@ -1904,6 +1933,18 @@ func freespecial(s *special, p unsafe.Pointer, size uintptr) {
 		lock(&mheap_.speciallock)
 		mheap_.specialprofilealloc.free(unsafe.Pointer(sp))
 		unlock(&mheap_.speciallock)
+	case _KindSpecialChecksum:
+		sc := (*specialchecksum)(unsafe.Pointer(s))
+		freeChecksum(sc.index)
+		lock(&mheap_.speciallock)
+		mheap_.specialchecksumalloc.free(unsafe.Pointer(sc))
+		unlock(&mheap_.speciallock)
+	case _KindSpecialPin:
+		sp := (*specialpin)(unsafe.Pointer(s))
+		freePin(sp.index, p)
+		lock(&mheap_.speciallock)
+		mheap_.specialpinalloc.free(unsafe.Pointer(sp))
+		unlock(&mheap_.speciallock)
 	default:
 		throw("bad special kind")
 		panic("not reached")
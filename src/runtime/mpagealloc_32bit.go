@@ -76,7 +76,7 @@ func (s *pageAlloc) sysInit() {
 		throw("failed to reserve page summary memory")
 	}
 	// There isn't much. Just map it and mark it as used immediately.
-	sysMap(reservation, totalSize, s.sysStat)
+	sysMap(reservation, totalSize, s.sysStat, isNotPersistent)
 	sysUsed(reservation, totalSize)
 
 	// Iterate over the reservation and cut it up into slices.
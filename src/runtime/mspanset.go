@@ -269,6 +269,29 @@ func (b *spanSet) reset() {
 	atomic.Storeuintptr(&b.spineLen, 0)
 }
 
+// remove removes span s from buffer b, and reports whether s was found.
+// It pops every span in b and pushes back all the others, so it takes
+// time linear in the size of b.
+//
+// remove may not be called concurrently with any other operations
+// on the span set, e.g. it is called with the world stopped.
+func (b *spanSet) remove(s *mspan) bool {
+	found := false
+	head, tail := b.index.load().split()
+	for i := head; i < tail; i++ {
+		t := b.pop()
+		if t == nil {
+			break
+		}
+		if t == s {
+			found = true
+		} else {
+			b.push(t)
+		}
+	}
+	return found
+}
+
 // spanSetBlockPool is a global pool of spanSetBlocks.
 var spanSetBlockPool spanSetBlockAlloc
 
@@ -89,6 +89,15 @@ type mstats struct {
 	last_next_gc     uint64 // next_gc for the previous GC
 	last_heap_inuse  uint64 // heap_inuse at mark termination of the previous GC
 
+	// Statistics about the persistent memory heap. pmem_released is updated
+	// atomically or with the heap lock held, and the others are computed by
+	// updatememstats. heap_sys, heap_inuse and heap_released include the
+	// persistent memory heap as well.
+	pmem_alloc    uint64 // bytes of allocated persistent memory objects
+	pmem_sys      uint64 // bytes in persistent memory arenas
+	pmem_inuse    uint64 // bytes in in-use persistent memory spans
+	pmem_released uint64 // bytes of persistent memory arenas released to the os
+
 	// triggerRatio is the heap growth ratio that triggers marking.
 	//
 	// E.g., if this is 0.6, then GC should start when the live
@@ -251,7 +260,9 @@ type MemStats struct {
 	// transient spike in live heap size.
 	HeapIdle uint64
 
-	// HeapInuse is bytes in in-use spans.
+	// HeapInuse is bytes in in-use spans. This does not include
+	// the in-use spans of the persistent memory heap, which are
+	// reported by PmemInuse.
 	//
 	// In-use spans have at least one object in them. These spans
 	// can only be used for other objects of roughly the same
@@ -421,10 +432,33 @@ type MemStats struct {
 		// in this size class.
 		Frees uint64
 	}
+
+	// Persistent memory heap statistics.
+	//
+	// These statistics are zero if persistent memory is not
+	// initialized. See also ReadPmemStats.
+
+	// PmemAlloc is bytes of allocated persistent memory objects.
+	PmemAlloc uint64
+
+	// PmemSys is bytes of persistent memory arenas mapped from the
+	// persistent memory file.
+	PmemSys uint64
+
+	// PmemInuse is bytes in in-use persistent memory spans.
+	// PmemInuse + HeapInuse is the number of bytes in all in-use
+	// heap spans.
+	PmemInuse uint64
+
+	// PmemReleased is bytes of persistent memory arenas that were
+	// returned to the OS. The contents of this memory are retained
+	// in the persistent memory file.
+	PmemReleased uint64
 }
 
 // Size of the trailing by_size array differs between mstats and MemStats,
-// and all data after by_size is local to runtime, not exported.
+// and all data after by_size is local to runtime, not exported. The persistent
+// memory statistics that follow BySize in MemStats are copied separately.
 // NumSizeClasses was changed, but we cannot change MemStats because of backward compatibility.
 // sizeof_C_MStats is the size of the prefix of mstats that
 // corresponds to MemStats. It should match Sizeof(MemStats{}).
@@ -432,8 +466,8 @@ var sizeof_C_MStats = unsafe.Offsetof(memstats.by_size) + 61*unsafe.Sizeof(memst
 
 func init() {
 	var memStats MemStats
-	if sizeof_C_MStats != unsafe.Sizeof(memStats) {
-		println(sizeof_C_MStats, unsafe.Sizeof(memStats))
+	if sizeof_C_MStats != unsafe.Offsetof(memStats.PmemAlloc) {
+		println(sizeof_C_MStats, unsafe.Offsetof(memStats.PmemAlloc))
 		throw("MStats vs MemStatsType size mismatch")
 	}
 
@@ -470,6 +504,14 @@ func readmemstats_m(stats *MemStats) {
 	// memstats.stacks_sys is only memory mapped directly for OS stacks.
 	// Add in heap-allocated stack memory for user consumption.
 	stats.StackSys += stats.StackInuse
+
+	// heap_inuse includes the persistent memory heap, which is reported
+	// separately.
+	stats.HeapInuse -= memstats.pmem_inuse
+	stats.PmemAlloc = memstats.pmem_alloc
+	stats.PmemSys = memstats.pmem_sys
+	stats.PmemInuse = memstats.pmem_inuse
+	stats.PmemReleased = atomic.Load64(&memstats.pmem_released)
 }
 
 //go:linkname readGCStats runtime/debug.readGCStats
@@ -515,8 +557,8 @@ func readGCStats_m(pauses *[]uint64) {
 	*pauses = p[:n+n+3]
 }
 
-// stats are currently supported only for volatile memory.
-// todo support stats for persistent memory
+// The allocation statistics are currently supported only for volatile memory.
+// The persistent memory heap is summarized by updatepmemstats.
 //go:nowritebarrier
 func updatememstats() {
 	// Flush mcaches to mcentral before doing anything else.
@@ -590,6 +632,35 @@ func updatememstats() {
 	memstats.alloc = totalAlloc - totalFree
 	memstats.heap_alloc = memstats.alloc
 	memstats.heap_objects = memstats.nmalloc - memstats.nfree
+
+	updatepmemstats()
+}
+
+// updatepmemstats computes the persistent memory heap statistics by walking
+// the persistent memory arenas and spans. The world must be stopped and the
+// mcaches must be flushed.
+//go:nowritebarrier
+func updatepmemstats() {
+	memstats.pmem_alloc = 0
+	memstats.pmem_sys = 0
+	memstats.pmem_inuse = 0
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return
+	}
+
+	var ps PmemStats
+	lock(&mheap_.lock)
+	readPmemStats(&ps)
+	for _, s := range mheap_.allspans {
+		if s.state.get() == mSpanInUse && s.memtype == isPersistent {
+			memstats.pmem_alloc += uint64(s.allocCount) * uint64(s.elemsize)
+		}
+	}
+	unlock(&mheap_.lock)
+	memstats.pmem_sys = ps.TotalBytes
+	// pmemUsage.inUse is updated along with heap_inuse whenever a persistent
+	// memory span is allocated or freed.
+	memstats.pmem_inuse = atomic.Load64(&pmemUsage.inUse)
 }
 
 // cachestats flushes all mcache stats.
@@ -0,0 +1,220 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Checksummed persistent memory objects. The checksum of an object allocated
+// using PnewChecked() is stored in the persistent memory checksum table. Each
+// entry of the table records the file offset of an object and the CRC32C
+// checksum of its slot:
+//
+//	| off | crc |
+//
+// The table is a persistent side table (see sideTable) whose first entry
+// stores the number of entries that follow it in its off field. An entry is
+// used if its offset is not 0. The
+// checksum of a new entry is persisted before its offset.
+//
+// The table records file offsets rather than pointers, so that it does not
+// keep the objects alive. Instead, each checksummed object has a special
+// record (see addspecial()) that holds the index of its entry. When the
+// garbage collector frees the object, the special record is freed and the
+// entry is cleared. The special records are created again for the objects in
+// the table during reconstruction.
+//
+// Updating the checksum of an object in PersistObject() reads the whole slot
+// of the object and writes and flushes the cache line that holds the entry,
+// so checksummed objects should not be persisted using many small
+// PersistObject() calls. Allocations pay none of this cost. Once a file holds
+// a checksummed object, PersistObject() also looks up the special records of
+// every object it persists.
+
+// pmemChecksum is an entry in the persistent memory checksum table
+type pmemChecksum struct {
+	off uintptr
+	crc uintptr
+}
+
+// A volatile data-structure that tracks the checksum table
+var pmemChecksums struct {
+	// Set to 1 once the checksum table holds an object. PersistObject()
+	// only looks for the checksum of an object if it is set.
+	enabled uint32
+
+	// The checksum table. Its lock is taken when a special record is freed
+	// by the garbage collector, so no allocation must be done while holding
+	// it.
+	sideTable
+}
+
+// The described object is a checksummed persistent memory object
+//
+//go:notinheap
+type specialchecksum struct {
+	special special
+	index   uintptr // Index of the entry of the object in the checksum table
+}
+
+// checksumEntries returns the entries of the checksum table 'table'
+func checksumEntries(table unsafe.Pointer) []pmemChecksum {
+	if table == nil {
+		return nil
+	}
+	n := (*pmemChecksum)(table).off
+	return (*[1 << 26]pmemChecksum)(table)[1 : n+1 : n+1]
+}
+
+// PnewChecked allocates a zeroed object in persistent memory whose type is the
+// dynamic type of 'typ', and returns a pointer to it. The value of 'typ' is
+// not used. A CRC32C checksum of the object is stored in persistent memory,
+// and is updated each time the object is persisted using PersistObject().
+// Writes that are persisted using PersistRange() or PersistField() do not
+// update the checksum. PmemVerifyObject() checks the object against its
+// checksum, to detect corruption of the object on the persistent memory
+// device. If the application crashes after the object is persisted but before
+// its checksum is, the object does not match its checksum after a restart
+// until it is persisted again. PnewChecked returns nil if there is no space
+// left for the object in the persistent memory file.
+func PnewChecked(typ interface{}) unsafe.Pointer {
+	t := efaceOf(&typ)._type
+	if t == nil {
+		panic(plainError("runtime: PnewChecked called with a nil type"))
+	}
+	// The checksum covers the whole slot of the object
+	p := pnewSlot(t)
+	if p == nil {
+		return nil
+	}
+	size := spanOfHeap(uintptr(p)).elemsize
+
+	lock(&pmemChecksums.lock)
+	for {
+		entries := checksumEntries(pmemChecksums.table)
+		for i := range entries {
+			if e := &entries[i]; e.off == 0 {
+				e.crc = uintptr(crc32c(0, p, size))
+				PersistRange(unsafe.Pointer(&e.crc), intSize)
+				e.off = fileOffsetOf(uintptr(p))
+				PersistRange(unsafe.Pointer(&e.off), intSize)
+				unlock(&pmemChecksums.lock)
+				atomic.Store(&pmemChecksums.enabled, 1)
+				addChecksumSpecial(p, uintptr(i))
+				return p
+			}
+		}
+
+		if !pmemChecksums.grow(pmemChecksum{}, unsafe.Offsetof(pmemChecksum{}.off),
+			&pmemHeader.checksumTable) {
+			unlock(&pmemChecksums.lock)
+			return nil
+		}
+	}
+}
+
+// addChecksumSpecial adds a special record to the checksummed object 'p'
+// whose entry in the checksum table is at 'index'
+func addChecksumSpecial(p unsafe.Pointer, index uintptr) {
+	lock(&mheap_.speciallock)
+	s := (*specialchecksum)(mheap_.specialchecksumalloc.alloc())
+	unlock(&mheap_.speciallock)
+	s.special.kind = _KindSpecialChecksum
+	s.index = index
+	if !addspecial(p, &s.special) {
+		throw("addChecksumSpecial: checksum already set")
+	}
+}
+
+// checksumIndex returns the index of the entry of the persistent memory
+// object 'p' in the checksum table, or -1 if the object is not checksummed
+func checksumIndex(p uintptr) int {
+	span := spanOfHeap(p)
+	if span == nil {
+		return -1
+	}
+	offset := p - span.base()
+	index := -1
+	lock(&span.speciallock)
+	for s := span.specials; s != nil; s = s.next {
+		if uintptr(s.offset) == offset && s.kind == _KindSpecialChecksum {
+			index = int((*specialchecksum)(unsafe.Pointer(s)).index)
+			break
+		}
+	}
+	unlock(&span.speciallock)
+	return index
+}
+
+// updateChecksum stores the checksum of the object of 'size' bytes at 'p' if
+// it is checksummed
+func updateChecksum(p, size uintptr) {
+	i := checksumIndex(p)
+	if i < 0 {
+		return
+	}
+	crc := uintptr(crc32c(0, unsafe.Pointer(p), size))
+	lock(&pmemChecksums.lock)
+	e := &checksumEntries(pmemChecksums.table)[i]
+	e.crc = crc
+	PersistRange(unsafe.Pointer(&e.crc), intSize)
+	unlock(&pmemChecksums.lock)
+}
+
+// freeChecksum clears the checksum table entry at 'index' of an object that
+// was freed by the garbage collector
+func freeChecksum(index uintptr) {
+	if pmemInfo.readOnly {
+		return
+	}
+	lock(&pmemChecksums.lock)
+	e := &checksumEntries(pmemChecksums.table)[index]
+	e.off = 0
+	PersistRange(unsafe.Pointer(&e.off), intSize)
+	unlock(&pmemChecksums.lock)
+}
+
+// PmemVerifyObject reports whether the persistent memory object that starts
+// at 'ptr' matches the checksum stored when it was last persisted using
+// PersistObject(). It returns false if 'ptr' is not the start of a live
+// object allocated using PnewChecked().
+func PmemVerifyObject(ptr unsafe.Pointer) bool {
+	if atomic.Load(&pmemChecksums.enabled) == 0 || !IsObjectStart(ptr) {
+		return false
+	}
+	i := checksumIndex(uintptr(ptr))
+	if i < 0 {
+		return false
+	}
+	crc := uintptr(crc32c(0, ptr, spanOfHeap(uintptr(ptr)).elemsize))
+	lock(&pmemChecksums.lock)
+	ok := checksumEntries(pmemChecksums.table)[i].crc == crc
+	unlock(&pmemChecksums.lock)
+	return ok
+}
+
+// restoreChecksumTable finds the checksum table after a restart, and adds a
+// special record to each checksummed object. Entries of objects that are no
+// longer allocated are cleared. This is called during reconstruction.
+func restoreChecksumTable(arenas []*arenaInfo) {
+	if !pmemChecksums.restore(pmemHeader.checksumTable, arenas, "checksum") {
+		return
+	}
+	entries := checksumEntries(pmemChecksums.table)
+	for i := range entries {
+		e := &entries[i]
+		if e.off == 0 {
+			continue
+		}
+		p := computeRootAddr(e.off, arenas)
+		if p == nil || !IsObjectStart(p) {
+			if !pmemInfo.readOnly {
+				e.off = 0
+				PersistRange(unsafe.Pointer(&e.off), intSize)
+			}
+			continue
+		}
+		atomic.Store(&pmemChecksums.enabled, 1)
+		addChecksumSpecial(p, uintptr(i))
+	}
+}
@@ -0,0 +1,84 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Persistent counters. A PmemCounter is a monotonic counter stored in its own
+// persistent memory object, which is registered as a named root so that the
+// counter is found after a restart. Each increment is persisted before the
+// new value is returned. As the counter only increases, the value persisted
+// by a flush is at least every value returned before the flush, even if other
+// goroutines increment the counter concurrently. So the counter found after a
+// crash is at least the last value that was returned, and no value is returned
+// twice. Values that were reserved but not returned before a crash are lost.
+
+// A lock to serialize the creation of counters, so that two goroutines that
+// create a counter with the same name get the same counter
+var pmemCounterLock mutex
+
+// PmemCounter is a durable monotonic counter in persistent memory. It is safe
+// for concurrent use by multiple goroutines.
+type PmemCounter struct {
+	val *uint64
+}
+
+// NewPmemCounter returns the persistent counter registered as the named root
+// 'name', and creates it if there is no such root. A new counter starts at 0,
+// so the first value returned by Next is 1. The root must have been set by
+// NewPmemCounter, and is subject to the limits of SetNamedRoot() on the name
+// and the number of named roots. NewPmemCounter returns ErrPmemOutOfSpace if
+// the counter cannot be allocated.
+func NewPmemCounter(name string) (*PmemCounter, error) {
+	if p := GetNamedRoot(name); p != nil {
+		return &PmemCounter{val: (*uint64)(p)}, nil
+	}
+	if pmemInfo.readOnly {
+		return nil, ErrPmemReadOnly
+	}
+
+	// As in PmemPin(), the counter is allocated without holding the lock
+	p := pnewSlot(uint64Type)
+	if p == nil {
+		return nil, ErrPmemOutOfSpace
+	}
+	lock(&pmemCounterLock)
+	defer unlock(&pmemCounterLock)
+	if q := GetNamedRoot(name); q != nil {
+		return &PmemCounter{val: (*uint64)(q)}, nil
+	}
+	PersistRange(p, unsafe.Sizeof(uint64(0)))
+	if err := SetNamedRoot(name, p); err != nil {
+		return nil, err
+	}
+	return &PmemCounter{val: (*uint64)(p)}, nil
+}
+
+// Next increments the counter and returns its new value. The value is
+// persistent when Next returns, at the cost of a cache line flush and a fence.
+func (c *PmemCounter) Next() uint64 {
+	return c.NextBatch(1)
+}
+
+// NextBatch reserves 'n' consecutive values of the counter using a single
+// flush, and returns the first of them. The counter is incremented by 'n', so
+// the next value returned is the last reserved value plus one. NextBatch
+// panics if 'n' is 0.
+func (c *PmemCounter) NextBatch(n uint64) uint64 {
+	if n == 0 {
+		panic(plainError("runtime: NextBatch called with a count of 0"))
+	}
+	if pmemInfo.readOnly {
+		panic(ErrPmemReadOnly)
+	}
+	v := atomic.Xadd64(c.val, int64(n))
+	PersistRange(unsafe.Pointer(c.val), unsafe.Sizeof(*c.val))
+	return v - n + 1
+}
+
+// Value returns the current value of the counter, which is the last value
+// returned or reserved.
+func (c *PmemCounter) Value() uint64 {
+	return atomic.Load64(c.val)
+}
@@ -0,0 +1,147 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Persistent memory debugging options. These are set using the GODEBUG
+// environment variable (see parsedebugvars()):
+//
+//	pmemcheck=1    checks the metadata logged for every persistent memory
+//	               allocation and span free, and throws at the first
+//	               inconsistency
+//	pmemverbose=1  prints every persistent memory span allocation and free,
+//	               every arena mapping, including the mappings that fail,
+//	               and the reset of a file whose first initialization was
+//	               interrupted, to standard error
+//	pmemfence=0    disables the fences issued after cache lines are flushed.
+//	               Persistent memory writes are then not durable in order,
+//	               so this is only meant to measure the cost of the fences.
+
+// Set to 1 if the heap type bits logged for each persistent memory allocation
+// are printed. See PmemTraceHeapBits().
+var pmemHeapBitsTrace uint32
+
+// PmemTraceHeapBits enables or disables printing the heap type bits logged for
+// each persistent memory allocation to standard error. For each allocation
+// that logs heap type bits, the address of the object, the size, pointer data
+// size and kind of its type, and either the type index of its span or the
+// logged heap type bit bytes are printed. The output is verbose, and is meant
+// for diagnosing the reconstruction of the heap type bits after a restart.
+func PmemTraceHeapBits(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.Store(&pmemHeapBitsTrace, v)
+}
+
+// traceHeapBits prints the heap type bits logged by logHeapBits() for the
+// object at 'addr' of type 'typ'. If the span of the object uses the optimized
+// type log, only the type index of the span is printed. Otherwise the 'n'
+// bytes of heap type bits starting at 'start' are printed.
+func traceHeapBits(addr uintptr, typ *_type, typIndex int, start *byte, n uintptr) {
+	print("pmem: heap bits addr=", hex(addr), " size=", typ.size, " ptrdata=",
+		typ.ptrdata, " kind=", typ.kind&kindMask)
+	if typIndex != 0 {
+		print(" typindex=", typIndex, "\n")
+		return
+	}
+	print(" bits=")
+	for i := uintptr(0); i < n; i++ {
+		if i != 0 {
+			print(",")
+		}
+		print(hex(*(*byte)(add(unsafe.Pointer(start), i))))
+	}
+	print("\n")
+}
+
+// pmemCheckAlloc checks the metadata logged for the persistent memory object
+// at 'x' allocated from the span 's', of which the first 'scanSize' bytes may
+// hold pointers. The span bitmap entry of the span is checked as PmemVerify()
+// does, and the heap type bits logged for the object are compared with the
+// heap type bits of the object. It is called by mallocgc() if pmemcheck is
+// set.
+func pmemCheckAlloc(s *mspan, x, scanSize uintptr, typ *_type) {
+	v := pmemVerifier{throwOnError: true}
+	sVal := *spanLogAddr(s)
+	if sVal == 0 {
+		v.report(s.base(), verifySpanNotLogged)
+	}
+	pa := pArenaOf(s.base())
+	v.verifySpan(pa, sVal, s.base())
+
+	// Heap type bits are logged per object only for small spans that do not
+	// use the optimized type log. Types with a GC program are not checked.
+	if scanSize == 0 || s.typIndex != 0 || s.spanclass.sizeclass() == 0 ||
+		typ.kind&kindGCProg != 0 {
+		return
+	}
+	start := heapBitsForAddr(x).bitp
+	end := heapBitsForAddr(x + scanSize - 1).bitp
+	n := uintptr(unsafe.Pointer(end)) - uintptr(unsafe.Pointer(start)) + 1
+	if !memequal(pmemHeapBitsAddr(x, pa), unsafe.Pointer(start), n) {
+		v.report(x, "logged heap type bits do not match the object")
+	}
+}
+
+// pmemCheckFree checks that the span bitmap entries of the pages of the
+// persistent memory span 's' are cleared after the span is freed. It is
+// called by freeSpanLocked() if pmemcheck is set.
+func pmemCheckFree(s *mspan) {
+	pa := pArenaOf(s.base())
+	bitmap := pa.spanBitmap()
+	first := (s.base() - pa.dataStart()) >> pageShift
+	for i := first; i < first+s.npages; i++ {
+		if bitmap[i] != 0 {
+			pmemCheckFailed(s.base()+(i-first)<<pageShift,
+				"span bitmap entry not cleared after the span is freed")
+		}
+	}
+}
+
+// pmemCheckFailed reports the inconsistency 'desc' found at 'addr' by the
+// pmemcheck checks and throws
+func pmemCheckFailed(addr uintptr, desc string) {
+	print("runtime: ", desc, " at ", hex(addr), "\n")
+	throw("inconsistent persistent memory metadata")
+}
+
+// pmemVerboseSpan prints the allocation or free of the persistent memory span
+// 's' if pmemverbose is set
+func pmemVerboseSpan(what string, s *mspan) {
+	if debug.pmemverbose == 0 {
+		return
+	}
+	print("pmem: span ", what, " base=", hex(s.base()), " npages=", s.npages,
+		" spanclass=", s.spanclass, "\n")
+}
+
+// pmemVerboseMapFailed prints that a persistent memory arena of 'size' bytes
+// could not be mapped at file offset 'off', and the space left in the file
+// below its size limit if it has one
+func pmemVerboseMapFailed(size, off uintptr) {
+	if debug.pmemverbose == 0 {
+		return
+	}
+	print("pmem: arena mapping failed size=", size, " offset=", off)
+	if l := pmemInfo.sizeLimit; l != 0 {
+		room := uintptr(0)
+		if l > off {
+			room = l - off
+		}
+		print(" room=", room)
+	}
+	print("\n")
+}
+
+// pmemVerboseArena prints the mapping of a persistent memory arena of 'size'
+// bytes at file offset 'off' to 'addr' if pmemverbose is set
+func pmemVerboseArena(addr, size, off uintptr) {
+	if debug.pmemverbose == 0 {
+		return
+	}
+	print("pmem: arena mapped addr=", hex(addr), " size=", size, " offset=", off, "\n")
+}
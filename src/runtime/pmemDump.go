@@ -0,0 +1,221 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+)
+
+// Implementation of PmemDumpLayout. It writes a textual map of each persistent
+// memory arena. Each arena is described by a header line followed by a list of
+// run-length encoded page runs:
+//
+//	arena <index> addr=<map address> size=<arena size> pages=<total pages>
+//	H <npages>          metadata pages (arena header, type and span bitmap)
+//	A <spc> <npages>    pages used by in-use spans of spanclass 'spc'
+//	F <npages>          free pages
+//	X <npages>          pages whose span bitmap entry is invalid
+//
+// Adjacent in-use spans with the same spanclass are merged into a single run so
+// that the output for a 64MB arena stays small enough to be scanned by eye. An
+// entry that does not describe a valid span (see validSpanLog()) is counted as
+// a single page, and the entry of the next page is decoded on its own.
+
+// PmemDumpLayout writes the page layout of the persistent memory heap to 'w',
+// which is typically an io.Writer. As in PmemDumpSpans(), the span bitmap
+// entries are read without holding the heap lock, so spans that are allocated
+// or freed concurrently may or may not be included.
+func PmemDumpLayout(w interface{ Write([]byte) (int, error) }) {
+	w.Write(appendPmemLayout(nil))
+}
+
+// The type of a page run written by appendPageRuns
+const (
+	layoutHeader  = 'H'
+	layoutAlloc   = 'A'
+	layoutFree    = 'F'
+	layoutInvalid = 'X'
+)
+
+func appendPmemLayout(b []byte) []byte {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return b
+	}
+	for i, pa := range pmemArenas() {
+		b = appendArenaLayout(b, i, pa)
+	}
+	return b
+}
+
+// appendArenaLayout appends the layout of the persistent memory arena 'pa'
+func appendArenaLayout(b []byte, idx int, pa *pArena) []byte {
+	mdSize, allocSize := pa.layout()
+	b = append(b, "arena "...)
+	b = appendIntStr(b, int64(idx), false)
+	b = append(b, " addr=0x"...)
+	b = appendHexStr(b, uint64(pa.mapAddr))
+	b = append(b, " size="...)
+	b = appendIntStr(b, int64(pa.size), false)
+	b = append(b, " pages="...)
+	b = appendIntStr(b, int64(pa.size>>pageShift), false)
+	b = append(b, '\n')
+	b = appendLayoutRun(b, layoutHeader, 0, mdSize>>pageShift)
+	bitmap := pa.spanBitmap()
+	if n := allocSize >> pageShift; n < uintptr(len(bitmap)) {
+		bitmap = bitmap[:n]
+	}
+	return appendPageRuns(b, bitmap)
+}
+
+// appendPageRuns appends the page runs of the span bitmap 'bitmap'
+func appendPageRuns(b []byte, bitmap []uint32) []byte {
+	var kind byte
+	var spc spanClass
+	var run uintptr
+	for i := uintptr(0); i < uintptr(len(bitmap)); {
+		n := uintptr(1)
+		k := byte(layoutFree)
+		var c spanClass
+		// Span bitmap entries are written atomically by logSpanAlloc()
+		if sVal := atomic.Load(&bitmap[i]); sVal != 0 {
+			var large bool
+			c, n, large, _, _ = spanLogDecode(sVal)
+			if validSpanLog(c, n, large) {
+				k = layoutAlloc
+			} else {
+				k, c, n = layoutInvalid, 0, 1
+			}
+		}
+		if i+n > uintptr(len(bitmap)) {
+			n = uintptr(len(bitmap)) - i
+		}
+		if run != 0 && (k != kind || c != spc) {
+			b = appendLayoutRun(b, kind, spc, run)
+			run = 0
+		}
+		kind, spc = k, c
+		run += n
+		i += n
+	}
+	if run != 0 {
+		b = appendLayoutRun(b, kind, spc, run)
+	}
+	return b
+}
+
+func appendLayoutRun(b []byte, kind byte, spc spanClass, npages uintptr) []byte {
+	b = append(b, kind)
+	if kind == layoutAlloc {
+		b = append(b, ' ')
+		b = appendIntStr(b, int64(spc), false)
+	}
+	b = append(b, ' ')
+	b = appendIntStr(b, int64(npages), false)
+	return append(b, '\n')
+}
+
+// Implementation of PmemDumpSpans. It writes one line for each arena and one
+// line for each non-zero span bitmap entry of the arena:
+//
+//	arena <index> addr=<map address> pages=<allocator usable pages>
+//	page=<index> addr=<span address> small spanclass=<spc> sizeclass=<sc> elemsize=<size> needzero=<0|1>
+//	page=<index> addr=<span address> large spanclass=<spc> npages=<npages> elemsize=<size> needzero=<0|1>
+//	page=<index> addr=<address> invalid value=<entry>
+//
+// The page index is relative to the first allocator usable page of the arena.
+
+// PmemDumpSpans writes the decoded span bitmap entries of all persistent memory
+// arenas to 'w', which is typically an io.Writer. The heap lock is held only
+// while the arena headers are collected. Entries are read without the lock, so
+// spans that are allocated or freed concurrently may or may not be included.
+func PmemDumpSpans(w interface{ Write([]byte) (int, error) }) {
+	w.Write(appendSpanDump(nil))
+}
+
+// PmemDumpSpansString returns the output of PmemDumpSpans as a string
+func PmemDumpSpansString() string {
+	return string(appendSpanDump(nil))
+}
+
+func appendSpanDump(b []byte) []byte {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return b
+	}
+	for i, pa := range pmemArenas() {
+		b = appendArenaSpans(b, i, pa)
+	}
+	return b
+}
+
+// pmemArenas returns the headers of all persistent memory arenas. The slice is
+// allocated before the heap lock is taken, as the lock must not be held while
+// allocating. Arenas added in between are not included.
+func pmemArenas() []*pArena {
+	n := 0
+	systemstack(func() {
+		lock(&mheap_.lock)
+		forEachPArena(func(pa *pArena) {
+			n++
+		})
+		unlock(&mheap_.lock)
+	})
+	arenas := make([]*pArena, 0, n)
+	systemstack(func() {
+		lock(&mheap_.lock)
+		forEachPArena(func(pa *pArena) {
+			if len(arenas) < cap(arenas) {
+				arenas = append(arenas, pa)
+			}
+		})
+		unlock(&mheap_.lock)
+	})
+	return arenas
+}
+
+func appendArenaSpans(b []byte, idx int, pa *pArena) []byte {
+	spanBase := pa.dataStart()
+	bitmap := pa.spanBitmap()
+	b = append(b, "arena "...)
+	b = appendIntStr(b, int64(idx), false)
+	b = append(b, " addr=0x"...)
+	b = appendHexStr(b, uint64(pa.mapAddr))
+	b = append(b, " pages="...)
+	b = appendIntStr(b, int64(len(bitmap)), false)
+	b = append(b, '\n')
+
+	for i := range bitmap {
+		// Span bitmap entries are written atomically by logSpanAlloc()
+		sVal := atomic.Load(&bitmap[i])
+		if sVal == 0 {
+			continue
+		}
+		b = append(b, "page="...)
+		b = appendIntStr(b, int64(i), false)
+		b = append(b, " addr=0x"...)
+		b = appendHexStr(b, uint64(spanBase+uintptr(i)<<pageShift))
+		spc, npages, large, needzero, _ := spanLogDecode(sVal)
+		if !validSpanLog(spc, npages, large) {
+			b = append(b, " invalid value=0x"...)
+			b = appendHexStr(b, uint64(sVal))
+			b = append(b, '\n')
+			continue
+		}
+		elemsize := npages << pageShift
+		if large {
+			b = append(b, " large spanclass="...)
+			b = appendIntStr(b, int64(spc), false)
+			b = append(b, " npages="...)
+			b = appendIntStr(b, int64(npages), false)
+		} else {
+			elemsize = uintptr(class_to_size[spc.sizeclass()])
+			b = append(b, " small spanclass="...)
+			b = appendIntStr(b, int64(spc), false)
+			b = append(b, " sizeclass="...)
+			b = appendIntStr(b, int64(spc.sizeclass()), false)
+		}
+		b = append(b, " elemsize="...)
+		b = appendIntStr(b, int64(elemsize), false)
+		b = append(b, " needzero="...)
+		b = appendIntStr(b, int64(bool2int(needzero)), false)
+		b = append(b, '\n')
+	}
+	return b
+}
@@ -0,0 +1,188 @@
+// +build pmemTest
+
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// A fault injection harness to test the crash consistency of persistent memory
+// updates. It is only built if the 'pmemTest' build tag is specified.
+//
+// While fault injection is active, all flushes done using PersistRange(),
+// PersistRanges() and FlushRange() are routed to faultFlush() instead of the
+// cache flush instructions or msync(). The harness simulates the persistent
+// memory device using a shadow copy of the persistent memory file. A flushed
+// range is copied to the shadow copy, so it only contains the writes that were
+// flushed. The device can be made to "crash" after a given number of flushes,
+// after which flushed ranges are no longer copied. The shadow copy is then the
+// contents the persistent memory file would have after a crash at that point,
+// and it can be written to a file and reopened to check that the persistent
+// data structures are consistent.
+//
+// Flushes are modeled as completing immediately, so reordering of flushes
+// between two fences is not simulated.
+
+const (
+	faultInjectEnabled = true
+
+	// The maximum number of flushed ranges that are recorded
+	maxFaultRanges = 1 << 16
+
+	// The number of bytes reserved in the shadow copy for arenas that are
+	// created while fault injection is active
+	faultHeadroom = 1 << 30
+)
+
+var faultInject struct {
+	// Set to 1 while fault injection is active
+	on uint32
+
+	// The number of flushes after which the simulated device crashes, or -1
+	// if the device should not crash.
+	crashAfter int64
+
+	// The number of flushes done since fault injection was started
+	flushes uint64
+
+	// The shadow copy of the persistent memory file. It is allocated outside
+	// the Go heap as flushes are done with the heap lock held.
+	shadow     uintptr
+	shadowSize uintptr
+
+	// The address and length of the flushed ranges. This is allocated outside
+	// the Go heap for the same reason as the shadow copy.
+	ranges *[maxFaultRanges][2]uintptr
+}
+
+// PmemFaultInject starts fault injection. The simulated persistent memory
+// device is initialized with the current contents of the persistent memory
+// file. If 'crashAfter' is not negative, the device crashes after that many
+// flushes, and any write flushed later is lost. This is only available if the
+// runtime is built with the 'pmemTest' build tag.
+func PmemFaultInject(crashAfter int) error {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return errorString("Persistent memory is not initialized")
+	}
+	if atomic.Load(&faultInject.on) != 0 {
+		return errorString("Fault injection is already active")
+	}
+
+	faultInject.crashAfter = int64(crashAfter)
+	faultInject.flushes = 0
+	systemstack(func() {
+		lock(&mheap_.lock)
+		size := pmemInfo.nextMapOffset + faultHeadroom
+		shadow := sysAlloc(size, &memstats.other_sys)
+		ranges := sysAlloc(unsafe.Sizeof(*faultInject.ranges), &memstats.other_sys)
+		if shadow == nil || ranges == nil {
+			throw("pmem fault injection: out of memory")
+		}
+		faultInject.shadow = uintptr(shadow)
+		faultInject.shadowSize = size
+		faultInject.ranges = (*[maxFaultRanges][2]uintptr)(ranges)
+		forEachPArena(func(pa *pArena) {
+			memmove(add(shadow, pa.fileOffset), unsafe.Pointer(pa.mapAddr), pa.size)
+		})
+		if pmemInfo.nextMapOffset == 0 {
+			// The file only contains the header
+			memmove(shadow, unsafe.Pointer(pmemHeader), pmemInfo.hdrRegionSize)
+		}
+		atomic.Store(&faultInject.on, 1)
+		unlock(&mheap_.lock)
+	})
+	return nil
+}
+
+// PmemFaultInjectStop stops fault injection. It returns the number of flushes
+// done while fault injection was active, the flushed ranges, and the contents
+// of the simulated persistent memory device. Only the first 65536 flushed
+// ranges are returned.
+func PmemFaultInjectStop() (flushes int, ranges []MemRange, image []byte) {
+	if atomic.Load(&faultInject.on) == 0 {
+		return 0, nil, nil
+	}
+	var size uintptr
+	systemstack(func() {
+		lock(&mheap_.lock)
+		atomic.Store(&faultInject.on, 0)
+		size = pmemInfo.nextMapOffset
+		if size == 0 {
+			size = pmemInfo.hdrRegionSize
+		}
+		unlock(&mheap_.lock)
+	})
+
+	image = make([]byte, size)
+	memmove(unsafe.Pointer(&image[0]), unsafe.Pointer(faultInject.shadow), size)
+	sysFree(unsafe.Pointer(faultInject.shadow), faultInject.shadowSize, &memstats.other_sys)
+	faultInject.shadow = 0
+
+	flushes = int(faultInject.flushes)
+	n := flushes
+	if n > maxFaultRanges {
+		n = maxFaultRanges
+	}
+	ranges = make([]MemRange, n)
+	for i := range ranges {
+		r := &faultInject.ranges[i]
+		ranges[i] = MemRange{unsafe.Pointer(r[0]), r[1]}
+	}
+	sysFree(unsafe.Pointer(faultInject.ranges), unsafe.Sizeof(*faultInject.ranges),
+		&memstats.other_sys)
+	faultInject.ranges = nil
+	return
+}
+
+// faultInjectActive reports whether flushes have to be routed to faultFlush()
+func faultInjectActive() bool {
+	return atomic.Load(&faultInject.on) != 0
+}
+
+// faultFlush simulates flushing the range of 'len' bytes at 'addr' to the
+// persistent memory device. The cache lines that cover the range are copied
+// to the shadow copy of the file, unless the device has crashed.
+func faultFlush(addr, len uintptr) {
+	n := atomic.Xadd64(&faultInject.flushes, 1)
+	if i := n - 1; i < maxFaultRanges {
+		faultInject.ranges[i] = [2]uintptr{addr, len}
+	}
+	if c := faultInject.crashAfter; c >= 0 && n > uint64(c) {
+		return
+	}
+
+	const lineSize = 64
+	start := addr &^ (lineSize - 1)
+	end := alignUp(addr+len, lineSize)
+	for start < end {
+		off, avail := faultFileOffset(start)
+		if avail == 0 {
+			return
+		}
+		n := end - start
+		if n > avail {
+			n = avail
+		}
+		if off+n <= faultInject.shadowSize {
+			memmove(unsafe.Pointer(faultInject.shadow+off), unsafe.Pointer(start), n)
+		}
+		start += n
+	}
+}
+
+// faultFileOffset returns the file offset of the persistent memory address
+// 'addr', and the number of bytes from 'addr' to the end of its mapping. It
+// returns 0 bytes if 'addr' is not a persistent memory address.
+func faultFileOffset(addr uintptr) (uintptr, uintptr) {
+	if hdr := uintptr(unsafe.Pointer(pmemHeader)); addr >= hdr && addr < hdr+pmemInfo.hdrRegionSize {
+		if pmemInfo.nextMapOffset == 0 {
+			return addr - hdr, hdr + pmemInfo.hdrRegionSize - addr
+		}
+	}
+	pa := pArenaOf(addr)
+	if pa == nil || addr < pa.mapAddr || addr >= pa.mapAddr+pa.size {
+		return 0, 0
+	}
+	return pa.fileOffset + addr - pa.mapAddr, pa.mapAddr + pa.size - addr
+}
@@ -0,0 +1,13 @@
+// +build !pmemTest
+
+package runtime
+
+// Fault injection is only available if the runtime is built with the
+// 'pmemTest' build tag. See pmemFaultInject.go.
+const faultInjectEnabled = false
+
+func faultInjectActive() bool {
+	return false
+}
+
+func faultFlush(addr, len uintptr) {}
@@ -3,6 +3,8 @@
 
 package runtime
 
+import "runtime/internal/atomic"
+
 const (
 	FLUSH_ALIGN = 64 // cache line size
 	MS_SYNC     = 4
@@ -52,6 +54,12 @@ func clflushopt(ptr uintptr)
 //go:noinline
 func compilerBarrier()
 
+//go:noescape
+func memmoveNT(dst, src, n uintptr)
+
+//go:noescape
+func memsetNT(dst, val, n uintptr)
+
 // msyncRange() flushes changes made to the in-core copy of a file that was
 // mapped into memory using mmap(2) back to the filesystem.
 func msyncRange(addr, len uintptr) (ret int) {
@@ -68,6 +76,7 @@ func msyncRange(addr, len uintptr) (ret int) {
 	// part of it may have been marked as undefined/inaccessible.  Msyncing such
 	// memory is not a bug.
 
+	atomic.Xadd64(&pmemInfo.msyncCalls, 1)
 	if ret = int(msync(uptr, len, MS_SYNC)); ret < 0 {
 		println("msync failed")
 	}
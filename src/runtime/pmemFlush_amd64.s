@@ -1,5 +1,7 @@
 // +build amd64
 
+#include "textflag.h"
+
 TEXT runtime·sfence(SB),$0
 	SFENCE
 	RET
@@ -24,3 +26,51 @@ TEXT runtime·clflushopt(SB), $0-8
 	// clflushopt BX
 	BYTE $0x66; BYTE $0x0F; BYTE $0xAE; BYTE $0x3B;
 	RET
+
+// func memmoveNT(dst, src, n uintptr)
+// Copies 'n' bytes from 'src' to 'dst' using non-temporal stores, which bypass
+// the CPU caches. 'dst' must be 64 byte aligned, and 'n' a multiple of 64. The
+// stores have to be followed by a store fence.
+TEXT runtime·memmoveNT(SB), NOSPLIT, $0-24
+	MOVQ	dst+0(FP), DI
+	MOVQ	src+8(FP), SI
+	MOVQ	n+16(FP), CX
+	SHRQ	$6, CX
+	JZ	done
+loop:
+	MOVOU	0(SI), X0
+	MOVOU	16(SI), X1
+	MOVOU	32(SI), X2
+	MOVOU	48(SI), X3
+	MOVNTO	X0, 0(DI)
+	MOVNTO	X1, 16(DI)
+	MOVNTO	X2, 32(DI)
+	MOVNTO	X3, 48(DI)
+	ADDQ	$64, SI
+	ADDQ	$64, DI
+	DECQ	CX
+	JNZ	loop
+done:
+	RET
+
+// func memsetNT(dst, val, n uintptr)
+// Sets 'n' bytes at 'dst' to the repeated 8 byte pattern 'val' using
+// non-temporal stores. 'dst' must be 64 byte aligned, and 'n' a multiple of 64.
+// The stores have to be followed by a store fence.
+TEXT runtime·memsetNT(SB), NOSPLIT, $0-24
+	MOVQ	dst+0(FP), DI
+	MOVQ	val+8(FP), X0
+	PUNPCKLQDQ	X0, X0
+	MOVQ	n+16(FP), CX
+	SHRQ	$6, CX
+	JZ	done
+loop:
+	MOVNTO	X0, 0(DI)
+	MOVNTO	X0, 16(DI)
+	MOVNTO	X0, 32(DI)
+	MOVNTO	X0, 48(DI)
+	ADDQ	$64, DI
+	DECQ	CX
+	JNZ	loop
+done:
+	RET
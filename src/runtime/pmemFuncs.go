@@ -4,6 +4,7 @@
 package runtime
 
 import (
+	"runtime/internal/atomic"
 	"unsafe"
 )
 
@@ -13,50 +14,83 @@ type fenceFunc func()
 var pmemFuncs struct {
 	flush flushFunc
 	fence fenceFunc
+
+	// The name of the cache flush primitive used by the flush function
+	kind string
+
+	// Set to true if the platform supports eADR
+	eadr bool
+
+	// The minimum number of bytes for which PmemMemmove() uses non-temporal
+	// stores. See SetPmemMemmoveThreshold().
+	ntThreshold uintptr
 }
 
-const (
-	// Block device compatibility mode
-	// In order to let application developers use our package even in those
-	// machines that do not have pmem, we are adding a block device
-	// compatibility mode. This mode gives a reduced consistency guarantee
-	// that the pmem application is resilient to application crashes or
-	// restart, but data can get irrecoverably corrupted in case of a host
-	// crash or restart. Therefore no need to msync data writes.
-	// See https://vmware.github.io/persistent-memory-projects/Block-Device-Compatibility/
-	blockDeviceCompatibility = true
-)
+// The default value of pmemFuncs.ntThreshold. For smaller copies, writing to
+// the CPU caches and flushing the written cache lines is faster (see
+// BenchmarkPmemMemmove).
+const defaultNTThreshold = 1024
 
 // The init function runs even before the main() function of the application is run.
+// It probes the CPU features (CPUID leaf 7) once and selects the best available
+// cache flush instruction. The preference order is clwb, clflushopt, and clflush.
 func init() {
 	// default functions
 	pmemFuncs.flush = flushClflush
 	// clflush does not require a fence, hence set default fence function as an
 	// empty function.
 	pmemFuncs.fence = fenceEmpty
-}
+	pmemFuncs.kind = "clflush"
+	pmemFuncs.ntThreshold = defaultNTThreshold
 
-// This function is used to set the flush and fence functions to be used
-// according to CPU/platform capabilities.
-func platformInit() {
 	// overwrite default functions depending on CPU features
 	if isCPUClfushoptPresent() {
 		pmemFuncs.flush = flushClflushopt
 		pmemFuncs.fence = memoryBarrier
+		pmemFuncs.kind = "clflushopt"
 	}
 
 	if isCPUClwbPresent() {
 		pmemFuncs.flush = flushClwb
 		pmemFuncs.fence = memoryBarrier
+		pmemFuncs.kind = "clwb"
 	}
+}
 
+// This function is used to set the flush and fence functions to be used
+// according to platform capabilities.
+func platformInit() {
 	hasEadr := pmemAutoFlush()
 	if hasEadr {
 		// If platform has eADR feature, then CPU caches are part of the
-		// persistence domain
+		// persistence domain and cache lines need not be flushed. A store
+		// fence is still required to preserve the ordering of stores to
+		// persistent memory.
 		pmemFuncs.flush = flushEmpty
-		pmemFuncs.fence = compilerBarrier
+		pmemFuncs.fence = memoryBarrier
+		pmemFuncs.kind = "none"
+		pmemFuncs.eadr = true
 	}
+	if debug.pmemfence == 0 {
+		// GODEBUG=pmemfence=0 disables fences, see pmemDebug.go
+		pmemFuncs.fence = fenceEmpty
+	}
+}
+
+// PmemHasEADR reports whether the platform supports eADR, in which case the
+// CPU caches are part of the persistence domain and the runtime does not flush
+// cache lines. This is known only after persistent memory is initialized.
+func PmemHasEADR() bool {
+	return pmemFuncs.eadr
+}
+
+// PmemFlushKind returns the name of the cache flush instruction used by the
+// runtime to flush persistent memory writes. It returns "clwb", "clflushopt",
+// or "clflush" depending on the CPU capabilities, and "none" if the platform
+// does not require cache lines to be flushed. It returns "" on platforms where
+// persistent memory is not supported.
+func PmemFlushKind() string {
+	return pmemFuncs.kind
 }
 
 // Flushing and fencing APIs exported
@@ -64,31 +98,200 @@ func platformInit() {
 // PersistRange - make any cached changes to a range of memory address persistent
 // 'addr' is the memory address to be flushed and 'len' is the length of the memory
 // address range to be flushed.
-// Depening on pmemInfo.isPmem. CPU flush instructions such as clflush() or the memory
-// flush function msync() will be called.
+// Depending on the sync mode and pmemInfo.isPmem, CPU flush instructions such as
+// clflush() or the memory flush function msync() will be called.
 func PersistRange(addr unsafe.Pointer, len uintptr) {
-	if pmemInfo.isPmem {
+	checkPersistedPointers(uintptr(addr), len)
+	start := opStatsStart()
+	if faultInjectEnabled && faultInjectActive() {
+		faultFlush(uintptr(addr), len)
+	} else if useMsync() {
+		msyncRange(uintptr(addr), len)
+	} else if pmemInfo.isPmem {
 		pmemFuncs.flush(uintptr(addr), len)
 		pmemFuncs.fence()
-	} else {
-		if blockDeviceCompatibility == false {
-			msyncRange(uintptr(addr), len)
+	}
+	opStatsDone(start, 1, len, 1)
+}
+
+// PersistRanges - make any cached changes to a set of memory address ranges
+// persistent. Cache lines of all the ranges are flushed first, followed by a
+// single fence. This amortizes the cost of the fence when several disjoint
+// ranges have to be persisted together.
+func PersistRanges(ranges []MemRange) {
+	checkPersistedRanges(ranges)
+	start := opStatsStart()
+	if faultInjectEnabled && faultInjectActive() {
+		for i := range ranges {
+			faultFlush(uintptr(ranges[i].Addr), ranges[i].Len)
+		}
+	} else if useMsync() {
+		for i := range ranges {
+			msyncRange(uintptr(ranges[i].Addr), ranges[i].Len)
+		}
+	} else if pmemInfo.isPmem {
+		for i := range ranges {
+			pmemFuncs.flush(uintptr(ranges[i].Addr), ranges[i].Len)
 		}
+		pmemFuncs.fence()
+	}
+	if start != 0 {
+		n := uintptr(0)
+		for i := range ranges {
+			n += ranges[i].Len
+		}
+		opStatsDone(start, uintptr(len(ranges)), n, 1)
 	}
 }
 
-// FlushRange - flush a range of persistent memory address
+// FlushRange - flush a range of persistent memory address. It does not issue a
+// fence, so the flushed range is not durable until a following Fence() call
+// returns. This allows a large buffer to be written sequentially and flushed
+// chunk by chunk as it is written, with a single Fence() at the end, as with
+// pmem_flush() and pmem_drain() of PMDK. If msync() is used to persist data,
+// the range is synced right away, so it is already durable when the following
+// Fence() call returns.
 func FlushRange(addr unsafe.Pointer, len uintptr) {
-	if pmemInfo.isPmem {
+	checkPersistedPointers(uintptr(addr), len)
+	start := opStatsStart()
+	if faultInjectEnabled && faultInjectActive() {
+		faultFlush(uintptr(addr), len)
+	} else if useMsync() {
+		msyncRange(uintptr(addr), len)
+	} else if pmemInfo.isPmem {
 		pmemFuncs.flush(uintptr(addr), len)
-	} else {
-		if blockDeviceCompatibility == false {
-			msyncRange(uintptr(addr), len)
-		}
 	}
+	opStatsDone(start, 1, len, 0)
 }
 
-// Fence - invoke a fence instruction
+// Fence - invoke a fence instruction. It waits for the flushes issued by the
+// preceding FlushRange() calls to complete.
 func Fence() {
+	start := opStatsStart()
 	pmemFuncs.fence()
+	opStatsDone(start, 0, 0, 1)
+}
+
+// PmemSync makes all writes to the persistent memory file durable. It is a
+// checkpoint for applications that write to persistent memory without
+// persisting each written range, e.g. to the reserved region. If the file is
+// not on a persistent memory device, or msync() is forced using
+// PmemSetSyncMode(), the header region and every arena of the file are synced
+// using msync(). Otherwise PmemSync only issues a fence. It does not flush any
+// cache line, so on a persistent memory device it is not a substitute for
+// flushing each write using FlushRange() or PersistRange(): it only ensures
+// that the flushes done before it have completed. PmemSync does nothing if the
+// file was opened using PmemOpenReadOnly().
+func PmemSync() error {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return errorString("Persistent memory is not initialized")
+	}
+	if pmemInfo.readOnly {
+		return nil
+	}
+	if pmemInfo.isPmem && !useMsync() {
+		Fence()
+		return nil
+	}
+
+	failed := msyncRange(uintptr(unsafe.Pointer(pmemHeader)), pmemInfo.hdrRegionSize) < 0
+	for _, pa := range pmemArenas() {
+		mapAddr := uintptr(unsafe.Pointer(pa)) - pa.headerOffset()
+		if msyncRange(mapAddr, pa.size) < 0 {
+			failed = true
+		}
+	}
+	if failed {
+		return errorString("Syncing persistent memory file failed")
+	}
+	return nil
+}
+
+// PmemMemmove copies 'n' bytes from 'src' to 'dst', and makes the copy at 'dst'
+// persistent. Copies of at least the threshold set by SetPmemMemmoveThreshold()
+// are done using non-temporal stores that bypass the CPU caches, so that the
+// copied cache lines need not be flushed afterwards. Smaller copies, and all
+// copies on platforms where the cache lines need not be flushed or are not
+// flushed using cache flush instructions, are done using memmove followed by
+// PersistRange(). The ranges may overlap. The copy is not visible to the
+// garbage collector, so the copied bytes must not hold pointers.
+func PmemMemmove(dst, src unsafe.Pointer, n uintptr) {
+	d, s := uintptr(dst), uintptr(src)
+	if !useNTStores(n) || (d > s && d < s+n) {
+		// Non-temporal stores are used only for forward copies
+		memmove(dst, src, n)
+		PersistRange(dst, n)
+		return
+	}
+	memmoveNTPersist(d, s, n)
+}
+
+// useNTStores reports whether a range of 'n' bytes should be written using
+// non-temporal stores. They are not used if the cache lines need not be flushed
+// or are not flushed using cache flush instructions.
+func useNTStores(n uintptr) bool {
+	return n >= pmemFuncs.ntThreshold && pmemInfo.isPmem && !pmemFuncs.eadr &&
+		!useMsync() && !(faultInjectEnabled && faultInjectActive())
+}
+
+// memmoveNTPersist copies 'n' bytes from 's' to 'd' and persists the copy. The
+// cache lines at 'd' that are completely overwritten are written using
+// non-temporal stores, and the partially overwritten cache lines at either end
+// are written using memmove and flushed.
+func memmoveNTPersist(d, s, n uintptr) {
+	head := alignUp(d, FLUSH_ALIGN) - d
+	if head > n {
+		head = n
+	}
+	body := (n - head) &^ (FLUSH_ALIGN - 1)
+	tail := n - head - body
+	if head != 0 {
+		memmove(unsafe.Pointer(d), unsafe.Pointer(s), head)
+		pmemFuncs.flush(d, head)
+	}
+	memmoveNT(d+head, s+head, body)
+	if tail != 0 {
+		memmove(unsafe.Pointer(d+head+body), unsafe.Pointer(s+head+body), tail)
+		pmemFuncs.flush(d+head+body, tail)
+	}
+	// Non-temporal stores always need a store fence, even if the flush
+	// instruction does not
+	sfence()
+}
+
+// memsetPersist sets the 'n' bytes starting at 'd' to 'c', and persists the
+// range.
+func memsetPersist(d uintptr, c byte, n uintptr) {
+	if !useNTStores(n) {
+		memsetBytes(d, c, n)
+		PersistRange(unsafe.Pointer(d), n)
+		return
+	}
+	memsetNTPersist(d, c, n)
+}
+
+// memsetNTPersist is like memmoveNTPersist(), but sets the bytes to 'c'
+func memsetNTPersist(d uintptr, c byte, n uintptr) {
+	head := alignUp(d, FLUSH_ALIGN) - d
+	if head > n {
+		head = n
+	}
+	body := (n - head) &^ (FLUSH_ALIGN - 1)
+	tail := n - head - body
+	if head != 0 {
+		memsetBytes(d, c, head)
+		pmemFuncs.flush(d, head)
+	}
+	memsetNT(d+head, uintptr(c)*0x0101010101010101, body)
+	if tail != 0 {
+		memsetBytes(d+head+body, c, tail)
+		pmemFuncs.flush(d+head+body, tail)
+	}
+	sfence()
+}
+
+// SetPmemMemmoveThreshold sets the minimum number of bytes for which
+// PmemMemmove() and PmemMemset() use non-temporal stores. The default is 1024 bytes.
+func SetPmemMemmoveThreshold(n uintptr) {
+	pmemFuncs.ntThreshold = n
 }
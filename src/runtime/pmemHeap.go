@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"runtime/internal/atomic"
+	"runtime/internal/math"
 	"unsafe"
 )
 
@@ -9,8 +10,14 @@ const (
 	// The size of the global header section in persistent memory file
 	pmemHeaderSize = unsafe.Sizeof(pHeader{})
 
-	// The size of the per-arena metadata excluding the span and type bitmap
+	// The size of the fixed part of the per-arena metadata, excluding the log
+	// slots and the span and type bitmaps
 	pArenaHeaderSize = unsafe.Sizeof(pArena{})
+
+	// The version of the layout of the persistent memory file. This has to be
+	// incremented whenever the layout of the header, the arena metadata, or
+	// the values logged in the span and type bitmaps change.
+	pmemFormatVersion = 15
 )
 
 // These constants indicate the possible swizzle state.
@@ -25,6 +32,7 @@ const (
 	initNotDone = iota // Persistent memory not initialiazed
 	initOngoing        // Persistent memory initialization ongoing
 	initDone           // Persistent memory initialization completed
+	initFailed         // Persistent memory initialization failed for good
 )
 
 const (
@@ -81,6 +89,31 @@ type pHeader struct {
 	// subsequent initialization of the persistent memory file.
 	magic int
 
+	// The size of the header region (pmemHeaderSize) when the file was created
+	hdrSize uintptr
+
+	// The size of the region reserved for the application that follows the
+	// header. See SetPmemReservedSize().
+	reservedSize uintptr
+
+	// The format version (pmemFormatVersion) of the file
+	formatVersion uint32
+
+	// The number of log slots in each arena header. See PmemOptions.LogSlots.
+	logSlots uint32
+
+	// A CRC32C checksum of the fields above. It is computed and persisted
+	// after all of them, so a checksum that matches proves that the header
+	// was completely initialized and has not been corrupted since.
+	hdrCRC uint32
+
+	// The initialization state of the header. It is set to initOngoing before
+	// the magic constant is persisted, and to initDone after the checksum is
+	// persisted. A header with a valid magic constant whose state is still
+	// initOngoing was being initialized when the first run of the application
+	// crashed. It is not covered by the checksum.
+	initState uint32
+
 	// The size of the file that is currently mapped into memory. This is used
 	// during reinitialization to identify if the file was externally truncated
 	// and to correctly map the file into memory.
@@ -105,6 +138,46 @@ type pHeader struct {
 	// 0 is used for types which are not cached, so we need to persist the
 	// mapping only for maxCacheTypes - 2 number of entries.
 	typeMap [maxCacheTypes - 2]uintptr
+
+	// typeDescs[i] describes the type cached at index i + 2. The heap type
+	// bits of the spans dedicated to a cached type are restored using it.
+	typeDescs [maxCacheTypes - 2]typeDesc
+
+	// The table of named application roots registered using SetNamedRoot().
+	// Like rootOffset, each entry stores the file offset of the root object.
+	namedRoots [maxNamedRoots]namedRoot
+
+	// The file offsets of the undo log buffers used by transactions. An
+	// offset is 0 if the log buffer is not yet allocated.
+	txLogs [maxTransactions]uintptr
+
+	// The file offset of the reference table that stores the reference counts
+	// of the objects allocated using PnewRC(), or 0 if it is not allocated.
+	refTable uintptr
+
+	// The file offset of the checksum table that stores the checksums of the
+	// objects allocated using PnewChecked(), or 0 if it is not allocated.
+	checksumTable uintptr
+
+	// The file offset of the pin table that records the objects pinned
+	// using PmemPin(), or 0 if it is not allocated.
+	pinTable uintptr
+
+	// The durable free lists of the objects released to a PmemPool
+	poolLists [maxPoolFreeLists]poolFreeList
+
+	// The version of the format of the application data in the file, set
+	// using PmemSetSchema(). It is 0 if the application never set it.
+	schemaVersion uint32
+
+	// The number of times the file was initialized by PmemInit without being
+	// opened read-only. See PmemEpoch().
+	epoch uint64
+
+	// The file offset of the timestamp table that stores the allocation
+	// times of the objects allocated using PnewTimed(), or 0 if it is not
+	// allocated.
+	timeTable uintptr
 }
 
 // Strucutre of a persistent memory arena header
@@ -134,12 +207,69 @@ type pArena struct {
 	// The number of bytes of data in this arena that have already been swizzled
 	bytesSwizzled uintptr
 
-	// The following data members are for supporting a minimal per-arena undo log
-	numLogEntries int         // Number of valid entries in the log section
-	logs          [2]logEntry // The actual log data
+	// The number of valid entries in the minimal per-arena undo log. The first
+	// entries are stored in the log slots that follow the arena header.
+	numLogEntries int
 
-	// This is followed by the heap type bits log and the span bitmap log which
-	// occupies a variable number of bytes depending on the size of the arena.
+	// The file offset of the spill buffer that holds the log entries that do
+	// not fit in the log slots. It is valid only if numLogEntries is larger
+	// than the number of log slots.
+	logSpill uintptr
+
+	// The number of pinned objects in this arena. An arena that holds pinned
+	// objects is never relocated. See PmemPin().
+	pinned uintptr
+
+	// This is followed by the log slots (see PmemOptions.LogSlots), and by the
+	// heap type bits log and the span bitmap log which occupies a variable
+	// number of bytes depending on the size of the arena.
+}
+
+// The modes that determine how writes to the persistent memory file are made
+// durable. See PmemSetSyncMode().
+const (
+	// Flush CPU cache lines if the file is on a persistent memory medium, and
+	// msync() the written ranges otherwise.
+	PmemSyncAuto = iota
+
+	// Block device compatibility mode
+	// In order to let application developers use our package even in those
+	// machines that do not have pmem, we are adding a block device
+	// compatibility mode. This mode gives a reduced consistency guarantee
+	// that the pmem application is resilient to application crashes or
+	// restart, but data can get irrecoverably corrupted in case of a host
+	// crash or restart. Therefore no need to msync data writes.
+	// See https://vmware.github.io/persistent-memory-projects/Block-Device-Compatibility/
+	PmemSyncNone
+
+	// Always msync() the written ranges, even if the file is on a persistent
+	// memory medium. This is intended to test the msync() path on machines
+	// that have persistent memory.
+	PmemSyncForce
+)
+
+// PmemSetSyncMode sets how writes to the persistent memory file are made
+// durable. 'mode' is one of PmemSyncAuto (the default), PmemSyncNone, or
+// PmemSyncForce. It is usually called before PmemInit(). msync() is only used
+// on linux/amd64.
+func PmemSetSyncMode(mode int) error {
+	if mode < PmemSyncAuto || mode > PmemSyncForce {
+		return errorString("Invalid persistent memory sync mode")
+	}
+	atomic.Store(&pmemInfo.syncMode, uint32(mode))
+	return nil
+}
+
+// useMsync reports whether msync() has to be used instead of cache flush
+// instructions to make writes to persistent memory durable.
+func useMsync() bool {
+	switch atomic.Load(&pmemInfo.syncMode) {
+	case PmemSyncForce:
+		return true
+	case PmemSyncAuto:
+		return !pmemInfo.isPmem
+	}
+	return false
 }
 
 // A volatile data-structure which stores all the necessary information about
@@ -152,6 +282,49 @@ var pmemInfo struct {
 	// and supports direct access (DAX)
 	isPmem bool
 
+	// The sync mode set using PmemSetSyncMode()
+	syncMode uint32
+
+	// The number of msync() calls made to persist writes
+	msyncCalls uint64
+
+	// The number of persistent memory allocations that failed as the heap
+	// could not grow
+	allocFailures uint64
+
+	// The size up to which the persistent memory file can grow, or 0 if it
+	// can grow until the device is full. See PmemOptions.MaxSize.
+	sizeLimit uintptr
+
+	// Set if the last arena of the file can be smaller than the size the heap
+	// asks for. See PmemOptions.ShortArenas.
+	shortArenas bool
+
+	// Set if the file was opened using PmemOpenReadOnly()
+	readOnly bool
+
+	// Set to 1 if persistent memory objects have to be cleared when they are
+	// freed by the garbage collector. See SetPmemZeroOnFree().
+	zeroOnFree uint32
+
+	// Set to 1 if arenas must be mapped at the address they were mapped at in
+	// the previous run. See SetPmemRelocation().
+	noRelocate uint32
+
+	// The size of the application reserved region of a new file. See
+	// SetPmemReservedSize().
+	reservedSize uintptr
+
+	// The number of log slots in each arena header. Before initialization, it
+	// is the count requested using PmemOptions.LogSlots, or 0 if none was
+	// requested. It is the count stored in the file once it is opened.
+	logSlots uintptr
+
+	// The size of the header, the application reserved region, and the
+	// padding that follows it, at the beginning of the file. The metadata of
+	// the first arena starts at this offset. See headerRegionSize().
+	hdrRegionSize uintptr
+
 	// Persistent memory initialization state
 	// This is used to prevent concurrent/multiple persistent memory initialization
 	initState uint32
@@ -167,26 +340,131 @@ var pmemInfo struct {
 	// garbage collection.
 	root unsafe.Pointer
 
-	// A lock to protect modifications to the root pointer
+	// The addresses of the named application roots. namedRoots[i] is the
+	// address of the root stored in entry i of the named root table in the
+	// header. Like 'root', this ensures that the named roots are not garbage
+	// collected.
+	namedRoots [maxNamedRoots]unsafe.Pointer
+
+	// A lock to protect modifications to the root pointer and the named roots
 	rootLock mutex
+
+	// Set if an ephemeral root was found in the named root table during
+	// reconstruction
+	ephemeralFound bool
+
+	// The validators registered using SetRootValidator(), and whether they
+	// rejected the root and each named root during reconstruction. A rejected
+	// root is still kept alive by 'root' or 'namedRoots', but GetRoot() and
+	// GetNamedRoot() return nil for it.
+	rootValidators     []rootValidator
+	rootRejected       bool
+	namedRootsRejected [maxNamedRoots]bool
+
+	// Set if the file was initialized by this run rather than reopened
+	created bool
+
+	// The size of the persistent memory file when it was opened. Arenas that
+	// are created in the file below this offset may hold stale data left by
+	// an earlier run, or garbage if the file was not created by the runtime.
+	staleSize uintptr
+
+	// The alignment of the mappings of the file if it is a device dax, or 0
+	// if it is a regular file
+	devDaxAlign uintptr
+
+	// Set once an arena of the file is added to the heap while it is being
+	// initialized. The heap cannot remove an arena, so a failed
+	// initialization cannot be retried after that.
+	arenasAdded bool
+
+	// Set to 1 if the arenas have to be mapped using huge pages. See
+	// PmemOptions.HugePages.
+	hugePages uint32
+
+	// Set to 1 if the kernel did not accept the huge page advice for an arena,
+	// or the arena is not aligned to a huge page
+	hugePagesDenied uint32
 }
 
 // PmemInit is the persistent memory initialization function.
 // It returns the application root pointer and an error value to indicate if
 // initialization was successful.
 // fname is the path to the file that has to be used as the persistent memory
-// medium.
+// medium. It can also be the path of a device dax character device (e.g.
+// /dev/dax0.0), whose size is the maximum size of the heap, as a device cannot
+// grow. A device dax cannot be opened read-only.
+// Only one persistent memory file can be used by a process. All persistent
+// memory allocations (pnew, pmake) are made from the single persistent memory
+// heap backed by this file, as the allocation builtins do not identify a
+// file. The per-arena metadata (span and heap type bitmaps, undo logs) is
+// already located using the address of an object, so supporting multiple
+// files requires a way to direct allocations to a particular file.
+// PmemInitOpts() initializes persistent memory with additional options.
+//
+// If several goroutines call PmemInit concurrently, only one of them
+// initializes persistent memory, and the others return ErrPmemAlreadyInit. If
+// initialization fails, persistent memory is left uninitialized and PmemInit
+// can be called again, e.g. after the file is repaired. The only exception is
+// a failure after some arenas of the file were added to the heap, which
+// cannot be undone; PmemInit then returns ErrPmemInitFailed in later calls.
 func PmemInit(fname string) (unsafe.Pointer, error) {
+	return pmemInit(fname, false, nil)
+}
+
+// pmemInit initializes persistent memory using the file 'fname'. If 'readOnly'
+// is set, the file must already be initialized, and is mapped such that it is
+// never modified. See PmemOpenReadOnly(). If 'apply' is not nil, it is called
+// to apply the initialization options once this call has started the
+// initialization, so that a concurrent initialization is not affected by them.
+func pmemInit(fname string, readOnly bool, apply func()) (unsafe.Pointer, error) {
 	if GOOS != "linux" || GOARCH != "amd64" {
-		return nil, errorString("Unsupported architecture")
+		return nil, ErrPmemUnsupportedArch
 	}
 
 	// Change persistent memory initialization state from not-done to ongoing
 	if !atomic.Cas(&pmemInfo.initState, initNotDone, initOngoing) {
-		return nil, errorString(`Persistent memory is already initialized
-				or initialization is ongoing`)
+		switch atomic.Load(&pmemInfo.initState) {
+		case initDone:
+			if fname != pmemInfo.fname {
+				return nil, ErrPmemOtherFile
+			}
+		case initFailed:
+			return nil, ErrPmemInitFailed
+		}
+		return nil, ErrPmemAlreadyInit
+	}
+	if apply != nil {
+		apply()
 	}
 
+	logSlots := pmemInfo.logSlots
+	root, err := initFile(fname, readOnly)
+	if err != nil {
+		// The file was unmapped by initFile()
+		pmemHeader = nil
+		if pmemInfo.arenasAdded {
+			atomic.Store(&pmemInfo.initState, initFailed)
+			return nil, err
+		}
+		pmemInfo.fname = ""
+		pmemInfo.readOnly = false
+		pmemInfo.devDaxAlign = 0
+		pmemInfo.staleSize = 0
+		pmemInfo.hdrRegionSize = 0
+		pmemInfo.isPmem = false
+		pmemInfo.created = false
+		pmemInfo.logSlots = logSlots
+		clearTypeMap()
+		atomic.Store(&pmemInfo.initState, initNotDone)
+	}
+	return root, err
+}
+
+// initFile initializes persistent memory using the file 'fname' once
+// pmemInit() has started the initialization. The file is unmapped if it
+// fails.
+func initFile(fname string, readOnly bool) (unsafe.Pointer, error) {
 	// platformInit() checks if the platform supports eADR. If not, the cache
 	// flush instruction is set according to the CPU capabilities.
 	platformInit()
@@ -194,31 +472,108 @@ func PmemInit(fname string) (unsafe.Pointer, error) {
 	// Set the persistent memory file name. This will be used to map the file
 	// into memory in growPmemRegion().
 	pmemInfo.fname = fname
+	pmemInfo.readOnly = readOnly
+	pmemInfo.devDaxAlign = getDevDaxAlign(fname)
+	if readOnly && pmemInfo.devDaxAlign != 0 {
+		return nil, errorString("A device dax cannot be opened read-only")
+	}
 
 	// Map the header section of the file to identify if this is a first-time
-	// initialization.
-	mapAddr, isPmem, err := mapFile(fname, int(pmemHeaderSize), fileCreate,
+	// initialization. If the file does not exist, mapFile() creates it and
+	// extends it to hold the header before it is mapped.
+	fileSize := getFileSize(fname)
+	exists := fileSize >= 0
+	if exists {
+		pmemInfo.staleSize = uintptr(fileSize)
+	}
+	mapAddr, isPmem, err := mapFile(fname, int(pmemHeaderSize), fileMapFlags(),
 		_DEFAULT_FMODE, 0, nil)
 	if err != 0 {
-		return nil, errorString("Mapping persistent memory file failed")
+		switch {
+		case !exists && readOnly:
+			return nil, errorString("Persistent memory file does not exist")
+		case !exists:
+			return nil, errorString("Creating persistent memory file failed")
+		case readOnly:
+			return nil, errorString("Mapping persistent memory file failed")
+		}
+		return nil, errorString("Extending or mapping persistent memory file failed")
 	}
 	pmemHeader = (*pHeader)(mapAddr)
 	pmemInfo.isPmem = isPmem
 
 	var gcp int
 	firstInit := pmemHeader.magic != hdrMagic
+	pmemInfo.hdrRegionSize = pmemHeaderSize
+	if firstInit && readOnly {
+		unmapHeader()
+		return nil, errorString("Persistent memory file is not initialized")
+	}
+	if !firstInit && pmemHeader.initState == initOngoing {
+		// The first run crashed while initializing the header. No arena is
+		// created until initialization completes, so the file holds no data
+		// and is initialized again.
+		if readOnly || pmemHeader.mappedSize != headerRegionSize(pmemHeader.reservedSize) {
+			unmapHeader()
+			return nil, ErrPmemIncompleteInit
+		}
+		if debug.pmemverbose != 0 {
+			print("pmem: resetting partially initialized file\n")
+		}
+		firstInit = true
+	}
 	if firstInit {
 		// First time initialization
-		// Store the mapped size in the header section
-		pmemHeader.mappedSize = pmemHeaderSize
-		PersistRange(unsafe.Pointer(&pmemHeader.mappedSize), intSize)
-
-		// Store the magic constant in the header section
-		pmemHeader.magic = hdrMagic
-		PersistRange(unsafe.Pointer(&pmemHeader.magic), intSize)
+		// The file is extended to hold the reserved region before the magic
+		// constant is persisted.
+		reserved := atomic.Loaduintptr(&pmemInfo.reservedSize)
+		if reserved > maxAlloc {
+			unmapHeader()
+			return nil, ErrPmemReservedTooLarge
+		}
+		if err := mapHeaderRegion(reserved); err != nil {
+			return nil, err
+		}
+		if pmemInfo.logSlots == 0 {
+			pmemInfo.logSlots = defaultLogSlots
+		}
+		if pmemInfo.staleSize != 0 {
+			// The header of an existing file may hold garbage in the fields
+			// that init() does not set
+			memclrNoHeapPointers(unsafe.Pointer(pmemHeader), pmemHeaderSize)
+			PersistRange(unsafe.Pointer(pmemHeader), pmemHeaderSize)
+		}
+		pmemHeader.init(reserved)
+		pmemInfo.created = true
 		println("First time initialization")
 	} else {
 		println("Not a first time intialization")
+		if pmemHeader.hdrCRC != pmemHeader.checksum() {
+			unmapHeader()
+			return nil, ErrPmemHeaderCorrupt
+		}
+		if v := pmemHeader.formatVersion; v != pmemFormatVersion {
+			unmapHeader()
+			return nil, pmemVersionError{v, pmemFormatVersion}
+		}
+		// The reserved region cannot be resized, as the first arena starts
+		// right after it and the arenas are located by their file offsets
+		if n := atomic.Loaduintptr(&pmemInfo.reservedSize); n != 0 && n != pmemHeader.reservedSize {
+			unmapHeader()
+			return nil, ErrPmemReservedSize
+		}
+		if n := pmemHeader.logSlots; n == 0 || n > maxLogSlots {
+			unmapHeader()
+			return nil, ErrPmemHeaderCorrupt
+		}
+		if n := pmemInfo.logSlots; n != 0 && n != uintptr(pmemHeader.logSlots) {
+			unmapHeader()
+			return nil, ErrPmemLogSlots
+		}
+		pmemInfo.logSlots = uintptr(pmemHeader.logSlots)
+		if err := mapHeaderRegion(pmemHeader.reservedSize); err != nil {
+			return nil, err
+		}
 		err := verifyMetadata()
 		if err != nil {
 			unmapHeader()
@@ -229,14 +584,7 @@ func PmemInit(fname string) (unsafe.Pointer, error) {
 		gcp = int(setGCPercent(-1))
 
 		// Restore the type information
-		for i := 0; i < maxCacheTypes-2; i++ {
-			if pmemHeader.typeMap[i] == 0 {
-				break
-			}
-			typOffset := pmemHeader.typeMap[i]
-			typAssigns[typOffset] = i + 2
-			numAssigned++
-		}
+		restoreTypeMap()
 
 		// Map all arenas found in the persistent memory file to memory. This
 		// function creates spans for the in-use regions of memory in the
@@ -245,19 +593,158 @@ func PmemInit(fname string) (unsafe.Pointer, error) {
 		err = mapArenas()
 		if err != nil {
 			unmapHeader()
+			if !pmemInfo.arenasAdded {
+				setGCPercent(int32(gcp))
+			}
 			return nil, err
 		}
 	}
+	// Start a new epoch of the file
+	if !readOnly {
+		atomic.Xadd64(&pmemHeader.epoch, 1)
+		PersistRange(unsafe.Pointer(&pmemHeader.epoch), unsafe.Sizeof(pmemHeader.epoch))
+	}
+
 	// TODO - Set persistent memory as initialized
 	atomic.Store(&pmemInfo.initState, initDone)
 	go typeProfileThread()
+	pmemGrowNotify()
 
 	if !firstInit {
 		// Enable garbage collection
 		enableGC(gcp)
 	}
 
-	return pmemInfo.root, nil
+	return GetRoot(), nil
+}
+
+// fileMapFlags returns the flags with which the persistent memory file is
+// mapped by mapFile()
+func fileMapFlags() int {
+	if pmemInfo.readOnly {
+		return fileReadOnly
+	}
+	return fileCreate
+}
+
+// sysMapPmem maps 'n' bytes of the persistent memory file at the reserved
+// address 'v', starting at the offset at which the file has to be mapped next.
+// It returns false if the file cannot be extended, e.g. because the device the
+// file is on is full.
+func sysMapPmem(v unsafe.Pointer, n uintptr, sysStat *uint64) bool {
+	if l := pmemInfo.sizeLimit; l != 0 && pmemInfo.nextMapOffset+n > l {
+		return false
+	}
+	p, isPmem, err := mapFile(pmemInfo.fname, int(n), fileMapFlags(),
+		_DEFAULT_FMODE, pmemInfo.nextMapOffset, v)
+	if err != 0 {
+		return false
+	}
+	if p != v {
+		throw("runtime: cannot map pages in arena address space")
+	}
+	pmemInfo.isPmem = isPmem
+	adviseArena(v, n)
+	mSysStatInc(sysStat, n)
+	return true
+}
+
+// shortArenaSize returns the size of a persistent memory arena smaller than
+// the 'size' bytes that could not be mapped, if short arenas are enabled. The
+// arena uses the space left in the file below its size limit, rounded down to
+// whole palloc chunks. It must be at least heapArenaBytes long, and must hold
+// the 'ask' bytes the heap grows by after its metadata. shortArenaSize returns
+// 0 if there is no such arena. The heap lock must be held.
+func shortArenaSize(ask, size uintptr) uintptr {
+	l := pmemInfo.sizeLimit
+	if !pmemInfo.shortArenas || l <= pmemInfo.nextMapOffset {
+		return 0
+	}
+	room := alignDown(l-pmemInfo.nextMapOffset, pallocChunkBytes)
+	if room >= size || room < heapArenaBytes {
+		return 0
+	}
+	offset := uintptr(0)
+	if pmemInfo.nextMapOffset == 0 {
+		offset = pmemInfo.hdrRegionSize
+	}
+	if _, usable := arenaLayout(room, offset, arenaHeaderSize()); usable < ask {
+		return 0
+	}
+	return room
+}
+
+// The size of the huge pages that persistent memory arenas are mapped with if
+// PmemOptions.HugePages is set
+const pmemHugePageSize = 2 << 20
+
+// adviseArena asks the kernel to map the 'n' bytes of the persistent memory
+// arena at 'addr' using huge pages, if huge pages are enabled. The runtime
+// page size (pageSize) is independent of the page size of the mapping, so the
+// arena metadata is laid out the same way either way.
+func adviseArena(addr unsafe.Pointer, n uintptr) {
+	if atomic.Load(&pmemInfo.hugePages) == 0 {
+		return
+	}
+	if uintptr(addr)%pmemHugePageSize != 0 || !adviseHugePages(addr, n) {
+		atomic.Store(&pmemInfo.hugePagesDenied, 1)
+	}
+}
+
+// mapPageSize returns the page size that the persistent memory arenas are
+// advised to be mapped with
+func mapPageSize() uintptr {
+	if atomic.Load(&pmemInfo.hugePages) == 0 || atomic.Load(&pmemInfo.hugePagesDenied) != 0 {
+		return physPageSize
+	}
+	return pmemHugePageSize
+}
+
+// pmemAllocFailed is called by mallocgc if a persistent memory allocation
+// fails. It releases 'mp' and returns the nil pointer returned by mallocgc.
+func pmemAllocFailed(mp *m) unsafe.Pointer {
+	mp.mallocing = 0
+	releasem(mp)
+	atomic.Xadd64(&pmemInfo.allocFailures, 1)
+	return nil
+}
+
+// pmemAllocError returns the error with which the pnew and pmake builtins panic
+// if a persistent memory allocation fails
+func pmemAllocError() error {
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+	return ErrPmemOutOfSpace
+}
+
+// headerRegionSize returns the size of the region at the beginning of the file
+// that holds the header and an application reserved region of 'reserved'
+// bytes. The region is rounded up to a multiple of the word size, so that the
+// metadata of the first arena that follows it is aligned. The allocator usable
+// region of the arena is further rounded up to a page by pArena.layout(). The
+// padding is used by neither the application nor the runtime.
+func headerRegionSize(reserved uintptr) uintptr {
+	return alignUp(pmemHeaderSize+reserved, intSize)
+}
+
+// mapHeaderRegion maps the header region of the file, which includes an
+// application reserved region of 'reserved' bytes, in place of the header
+// mapped by PmemInit.
+func mapHeaderRegion(reserved uintptr) error {
+	size := headerRegionSize(reserved)
+	if size == pmemHeaderSize {
+		return nil
+	}
+	unmapHeader()
+	mapAddr, _, err := mapFile(pmemInfo.fname, int(size), fileMapFlags(),
+		_DEFAULT_FMODE, 0, nil)
+	if err != 0 {
+		return errorString("Extending or mapping persistent memory file failed")
+	}
+	pmemHeader = (*pHeader)(mapAddr)
+	pmemInfo.hdrRegionSize = size
+	return nil
 }
 
 // Arena information structure which will be used during reconstruction and
@@ -283,7 +770,7 @@ func mapArenas() error {
 	// A slice containing information about each mapped arena
 	var arenas []*arenaInfo
 
-	if pmemHeader.mappedSize == pmemHeaderSize {
+	if pmemHeader.mappedSize == pmemInfo.hdrRegionSize {
 		// The persistent memory file contains only the header section and does
 		// not contain any arenas.
 		return nil
@@ -297,10 +784,10 @@ func mapArenas() error {
 		// arena at the map address.
 		var offset uintptr
 		if mapped == 0 {
-			offset = pmemHeaderSize
+			offset = pmemInfo.hdrRegionSize
 		}
 		mapAddr, _, err := mapFile(pmemInfo.fname, int(pArenaHeaderSize+offset),
-			fileCreate, _DEFAULT_FMODE, mapped, nil)
+			fileMapFlags(), _DEFAULT_FMODE, mapped, nil)
 		if err != 0 {
 			unmapArenas(arenas)
 			return errorString("Arena mapping failed")
@@ -315,16 +802,30 @@ func mapArenas() error {
 			addrOffset += (1 * 1024 * 1024 * 1024)
 		}
 		arenaMapAddr := unsafe.Pointer(parena.mapAddr + addrOffset)
+		pinned := parena.pinned != 0
+		if pinned {
+			// An arena that holds pinned objects is never relocated
+			arenaMapAddr = unsafe.Pointer(parena.mapAddr)
+		}
 		arenaSize := parena.size
-		munmap(mapAddr, pArenaHeaderSize+offset)
+		unmapFile(mapAddr, pArenaHeaderSize+offset)
 
 		// Try mapping the arena at the exact address it was mapped previously
-		// mapFile() will fail if the file cannot be mapped at the requested address
-		mapAddr, _, err = mapFile(pmemInfo.fname, int(arenaSize), fileCreate,
-			_DEFAULT_FMODE, mapped, arenaMapAddr)
+		// mapFile() will fail if the file cannot be mapped at the requested
+		// address, or if any part of the address range is already in use.
+		mapAddr, _, err = mapFile(pmemInfo.fname, int(arenaSize),
+			fileMapFlags()|fileNoReplace, _DEFAULT_FMODE, mapped, arenaMapAddr)
 		if err != 0 {
+			if pinned {
+				unmapArenas(arenas)
+				return ErrPmemPinned
+			}
+			if atomic.Load(&pmemInfo.noRelocate) != 0 {
+				unmapArenas(arenas)
+				return ErrPmemRelocation
+			}
 			// Try mapping the arena again, but at any address
-			mapAddr, _, err = mapFile(pmemInfo.fname, int(arenaSize), fileCreate,
+			mapAddr, _, err = mapFile(pmemInfo.fname, int(arenaSize), fileMapFlags(),
 				_DEFAULT_FMODE, mapped, nil)
 			if err != 0 {
 				unmapArenas(arenas)
@@ -332,17 +833,29 @@ func mapArenas() error {
 			}
 		}
 
+		// Point the arena header at the actual mapped region
+		parena = (*pArena)(unsafe.Pointer(uintptr(mapAddr) + offset))
+
+		// Check that the span bitmap can be decoded before any span in this
+		// arena is created
+		if err := parena.validateSpanBitmap(); err != nil {
+			unmapFile(mapAddr, arenaSize)
+			unmapArenas(arenas)
+			return err
+		}
+
 		// Create the volatile memory arena datastructures for the newly mapped
 		// heap regions. Each volatile arena datastructure contains the runtime
 		// heap type bitmap and span table for the region it manages.
+		adviseArena(mapAddr, arenaSize)
+		pmemInfo.arenasAdded = true
 		lock(&h.lock)
 		h.createArenaMetadata(mapAddr, arenaSize)
 		unlock(&h.lock)
+		pmemVerboseArena(uintptr(mapAddr), arenaSize, mapped)
 
 		mapped += arenaSize
 
-		// Point the arena header at the actual mapped region
-		parena = (*pArena)(unsafe.Pointer(uintptr(mapAddr) + offset))
 		// arenaInfo struct and the pointers within it are garbage-collected
 		// once this function returns
 		ar := &arenaInfo{pa: parena, mapAddr: uintptr(mapAddr), bitsArray: make([]byte, 1024)}
@@ -360,9 +873,11 @@ func mapArenas() error {
 	err := swizzleArenas(arenas)
 	if err != nil {
 		unmapArenas(arenas)
+		return err
 	}
 
-	return err
+	pmemGrowAdd(len(arenas), mapped)
+	return nil
 }
 
 // A helper function that iterates the arena slice and unmaps all of them
@@ -371,14 +886,24 @@ func unmapArenas(arenas []*arenaInfo) {
 		pa := ar.pa
 		mapAddr := unsafe.Pointer(pa.mapAddr)
 		mapSize := pa.size
-		munmap(mapAddr, mapSize)
+		unmapFile(mapAddr, mapSize)
 	}
 }
 
 // A helper function that unmaps the header section of the persistent memory
 // file in case any errors happen during the reconstruction process.
 func unmapHeader() {
-	munmap(unsafe.Pointer(pmemHeader), pmemHeaderSize)
+	unmapFile(unsafe.Pointer(pmemHeader), pmemInfo.hdrRegionSize)
+}
+
+// unmapFile unmaps the 'n' bytes of the persistent memory file mapped at
+// 'addr'. The mappings of a device dax span whole units of its alignment (see
+// mapDevDax()), and the kernel cannot split them, so they are unmapped whole.
+func unmapFile(addr unsafe.Pointer, n uintptr) {
+	if a := pmemInfo.devDaxAlign; a != 0 {
+		n = alignUp(n, a)
+	}
+	munmap(addr, n)
 }
 
 // This function goes through the span bitmap found in the arena header, and
@@ -396,89 +921,80 @@ func (ar *arenaInfo) reconstruct() {
 	h.pages[isPersistent].allocRange(ar.mapAddr, (mdata+allocSize)/pageSize)
 	unlock(&h.lock)
 
+	// A persistent memory arena can be larger than a heap arena, and a large
+	// span within it can cover several heap arenas. Record the arena header in
+	// every heap arena covered by this arena so that any address within a
+	// reconstructed span can be resolved to its arena header.
+	for ai := arenaIndex(ar.mapAddr); ai <= arenaIndex(ar.mapAddr+pa.size-1); ai++ {
+		arena := mheap_.arenas[ai.l1()][ai.l2()]
+		arena.pArena = (uintptr)(unsafe.Pointer(pa))
+	}
+
 	// jerrin XXX TODO
 	mSysStatInc(&memstats.heap_inuse, allocSize)
+	pmemUsageAdd(int64(allocSize))
+
+	// The free pages of the arena may hold objects freed in an earlier run.
+	// The page allocator treats pages beyond zeroedBase as zeroed, so mark
+	// the whole arena as dirty before the free pages are released to it.
+	markNotZeroed(ar.mapAddr, pa.size)
 	//mSysStatDec(&memstats.heap_idle, allocSize)
 	atomic.Xadd64(&mheap_.pagesInUse, int64(allocSize/pageSize))
 
-	// We need to add the space occupied by the common persistent memory header
-	// for the first arena.
-	var off uintptr
-	if pa.fileOffset == 0 {
-		off = pmemHeaderSize
-	}
-
-	// Compute the address of the span bitmap within the arena header.
-	typeEntries := allocSize / bytesPerBitmapByte
-	typeBitsAddr := ar.mapAddr + off + pArenaHeaderSize
-	spanBitsAddr := unsafe.Pointer(typeBitsAddr + typeEntries)
-	spanBitmap := (*(*[1 << 28]uint32)(spanBitsAddr))[:allocPages]
-
-	// Iterate over the span bitmap log and recreate spans one by one
-	var i, j uintptr
-	for i < allocPages {
-		sval := spanBitmap[i]
+	// Iterate over the span bitmap log and recreate spans one by one. A zero
+	// entry marks a free page, and each run of consecutive free pages is
+	// returned to the page allocator as a single free span. Freeing the pages
+	// one at a time would leave the page allocator with only single page free
+	// spans until they are merged again.
+	spanBitmap := pa.spanBitmap()
+	for i := uintptr(0); i < allocPages; {
 		addr := spanBase + (i << pageShift)
-		if sval == 0 {
-			for j = i + 1; j < allocPages; j++ {
-				if spanBitmap[j] != 0 {
-					break
-				}
-			}
-			npages := (j - i)
+		npages, free := nextSpanRun(spanBitmap, i)
+		if free {
 			lock(&h.lock)
-			// TODO jerrin XXX
-			// since you are freeing spans here, maybe initially you should mark
-			// all pages as allocated
-			// TODO XXX jerrin this ends up creating a span -- not necessary ?
-			// are there any costs to creating a span
 			freeSpan(npages, addr, 1, (uintptr)(unsafe.Pointer(pa)))
 			unlock(&h.lock)
-			i += npages
 		} else {
-			s := pa.createSpan(sval, addr)
-			//h.pages[isPersistent].allocRange(s.base(), s.npages)
-			// TODO
-			// s.pArena = (uintptr)(unsafe.Pointer(pa))
-			// TODO xxx jerrin iterate over all the possible arenas
-			// can span be bigger than 64 mb?
-			// better still would be to do this just at the pmem arena level
-			ai := arenaIndex(addr)
-			arenaT := mheap_.arenas[ai.l1()][ai.l2()]
-			arenaT.pArena = (uintptr)(unsafe.Pointer(pa))
+			s := pa.createSpan(spanBitmap[i], addr)
 
 			// The heap type bits need to be restored only if the span is known
-			// to have pointers in it.
-			if !s.spanclass.noscan() {
+			// to have pointers in it, or if it can hold tiny blocks (see
+			// logTinyBlock()).
+			if !s.spanclass.noscan() || s.spanclass == tinySpanClass {
 				ar.restoreSpanHeapBits(s)
 			}
-			i += s.npages
 		}
+		i += npages
 	}
 }
 
+// nextSpanRun returns the number of pages covered by the span that starts at
+// page 'i' of the span bitmap 'bitmap'. If page 'i' is free, it instead returns
+// the number of consecutive free pages that start at it, and 'free' is set.
+func nextSpanRun(bitmap []uint32, i uintptr) (npages uintptr, free bool) {
+	if sVal := bitmap[i]; sVal != 0 {
+		_, npages, _, _, _ = spanLogDecode(sVal)
+		return npages, false
+	}
+	j := i + 1
+	for j < uintptr(len(bitmap)) && bitmap[j] == 0 {
+		j++
+	}
+	return j - i, true
+}
+
 // createSpan figures out the properties of the span to be reconstructed such as
 // spanclass, number of pages, the needzero value, etc. and calls the core
 // reconstruction function createSpanCore.
 func (pa *pArena) createSpan(sVal uint32, baseAddr uintptr) *mspan {
-	var npages uintptr
-	var spc spanClass
-	large := false
-	needzero := (sVal & 1) == 1
-	if sVal > maxSmallSpanLogVal { // large allocation
-		large = true
-		noscan := (sVal >> 2 & 1) == 1
-		npages = uintptr((sVal >> 3) - 67 + 4)
-		spc = makeSpanClass(0, noscan)
-	} else {
-		npages = uintptr(class_to_allocnpages[sVal>>3])
-		spc = spanClass(sVal >> 2)
-	}
+	spc, npages, large, needzero, optType := spanLogDecode(sVal)
 	typIndex := 0
-	if sVal>>1&1 != 0 {
+	if optType {
 		// Span uses optimized heap type bit logging. Find out the type index
-		typAddr := pmemHeapBitsAddr(baseAddr, pa)
-		typIndex = *(*int)(typAddr)
+		typIndex = (*spanTypeLog)(pmemHeapBitsAddr(baseAddr, pa)).typIndex
+		if typIndex <= 0 || typIndex >= maxCacheTypes {
+			throw("Invalid type index in span heap type bits")
+		}
 	}
 
 	return createSpanCore(spc, baseAddr, npages, large, needzero, typIndex)
@@ -596,6 +1112,47 @@ func createSpanCore(spc spanClass, base, npages uintptr, large, needzero bool, t
 	return s
 }
 
+// markNotZeroed records that the 'size' bytes of persistent memory at 'base'
+// may not be zero, so that the page allocator zeroes the pages in the range
+// before they are allocated. See mheap.allocNeedsZero().
+func markNotZeroed(base, size uintptr) {
+	for size > 0 {
+		ai := arenaIndex(base)
+		ha := mheap_.arenas[ai.l1()][ai.l2()]
+		arenaBase := base % heapArenaBytes
+		arenaLimit := arenaBase + size
+		if arenaLimit > heapArenaBytes {
+			arenaLimit = heapArenaBytes
+		}
+		// zeroedBase is monotonically increasing
+		for {
+			zeroedBase := atomic.Loaduintptr(&ha.zeroedBase)
+			if zeroedBase >= arenaLimit ||
+				atomic.Casuintptr(&ha.zeroedBase, zeroedBase, arenaLimit) {
+				break
+			}
+		}
+		base += arenaLimit - arenaBase
+		size -= arenaLimit - arenaBase
+	}
+}
+
+// clearStaleArena prepares the file region of a new arena of 'size' bytes
+// mapped at 'mapAddr', if the region was part of the file when it was opened.
+// The arena header and metadata, which would otherwise be read as the undo log,
+// the span bitmap, and the heap type bits of the arena after a restart, are
+// cleared. The pages of the arena are marked as needing to be zeroed before
+// use. This must be called before the arena header is initialized.
+func (pa *pArena) clearStaleArena(size, mapAddr, fileOffset uintptr) {
+	*pa = pArena{size: size, mapAddr: mapAddr, fileOffset: fileOffset}
+	mdata, _ := pa.layout()
+	mdEnd := mapAddr + mdata
+	mdStart := uintptr(unsafe.Pointer(pa)) + arenaHeaderSize()
+	memclrNoHeapPointers(unsafe.Pointer(mdStart), mdEnd-mdStart)
+	PersistRange(unsafe.Pointer(pa), mdEnd-uintptr(unsafe.Pointer(pa)))
+	markNotZeroed(mapAddr, size)
+}
+
 // freeSpan() is used to put back trimmed out regions of a span back into the
 // memory allocator free list/treap. 'npages' is the number of pages in the trimmed
 // region, and 'base' is its start address.
@@ -615,6 +1172,10 @@ func freeSpan(npages, base uintptr, needzero uint8, parena uintptr) {
 	h.setSpans(t.base(), t.npages, t)
 	t.needzero = needzero
 	t.state.set(mSpanInUse)
+	// freeSpanLocked() expects an in-use span to be swept, and a garbage
+	// collection may have completed before the persistent memory file is
+	// opened.
+	t.sweepgen = h.sweepgen
 	h.freeSpanLocked(t, true, true)
 }
 
@@ -632,36 +1193,727 @@ func InPmem(addr uintptr) bool {
 	return inpmem(addr)
 }
 
+// IsPmem reports whether 'ptr' points into an object in the persistent memory
+// heap. It can be used to check that an object expected to be persistent was
+// not allocated in volatile memory. It returns false for nil, for pointers to
+// volatile memory, and for pointers into the persistent memory file that are
+// not in an in-use span, such as the header or the reserved region. All
+// persistent memory arenas are checked, as the span of an address is found
+// using the heap arena it is in.
+func IsPmem(ptr unsafe.Pointer) bool {
+	return inpmem(uintptr(ptr))
+}
+
+// Set to 1 if persistent memory allocations fall back to volatile memory
+// before persistent memory is initialized. See PmemAllowFallback().
+var pmemFallback uint32
+
+// PmemAllowFallback enables or disables allocating persistent memory objects
+// in volatile memory while persistent memory is not initialized, e.g. because
+// PmemInit was not called or failed. By default, such an allocation throws.
+// With the fallback enabled, the pnew and pmake builtins, Pnew, PmakeSlice,
+// PnewAligned, and the allocations of a PmemPersist() call allocate ordinary
+// volatile objects instead, for which IsPmem() reports false. This lets an
+// application that prefers persistence run without a persistent memory
+// device, e.g. in tests, as long as it checks IsPmem() where it relies on
+// durability. The objects are not moved to persistent memory when it is
+// initialized later. Allocations that record the object in the persistent
+// memory file, such as PnewRC and PnewChecked, still throw.
+func PmemAllowFallback(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.Store(&pmemFallback, v)
+}
+
+// IsObjectStart checks whether 'ptr' is the start address of a live object in
+// the persistent memory heap. It returns false if 'ptr' is an interior pointer,
+// points to a free slot in a span, or is not a persistent memory address. This
+// can be used by applications to validate pointers recovered after a restart
+// before dereferencing them.
+func IsObjectStart(ptr unsafe.Pointer) bool {
+	p := uintptr(ptr)
+	s := spanOfHeap(p)
+	if s == nil || s.memtype != isPersistent {
+		return false
+	}
+
+	if s.spanclass.sizeclass() == 0 {
+		// A large span holds exactly one object which starts at the span base
+		return p == s.base() && !s.isFree(0)
+	}
+
+	// For a small span, 'p' must fall on an element boundary and the
+	// corresponding slot must be marked as allocated.
+	off := p - s.base()
+	if off%s.elemsize != 0 {
+		return false
+	}
+	idx := off / s.elemsize
+	if idx >= s.nelems {
+		return false
+	}
+	return !s.isFree(idx)
+}
+
+// PersistObject makes the persistent memory object that starts at 'ptr'
+// persistent. The size of the object is found from its span, and all the bytes
+// of the slot that holds the object are flushed, followed by a fence. The slot
+// can be larger than the type of the object, as the size is rounded up to a
+// size class. Objects smaller than 16 bytes without pointers can share a
+// 16-byte block, in which case 'ptr' can point anywhere in the block and the
+// whole block is flushed. If the object was allocated using PnewChecked(), its
+// checksum is updated after the object is persistent. PersistObject panics if
+// 'ptr' is not the start of a live persistent memory object.
+func PersistObject(ptr unsafe.Pointer) {
+	base, size := pmemObjectOf(ptr, "PersistObject")
+	PersistRange(unsafe.Pointer(base), size)
+	if atomic.Load(&pmemChecksums.enabled) != 0 {
+		updateChecksum(base, size)
+	}
+}
+
+// PersistField makes the 'size' bytes at 'field' persistent, where 'field' is
+// the address of a field of the persistent memory object that starts at 'obj'.
+// Only the cache lines that hold the field are flushed. PersistField panics if
+// 'obj' is not the start of a live persistent memory object, or if the field
+// is not within the object.
+func PersistField(obj, field unsafe.Pointer, size uintptr) {
+	base, n := pmemObjectOf(obj, "PersistField")
+	f := uintptr(field)
+	if f < base || size > n || f-base > n-size {
+		panic(plainError("runtime: PersistField called with a field that is not within the object"))
+	}
+	PersistRange(field, size)
+}
+
+// PmemSliceAt returns a pointer to a slice header of 'len' elements of
+// 'elemSize' bytes, whose backing array is the persistent memory object that
+// starts at 'ptr'. This is used to rebuild a slice from a pointer found after
+// a restart, e.g.:
+//
+//	s := *(*[]T)(runtime.PmemSliceAt(ptr, unsafe.Sizeof(T{}), n))
+//
+// The capacity of the slice is 'len'. PmemSliceAt panics if 'ptr' is not the
+// start of a live persistent memory object, or if the object is too small to
+// hold 'len' elements, which usually means that the length was not persisted
+// along with the object.
+func PmemSliceAt(ptr unsafe.Pointer, elemSize uintptr, len int) unsafe.Pointer {
+	// 'ptr' can be in the middle of a tiny block, so the length is bounded by
+	// the end of the block
+	base, size := pmemObjectOf(ptr, "PmemSliceAt")
+	size -= uintptr(ptr) - base
+	n, overflow := math.MulUintptr(elemSize, uintptr(len))
+	if elemSize == 0 || len < 0 || overflow || n > size {
+		panic(plainError("runtime: PmemSliceAt called with a length that does not fit in the object"))
+	}
+	return unsafe.Pointer(&slice{array: ptr, len: len, cap: len})
+}
+
+// pmemObjectOf returns the start address and the size of the slot of the
+// persistent memory object that starts at 'ptr'. 'fn' is the name of the
+// calling function used if it panics.
+func pmemObjectOf(ptr unsafe.Pointer, fn string) (base, size uintptr) {
+	p := uintptr(ptr)
+	s := spanOfHeap(p)
+	if s != nil && isTinyBlock(s, p) {
+		// 'ptr' can be a tiny object within a 16-byte block
+		p = alignDown(p, maxTinySize)
+	}
+	if !IsObjectStart(unsafe.Pointer(p)) {
+		panic(plainError("runtime: " + fn + " called with an address that is not the start of a persistent memory object"))
+	}
+	return p, s.elemsize
+}
+
+// PmemPointers returns the addresses of the pointer fields of the persistent
+// memory object that starts at 'ptr' which hold a non-nil pointer. The pointer
+// fields are found using the heap type bits of the object. It returns nil if
+// the object has no such fields, or if 'ptr' is not the start of a live
+// persistent memory object (see IsObjectStart()).
+func PmemPointers(ptr unsafe.Pointer) []unsafe.Pointer {
+	if !IsObjectStart(ptr) {
+		return nil
+	}
+	s := spanOfHeap(uintptr(ptr))
+	if s.spanclass.noscan() {
+		return nil
+	}
+
+	var ptrs []unsafe.Pointer
+	addr := uintptr(ptr)
+	hbits := heapBitsForAddr(addr)
+	for i := uintptr(0); i < s.elemsize; i += intSize {
+		if i != 0 {
+			hbits = hbits.next()
+		}
+		bits := hbits.bits()
+		if i != 1*intSize && bits&bitScan == 0 {
+			break // no more pointers in this object
+		}
+		if bits&bitPointer == 0 {
+			continue // not a pointer
+		}
+		if *(*uintptr)(unsafe.Pointer(addr + i)) != 0 {
+			ptrs = append(ptrs, unsafe.Pointer(addr+i))
+		}
+	}
+	return ptrs
+}
+
+// forEachPointerIn calls 'f' with the address of each non-nil pointer word of
+// the heap objects that overlap the range of 'n' bytes starting at 'p', including
+// pointer words that only partly overlap the range. It stops and returns false
+// as soon as 'f' returns false.
+func forEachPointerIn(p, n uintptr, f func(addr uintptr) bool) bool {
+	return forEachPointerWordIn(p, n, func(addr uintptr) bool {
+		return *(*uintptr)(unsafe.Pointer(addr)) == 0 || f(addr)
+	})
+}
+
+// forEachPointerWordIn is like forEachPointerIn, but also calls 'f' for the
+// pointer words that are nil.
+func forEachPointerWordIn(p, n uintptr, f func(addr uintptr) bool) bool {
+	start, end := p, p+n
+	for p < end {
+		s := spanOfHeap(p)
+		if s == nil {
+			p = alignDown(p, pageSize) + pageSize
+			continue
+		}
+		if s.spanclass.noscan() {
+			p = s.limit
+			continue
+		}
+		base := s.base() + s.objIndex(p)*s.elemsize
+		hbits := heapBitsForAddr(base)
+		for i := uintptr(0); i < s.elemsize && base+i < end; i += intSize {
+			if i != 0 {
+				hbits = hbits.next()
+			}
+			bits := hbits.bits()
+			if i != 1*intSize && bits&bitScan == 0 {
+				break // no more pointers in this object
+			}
+			a := base + i
+			if bits&bitPointer != 0 && a+intSize > start && !f(a) {
+				return false
+			}
+		}
+		p = base + s.elemsize
+	}
+	return true
+}
+
+// checkMemsetRange panics if the range of 'n' bytes starting at 'p' is not in
+// persistent memory, or if it holds a non-nil pointer. Overwriting a pointer
+// outside a transaction could leave a dangling pointer in persistent memory
+// if the application crashes before it updates the objects it points to.
+func checkMemsetRange(p, n uintptr) {
+	if !inpmem(p) || !inpmem(p+n-1) {
+		panic(plainError("runtime: PmemMemset of a range not in persistent memory"))
+	}
+	if !forEachPointerIn(p, n, func(addr uintptr) bool { return false }) {
+		panic(plainError("runtime: PmemMemset of a range that holds pointers outside a transaction"))
+	}
+}
+
+// PmemMemset sets the 'n' bytes starting at 'addr' to 'c', and makes the range
+// persistent. Large ranges are written using non-temporal stores where they are
+// supported (see SetPmemMemmoveThreshold()), so that the range is written only
+// once. The range must be in persistent memory and must not hold any non-nil
+// pointer, else PmemMemset panics. Use PTx.Clear() to clear a range that holds
+// pointers.
+func PmemMemset(addr unsafe.Pointer, c byte, n uintptr) {
+	if n == 0 {
+		return
+	}
+	p := uintptr(addr)
+	checkMemsetRange(p, n)
+	memsetPersist(p, c, n)
+}
+
+// PmemClear zeroes the 'n' bytes starting at 'addr' and makes the range
+// persistent. See PmemMemset().
+func PmemClear(addr unsafe.Pointer, n uintptr) {
+	PmemMemset(addr, 0, n)
+}
+
+// memsetBytes sets the 'n' bytes starting at 'p' to 'c'
+func memsetBytes(p uintptr, c byte, n uintptr) {
+	if c == 0 {
+		memclrNoHeapPointers(unsafe.Pointer(p), n)
+		return
+	}
+	for i := uintptr(0); i < n; i++ {
+		*(*byte)(unsafe.Pointer(p + i)) = c
+	}
+}
+
+// Pfree releases the persistent memory object that starts at 'ptr', so that
+// its memory can be reused right away. The object is cleared, so that it no
+// longer keeps the objects it points to alive, and its slot is freed. If it was
+// the last object in its span, the span is returned to the heap and its span
+// bitmap entry is cleared, unless a P is allocating from the span, in which
+// case the garbage collector returns it. The application must not keep any
+// pointer to the object, as the garbage collector reports a pointer to a free
+// slot as an error. Pfree stops the world to free the slot, and waits for the
+// mark phase of a garbage collection cycle in progress to end, so it is meant
+// for objects whose lifetime is managed by the application rather than as a
+// replacement for the garbage collector. It must not be called while holding
+// a runtime lock.
+// Pfree throws if 'ptr' is not the start of a persistent memory object, if
+// the object was already freed, or if 'ptr' points into a block of the tiny
+// allocator, as the other objects of the block would be freed along with it.
+func Pfree(ptr unsafe.Pointer) {
+	p := uintptr(ptr)
+	for {
+		s := pfreeSpanOf(p)
+		// The garbage collector could mark the object while its slot is
+		// freed, and the alloc bits of the span are replaced when it is
+		// swept.
+		gcWaitOnMark(atomic.Load(&work.cycles))
+		mp := acquirem()
+		s.ensureSwept()
+		releasem(mp)
+
+		stopTheWorld("Pfree")
+		// 'ptr' keeps the object alive until the world is stopped, and must
+		// not be live once the world is started again after the slot is
+		// freed.
+		KeepAlive(ptr)
+		sg := mheap_.sweepgen
+		if gcphase == _GCoff && (s.sweepgen == sg || s.sweepgen == sg+3) {
+			size := pfreeLocked(s, p)
+			startTheWorld()
+			if trace.enabled {
+				tracePmemFree(size, false)
+			}
+			return
+		}
+		// A new cycle started before the world was stopped
+		startTheWorld()
+	}
+}
+
+// pfreeSpanOf returns the span of the persistent memory object that starts at
+// 'p', and throws if the object cannot be released using Pfree()
+func pfreeSpanOf(p uintptr) *mspan {
+	s := spanOfHeap(p)
+	if s == nil || s.memtype != isPersistent {
+		if pa := pArenaOf(p); pa != nil && pa.pageFree(p) {
+			throw("Pfree: double free of persistent memory object")
+		}
+		throw("Pfree: pointer is not in persistent memory")
+	}
+	if isTinyBlock(s, p) {
+		throw("Pfree: pointer is in a tiny block shared with other objects")
+	}
+	idx := s.objIndex(p)
+	if p != s.base()+idx*s.elemsize {
+		throw("Pfree: pointer is not the start of a persistent memory object")
+	}
+	if s.isFree(idx) {
+		throw("Pfree: double free of persistent memory object")
+	}
+	return s
+}
+
+// pfreeLocked clears and frees the persistent memory object at 'p' in span
+// 's', and returns the size of its slot. The world must be stopped with the
+// garbage collector off, and 's' must be swept.
+func pfreeLocked(s *mspan, p uintptr) uintptr {
+	// Another Pfree() call could have freed the object first
+	if pfreeSpanOf(p) != s {
+		throw("Pfree: double free of persistent memory object")
+	}
+	size := s.elemsize
+	memclrNoHeapPointers(unsafe.Pointer(p), size)
+	PersistRange(unsafe.Pointer(p), size)
+	pfreeSpecials(s, p)
+
+	c := getg().m.p.ptr().mcache
+	spc := s.spanclass
+	mc := &mheap_.central[s.memtype][spc][s.typIndex].mcentral
+	sg := mheap_.sweepgen
+	if spc.sizeclass() == 0 {
+		// A large object span is on the full swept list of its mcentral
+		// (see largeAlloc()), and is freed along with the object. If it is
+		// not found, which should not happen, the next sweep frees it.
+		if mc.fullSwept(sg).remove(s) {
+			s.allocCount = 0
+			mheap_.freeSpan(s)
+			c.local_nlargefree++
+			c.local_largefree += size
+		}
+		return size
+	}
+
+	// The allocator only looks for free slots from freeindex onwards, and
+	// finds them using the alloc bits. Move freeindex back to the freed slot,
+	// and mark the slots in between, which are all in use, as allocated.
+	idx := s.objIndex(p)
+	for i := idx + 1; i < s.freeindex; i++ {
+		bytep, mask := s.allocBits.bitp(i)
+		*bytep |= mask
+	}
+	if idx < s.freeindex {
+		s.freeindex = idx
+	}
+	bytep, mask := s.allocBits.bitp(idx)
+	*bytep &^= mask
+	s.refillAllocCache((s.freeindex &^ 63) / 8)
+	s.allocCache >>= s.freeindex % 64
+	s.allocCount--
+
+	if s.sweepgen == sg+3 {
+		// The span is cached by a P, which can allocate from it again. The
+		// statistics account for the free when the span is uncached (see
+		// uncacheSpan()).
+		if s.allocCount == 0 {
+			pfreeUncache(s, mc)
+			mheap_.freeSpan(s)
+		}
+		return size
+	}
+	c.local_nsmallfree[spc.sizeclass()]++
+	if s.allocCount == 0 {
+		// Return the empty span to the heap. If it is not found, which
+		// should not happen, the next sweep returns it.
+		if mc.partialSwept(sg).remove(s) || mc.fullSwept(sg).remove(s) {
+			mheap_.freeSpan(s)
+		}
+	} else if uintptr(s.allocCount)+1 == s.nelems {
+		// The span was full, so let the allocator find the freed slot
+		if mc.fullSwept(sg).remove(s) {
+			mc.partialSwept(sg).push(s)
+		}
+	}
+	return size
+}
+
+// pfreeUncache removes the empty span 's' from the mcache of the P that caches
+// it, and undoes the statistics updated by cacheSpan(), as uncacheSpan() does.
+// 'mc' is the mcentral of the span. The world must be stopped.
+func pfreeUncache(s *mspan, mc *mcentral) {
+	for _, p := range allp {
+		a := &p.mcache.alloc[s.memtype][s.spanclass]
+		if a[s.typIndex] == s {
+			a[s.typIndex] = &emptymspan
+		}
+	}
+	atomic.Store(&s.sweepgen, mheap_.sweepgen)
+	n := int64(s.nelems)
+	atomic.Xadd64(&mc.nmalloc, -n)
+	atomic.Xadd64(&memstats.heap_live, -n*int64(s.elemsize))
+}
+
+// pfreeSpecials frees the special records of the object at 'p' in span 's',
+// as the sweeper does for an object that is not marked. A finalizer of the
+// object is not run, as the object no longer exists.
+func pfreeSpecials(s *mspan, p uintptr) {
+	if s.specials == nil {
+		return
+	}
+	start := p - s.base()
+	end := start + s.elemsize
+	specialp := &s.specials
+	for special := *specialp; special != nil; special = *specialp {
+		if off := uintptr(special.offset); off >= end {
+			break
+		} else if off < start {
+			specialp = &special.next
+			continue
+		}
+		*specialp = special.next
+		if special.kind == _KindSpecialFinalizer {
+			lock(&mheap_.speciallock)
+			mheap_.specialfinalizeralloc.free(unsafe.Pointer(special))
+			unlock(&mheap_.speciallock)
+		} else {
+			freespecial(special, unsafe.Pointer(p), s.elemsize)
+		}
+	}
+	if s.specials == nil {
+		spanHasNoSpecials(s)
+	}
+}
+
+// SetPmemRelocation sets whether persistent memory arenas can be mapped at a
+// different address than in the previous run. Persistent pointers are stored as
+// absolute virtual addresses, so PmemInit first tries to map each arena at the
+// address it was mapped at previously. If that address is not available, the
+// arena is mapped elsewhere and all pointers into it are swizzled. Disabling
+// relocation makes PmemInit return ErrPmemRelocation instead, for applications
+// that store persistent addresses where the runtime cannot swizzle them, e.g.
+// in uintptr fields. It must be called before PmemInit.
+func SetPmemRelocation(allow bool) {
+	v := uint32(1)
+	if allow {
+		v = 0
+	}
+	atomic.Store(&pmemInfo.noRelocate, v)
+}
+
+// SetPmemReservedSize sets the size of a region at the beginning of a new
+// persistent memory file that is reserved for the application. The runtime
+// never allocates objects in, or otherwise writes to, the reserved region, and
+// the garbage collector does not scan it. The size need not be a multiple of
+// the page size. The size is stored in the file, and must be set before
+// PmemInit. The region of an existing file cannot be resized, so if the size
+// is not 0 and the file already exists, PmemInit returns ErrPmemReservedSize
+// unless the size matches the size stored in the file. Use
+// PmemReservedRegion() to access the region.
+func SetPmemReservedSize(n uintptr) {
+	atomic.Storeuintptr(&pmemInfo.reservedSize, n)
+}
+
+// PmemReservedRegion returns the address and the size of the application
+// reserved region of the persistent memory file. The address can change across
+// restarts, so the region must not hold pointers into the persistent memory
+// heap. The size is 0 if the file has no reserved region or PmemInit has not
+// been called. Writes to the region are made persistent using PersistRange().
+func PmemReservedRegion() (unsafe.Pointer, uintptr) {
+	if atomic.Load(&pmemInfo.initState) != initDone || pmemHeader.reservedSize == 0 {
+		return nil, 0
+	}
+	return add(unsafe.Pointer(pmemHeader), pmemHeaderSize), pmemHeader.reservedSize
+}
+
+// PmemEpoch returns the epoch of the persistent memory file. The epoch is
+// incremented and persisted each time PmemInit initializes the file, unless
+// the file is opened read-only, so a new file is at epoch 1. An application
+// that stores file offsets outside the file can record the epoch along with
+// them. If the epoch is not one more than the recorded epoch at the next
+// start, the file was opened by another process in between, or it is an older
+// copy of the file, and the offsets must be validated again. The epoch is read
+// from the file, so a process also sees the epoch change if another process
+// opens the file while it is using it. PmemEpoch returns 0 if persistent
+// memory is not initialized.
+func PmemEpoch() uint64 {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return 0
+	}
+	return atomic.Load64(&pmemHeader.epoch)
+}
+
+// PmemBounds returns the bounds of the persistent memory file mapping. 'base'
+// is the address at which the beginning of the file is mapped, and 'start' is
+// the first address managed by the persistent memory allocator, which follows
+// the file header, the reserved region, and the metadata of the first arena.
+// The file is mapped one arena at a time, and the arenas that follow the first
+// one are usually mapped right after it. 'end' is the end of the arenas that
+// are mapped contiguously from 'base'. The file offset of any address 'p' in
+// [base, end) is p - base. An arena that could not be mapped at its previous
+// address can be outside these bounds. All bounds are 0 if persistent memory
+// is not initialized or if no arena is mapped yet.
+func PmemBounds() (base, start, end uintptr) {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return
+	}
+	systemstack(func() {
+		lock(&mheap_.lock)
+		base, start, end = pmemBounds()
+		unlock(&mheap_.lock)
+	})
+	return
+}
+
+// pmemBounds computes the bounds returned by PmemBounds(). The heap lock must
+// be held.
+func pmemBounds() (base, start, end uintptr) {
+	for grown := true; grown; {
+		grown = false
+		forEachPArena(func(pa *pArena) {
+			addr := uintptr(unsafe.Pointer(pa)) - pa.headerOffset()
+			switch {
+			case pa.fileOffset == 0 && base == 0:
+				base, start, end = addr, pa.dataStart(), addr+pa.size
+				grown = true
+			case base != 0 && pa.fileOffset == end-base && addr == end:
+				end += pa.size
+				grown = true
+			}
+		})
+	}
+	return
+}
+
+// Bounds returns the bounds of the mapping of the file. See PmemBounds().
+func (r *PmemRegion) Bounds() (base, start, end uintptr) {
+	return PmemBounds()
+}
+
+// SetPmemZeroOnFree sets whether persistent memory objects are cleared when
+// they are freed by the garbage collector. Without this, the contents of a
+// freed object remain in the persistent memory file until the memory is reused,
+// and survive application restarts. Enabling this adds the cost of clearing
+// and persisting every freed object to the sweep phase of the garbage
+// collector. Objects freed using Pfree() are always cleared.
+func SetPmemZeroOnFree(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.Store(&pmemInfo.zeroOnFree, v)
+}
+
+// clearFreedObjects clears the objects in the persistent memory span 's' that
+// are freed by the current sweep, i.e. the objects that are allocated but not
+// marked. This is called by the sweeper before the span is returned to the
+// heap, so if the span becomes free, its contents are persistently cleared
+// before the span bitmap records it as free. A crash in between leaves an
+// in-use span with cleared objects, which are never reachable.
+func clearFreedObjects(s *mspan) {
+	mbits := s.markBitsForBase()
+	abits := s.allocBitsForIndex(0)
+	cleared := false
+	for i := uintptr(0); i < s.nelems; i++ {
+		if !mbits.isMarked() && (abits.index < s.freeindex || abits.isMarked()) {
+			// The object is dead, so no write barriers are needed
+			x := unsafe.Pointer(s.base() + i*s.elemsize)
+			memclrNoHeapPointers(x, s.elemsize)
+			FlushRange(x, s.elemsize)
+			cleared = true
+		}
+		mbits.advance()
+		abits.advance()
+	}
+	if cleared {
+		Fence()
+	}
+}
+
+// pArenaOf returns the header of the persistent memory arena that contains
+// 'p', or nil if 'p' is not in persistent memory.
+func pArenaOf(p uintptr) *pArena {
+	ri := arenaIndex(p)
+	if arenaL1Bits == 0 {
+		if ri.l2() >= uint(len(mheap_.arenas[0])) {
+			return nil
+		}
+	} else if ri.l1() >= uint(len(mheap_.arenas)) {
+		return nil
+	}
+	l2 := mheap_.arenas[ri.l1()]
+	if arenaL1Bits != 0 && l2 == nil {
+		return nil
+	}
+	ha := l2[ri.l2()]
+	if ha == nil {
+		return nil
+	}
+	return (*pArena)(unsafe.Pointer(ha.pArena))
+}
+
+// pageFree reports whether the page containing 'p' is free according to the
+// span bitmap of the persistent memory arena 'pa'. A page is free only if no
+// span that starts at or before it covers it.
+func (pa *pArena) pageFree(p uintptr) bool {
+	_, allocSize := pa.layout()
+	arenaStart := pa.dataStart()
+	if p < arenaStart || p >= arenaStart+allocSize {
+		return false
+	}
+	spanBitmap := pa.spanBitmap()
+	page := (p - arenaStart) >> pageShift
+	for i := uintptr(0); i <= page; i++ {
+		if sVal := spanBitmap[i]; sVal != 0 {
+			_, npages, _, _, _ := spanLogDecode(sVal)
+			if i+npages > page {
+				return false
+			}
+			i += npages - 1
+		}
+	}
+	return true
+}
+
 // GetRoot returns the application root pointer. After a restart, the swizzling
 // code will take care of setting the correct 'swizzled' pointer as root.
 // GetRoot() returns nil if it is called before persistent memory initialization
-// is completed.
+// is completed, or if the root was rejected by its validator (see
+// SetRootValidator()).
 func GetRoot() unsafe.Pointer {
+	if pmemInfo.rootRejected {
+		return nil
+	}
 	return pmemInfo.root
 }
 
 // SetRoot stores the application root pointer in the persistent memory header
-// region.
+// region. Persistent memory objects are garbage collected like volatile
+// objects: an object that is not reachable from the root, a named root, a
+// table of the runtime such as the reference table of PnewRC(), or a volatile
+// variable is reclaimed, and its span is returned to the heap once all its
+// objects are reclaimed. Pfree() reclaims an object right away instead, and
+// returns its span to the heap if it was the last object in it. PmemInit maps
+// every arena of the file, so no pointer to a persistent memory object is
+// hidden from the garbage collector. An object that must outlive the current
+// run has to be reachable from a root.
 func SetRoot(addr unsafe.Pointer) (err error) {
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+	return setRoot(addr)
+}
+
+func setRoot(addr unsafe.Pointer) (err error) {
 	s := spanOfHeap(uintptr(addr))
 	if s == nil || s.memtype != isPersistent {
 		return errorString("Invalid address passed to SetRoot")
 	}
 
-	ai := arenaIndex(uintptr(addr))
-	arena := mheap_.arenas[ai.l1()][ai.l2()]
-	pa := (*pArena)(unsafe.Pointer(arena.pArena))
-	fo := pa.fileOffset
-	po := uintptr(addr) - arena.pArena
-
 	lock(&pmemInfo.rootLock)
 	pmemInfo.root = addr
-	pmemHeader.rootOffset = po + fo
+	pmemInfo.rootRejected = false
+	pmemHeader.rootOffset = fileOffsetOf(uintptr(addr))
 	PersistRange((unsafe.Pointer)(&pmemHeader.rootOffset), intSize)
 	unlock(&pmemInfo.rootLock)
 	return
 }
 
+// fileOffsetOf returns the offset from the beginning of the persistent memory
+// file of the persistent memory address 'addr'.
+func fileOffsetOf(addr uintptr) uintptr {
+	ai := arenaIndex(addr)
+	arena := mheap_.arenas[ai.l1()][ai.l2()]
+	pa := (*pArena)(unsafe.Pointer(arena.pArena))
+	return pa.fileOffset + addr - arena.pArena
+}
+
+// forEachPArena calls 'fn' for the header of every persistent memory arena.
+// The heap lock must be held.
+func forEachPArena(fn func(pa *pArena)) {
+	var last uintptr
+	for _, ai := range mheap_.allArenas {
+		pa := mheap_.arenas[ai.l1()][ai.l2()].pArena
+		// A persistent memory arena can span several consecutive heap arenas
+		if pa == 0 || pa == last {
+			continue
+		}
+		last = pa
+		fn((*pArena)(unsafe.Pointer(pa)))
+	}
+}
+
+// addrOfFileOffset returns the address at which the persistent memory file
+// offset 'off' is currently mapped. It returns 0 if the offset is not mapped.
+func addrOfFileOffset(off uintptr) uintptr {
+	for _, ai := range mheap_.allArenas {
+		ha := mheap_.arenas[ai.l1()][ai.l2()]
+		if ha.pArena == 0 {
+			continue
+		}
+		pa := (*pArena)(unsafe.Pointer(ha.pArena))
+		if off >= pa.fileOffset && off-pa.fileOffset < pa.size {
+			return ha.pArena + off - pa.fileOffset
+		}
+	}
+	return 0
+}
+
 // enableGC runs a full GC cycle in a new goroutine.
 // The argumnet gcp specifies garbage collection percentage and controls how
 // often GC is run (see https://golang.org/pkg/runtime/debug/#SetGCPercent).
@@ -727,18 +1979,20 @@ func (ar *arenaInfo) restoreSpanHeapBits(s *mspan) {
 		ar.bitsArray = make([]byte, numBytesReqd)
 	}
 
-	addr := uintptr(pmemHeapBitsAddr(spanAddr, parena))
-	kindAddr := (*uint8)(unsafe.Pointer(addr + intSize))
-	ar.typ.kind = *kindAddr
-
-	sizeAddr := (*uintptr)(unsafe.Pointer(addr + 16))
-	ar.typ.size = *sizeAddr
-
-	ptrAddr := (*uintptr)(unsafe.Pointer(addr + 24))
-	ar.typ.ptrdata = *ptrAddr
-
-	gcDataAddr := unsafe.Pointer(addr + 32)
-	ar.typ.gcdata = (*byte)(gcDataAddr)
+	if s.typIndex >= 2 {
+		// The type is described in the type descriptor table in the header
+		d := &pmemHeader.typeDescs[s.typIndex-2]
+		ar.typ.kind = d.kind
+		ar.typ.size = d.size
+		ar.typ.ptrdata = d.ptrdata
+		ar.typ.gcdata = &d.mask[0]
+	} else {
+		tl := (*spanTypeLog)(pmemHeapBitsAddr(spanAddr, parena))
+		ar.typ.kind = tl.kind
+		ar.typ.size = tl.size
+		ar.typ.ptrdata = tl.ptrdata
+		ar.typ.gcdata = (*byte)(tl.mask())
+	}
 
 	// If nelems is greater than 1, it implies this span contains array elements
 	nelems := s.elemsize / ar.typ.size
@@ -813,7 +2067,7 @@ func swizzleArenas(arenas []*arenaInfo) (err error) {
 		// state is set as swizzleDone.
 		for _, ar := range arenas {
 			pa := ar.pa
-			pa.logEntry(unsafe.Pointer(&pa.delta))
+			pa.logEntry(unsafe.Pointer(&pa.delta), intSize)
 			pa.delta = 0
 			PersistRange(unsafe.Pointer(&pa.delta), intSize)
 			// The data logged here will be discarded when resetLog() is called
@@ -826,6 +2080,7 @@ func swizzleArenas(arenas []*arenaInfo) (err error) {
 
 	// At this point any partially completed swizzle operation from previous runs
 	// is completed. If swizzling is required for this run, do that now.
+	relocated := false
 	for i, ar := range arenas {
 		// Set bytesSwizzled as 0. This can be done without logging as
 		// swizzling is considered to have started only when swizzleState is set
@@ -840,24 +2095,34 @@ func swizzleArenas(arenas []*arenaInfo) (err error) {
 		offsetTable[i] = int(ar.mapAddr) - (int(pa.mapAddr) - pa.delta)
 		rangeTable[i].s = uintptr(int(pa.mapAddr) - pa.delta)
 		rangeTable[i].e = uintptr(int(pa.mapAddr) - pa.delta + int(pa.size))
+		if offsetTable[i] != 0 {
+			relocated = true
+		}
 	}
 
-	// Set swizzle state as swizzleSetup
-	pmemHeader.setSwizzleState(swizzleSetup)
+	// If every arena is mapped at the address it was mapped at in the previous
+	// run, no pointer has to be swizzled and the arenas need not be walked.
+	if relocated {
+		// Set swizzle state as swizzleSetup
+		pmemHeader.setSwizzleState(swizzleSetup)
 
-	for i, ar := range arenas {
-		pa := ar.pa
-		// Write the new map address and delta value to arena header
-		pa.logEntry(unsafe.Pointer(&pa.mapAddr))
-		pa.logEntry(unsafe.Pointer(&pa.delta))
-		pa.mapAddr = ar.mapAddr
-		pa.delta = offsetTable[i]
-		// Commit persists the changes and then resets the log
-		pa.commitLog()
+		for i, ar := range arenas {
+			pa := ar.pa
+			// Write the new map address and delta value to arena header
+			pa.logEntry(unsafe.Pointer(&pa.mapAddr), intSize)
+			pa.logEntry(unsafe.Pointer(&pa.delta), intSize)
+			pa.mapAddr = ar.mapAddr
+			pa.delta = offsetTable[i]
+			// Commit persists the changes and then resets the log
+			pa.commitLog()
+		}
+
+		// Set swizzle state as swizzleOngoing
+		pmemHeader.setSwizzleState(swizzleOngoing)
 	}
 
-	// Set swizzle state as swizzleOngoing
-	pmemHeader.setSwizzleState(swizzleOngoing)
+	// Revert the transactions that were not completed in the previous run
+	recoverTxLogs(arenas)
 
 	// Call the application callback function, if one is registered
 	if AppCallBack != nil {
@@ -865,37 +2130,70 @@ func swizzleArenas(arenas []*arenaInfo) (err error) {
 		AppCallBack(newRoot)
 	}
 
-	// Swizzle pointers in each arena
-	for _, ar := range arenas {
-		go ar.swizzle(dc)
-	}
-	// Wait until all goroutines complete swizzling.
-	for range arenas {
-		<-dc
-	}
+	if relocated {
+		// Swizzle pointers in each arena
+		for _, ar := range arenas {
+			go ar.swizzle(dc)
+		}
+		// Wait until all goroutines complete swizzling.
+		for range arenas {
+			<-dc
+		}
 
-	for _, ar := range arenas {
-		pa := ar.pa
-		pa.logEntry(unsafe.Pointer(&pa.delta))
-		pa.delta = 0
-		PersistRange(unsafe.Pointer(&pa.delta), intSize)
-	}
+		for _, ar := range arenas {
+			pa := ar.pa
+			pa.logEntry(unsafe.Pointer(&pa.delta), intSize)
+			pa.delta = 0
+			PersistRange(unsafe.Pointer(&pa.delta), intSize)
+		}
 
-	// Set swizzle state as swizzleDone
-	// TODO
+		// Set swizzle state as swizzleDone
+		// TODO
 
-	for _, ar := range arenas {
-		pa := ar.pa
-		pa.resetLog()
+		for _, ar := range arenas {
+			pa := ar.pa
+			pa.resetLog()
+		}
 	}
 
 	// The address of the application root pointer may have changed. So compute
 	// the address of the root pointer, and set it as the root pointer.
 	if pmemHeader.rootOffset != 0 {
 		newRoot := computeRootAddr(pmemHeader.rootOffset, arenas)
-		err = SetRoot(newRoot)
+		err = setRoot(newRoot)
 	}
 
+	// Similarly, compute the addresses of the named roots. Their offsets in
+	// the file do not change, so the header need not be updated.
+	for i := range pmemHeader.namedRoots {
+		nr := &pmemHeader.namedRoots[i]
+		if nr.nameLen != 0 {
+			pmemInfo.namedRoots[i] = computeRootAddr(nr.offset, arenas)
+			if nr.ephemeral() {
+				pmemInfo.ephemeralFound = true
+			}
+		}
+	}
+
+	// Complete the releases of reference counted objects that were
+	// interrupted by a crash
+	restoreRefTable(arenas)
+
+	// Track the allocation times of the timestamped objects again
+	restoreTimeTable(arenas)
+
+	// Track the objects whose checksums are maintained again
+	restoreChecksumTable(arenas)
+
+	// Track the pinned objects again
+	restorePinTable(arenas)
+
+	// Find the objects released to pools in the previous run
+	restorePoolLists(arenas)
+
+	// Check the roots using the validators of the application
+	validateRoots()
+
 	return
 }
 
@@ -916,6 +2214,51 @@ func computeRootAddr(offset uintptr, arenas []*arenaInfo) unsafe.Pointer {
 	return nil
 }
 
+// init initializes the header of a new persistent memory file with an
+// application reserved region of 'reserved' bytes. The magic constant is made
+// persistent only after the rest of the header fields, and the checksum after
+// the magic constant. So a header with a valid magic constant never has a
+// stale mapped size, and a valid checksum proves that the header was
+// completely initialized. The initialization state is persisted first and
+// last, so that a reopen can tell a header whose initialization was
+// interrupted from a corrupted one.
+func (ph *pHeader) init(reserved uintptr) {
+	ph.initState = initOngoing
+	PersistRange(unsafe.Pointer(&ph.initState), unsafe.Sizeof(ph.initState))
+
+	ph.mappedSize = headerRegionSize(reserved)
+	PersistRange(unsafe.Pointer(&ph.mappedSize), intSize)
+
+	ph.hdrSize = pmemHeaderSize
+	ph.reservedSize = reserved
+	ph.formatVersion = pmemFormatVersion
+	ph.logSlots = uint32(pmemInfo.logSlots)
+	PersistRange(unsafe.Pointer(&ph.hdrSize),
+		unsafe.Offsetof(ph.hdrCRC)-unsafe.Offsetof(ph.hdrSize))
+
+	ph.magic = hdrMagic
+	PersistRange(unsafe.Pointer(&ph.magic), intSize)
+
+	ph.hdrCRC = ph.checksum()
+	PersistRange(unsafe.Pointer(&ph.hdrCRC), unsafe.Sizeof(ph.hdrCRC))
+
+	ph.initState = initDone
+	PersistRange(unsafe.Pointer(&ph.initState), unsafe.Sizeof(ph.initState))
+}
+
+// init initializes the header of a new persistent memory arena of 'size'
+// bytes mapped at 'mapAddr'. As with the file header, the magic constant is
+// made persistent only after the rest of the arena header.
+func (pa *pArena) init(size, mapAddr, fileOffset uintptr) {
+	pa.size = size
+	pa.mapAddr = mapAddr
+	pa.fileOffset = fileOffset
+	PersistRange(unsafe.Pointer(&pa.size), pArenaHeaderSize-unsafe.Offsetof(pa.size))
+
+	pa.magic = hdrMagic
+	PersistRange(unsafe.Pointer(&pa.magic), intSize)
+}
+
 func (ph *pHeader) setSwizzleState(state int) {
 	ph.swizzleState = state
 	PersistRange(unsafe.Pointer(&ph.swizzleState), intSize)
@@ -1003,8 +2346,8 @@ func (ar *arenaInfo) swizzle(dc chan bool) {
 					continue
 				}
 
-				pa.logEntry(unsafe.Pointer(&pa.bytesSwizzled))
-				pa.logEntry(unsafe.Pointer(addr))
+				pa.logEntry(unsafe.Pointer(&pa.bytesSwizzled), intSize)
+				pa.logEntry(unsafe.Pointer(addr), intSize)
 
 				pa.bytesSwizzled = (addr - start + 8)
 				*au = newAddr
@@ -1056,6 +2399,9 @@ var (
 	// so far
 	numAssigned int
 
+	// A lock to protect the assignment of types to be specially cached
+	typLock mutex
+
 	// Mapping between index assigned by typeIndex() and the type pointer
 	typMap [100]*_type
 
@@ -1127,11 +2473,7 @@ func typeProfileThread() {
 				if currAllocs > threshAllocs {
 					freq := (typProf[off] - prevAllocs[off])
 					if freq > 100 {
-						numAssigned++
-						typAssigns[off] = numAssigned
-						// store the mapping persistently
-						pmemHeader.typeMap[numAssigned-2] = off
-						PersistRange(unsafe.Pointer(&pmemHeader.typeMap[numAssigned-2]), intSize)
+						promoteType(typ)
 						typMap[i] = nil
 						if numAssigned == maxCacheTypes-1 {
 							// No more space to cache more type entries
@@ -1149,17 +2491,17 @@ func typeProfileThread() {
 // in the mcache. If the type is not yet specially cached, then this function
 // increments the allocation count of this type.
 func typeIndex(typ *_type, sizeclass uint8) int {
+	// Types built by PmemPersist() are not in the type section of the binary
+	if typ.tflag&tflagPmemCopy != 0 {
+		return 0
+	}
+
 	// Slices are always cached at index 1
 	if typ.kind&kindSlice == kindSlice {
 		return 1
 	}
 
-	tu := uintptr(unsafe.Pointer(typ))
-	offset := (tu - typeBase) / 32
-	if offset >= 50000 || tu%32 != 0 {
-		throw("Index overflow or type address not a multiple of 32")
-	}
-
+	offset := typeOffset(typ)
 	if typAssigns[offset] != 0 {
 		// This type has already been promoted to be specially cached, so just
 		// return the index associated with the type.
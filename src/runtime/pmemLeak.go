@@ -0,0 +1,307 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"runtime/internal/sys"
+	"unsafe"
+)
+
+// Implementation of the persistent memory leak detector. Every object that
+// remains allocated in the persistent memory heap is either reachable from
+// somewhere, or was allocated in a previous run and has not yet been freed by
+// the garbage collector. But only the objects that are reachable from the
+// persistent roots (the application root, the named roots, and the log buffers
+// and side tables used by the runtime) can be found by the application after a
+// restart. Any other object is therefore reported as a persistent memory leak.
+
+const (
+	// The maximum number of leaked objects that are listed in the error
+	// returned by PmemAssertNoLeaks
+	maxLeakReport = 16
+)
+
+// PmemLeak describes one leaked persistent memory object
+type PmemLeak struct {
+	Addr uintptr // The start address of the object
+	Size uintptr // The size of the object in bytes
+}
+
+// The maximum number of entries of the scratch arrays of the leak check. The
+// arrays are smaller on 32-bit platforms, where larger arrays do not fit in the
+// address space.
+const maxLeakEntries = 1 << (26 + 4*_64bit)
+
+// leakState holds the scratch memory used while searching for leaked objects.
+// It is allocated outside the Go heap as it is used with the world stopped.
+type leakState struct {
+	// An open addressing hash set of the base addresses of objects that are
+	// reachable from the persistent roots.
+	set     *[maxLeakEntries]uintptr
+	setMask uintptr
+
+	// The worklist of reachable objects that are yet to be scanned. Each
+	// object is added at most once, so it never holds more entries than the
+	// number of allocated objects.
+	stack *[maxLeakEntries]uintptr
+	top   uintptr
+
+	// The leaked objects. This reuses the memory of 'stack' once all
+	// reachable objects are scanned.
+	leaked  *[maxLeakEntries / 2]PmemLeak
+	nleaked uintptr
+
+	setBytes, stackBytes uintptr
+}
+
+// PmemAssertNoLeaks runs a garbage collection cycle and checks that every
+// object that is still allocated in the persistent memory heap is reachable
+// from the persistent roots. It returns an error that lists the leaked
+// objects otherwise. This is intended to be called by tests after an
+// operation on a persistent data structure, e.g.:
+//
+//	if err := runtime.PmemAssertNoLeaks(); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// Objects that are referenced by volatile variables at the time of the call
+// are not freed by the garbage collector, but they are still reported since
+// they are lost on a restart.
+func PmemAssertNoLeaks() error {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return errorString("Persistent memory is not initialized")
+	}
+
+	// GC() returns only after the sweep of the new cycle completes. So the
+	// allocation bits of all persistent memory spans are up-to-date.
+	GC()
+
+	var ls leakState
+	stopTheWorld("pmem leak check")
+	systemstack(func() {
+		findPmemLeaks(&ls)
+	})
+	startTheWorld()
+
+	var err error
+	if ls.nleaked != 0 {
+		err = errorString(leakReport(&ls))
+	}
+	ls.free()
+	return err
+}
+
+// PmemCheckLeaks returns the persistent memory objects that are allocated but
+// not reachable from the persistent roots. Unlike PmemAssertNoLeaks, this does
+// not run a garbage collection cycle. So when called right after PmemInit(),
+// it reports the objects that were leaked in previous runs of the application,
+// before the garbage collector frees them. Objects that are referenced only by
+// volatile variables are reported as well. This walks the entire persistent
+// memory heap with the world stopped, and is meant for debugging and testing.
+func PmemCheckLeaks() []PmemLeak {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return nil
+	}
+
+	var ls leakState
+	stopTheWorld("pmem leak check")
+	systemstack(func() {
+		findPmemLeaks(&ls)
+	})
+	startTheWorld()
+
+	var leaks []PmemLeak
+	if ls.nleaked != 0 {
+		leaks = make([]PmemLeak, ls.nleaked)
+		copy(leaks, ls.leaked[:ls.nleaked])
+	}
+	ls.free()
+	return leaks
+}
+
+// findPmemLeaks marks all persistent memory objects reachable from the
+// persistent roots and records the allocated objects that were not marked.
+// The world must be stopped. The scratch memory has to be released using
+// free() once the leaked objects are consumed.
+func findPmemLeaks(ls *leakState) {
+	var nobj uintptr
+	forEachPmemObject(func(base, size uintptr) {
+		nobj++
+	})
+	if nobj == 0 {
+		return
+	}
+
+	setSize := uintptr(1)
+	for setSize < 2*nobj {
+		setSize <<= 1
+	}
+	ls.setBytes = alignUp(setSize*sys.PtrSize, physPageSize)
+	ls.stackBytes = alignUp(nobj*unsafe.Sizeof(PmemLeak{}), physPageSize)
+	setMem := sysAlloc(ls.setBytes, &memstats.other_sys)
+	stackMem := sysAlloc(ls.stackBytes, &memstats.other_sys)
+	if setMem == nil || stackMem == nil {
+		throw("pmem leak check: out of memory")
+	}
+	ls.set = (*[maxLeakEntries]uintptr)(setMem)
+	ls.setMask = setSize - 1
+	ls.stack = (*[maxLeakEntries]uintptr)(stackMem)
+
+	ls.markObject(uintptr(pmemInfo.root))
+	for _, r := range pmemInfo.namedRoots {
+		ls.markObject(uintptr(r))
+	}
+	for _, l := range txInfo.logs {
+		ls.markObject(uintptr(l))
+	}
+	for _, spill := range logSpills.m {
+		ls.markObject(uintptr(spill))
+	}
+	ls.markObject(uintptr(pmemRefs.table))
+	ls.markObject(uintptr(pmemChecksums.table))
+	ls.markObject(uintptr(pmemPins.table))
+	ls.markObject(uintptr(pmemTimes.table))
+	for i := range poolLists.tables {
+		ls.markObject(uintptr(poolLists.tables[i].table))
+	}
+	for ls.top > 0 {
+		ls.top--
+		ls.scanObject(ls.stack[ls.top])
+	}
+
+	ls.leaked = (*[maxLeakEntries / 2]PmemLeak)(stackMem)
+	forEachPmemObject(func(base, size uintptr) {
+		if !ls.marked(base) {
+			ls.leaked[ls.nleaked] = PmemLeak{base, size}
+			ls.nleaked++
+		}
+	})
+}
+
+// free releases the scratch memory used by the leak check
+func (ls *leakState) free() {
+	if ls.set != nil {
+		sysFree(unsafe.Pointer(ls.set), ls.setBytes, &memstats.other_sys)
+		sysFree(unsafe.Pointer(ls.stack), ls.stackBytes, &memstats.other_sys)
+	}
+}
+
+// forEachPmemObject calls 'fn' for every allocated object in the persistent
+// memory heap. The world must be stopped.
+func forEachPmemObject(fn func(base, size uintptr)) {
+	for _, s := range mheap_.allspans {
+		if s.state.get() != mSpanInUse || s.memtype != isPersistent {
+			continue
+		}
+		for i := uintptr(0); i < s.nelems; i++ {
+			if !s.isFree(i) {
+				fn(s.base()+i*s.elemsize, s.elemsize)
+			}
+		}
+	}
+}
+
+// markObject adds the persistent memory object that contains 'p' to the set
+// of reachable objects, and queues it for scanning if it was not already
+// present in the set.
+func (ls *leakState) markObject(p uintptr) {
+	if p == 0 {
+		return
+	}
+	s := spanOfHeap(p)
+	if s == nil || s.memtype != isPersistent {
+		return
+	}
+	idx := s.objIndex(p)
+	if s.isFree(idx) {
+		return
+	}
+	base := s.base() + idx*s.elemsize
+
+	h := (base / sys.PtrSize) & ls.setMask
+	for ls.set[h] != 0 {
+		if ls.set[h] == base {
+			return
+		}
+		h = (h + 1) & ls.setMask
+	}
+	ls.set[h] = base
+	ls.stack[ls.top] = base
+	ls.top++
+}
+
+// marked reports whether the object starting at 'base' is reachable
+func (ls *leakState) marked(base uintptr) bool {
+	h := (base / sys.PtrSize) & ls.setMask
+	for ls.set[h] != 0 {
+		if ls.set[h] == base {
+			return true
+		}
+		h = (h + 1) & ls.setMask
+	}
+	return false
+}
+
+// scanObject marks all persistent memory objects referenced by the pointer
+// slots of the object starting at 'b'.
+func (ls *leakState) scanObject(b uintptr) {
+	s := spanOfUnchecked(b)
+	if s.spanclass.noscan() {
+		return
+	}
+	n := s.elemsize
+	hbits := heapBitsForAddr(b)
+	for i := uintptr(0); i < n; i += sys.PtrSize {
+		if i != 0 {
+			hbits = hbits.next()
+		}
+		bits := hbits.bits()
+		if bits&bitScan == 0 {
+			break // no more pointers in this object
+		}
+		if bits&bitPointer == 0 {
+			continue
+		}
+		obj := *(*uintptr)(unsafe.Pointer(b + i))
+		if obj != 0 && obj-b >= n {
+			ls.markObject(obj)
+		}
+	}
+}
+
+// leakReport formats the error message for the leaked objects in 'ls'
+func leakReport(ls *leakState) string {
+	b := make([]byte, 0, 64+maxLeakReport*48)
+	b = append(b, "Persistent memory leak: "...)
+	b = appendIntStr(b, int64(ls.nleaked), false)
+	b = append(b, " object(s) not reachable from the persistent roots:"...)
+	n := ls.nleaked
+	if n > maxLeakReport {
+		n = maxLeakReport
+	}
+	for i := uintptr(0); i < n; i++ {
+		b = append(b, " 0x"...)
+		b = appendHexStr(b, uint64(ls.leaked[i].Addr))
+		b = append(b, " (size "...)
+		b = appendIntStr(b, int64(ls.leaked[i].Size), false)
+		b = append(b, ')')
+	}
+	if ls.nleaked > n {
+		b = append(b, " ..."...)
+	}
+	return string(b)
+}
+
+func appendHexStr(b []byte, v uint64) []byte {
+	const dig = "0123456789abcdef"
+	var buf [16]byte
+	i := len(buf)
+	for {
+		i--
+		buf[i] = dig[v%16]
+		v /= 16
+		if v == 0 {
+			break
+		}
+	}
+	return append(b, buf[i:]...)
+}
@@ -9,17 +9,94 @@ import (
 type logEntry struct {
 	// Offset of the address to be logged from the arena map address
 	off uintptr
-	// The value to be logged
-	val int
+	// The number of bytes logged in data
+	len uintptr
+	// The logged data
+	data [logDataSize]byte
+}
+
+// MemRange describes a memory address range that is to be persisted using
+// PersistRanges().
+type MemRange struct {
+	Addr unsafe.Pointer
+	Len  uintptr
 }
 
 const (
-	// The maximum number of entries that can be logged in the arena header
-	maxLogEntries = 2
+	// The number of entries that can be logged in the arena header of a file
+	// whose log slot count is not set using PmemOptions.LogSlots, and the
+	// largest count that can be set. Additional entries are stored in a spill
+	// buffer allocated in persistent memory.
+	defaultLogSlots = 2
+	maxLogSlots     = 64
 
 	logEntrySize = unsafe.Sizeof(logEntry{})
+
+	// The maximum number of bytes that can be logged in one log entry. This
+	// makes each log entry occupy one cache line. Larger ranges are logged
+	// using multiple entries.
+	logDataSize = 48
+
+	// The number of entries in the first spill buffer allocated for an arena
+	minSpillEntries = 8
 )
 
+// A spill buffer starts with the number of entries it can hold, followed by
+// the entries. The arena header refers to its spill buffer only using its file
+// offset, so logSpills keeps the spill buffers reachable for the GC.
+var logSpills struct {
+	lock mutex
+	m    map[uintptr]unsafe.Pointer // arena header address -> spill buffer
+}
+
+// spanTypeLog is the layout of the start of the heap type bits log of a span
+// that uses the optimized representation (see logHeapBits()). The type index is
+// always logged. For a slice span, the fields of the type that are needed to
+// restore the heap type bits follow it, and the pointer mask of the type
+// follows the structure.
+type spanTypeLog struct {
+	typIndex int
+	kind     uint8
+	size     uintptr
+	ptrdata  uintptr
+}
+
+// mask returns the address of the pointer mask of the type logged in 'tl'
+func (tl *spanTypeLog) mask() unsafe.Pointer {
+	return add(unsafe.Pointer(tl), unsafe.Sizeof(*tl))
+}
+
+// PmemTypeInfo returns the type logged for the persistent memory span that
+// holds 'ptr', i.e. the kind, as a reflect.Kind value, the size, and the
+// number of bytes that can hold pointers of the type of the objects in the
+// span. The type is read from the persistent metadata that is used to restore
+// the heap type bits of the span after a restart. Only spans that hold
+// objects of a single type log their type, e.g. the spans of a PmemPool. ok is
+// false for other spans, whose heap type bits are logged for each object, and
+// if 'ptr' does not point into a persistent memory span.
+func PmemTypeInfo(ptr unsafe.Pointer) (kind uint8, size uintptr, ptrdata uintptr, ok bool) {
+	if !inpmem(uintptr(ptr)) {
+		return
+	}
+	s := spanOfHeap(uintptr(ptr))
+	if s == nil || s.memtype != isPersistent || s.typIndex == 0 {
+		return
+	}
+	if s.typIndex >= 2 {
+		// The type is described in the type descriptor table in the header
+		d := &pmemHeader.typeDescs[s.typIndex-2]
+		kind, size, ptrdata = d.kind, d.size, d.ptrdata
+	} else {
+		tl := (*spanTypeLog)(pmemHeapBitsAddr(s.base(), pArenaOf(s.base())))
+		kind, size, ptrdata = tl.kind, tl.size, tl.ptrdata
+	}
+	if size == 0 {
+		// No object of the span was allocated yet
+		return 0, 0, 0, false
+	}
+	return kind & kindMask, size, ptrdata, true
+}
+
 // logHeapBits is used to log the heap type bits set by the memory allocator
 // during a persistent memory allocation request.
 // 'addr' is the start address of the allocated region. The heap type bits to be
@@ -29,18 +106,18 @@ const (
 // region has pointers. The heap type bits logged is different for spans that
 // are cached at index 0 and not used for specific type allocation, and for
 // spans that are specially cached for a particular type allocation. For a
-// specially cached span, logHeapBits logs the type index followed by the
-// metdata from the type datastructure. This is done only for the first object.
+// specially cached span, logHeapBits logs the type index. This is done only for
+// the first object. The metadata of a cached type is stored in the type
+// descriptor table in the header when the type is promoted (see promoteType()).
+// Slices are cached at index 1 without a type descriptor, so for a slice span
+// the type index is followed by the metadata from the type datastructure.
 // For other spans, the heap type bits are copied as-is for each objects.
 //
-// Specially cached spans:
+// Slice spans (see spanTypeLog):
 // +------------+---------+---------+---------+-----------+
 // | Type index |   KIND  |   SIZE  | PTRDATA |  GC DATA  |
 // |   8 bytes  | 8 bytes | 8 bytes | 8 bytes | var-sized |
 // +------------+---------+---------+---------+-----------+
-//
-// TODO - type metadata need not be saved for each span. It can instead be
-// stored in the global header.
 func logHeapBits(addr uintptr, startByte, endByte *byte, typ *_type) {
 	span := spanOfUnchecked(addr)
 	if span.memtype != isPersistent {
@@ -54,30 +131,31 @@ func logHeapBits(addr uintptr, startByte, endByte *byte, typ *_type) {
 	arena := mheap_.arenas[ai.l1()][ai.l2()]
 	pArena := (*pArena)(unsafe.Pointer(arena.pArena))
 	numHeapBytes := uintptr(unsafe.Pointer(endByte)) - uintptr(unsafe.Pointer(startByte)) + 1
+	if atomic.Load(&pmemHeapBitsTrace) != 0 {
+		traceHeapBits(addr, typ, span.typIndex, startByte, numHeapBytes)
+	}
 
 	if optLog {
-		typAddr := (*int)(pmemHeapBitsAddr(span.base(), pArena))
-		// Write the type index (8 bytes) at the beginning of the log followed
-		// by the type metadata - kind, size ptrdata, gcdata (see _type structure
-		// representation in type.go).
-		if *typAddr != span.typIndex {
-			*typAddr = span.typIndex
+		tl := (*spanTypeLog)(pmemHeapBitsAddr(span.base(), pArena))
+		if tl.typIndex != span.typIndex {
+			tl.typIndex = span.typIndex
+		}
+		if span.typIndex >= 2 {
+			// The type is described in the type descriptor table in the
+			// header, so only the type index has to be logged.
+			pmemAddDirty(uintptr(unsafe.Pointer(&tl.typIndex)), unsafe.Sizeof(tl.typIndex))
+			return
 		}
 
-		tu := uintptr(unsafe.Pointer(typAddr))
-		kindAddr := (*uint8)(unsafe.Pointer(tu + intSize))
-		*kindAddr = typ.kind
-		sizeAddr := (*uintptr)(unsafe.Pointer(tu + 16))
-		*sizeAddr = typ.size
-		ptrAddr := (*uintptr)(unsafe.Pointer(tu + 24))
-		*ptrAddr = typ.ptrdata
-
-		// If typ.ptrdata is a multiple of 8, then the below step is not necessary
-		numHeapTypeBits := (typ.ptrdata + 7) / 8
-		numHeapTypeBytes := (numHeapTypeBits + 7) / 8
-		gcDataAddr := unsafe.Pointer(tu + 32)
-		memmove(gcDataAddr, unsafe.Pointer(typ.gcdata), numHeapTypeBytes)
-		PersistRange(unsafe.Pointer(typAddr), numHeapTypeBytes+32)
+		tl.kind = typ.kind
+		tl.size = typ.size
+		tl.ptrdata = typ.ptrdata
+		numHeapTypeBytes := typeMaskBytes(typ)
+		memmove(tl.mask(), unsafe.Pointer(typ.gcdata), numHeapTypeBytes)
+
+		// The fields written above are contiguous, so they are flushed as a
+		// single range.
+		pmemAddDirty(uintptr(unsafe.Pointer(tl)), unsafe.Sizeof(*tl)+numHeapTypeBytes)
 	} else {
 		logAddr := pmemHeapBitsAddr(addr, pArena)
 		// From heapBitsSetType()
@@ -86,25 +164,103 @@ func logHeapBits(addr uintptr, startByte, endByte *byte, typ *_type) {
 		// so there are no write-write races for access to the heap bitmap.
 		// Hence, heapBitsSetType can access the bitmap without atomics.
 		memmove(logAddr, unsafe.Pointer(startByte), numHeapBytes)
-		PersistRange(logAddr, numHeapBytes)
+		pmemAddDirty(uintptr(logAddr), numHeapBytes)
+	}
+}
+
+// Tiny blocks. The tiny allocator packs persistent memory objects smaller than
+// 16 bytes without pointers into 16-byte blocks of tinySpanClass spans, and
+// objects of exactly 16 bytes without pointers are allocated from the same
+// spans. The heap type bits of objects without pointers are otherwise unused,
+// so the pointer bit of the first word of a block records whether it is a tiny
+// block. The bit is logged along with the heap type bits, and restored with
+// them after a restart.
+
+// logTinyBlock records whether the 16-byte block at 'x' in a tinySpanClass
+// persistent memory span was allocated by the tiny allocator. It is called
+// for every allocation from such a span, so the bit of a reused block is
+// always up to date.
+func logTinyBlock(x uintptr, tiny bool) {
+	h := heapBitsForAddr(x)
+	mask := uint8(bitPointer << h.shift)
+	var bit uint8
+	if tiny {
+		bit = mask
+	}
+	logAddr := (*uint8)(pmemHeapBitsAddr(x, pArenaOf(x)))
+	if *h.bitp&mask == bit && *logAddr&mask == bit {
+		return
+	}
+	// As in logHeapBits(), there is only one allocation from a given span
+	// active at a time, so the bitmap bytes are written without atomics.
+	*h.bitp = *h.bitp&^mask | bit
+	*logAddr = *logAddr&^mask | bit
+	pmemAddDirty(uintptr(unsafe.Pointer(logAddr)), 1)
+}
+
+// isTinyBlock reports whether 'p' points into a block of the persistent
+// memory span 's' that was allocated by the tiny allocator
+func isTinyBlock(s *mspan, p uintptr) bool {
+	if s.spanclass != tinySpanClass {
+		return false
 	}
+	h := heapBitsForAddr(alignDown(p, maxTinySize))
+	return *h.bitp&(bitPointer<<h.shift) != 0
+}
+
+// The maximum number of ranges recorded in a pmemDirtyList. An allocation
+// writes at most two ranges: the span bitmap entry of a new span, and the
+// logged heap type bits or type of the span, or the tiny block bit of an
+// object without pointers.
+const maxDirtyRanges = 4
+
+// pmemDirtyList records the persistent memory metadata ranges written during
+// one persistent memory allocation. logSpanAlloc() and logHeapBits() add the
+// ranges they write to the list of the current M instead of persisting them,
+// and mallocgc() drains the list before returning the allocated object. This
+// way an allocation flushes all the metadata it writes but issues only one
+// fence, or two if it allocates a new span: the logged heap type bits of a new
+// span are persisted before its span bitmap entry is written. The ranges are
+// stored as uintptr, as the list is updated with mallocing set and its ranges
+// are not in the heap.
+type pmemDirtyList struct {
+	n      int
+	ranges [maxDirtyRanges][2]uintptr
+}
+
+// pmemAddDirty records that the 'size' bytes at 'addr' were written by the
+// current persistent memory allocation and have to be persisted before the
+// allocation returns. If the list is full, the range is flushed right away.
+func pmemAddDirty(addr, size uintptr) {
+	d := &getg().m.pmemDirty
+	if d.n == len(d.ranges) {
+		FlushRange(unsafe.Pointer(addr), size)
+		return
+	}
+	d.ranges[d.n] = [2]uintptr{addr, size}
+	d.n++
+}
+
+// pmemDrainDirty flushes the ranges recorded in the dirty list of 'mp' and
+// issues a single fence, if any range was recorded. It is called by mallocgc()
+// at the end of each persistent memory allocation.
+func pmemDrainDirty(mp *m) {
+	d := &mp.pmemDirty
+	if d.n == 0 {
+		return
+	}
+	for i := 0; i < d.n; i++ {
+		FlushRange(unsafe.Pointer(d.ranges[i][0]), d.ranges[i][1])
+	}
+	d.n = 0
+	Fence()
 }
 
 // pmemHeapBitsAddr returns the address in persistent memory where heap type
 // bitmap will be logged corresponding to virtual address 'x'
 func pmemHeapBitsAddr(x uintptr, pa *pArena) unsafe.Pointer {
-	off := uintptr(0)
-	if pa.fileOffset == 0 {
-		// Account the space occupied by the common persistent memory header
-		// present in the first arena.
-		off = pmemHeaderSize
-	}
-	pu := uintptr(unsafe.Pointer(pa))
-	mdSize, _ := pa.layout()
-	arenaStart := pu - off + mdSize
-	allocOffset := (x - arenaStart) / 32
-
-	typeBitsAddr := pu + pArenaHeaderSize
+	allocOffset := (x - pa.dataStart()) / bytesPerBitmapByte
+	typeBitsAddr := uintptr(unsafe.Pointer(pa)) + arenaHeaderSize()
 	return unsafe.Pointer(typeBitsAddr + allocOffset)
 }
 
@@ -114,6 +270,8 @@ func logSpanAlloc(s *mspan) {
 		throw("Invalid span passed to logSpanAlloc")
 	}
 
+	pmemVerboseSpan("alloc", s)
+
 	// The address at which the span value has to be logged
 	logAddr := spanLogAddr(s)
 
@@ -143,8 +301,9 @@ func logSpanAlloc(s *mspan) {
 	*/
 
 	atomic.Store(logAddr, logVal)
-	// Store fence will be called at the end of mallocgc()
-	FlushRange(unsafe.Pointer(logAddr), unsafe.Sizeof(*logAddr))
+	// The entry is flushed and fenced at the end of mallocgc(), after the
+	// heap type bits logged for the span are persistent
+	pmemAddDirty(uintptr(unsafe.Pointer(logAddr)), unsafe.Sizeof(*logAddr))
 }
 
 // Function to log that a span has been completely freed. This is done by
@@ -159,98 +318,356 @@ func logSpanFree(s *mspan) {
 	PersistRange(unsafe.Pointer(logAddr), unsafe.Sizeof(*logAddr))
 }
 
-// A helper function to compute the value that should be logged to record the
-// allocation of span s.
-// For a small span, the value logged is -
-// (s.spc << 2 | optTypeLog << 1 | s.needzero) and for a large span the value
-// logged is - ((67+s.npages-4) << 3 | s.spc << 2 | optTypeLog << 1 | s.needzero).
+// The value logged in the span bitmap to record the allocation of a span is:
+//
+//	small span: spc << 2 | optTypeLog << 1 | needzero
+//	large span: (67+npages-4) << 3 | spc << 2 | needzero
+//
+// Bit 0 is the needzero value of the span in both cases. A small span uses the
+// remaining bits to store its spanclass, which is at most maxSmallSpanclass,
+// and the size class of the span gives its number of pages. A large span has a
+// spanclass of 0 or 1, so only bit 2 (the noscan bit) of the spanclass is
+// stored, and bits 3 and above store the number of pages. A large span has at
+// least 5 pages, so the value logged for a large span is always larger than
+// maxSmallSpanLogVal, which tells the two encodings apart.
 // For a small span, optTypeLog bit indicates that the heap type bits logged for
 // this span is an optimized representation - only the first object in the span
 // has its type bits logged. All other objects in the span have the same type
-// representation.
-// optTypeLog bit is currently unused for a large span.
+// representation. Bit 1 is always 0 for a large span, and is ignored when a
+// large span value is decoded.
+
+// A helper function to compute the value that should be logged to record the
+// allocation of span s.
 func spanLogValue(s *mspan) uint32 {
-	logVal := uintptr(0)
-	if s.elemsize > maxSmallSize { // large allocation
-		npages := s.elemsize >> pageShift
-		logVal = (67+npages-4)<<3 | uintptr(s.spanclass)<<2 | uintptr(s.needzero)
+	return spanLogEncode(s.spanclass, s.npages, s.elemsize > maxSmallSize,
+		s.needzero != 0, s.typIndex != 0)
+}
+
+// spanLogEncode returns the span bitmap value of a span with spanclass 'spc'
+// and 'npages' pages. 'optType' is not recorded for a large span.
+func spanLogEncode(spc spanClass, npages uintptr, large, needzero, optType bool) uint32 {
+	logVal := uintptr(bool2int(needzero))
+	if large {
+		logVal |= (67+npages-4)<<3 | uintptr(spc)<<2
 	} else {
-		optTypeLog := bool2int(s.typIndex != 0)
-		logVal = uintptr(s.spanclass)<<2 | uintptr(optTypeLog)<<1 | uintptr(s.needzero)
+		logVal |= uintptr(spc)<<2 | uintptr(bool2int(optType))<<1
 	}
 	return uint32(logVal)
 }
 
+// spanLogDecode is the inverse of spanLogEncode. It returns the spanclass, the
+// number of pages, whether the span is a large span, the needzero value, and
+// whether the heap type bits are logged using the optimized representation, of
+// the span that was logged as 'sVal' in the span bitmap.
+func spanLogDecode(sVal uint32) (spc spanClass, npages uintptr, large, needzero, optType bool) {
+	needzero = (sVal & 1) == 1
+	if sVal > maxSmallSpanLogVal { // large allocation
+		large = true
+		noscan := (sVal >> 2 & 1) == 1
+		npages = uintptr((sVal >> 3) - 67 + 4)
+		spc = makeSpanClass(0, noscan)
+	} else {
+		optType = (sVal >> 1 & 1) == 1
+		npages = uintptr(class_to_allocnpages[sVal>>3])
+		spc = spanClass(sVal >> 2)
+	}
+	return
+}
+
+// checkSpanBitmap checks that every span recorded in the span bitmap 'bitmap'
+// can be decoded. A span log value is valid if it decodes to a small span
+// class with a size class, or to a large span of more than maxSmallSize bytes,
+// and if the pages of the span are within the bitmap. A value can be invalid
+// if the span bitmap was corrupted, or if a crash happened while it was being
+// written. It returns the index of the first page with an invalid value.
+func checkSpanBitmap(bitmap []uint32) (page uintptr, ok bool) {
+	for i := uintptr(0); i < uintptr(len(bitmap)); {
+		sVal := bitmap[i]
+		if sVal == 0 {
+			i++
+			continue
+		}
+		spc, npages, large, _, _ := spanLogDecode(sVal)
+		if !validSpanLog(spc, npages, large) || npages > uintptr(len(bitmap))-i {
+			return i, false
+		}
+		i += npages
+	}
+	return 0, true
+}
+
+// validSpanLog reports whether a span log value that decodes to 'spc',
+// 'npages', and 'large' describes a valid span.
+func validSpanLog(spc spanClass, npages uintptr, large bool) bool {
+	if large {
+		return npages<<pageShift > maxSmallSize && npages <= maxLargeSpanPages
+	}
+	sc := spc.sizeclass()
+	return sc != 0 && sc < _NumSizeClasses
+}
+
+// validateSpanBitmap checks the span bitmap of the persistent memory arena
+// 'pa' before the spans recorded in it are reconstructed.
+func (pa *pArena) validateSpanBitmap() error {
+	return validateSpanBitmap(pa.spanBitmap(), pa.fileOffset)
+}
+
+func validateSpanBitmap(bitmap []uint32, arenaOffset uintptr) error {
+	if page, ok := checkSpanBitmap(bitmap); !ok {
+		return spanLogError{arenaOffset, page, bitmap[page]}
+	}
+	return nil
+}
+
 // A helper function to compute the address at which the span log has to be
 // written.
 func spanLogAddr(s *mspan) *uint32 {
 	ai := arenaIndex(s.base())
 	arena := mheap_.arenas[ai.l1()][ai.l2()]
-	pArena := (*pArena)(unsafe.Pointer(arena.pArena))
-	mdSize, allocSize := pArena.layout()
-	arenaStart := pArena.mapAddr + mdSize
-
-	offset := uintptr(0)
-	if pArena.fileOffset == 0 {
-		// Account the space occupied by the common persistent memory header
-		// present in the first arena.
-		offset = pmemHeaderSize
-	}
-
-	// Add offset, arena header, and heap typebitmap size to get the address of span bitmap
-	spanBitmap := pArena.mapAddr + offset + pArenaHeaderSize + allocSize/bytesPerBitmapByte
+	pa := (*pArena)(unsafe.Pointer(arena.pArena))
 
 	// Index of the first page of this span within the persistent memory arena
-	pageOffset := (s.base() - arenaStart) >> pageShift
-
-	logAddr := spanBitmap + (pageOffset * spanBytesPerPage)
-	return (*uint32)(unsafe.Pointer(logAddr))
+	pageOffset := (s.base() - pa.dataStart()) >> pageShift
+	return &pa.spanBitmap()[pageOffset]
 }
 
 // The following functions help implement a minimal undo log in the runtime
 // using persistent memory arena header undo buffers.
-// Each arena support storing two data items. Both data items are stored as a
-// signed int value. The only unsigned value logged here is the arena map address
-// (mapAddr). But since Go uses only 48 bits for heap address (see comment about
-// heapAddrBits in malloc.go), it is safe to store and retrieve mapAddr as a
-// signed value.
-
-// Function to log a value in the arena header. Each arena supports logging up
-// to 'maxLogEntries' number of entries.
-func (pa *pArena) logEntry(addr unsafe.Pointer) {
+// Each arena header stores up to pmemInfo.logSlots log entries, and the rest are
+// stored in a spill buffer. Each log entry stores up to 'logDataSize' bytes of
+// data along with the offset and the length of the logged range.
+// An arena has a single undo log which can only log ranges within the arena.
+// The functions below can be called concurrently, but a commit or a revert
+// applies to all the entries in the log, including those added by other
+// goroutines. Transactions (PTx) do not use the arena undo logs.
+
+// logLock returns the lock that protects the undo log of the arena 'pa'. The
+// lock is kept in the volatile metadata of the heap arena that holds the arena
+// header, as the arena header itself is in persistent memory.
+func (pa *pArena) logLock() *mutex {
+	ai := arenaIndex(uintptr(unsafe.Pointer(pa)))
+	return &mheap_.arenas[ai.l1()][ai.l2()].pLogLock
+}
+
+// Function to log the 'size' bytes at address 'addr' in the arena undo log.
+// A log entry, including its offset and length, is persisted before the number
+// of log entries is incremented. So a crash while logging never exposes a
+// partially written entry to revertLog(). It throws if the range cannot be
+// logged, see tryLogEntry().
+func (pa *pArena) logEntry(addr unsafe.Pointer, size uintptr) {
+	if err := pa.tryLogEntry(addr, size); err != nil {
+		throw(string(err.(errorString)))
+	}
+}
+
+var (
+	errLogRange = errorString("Invalid arena logging request")
+	errLogFull  = errorString("No more space in the arena to log values")
+)
+
+// tryLogEntry is like logEntry, but returns an error instead of throwing if
+// the range is not within the arena, or if the log cannot be grown to hold it.
+// A range that does not fit in the log may be partially logged. This is safe,
+// as reverting the log only restores the old contents of the logged part.
+func (pa *pArena) tryLogEntry(addr unsafe.Pointer, size uintptr) error {
 	// Store the offset from the beginning of the arena instead of the
 	// actual address
 	off := uintptr(addr) - uintptr(unsafe.Pointer(pa))
-	if off >= pa.size {
-		throw("Invalid arena logging request")
+	if off >= pa.size || size > pa.size-off {
+		return errLogRange
 	}
 
-	ind := pa.numLogEntries
-	if ind == maxLogEntries {
-		throw("No more space in the arena to log values")
+	lock(pa.logLock())
+	defer unlock(pa.logLock())
+	for size > 0 {
+		n := size
+		if n > logDataSize {
+			n = logDataSize
+		}
+
+		ind := pa.numLogEntries
+		slots := int(pmemInfo.logSlots)
+		var e *logEntry
+		if ind < slots {
+			e = pa.logSlot(ind)
+		} else {
+			spill, capacity := pa.spillFor(ind - slots + 1)
+			if spill == 0 {
+				// The spill buffer has to grow. It is allocated without
+				// holding the log lock, as mallocgc() can invoke the
+				// callbacks of the application. Entries may be logged
+				// meanwhile, so the entry index is computed again.
+				unlock(pa.logLock())
+				buf := newSpill(ind-slots+1, capacity)
+				lock(pa.logLock())
+				if buf == nil {
+					return errLogFull
+				}
+				pa.installSpill(buf)
+				continue
+			}
+			e = spillEntry(spill, ind-slots)
+		}
+
+		e.off = off
+		e.len = n
+		memmove(unsafe.Pointer(&e.data[0]), addr, n)
+		PersistRange(unsafe.Pointer(e), logEntrySize)
+
+		pa.numLogEntries = ind + 1
+		PersistRange(unsafe.Pointer(&pa.numLogEntries), intSize)
+
+		addr = add(addr, n)
+		off += n
+		size -= n
 	}
+	return nil
+}
 
-	val := *(*int)(addr)
-	pa.logs[ind].off = off
-	pa.logs[ind].val = val
-	PersistRange(unsafe.Pointer(&pa.logs[ind]), logEntrySize)
+// logAt returns the i-th log entry of the arena. 'spill' is the address of
+// the spill buffer of the arena, and is used only if i is not less than the
+// number of log slots in the arena header.
+func (pa *pArena) logAt(i int, spill uintptr) *logEntry {
+	if slots := int(pmemInfo.logSlots); i >= slots {
+		return spillEntry(spill, i-slots)
+	}
+	return pa.logSlot(i)
+}
 
-	pa.numLogEntries = ind + 1
-	PersistRange(unsafe.Pointer(&pa.numLogEntries), intSize)
+// logSlot returns the i-th log entry stored in the arena header. The log slots
+// follow the fixed part of the arena header.
+func (pa *pArena) logSlot(i int) *logEntry {
+	return (*logEntry)(add(unsafe.Pointer(pa), pArenaHeaderSize+uintptr(i)*logEntrySize))
 }
 
-// Copies the logged data back back to persistent memory
+func spillEntry(spill uintptr, i int) *logEntry {
+	return (*logEntry)(unsafe.Pointer(spill + intSize + uintptr(i)*logEntrySize))
+}
+
+// spillAddr returns the address of the spill buffer of the arena. If the
+// spill buffer was allocated in a previous run, its address is computed from
+// the file offset stored in the arena header.
+func (pa *pArena) spillAddr() uintptr {
+	if pa.numLogEntries <= int(pmemInfo.logSlots) {
+		return 0
+	}
+	lock(&logSpills.lock)
+	spill := logSpills.m[uintptr(unsafe.Pointer(pa))]
+	unlock(&logSpills.lock)
+	if spill != nil {
+		return uintptr(spill)
+	}
+	addr := addrOfFileOffset(pa.logSpill)
+	if addr == 0 {
+		throw("Invalid arena log spill buffer")
+	}
+	return addr
+}
+
+// spillFor returns the address of the spill buffer of the arena if it can hold
+// at least 'n' entries. Otherwise it returns 0 and the capacity of the spill
+// buffer, and the caller has to grow it using newSpill() and installSpill().
+// The log lock must be held.
+func (pa *pArena) spillFor(n int) (spill uintptr, capacity int) {
+	spill, capacity = pa.currentSpill()
+	if spill == 0 || n > capacity {
+		return 0, capacity
+	}
+	if pa.logSpill != fileOffsetOf(spill) {
+		pa.logSpill = fileOffsetOf(spill)
+		PersistRange(unsafe.Pointer(&pa.logSpill), intSize)
+	}
+	return spill, capacity
+}
+
+// currentSpill returns the address and the capacity of the spill buffer of the
+// arena, or 0 if it has none. The log lock must be held.
+func (pa *pArena) currentSpill() (spill uintptr, capacity int) {
+	spill = pa.spillAddr()
+	if spill == 0 {
+		// There are no spill entries in use, but a buffer allocated
+		// previously in this run can be reused.
+		lock(&logSpills.lock)
+		spill = uintptr(logSpills.m[uintptr(unsafe.Pointer(pa))])
+		unlock(&logSpills.lock)
+	}
+	if spill != 0 {
+		capacity = *(*int)(unsafe.Pointer(spill))
+	}
+	return spill, capacity
+}
+
+// newSpill allocates a spill buffer that can hold at least 'n' entries, and
+// at least twice as many as a buffer of 'capacity' entries. It returns nil if
+// the buffer cannot be allocated. It must be called without holding the log
+// lock.
+func newSpill(n, capacity int) unsafe.Pointer {
+	if pmemInfo.initState != initDone {
+		// Persistent memory cannot be allocated during initialization
+		return nil
+	}
+	newCap := 2 * capacity
+	if newCap < minSpillEntries {
+		newCap = minSpillEntries
+	}
+	for newCap < n {
+		newCap *= 2
+	}
+	buf := mallocgc(intSize+uintptr(newCap)*logEntrySize, nil, true, isPersistent)
+	if buf == nil {
+		return nil
+	}
+	*(*int)(buf) = newCap
+	return buf
+}
+
+// installSpill makes 'buf' the spill buffer of the arena, unless the current
+// spill buffer is at least as large. A larger buffer is made visible to the
+// recovery code only after all the existing spill entries are copied into it.
+// The log lock must be held.
+func (pa *pArena) installSpill(buf unsafe.Pointer) {
+	newCap := *(*int)(buf)
+	inUse := pa.numLogEntries - int(pmemInfo.logSlots)
+	spill, capacity := pa.currentSpill()
+	if newCap <= capacity || newCap < inUse {
+		// The spill buffer was grown meanwhile. 'buf' is unreachable and
+		// is freed by the garbage collector.
+		return
+	}
+	size := intSize + uintptr(newCap)*logEntrySize
+	if inUse > 0 {
+		memmove(add(buf, intSize), unsafe.Pointer(spill+intSize), uintptr(inUse)*logEntrySize)
+	}
+	PersistRange(buf, size)
+
+	lock(&logSpills.lock)
+	if logSpills.m == nil {
+		logSpills.m = make(map[uintptr]unsafe.Pointer)
+	}
+	logSpills.m[uintptr(unsafe.Pointer(pa))] = buf
+	unlock(&logSpills.lock)
+
+	pa.logSpill = fileOffsetOf(uintptr(buf))
+	PersistRange(unsafe.Pointer(&pa.logSpill), intSize)
+}
+
+// Copies the logged data back to persistent memory. The entries are
+// reverted from the last to the first, so that an address that was logged more
+// than once is restored to its oldest value.
 func (pa *pArena) revertLog() {
+	lock(pa.logLock())
+	defer unlock(pa.logLock())
 	if pa.numLogEntries == 0 {
 		// No log entries to revert
 		return
 	}
 
-	for i := 0; i < pa.numLogEntries; i++ {
-		addr := unsafe.Pointer(pa.logs[i].off + uintptr(unsafe.Pointer(pa)))
-		ai := (*int)(addr)
-		*ai = pa.logs[i].val
-		PersistRange(addr, intSize)
+	spill := pa.spillAddr()
+	for i := pa.numLogEntries - 1; i >= 0; i-- {
+		e := pa.logAt(i, spill)
+		addr := unsafe.Pointer(e.off + uintptr(unsafe.Pointer(pa)))
+		memmove(addr, unsafe.Pointer(&e.data[0]), e.len)
+		PersistRange(addr, e.len)
 	}
 
 	pa.numLogEntries = 0
@@ -259,16 +676,22 @@ func (pa *pArena) revertLog() {
 
 // Discards all log entries without copying any data
 func (pa *pArena) resetLog() {
+	lock(pa.logLock())
 	pa.numLogEntries = 0
 	PersistRange(unsafe.Pointer(&pa.numLogEntries), intSize)
+	unlock(pa.logLock())
 }
 
 // Discards the log entries by setting numLogEntries as 0. It also flushes the
 // persistent memory addresses into which data were written.
 func (pa *pArena) commitLog() {
+	lock(pa.logLock())
+	defer unlock(pa.logLock())
+	spill := pa.spillAddr()
 	for i := 0; i < pa.numLogEntries; i++ {
-		addr := pa.logs[i].off + uintptr(unsafe.Pointer(pa))
-		PersistRange(unsafe.Pointer(addr), intSize)
+		e := pa.logAt(i, spill)
+		addr := e.off + uintptr(unsafe.Pointer(pa))
+		PersistRange(unsafe.Pointer(addr), e.len)
 	}
 	pa.numLogEntries = 0
 	PersistRange(unsafe.Pointer(&pa.numLogEntries), intSize)
@@ -8,7 +8,13 @@ import "unsafe"
 const (
 	fileCreate = (1 << 0)
 	fileExcl     = (1 << 1)
-	fileAllFlags = fileCreate | fileExcl
+	// Map the file only at the requested address, and fail instead of
+	// replacing any existing mapping in the requested range
+	fileNoReplace = (1 << 2)
+	// Open the file read-only and map it copy-on-write, so that writes to the
+	// mapping are never written back to the file. The file is not extended.
+	fileReadOnly = (1 << 3)
+	fileAllFlags = fileCreate | fileExcl | fileNoReplace | fileReadOnly
 
 	// The valid file open modes that can be passed to the open system call are
 	// 0400, 0200, etc (see http://man7.org/linux/man-pages/man2/open.2.html).
@@ -27,6 +33,10 @@ const (
 	// persistent memory region. This constant will then help to differentiate
 	// between a first run and subsequent runs.
 	hdrMagic = 0x73E85840266B4B1E
+
+	// The alignment of the mappings of a device dax whose alignment cannot be
+	// read from sysfs. This is the default alignment of the kernel.
+	devDaxDefaultAlign = 2 << 20
 )
 
 // mapFile creates or opens the file passed as argument and maps it to memory.
@@ -34,12 +44,15 @@ const (
 // indicate if the path is on a persistent memory device, and an error value.
 // 'path' points to the file to be mapped, 'len' is the file length to be mapped
 // in memory, 'flags' and 'mode' are the values to be passed to the file open
-// system call. Supported flags are: fileCreate and fileExcl
+// system call. Supported flags are: fileCreate, fileExcl, fileNoReplace and
+// fileReadOnly.
 // 'off' is the offset in the file.
 // 'mapAddr' is the address at which the caller wants to map the file. It can be
 // set as nil if the caller has no preference on the mapping address.
 // If the file length is less than the region requested to be mapped, then the
 // file will be extended to accommodate the map request.
+// 'path' can also be a device dax, which is opened without creating it, and is
+// never extended (see mapDevDax()).
 // Some of the code layout taken from PMDK's libpmem library.
 func mapFile(path string, len, flags, mode int, off uintptr,
 	mapAddr unsafe.Pointer) (addr unsafe.Pointer, isPmem bool, err int) {
@@ -59,8 +72,12 @@ func mapFile(path string, len, flags, mode int, off uintptr,
 
 	devDax := isFileDevDax(path)
 	if devDax {
-		println("Device DAX not supported")
-		return
+		// A device dax always exists, and can only be mapped shared, so
+		// fileCreate is ignored and the mapping cannot be copy-on-write
+		if flags&(fileExcl|fileReadOnly) != 0 {
+			println("fileExcl and fileReadOnly not allowed for a device dax")
+			return
+		}
 	} else {
 		if flags&fileCreate != 0 {
 			if len < 0 {
@@ -83,11 +100,19 @@ func mapFile(path string, len, flags, mode int, off uintptr,
 			openFlags |= _O_EXCL
 		}
 
-		if (len != 0) && (flags&fileCreate == 0) {
+		if (len != 0) && (flags&(fileCreate|fileReadOnly) == 0) {
 			println("Non-zero 'len' not allowed without fileCreate flag")
 			return
 		}
 
+		if flags&fileReadOnly != 0 {
+			if flags&fileCreate != 0 {
+				println("fileCreate not allowed with fileReadOnly flag")
+				return
+			}
+			openFlags = _O_RDONLY
+		}
+
 		if (len == 0) && (flags&fileCreate != 0) {
 			println("Zero 'len' not allowed with fileCreate flag")
 			return
@@ -111,7 +136,11 @@ func mapFile(path string, len, flags, mode int, off uintptr,
 		return
 	}
 
-	addr, isPmem, err = mapHelper(fd, flags, len, off, mapAddr, fsize)
+	if devDax {
+		addr, isPmem, err = mapDevDax(fd, flags, len, off, mapAddr, fsize)
+	} else {
+		addr, isPmem, err = mapHelper(fd, flags, len, off, mapAddr, fsize)
+	}
 	if err != 0 && delFileOnErr {
 		unlinkFile(path)
 	}
@@ -120,8 +149,41 @@ func mapFile(path string, len, flags, mode int, off uintptr,
 	return
 }
 
+// mapDevDax maps 'len' bytes at offset 'off' of the device dax 'fd', which is
+// 'fsize' bytes long. The kernel only maps a device dax in whole units of its
+// alignment, so the offset must be aligned and the length is rounded up to the
+// alignment. The arenas are mapped at multiples of pallocChunkBytes, so larger
+// alignments are not supported. A device dax cannot be extended, so the
+// mapping fails with ENOSPC if it extends beyond the end of the device.
+func mapDevDax(fd int32, flags, len int, off uintptr, mapAddr unsafe.Pointer,
+	fsize int) (addr unsafe.Pointer, isPmem bool, err int) {
+	align := utilDevDaxAlign(fd)
+	if align > pallocChunkBytes {
+		println("mapDevDax: device alignment is not supported")
+		return nil, false, _EINVAL
+	}
+	if off%align != 0 {
+		println("mapDevDax: offset is not aligned to the device alignment")
+		return nil, false, _EINVAL
+	}
+	n := alignUp(uintptr(len), align)
+	if uintptr(fsize) < off+n {
+		return nil, false, _ENOSPC
+	}
+	mapFlags := __MAP_SHARED
+	if flags&fileNoReplace != 0 {
+		mapFlags |= _MAP_FIXED_NOREPLACE
+	}
+	return utilMap(mapAddr, fd, int(n), mapFlags, off, false)
+}
+
 func mapHelper(fd int32, flags, len int, off uintptr,
 	mapAddr unsafe.Pointer, fsize int) (addr unsafe.Pointer, isPmem bool, err int) {
+	if flags&fileReadOnly != 0 && fsize < (int(off)+len) {
+		// A file opened read-only cannot be extended
+		println("mapHelper: file is too small")
+		return nil, false, _EINVAL
+	}
 	if fsize < (int(off) + len) {
 		// Need to extend the file to map the file
 		// set the length of the file to 'off+len'
@@ -135,5 +197,15 @@ func mapHelper(fd int32, flags, len int, off uintptr,
 		}
 	}
 
-	return utilMap(mapAddr, fd, len, __MAP_SHARED, off, false)
+	mapFlags := __MAP_SHARED
+	if flags&fileReadOnly != 0 {
+		// A read-only file is mapped copy-on-write rather than PROT_READ, as
+		// reconstruction and the garbage collector write to the mapping. The
+		// written pages are never stored in the file. See pmemReadOnly.go.
+		mapFlags = _MAP_PRIVATE
+	}
+	if flags&fileNoReplace != 0 {
+		mapFlags |= _MAP_FIXED_NOREPLACE
+	}
+	return utilMap(mapAddr, fd, len, mapFlags, off, false)
 }
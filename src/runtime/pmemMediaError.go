@@ -0,0 +1,112 @@
+package runtime
+
+import "unsafe"
+
+// A PmemMediaError is the value of the panic raised when a goroutine accesses
+// a persistent memory address that cannot be read or written, and the kernel
+// delivers a SIGBUS signal instead. This happens when the persistent memory
+// device reports a bad block (hardware poison), or when the backing file was
+// truncated while it was mapped. The data at the address is lost, but the
+// rest of the heap is not affected, so the application can recover from the
+// panic and, for example, drop or rebuild the object that holds the address.
+type PmemMediaError struct {
+	addr     uintptr // The faulting address
+	offset   uintptr // The file offset of the faulting address
+	object   uintptr // The start address of the object that holds the address
+	span     uintptr // The start address of the span that holds the address
+	spanSize uintptr // The size of the span in bytes
+}
+
+func (e *PmemMediaError) RuntimeError() {}
+
+func (e *PmemMediaError) Error() string {
+	var buf [200]byte
+	b := append(buf[:0], "runtime error: persistent memory media error at address "...)
+	b = appendHex(b, e.addr)
+	b = append(b, " (file offset "...)
+	b = appendHex(b, e.offset)
+	b = append(b, ", object "...)
+	b = appendHex(b, e.object)
+	b = append(b, ", span "...)
+	b = appendHex(b, e.span)
+	b = append(b, " of "...)
+	var ibuf [20]byte
+	b = append(b, itoa(ibuf[:], uint64(e.spanSize))...)
+	b = append(b, " bytes)"...)
+	return string(b)
+}
+
+// Addr returns the address where the fault occurred.
+func (e *PmemMediaError) Addr() uintptr {
+	return e.addr
+}
+
+// Offset returns the offset of the faulting address in the persistent memory
+// file. The offset can be used to clear the bad block on the device.
+func (e *PmemMediaError) Offset() uintptr {
+	return e.offset
+}
+
+// Object returns the start address of the persistent memory object that holds
+// the faulting address. It is 0 if the address is not in an allocated slot.
+func (e *PmemMediaError) Object() uintptr {
+	return e.object
+}
+
+// appendHex appends the hexadecimal representation of 'v' to 'b'
+func appendHex(b []byte, v uintptr) []byte {
+	const dig = "0123456789abcdef"
+	var buf [2 * intSize]byte
+	i := len(buf)
+	for {
+		i--
+		buf[i] = dig[v%16]
+		v /= 16
+		if v == 0 {
+			break
+		}
+	}
+	return append(append(b, "0x"...), buf[i:]...)
+}
+
+// pmemMediaError returns the description of a fault at the persistent memory
+// address 'addr', or nil if 'addr' is not in a persistent memory span. It is
+// called by sigpanic() when a SIGBUS signal is delivered.
+func pmemMediaError(addr uintptr) *PmemMediaError {
+	s := spanOfHeap(addr)
+	if s == nil || s.memtype != isPersistent {
+		return nil
+	}
+	e := &PmemMediaError{
+		addr:     addr,
+		offset:   mediaOffsetOf(addr),
+		span:     s.base(),
+		spanSize: s.npages << pageShift,
+	}
+	if i := s.objIndex(addr); i < s.nelems && !s.isFree(i) {
+		e.object = s.base() + i*s.elemsize
+	}
+	return e
+}
+
+// mediaOffsetOf returns the offset of the persistent memory address 'addr' in
+// the file. Unlike fileOffsetOf(), it includes the header region that precedes
+// the header of the first arena.
+func mediaOffsetOf(addr uintptr) uintptr {
+	ai := arenaIndex(addr)
+	pa := (*pArena)(unsafe.Pointer(mheap_.arenas[ai.l1()][ai.l2()].pArena))
+	return fileOffsetOf(addr) + pa.headerOffset()
+}
+
+// printPmemMediaError prints the description of a fault at the persistent
+// memory address 'addr' if it is in a persistent memory span. This is used
+// when the goroutine that faulted cannot panic.
+func printPmemMediaError(addr uintptr) {
+	s := spanOfHeap(addr)
+	if s == nil || s.memtype != isPersistent {
+		return
+	}
+	print("persistent memory media error at address ", hex(addr),
+		" (file offset ", hex(mediaOffsetOf(addr)), ", span ", hex(s.base()),
+		" of ", s.npages<<pageShift, " bytes)\n")
+}
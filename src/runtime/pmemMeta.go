@@ -10,20 +10,29 @@ const (
 	bytesPerBitmapByte = wordsPerBitmapByte * sys.PtrSize
 
 	// The number of bytes needed to log a span allocation in the span bitmap.
-	// To log allocation of a small span s, the value recorded is
-	// ((s.spanclass) << 1 | s.needzero).
-	// spanClass for a small allocation vary from 4 to 133. For a large
-	// allocation that uses 'npages' pages and has spanClass 'spc', the value
-	// recorded is: ((66+npages-4) << 2 | spc << 1 | s.needzero).
+	// See spanLogValue() for the value recorded for small and large spans.
 	// A large span uses 5 or more pages, and its spanClass is always 0 or 1.
 	spanBytesPerPage = 4
+
+	// The maximum number of pages in a large span whose allocation can be
+	// recorded in a span bitmap entry. The value logged for a large span is
+	// ((67+npages-4) << 3 | ...) which has to fit in spanBytesPerPage bytes.
+	// A span never crosses a persistent memory arena, but a large span can
+	// cover several heap arenas.
+	maxLargeSpanPages = (1 << (spanBytesPerPage*8 - 3)) - 1 - 67 + 4
 )
 
 // Computes the size of the persistent memory metadata section necessary
-// for an arena of size 'size'. The metadata occupies pArenaHeaderSize bytes to
+// for an arena of size 'size'. The metadata occupies arenaHeaderSize() bytes to
 // store the arena header and a variable number of bytes to store the heap type
 // bitmap and the span bitmap. See pArena struct.
 func metadataSize(size uintptr) uintptr {
+	return metadataSizeFor(size, arenaHeaderSize())
+}
+
+// metadataSizeFor is like metadataSize(), for arenas with headers of 'hdrSize'
+// bytes
+func metadataSizeFor(size, hdrSize uintptr) uintptr {
 	if size%pageSize != 0 {
 		throw("size has to a multiple of page size")
 	}
@@ -33,7 +42,13 @@ func metadataSize(size uintptr) uintptr {
 	// Size required for the span bitmap
 	spanBitmapSize := (size / pageSize) * spanBytesPerPage
 
-	return uintptr(pArenaHeaderSize + heapBitmapSize + spanBitmapSize)
+	return uintptr(hdrSize + heapBitmapSize + spanBitmapSize)
+}
+
+// arenaHeaderSize returns the size of an arena header, including the log
+// slots that follow its fixed part
+func arenaHeaderSize() uintptr {
+	return pArenaHeaderSize + pmemInfo.logSlots*logEntrySize
 }
 
 // Given a persistent memory arena of total 'size' bytes, this function computes
@@ -53,23 +68,278 @@ func metadataSize(size uintptr) uintptr {
 // TODO: this calculations in this function needs to be further improved
 // TODO XXX jerrin
 func (p *pArena) layout() (uintptr, uintptr) {
+	return arenaLayout(p.size, p.headerOffset(), arenaHeaderSize())
+}
+
+// arenaLayout computes the layout of an arena of 'size' bytes whose first 'off'
+// bytes are reserved, and whose header is 'hdrSize' bytes, as described above
+func arenaLayout(size, off, hdrSize uintptr) (uintptr, uintptr) {
 	// ps := pageSize / spanBytesPerPage
 	// Y + metadataSize(Y) = S'
-	// Y + (pArenaHeaderSize + Y/bytesPerBitmapByte + Y/ps) = S'
-	// Y = (ps * (S' - pArenaHeaderSize)) / ((ps/bytesPerBitmapByte) + 1 + ps)
-	var off uintptr
-	if p.fileOffset == 0 {
-		off = pmemHeaderSize
-	}
+	// Y + (hdrSize + Y/bytesPerBitmapByte + Y/ps) = S'
+	// Y = (ps * (S' - hdrSize)) / ((ps/bytesPerBitmapByte) + 1 + ps)
 	ps := uintptr(pageSize / spanBytesPerPage)
-	availSize := p.size - off
-	Y := (ps * (availSize - pArenaHeaderSize)) / ((ps / bytesPerBitmapByte) + 1 + ps)
-	rem := p.size - Y
+	availSize := size - off
+	Y := (ps * (availSize - hdrSize)) / ((ps / bytesPerBitmapByte) + 1 + ps)
+	rem := size - Y
 	remRound := alignUp(rem, pageSize)
-	usable := p.size - remRound
+	usable := size - remRound
 	return remRound, usable
 }
 
+// arenaGrowthSize returns the size of the arena that mheap.sysAlloc() maps for
+// the smallest heap growth, which is one palloc chunk (see mheap.grow()), if
+// the first 'off' bytes of the arena are reserved and its header is 'hdrSize'
+// bytes
+func arenaGrowthSize(off, hdrSize uintptr) uintptr {
+	n := uintptr(pallocChunkBytes)
+	return alignUp(n+alignUp(metadataSizeFor(n, hdrSize)+off, pageSize), heapArenaBytes)
+}
+
+// reservedRegionFits reports whether the first arena of a new file, which holds
+// the header region with an application reserved region of 'reserved' bytes,
+// can be mapped without growing the file beyond 'limit' bytes, and still have
+// space for the allocator. 'limit' is 0 if the file size is not limited, and
+// 'short' is set if short arenas are enabled (see PmemOptions.ShortArenas).
+func reservedRegionFits(reserved, limit, hdrSize uintptr, short bool) bool {
+	if reserved > maxAlloc {
+		return false
+	}
+	off := headerRegionSize(reserved)
+	if limit == 0 || arenaGrowthSize(off, hdrSize) <= limit {
+		return true
+	}
+	room := alignDown(limit, pallocChunkBytes)
+	if !short || room < heapArenaBytes || room <= off+hdrSize {
+		return false
+	}
+	_, usable := arenaLayout(room, off, hdrSize)
+	return usable >= pallocChunkBytes
+}
+
+// headerOffset returns the number of bytes at the beginning of the arena that
+// are used by the common persistent memory header region. Only the first arena
+// in the file holds the header region, and the arena header follows it.
+func (p *pArena) headerOffset() uintptr {
+	if p.fileOffset == 0 {
+		return pmemInfo.hdrRegionSize
+	}
+	return 0
+}
+
+// dataStart returns the address of the first allocator usable byte of the
+// arena. It follows the header region (in the first arena only), the arena
+// header, the heap type bitmap, and the span bitmap, rounded up to a page. The
+// address is computed from the address of the arena header rather than from
+// p.mapAddr, as p.mapAddr holds the previous map address of a relocated arena
+// until its pointers are swizzled.
+func (p *pArena) dataStart() uintptr {
+	mdSize, _ := p.layout()
+	return uintptr(unsafe.Pointer(p)) - p.headerOffset() + mdSize
+}
+
+// spanBitmap returns the span bitmap of the persistent memory arena 'p'. The
+// bitmap has one entry for each page in the allocator usable region of the
+// arena. Only the entry corresponding to the first page of an in-use span is
+// non-zero.
+func (p *pArena) spanBitmap() []uint32 {
+	_, allocSize := p.layout()
+	allocPages := allocSize >> pageShift
+	typeBitsAddr := uintptr(unsafe.Pointer(p)) + arenaHeaderSize()
+	spanBitsAddr := unsafe.Pointer(typeBitsAddr + allocSize/bytesPerBitmapByte)
+	return (*(*[1 << 28]uint32)(spanBitsAddr))[:allocPages:allocPages]
+}
+
+// ErrPmemHeaderCorrupt is returned by PmemInit if the persistent memory file
+// has a valid magic constant but its header checksum does not match.
+var ErrPmemHeaderCorrupt error = errorString("Persistent memory header is corrupt")
+
+// ErrPmemIncompleteInit is returned by PmemInit if the first run of the
+// application crashed while the persistent memory file was being initialized,
+// and the file cannot be initialized again. This is the case if the file is
+// opened read-only, or if the file has grown since, which means that its
+// header is corrupt. Otherwise, PmemInit initializes such a file again.
+var ErrPmemIncompleteInit error = errorString("Persistent memory file initialization was not completed")
+
+// ErrPmemReservedSize is returned by PmemInit if the size of the application
+// reserved region set using SetPmemReservedSize() does not match the size of
+// the reserved region of an existing persistent memory file.
+var ErrPmemReservedSize error = errorString("Persistent memory reserved region size does not match the file")
+
+// ErrPmemReservedTooLarge is returned by PmemInit if the application reserved
+// region set using SetPmemReservedSize() is too large to be mapped, and by
+// PmemInitOpts if the first arena of a new file, which holds the reserved
+// region, cannot be mapped without growing the file beyond PmemOptions.MaxSize.
+var ErrPmemReservedTooLarge error = errorString("Persistent memory reserved region does not fit in the file")
+
+// ErrPmemLogSlots is returned by PmemInitOpts if PmemOptions.LogSlots does not
+// match the number of log slots of an existing persistent memory file.
+var ErrPmemLogSlots error = errorString("Persistent memory log slot count does not match the file")
+
+// ErrPmemAlreadyInit is returned by PmemInit, PmemInitOpts, and
+// PmemOpenReadOnly if persistent memory is already initialized, or if another
+// goroutine is initializing it.
+var ErrPmemAlreadyInit error = errorString("Persistent memory is already initialized or initialization is ongoing")
+
+// ErrPmemOtherFile is returned by PmemInit and PmemInitOpts if persistent
+// memory is already initialized using a different file. Only one persistent
+// memory file can be used by a process.
+var ErrPmemOtherFile error = errorString("Persistent memory is already initialized using a different file")
+
+// ErrPmemInitFailed is returned by PmemInit, PmemInitOpts, and
+// PmemOpenReadOnly if an earlier initialization failed after some arenas of
+// the file were added to the heap. Unlike other initialization failures, such
+// a failure cannot be undone, so persistent memory cannot be used by the
+// process.
+var ErrPmemInitFailed error = errorString("Persistent memory initialization failed and cannot be retried")
+
+// ErrPmemUnsupportedArch is returned by PmemInit on platforms other than
+// linux/amd64. The persistent memory metadata layout assumes 64-bit pointers
+// and integers, and mapping the file is only implemented for linux/amd64. On
+// other platforms, the persistent memory functions are stubs that compile but
+// must not be called.
+var ErrPmemUnsupportedArch error = errorString("Persistent memory is only supported on linux/amd64")
+
+// ErrPmemVersionMismatch is reported by PmemInit if the persistent memory file
+// was created by a runtime that uses a different file format version. The
+// error returned by PmemInit includes both versions, and errors.Is() reports
+// it as ErrPmemVersionMismatch.
+var ErrPmemVersionMismatch error = errorString("Persistent memory file format version mismatch")
+
+// pmemVersionError is the error returned when the format version stored in
+// the persistent memory file header does not match pmemFormatVersion.
+type pmemVersionError struct {
+	onDisk   uint32
+	expected uint32
+}
+
+func (e pmemVersionError) RuntimeError() {}
+
+func (e pmemVersionError) Error() string {
+	b := make([]byte, 0, 128)
+	b = append(b, ErrPmemVersionMismatch.Error()...)
+	b = append(b, ": file version "...)
+	b = appendIntStr(b, int64(e.onDisk), false)
+	b = append(b, ", expected version "...)
+	b = appendIntStr(b, int64(e.expected), false)
+	return string(b)
+}
+
+func (e pmemVersionError) Is(target error) bool {
+	return target == ErrPmemVersionMismatch
+}
+
+// ErrPmemFileTooSmall is reported by PmemInit if the persistent memory file is
+// smaller than the size of the persistent memory heap recorded in its header,
+// e.g. because the file was truncated externally. The error returned by
+// PmemInit includes both sizes, and errors.Is() reports it as
+// ErrPmemFileTooSmall. The file is checked before any part of the heap is
+// mapped, as accessing a mapping beyond the end of the file faults.
+var ErrPmemFileTooSmall error = errorString("Persistent memory file is smaller than its heap")
+
+// pmemFileSizeError is the error returned when the size of the persistent
+// memory file is less than the mapped size stored in its header.
+type pmemFileSizeError struct {
+	size     uintptr
+	expected uintptr
+}
+
+func (e pmemFileSizeError) RuntimeError() {}
+
+func (e pmemFileSizeError) Error() string {
+	b := make([]byte, 0, 128)
+	b = append(b, ErrPmemFileTooSmall.Error()...)
+	b = append(b, ": file size "...)
+	b = appendIntStr(b, int64(e.size), false)
+	b = append(b, ", expected at least "...)
+	b = appendIntStr(b, int64(e.expected), false)
+	return string(b)
+}
+
+func (e pmemFileSizeError) Is(target error) bool {
+	return target == ErrPmemFileTooSmall
+}
+
+// ErrPmemRelocation is returned by PmemInit if relocation is disabled using
+// SetPmemRelocation() and an arena cannot be mapped at the address it was
+// mapped at in the previous run.
+var ErrPmemRelocation error = errorString("Persistent memory arena cannot be mapped at its previous address")
+
+// ErrPmemPinned is returned by PmemInit if an arena that holds objects pinned
+// using PmemPin() cannot be mapped at the address it was mapped at in the
+// previous run. Such an arena is never relocated, even if relocation is
+// allowed.
+var ErrPmemPinned error = errorString("Persistent memory arena with pinned objects cannot be mapped at its previous address")
+
+// ErrPmemOutOfSpace is the value the pnew and pmake builtins panic with if
+// there is no space left in the persistent memory file for the allocation, and
+// the persistent memory heap cannot grow because the file system or device the
+// file is on is full. Pnew, PmakeSlice, PnewAligned, and PmemPool.New return
+// nil instead. Setting GODEBUG=pmemverbose=1 prints the size of each arena
+// mapping that fails.
+var ErrPmemOutOfSpace error = errorString("Persistent memory is out of space")
+
+// ErrPmemReadOnly is returned by the functions that modify persistent memory if
+// the persistent memory file was opened using PmemOpenReadOnly(). The pnew and
+// pmake builtins panic with it.
+var ErrPmemReadOnly error = errorString("Persistent memory file is opened read-only")
+
+// ErrPmemSpanLogCorrupt is reported by PmemInit if the span bitmap of a
+// persistent memory arena has a value that cannot be decoded. The error
+// returned by PmemInit includes the offending page, and errors.Is() reports it
+// as ErrPmemSpanLogCorrupt.
+var ErrPmemSpanLogCorrupt error = errorString("Persistent memory span bitmap is corrupt")
+
+// spanLogError is the error returned when the span bitmap entry of page 'page'
+// in the arena at file offset 'arenaOffset' has an invalid value 'val'.
+type spanLogError struct {
+	arenaOffset uintptr
+	page        uintptr
+	val         uint32
+}
+
+func (e spanLogError) RuntimeError() {}
+
+func (e spanLogError) Error() string {
+	b := make([]byte, 0, 128)
+	b = append(b, ErrPmemSpanLogCorrupt.Error()...)
+	b = append(b, ": invalid value 0x"...)
+	b = appendHexStr(b, uint64(e.val))
+	b = append(b, " at page "...)
+	b = appendIntStr(b, int64(e.page), false)
+	b = append(b, " of arena at offset 0x"...)
+	b = appendHexStr(b, uint64(e.arenaOffset))
+	return string(b)
+}
+
+func (e spanLogError) Is(target error) bool {
+	return target == ErrPmemSpanLogCorrupt
+}
+
+// The reversed Castagnoli polynomial used to compute CRC32C checksums
+const crc32cPoly = 0x82F63B78
+
+// crc32c updates 'crc' with the n bytes starting at p. This is a bitwise
+// implementation as it is only used for small metadata structures.
+func crc32c(crc uint32, p unsafe.Pointer, n uintptr) uint32 {
+	crc = ^crc
+	for i := uintptr(0); i < n; i++ {
+		crc ^= uint32(*(*byte)(add(p, i)))
+		for j := 0; j < 8; j++ {
+			crc = (crc >> 1) ^ (crc32cPoly & -(crc & 1))
+		}
+	}
+	return ^crc
+}
+
+// checksum computes the CRC32C checksum of the header fields that are written
+// only once when the file is created, from magic up to and including logSlots.
+// Fields that are updated later, such as mappedSize, are not covered so that a
+// crash while updating them is not reported as a corruption.
+func (ph *pHeader) checksum() uint32 {
+	return crc32c(0, unsafe.Pointer(ph), unsafe.Offsetof(ph.hdrCRC))
+}
+
 // This function goes through the persistent memory file, and ensure that its
 // metadata is consistent. This involves ensuring the file was not externally
 // truncated. Also, it ensures that the header magic in each of the arena
@@ -82,38 +352,39 @@ func verifyMetadata() error {
 		return errorString("Get file size failed")
 	}
 	if fsize < int(mappedSize) {
-		return errorString("File was externally truncated")
+		return pmemFileSizeError{uintptr(fsize), mappedSize}
 	}
 
-	if mappedSize == pmemHeaderSize {
+	if mappedSize == pmemInfo.hdrRegionSize {
 		// The persistent memory file only contains the header region, and does
 		// not contain any arenas.
 		return nil
 	}
 
-	// Map the first page of each arena and check that the arena header magic
-	// is correct. Also ensure that the global mapped size equals the sum of the
+	// Map the header of each arena and check that the arena header magic is
+	// correct. Also ensure that the global mapped size equals the sum of the
 	// size of each arena.
 	totalArenaSize := uintptr(0)
 	for totalArenaSize < mappedSize {
 		arenaOff := uintptr(0)
-		mapAddr, isPmem, err := mapFile(pmemInfo.fname, pageSize, fileCreate,
+		if totalArenaSize == 0 {
+			// Add the global header size to get to the first arena's metadata
+			arenaOff = pmemInfo.hdrRegionSize
+		}
+		mapLen := arenaOff + pArenaHeaderSize
+		mapAddr, isPmem, err := mapFile(pmemInfo.fname, int(mapLen), fileMapFlags(),
 			_DEFAULT_FMODE, totalArenaSize, nil)
 		if err != 0 {
 			return errorString("Arena map failed")
 		}
-		if totalArenaSize == 0 {
-			// Add the global header size to get to the first arena's metadata
-			arenaOff = pmemHeaderSize
-		}
 
 		parena := (*pArena)(unsafe.Pointer(uintptr(mapAddr) + arenaOff))
 		if parena.magic != hdrMagic || isPmem != pmemInfo.isPmem {
-			munmap(mapAddr, pageSize)
+			unmapFile(mapAddr, mapLen)
 			return errorString("Arena metadata mismatch")
 		}
 		totalArenaSize += parena.size
-		munmap(mapAddr, pageSize)
+		unmapFile(mapAddr, mapLen)
 	}
 
 	if totalArenaSize != mappedSize {
@@ -0,0 +1,172 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Implementation of PmemPersist. The volatile objects reachable from a pointer
+// are copied to persistent memory one at a time. The volatile runtime does not
+// record the type of a heap object, so the type of each copy is built from the
+// heap type bits of the volatile object: it has the size of the object slot,
+// and its pointer mask marks the pointer words of the object. The copy is
+// allocated with that type, so that its heap type bits are set and logged as
+// for any persistent memory object.
+
+// PmemPersist copies the volatile heap objects reachable from 'ptr' to
+// persistent memory, and returns the address of the copy of the object 'ptr'
+// points into. The pointers in the copies that point to the copied volatile
+// objects are changed to point to their copies, so the copies form the same
+// object graph, including cycles and pointers into the middle of objects.
+// Pointers to persistent memory objects and to memory outside the heap, e.g.
+// global variables, are kept as is. Each copy is persistent when PmemPersist
+// returns, but the copies are only reachable after a restart if the returned
+// address is stored in a persistent memory object, or set as the root.
+//
+// The volatile objects are not modified, and must not be modified while they
+// are copied. If 'ptr' already points into persistent memory, it is returned
+// as is. PmemPersist returns nil if 'ptr' is nil or if there is no space left
+// in the persistent memory file, and panics if 'ptr' does not point into a
+// volatile heap object.
+func PmemPersist(ptr unsafe.Pointer) unsafe.Pointer {
+	if ptr == nil || inpmem(uintptr(ptr)) {
+		return ptr
+	}
+	if pmemInfo.readOnly {
+		panic(plainError("runtime: PmemPersist called on a read-only persistent memory file"))
+	}
+	base, s, _ := findObject(uintptr(ptr), 0, 0)
+	if base == 0 {
+		panic(plainError("runtime: PmemPersist called with a pointer that is not in a volatile heap object"))
+	}
+
+	m := pmemMigration{copies: make(map[uintptr]unsafe.Pointer)}
+	root := m.copyOf(base, s)
+	for root != nil && len(m.work) != 0 {
+		o := m.work[len(m.work)-1]
+		m.work = m.work[:len(m.work)-1]
+		if !m.migrate(o) {
+			root = nil
+		}
+	}
+	KeepAlive(ptr)
+	if root == nil {
+		return nil
+	}
+	return add(root, uintptr(ptr)-base)
+}
+
+// pmemMigration tracks the objects copied by a PmemPersist() call
+type pmemMigration struct {
+	// The copy of each volatile object, indexed by the address of the object
+	copies map[uintptr]unsafe.Pointer
+
+	// The objects that are allocated but not yet copied. The volatile objects
+	// are kept alive by the object graph being copied.
+	work []migrateWork
+}
+
+type migrateWork struct {
+	src uintptr
+	dst unsafe.Pointer
+	typ *_type // The type the copy was allocated with, or nil if it is noscan
+}
+
+// copyOf returns the persistent memory copy of the volatile object at 'base'
+// in span 's'. If the object was not copied yet, the copy is allocated and the
+// object is queued to be copied. It returns nil if the copy cannot be
+// allocated.
+func (m *pmemMigration) copyOf(base uintptr, s *mspan) unsafe.Pointer {
+	if dst, ok := m.copies[base]; ok {
+		return dst
+	}
+	var typ *_type
+	if !s.spanclass.noscan() {
+		if typ = objectType(base, s.elemsize); typ.ptrdata == 0 {
+			typ = nil
+		}
+	}
+	dst := mallocgc(s.elemsize, typ, needZeroed, isPersistent)
+	if dst == nil {
+		return nil
+	}
+	m.copies[base] = dst
+	m.work = append(m.work, migrateWork{base, dst, typ})
+	return dst
+}
+
+// migrate copies the volatile object of 'o' to its copy, makes each pointer in
+// the copy that points into a volatile heap object point into its copy, and
+// persists the copy. It returns false if a copy cannot be allocated.
+func (m *pmemMigration) migrate(o migrateWork) bool {
+	dst := o.dst
+	size := spanOfHeap(uintptr(dst)).elemsize
+	if o.typ == nil {
+		memmove(dst, unsafe.Pointer(o.src), size)
+		PersistRange(dst, size)
+		return true
+	}
+
+	typedmemmove(o.typ, dst, unsafe.Pointer(o.src))
+	hbits := heapBitsForAddr(uintptr(dst))
+	for i := uintptr(0); i < o.typ.ptrdata; i += intSize {
+		if i != 0 {
+			hbits = hbits.next()
+		}
+		bits := hbits.bits()
+		if i != 1*intSize && bits&bitScan == 0 {
+			break
+		}
+		if bits&bitPointer == 0 {
+			continue
+		}
+		slot := (*unsafe.Pointer)(add(dst, i))
+		p := uintptr(*slot)
+		if p == 0 || inpmem(p) {
+			continue
+		}
+		base, ps, _ := findObject(p, 0, 0)
+		if base == 0 {
+			// Not a heap object, e.g. a global variable
+			continue
+		}
+		c := m.copyOf(base, ps)
+		if c == nil {
+			return false
+		}
+		*slot = add(c, p-base)
+	}
+	PersistRange(dst, size)
+	return true
+}
+
+// objectType returns a type of 'size' bytes whose pointer words are the
+// pointer words of the heap object at 'base'. The type is only used to set the
+// heap type bits of the persistent memory copy of the object, and to copy it.
+func objectType(base, size uintptr) *_type {
+	mask := make([]byte, (size/intSize+7)/8)
+	ptrdata := uintptr(0)
+	hbits := heapBitsForAddr(base)
+	for i := uintptr(0); i < size; i += intSize {
+		if i != 0 {
+			hbits = hbits.next()
+		}
+		bits := hbits.bits()
+		if i != 1*intSize && bits&bitScan == 0 {
+			break // no more pointers in this object
+		}
+		if bits&bitPointer != 0 {
+			w := i / intSize
+			mask[w/8] |= 1 << (w % 8)
+			ptrdata = i + intSize
+		}
+	}
+	return &_type{
+		size:       size,
+		ptrdata:    ptrdata,
+		tflag:      tflagPmemCopy,
+		align:      uint8(intSize),
+		fieldAlign: uint8(intSize),
+		kind:       kindStruct,
+		gcdata:     &mask[0],
+	}
+}
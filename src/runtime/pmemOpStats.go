@@ -0,0 +1,147 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+)
+
+// PmemOpStats records statistics about the cache line flush and fence
+// operations done to make writes to persistent memory durable. The counters
+// are only updated while collection is enabled using SetPmemOpStats(). See
+// ReadPmemOpStats().
+type PmemOpStats struct {
+	// FlushCount is the number of address ranges flushed using
+	// PersistRange(), PersistRanges() and FlushRange(). This includes the
+	// ranges persisted by the runtime itself.
+	FlushCount uint64
+
+	// FenceCount is the number of fences issued by PersistRange(),
+	// PersistRanges() and Fence().
+	FenceCount uint64
+
+	// BytesFlushed is the total size of the flushed address ranges.
+	BytesFlushed uint64
+
+	// FlushCycles is the number of CPU cycles spent flushing the ranges and
+	// issuing the fences, as measured using the timestamp counter. If writes
+	// are made durable using msync(), this includes the cost of the
+	// system calls.
+	FlushCycles uint64
+}
+
+// pmemOpCounters counts the flush and fence operations done on a P
+type pmemOpCounters struct {
+	flushes      uint64
+	fences       uint64
+	bytesFlushed uint64
+	flushCycles  uint64
+}
+
+// add adds the counters in 'c' to 'oc'
+func (oc *pmemOpCounters) add(c *pmemOpCounters) {
+	atomic.Xadd64(&oc.flushes, int64(atomic.Load64(&c.flushes)))
+	atomic.Xadd64(&oc.fences, int64(atomic.Load64(&c.fences)))
+	atomic.Xadd64(&oc.bytesFlushed, int64(atomic.Load64(&c.bytesFlushed)))
+	atomic.Xadd64(&oc.flushCycles, int64(atomic.Load64(&c.flushCycles)))
+}
+
+// take adds the counters in 'c' to 'oc' and clears 'c'. This is used when a P
+// is destroyed, when the world is stopped.
+func (oc *pmemOpCounters) take(c *pmemOpCounters) {
+	oc.add(c)
+	*c = pmemOpCounters{}
+}
+
+var pmemOpStats struct {
+	// Set to 1 if the counters are updated. See SetPmemOpStats().
+	enabled uint32
+
+	// The counters of the operations done without a P, and of the Ps that
+	// were destroyed
+	dead pmemOpCounters
+
+	// A lock to protect base
+	lock mutex
+
+	// The sum of the counters when ResetPmemOpStats() was last called
+	base pmemOpCounters
+}
+
+// SetPmemOpStats enables or disables the collection of the flush and fence
+// statistics reported by ReadPmemOpStats(). Collection is disabled by default,
+// and the counters are kept when it is disabled. Each flush and fence reads
+// the timestamp counter twice while collection is enabled.
+func SetPmemOpStats(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.Store(&pmemOpStats.enabled, v)
+}
+
+// opStatsStart returns the timestamp at which a flush or fence operation
+// starts, or 0 if the operation is not counted
+func opStatsStart() int64 {
+	if atomic.Load(&pmemOpStats.enabled) == 0 {
+		return 0
+	}
+	return cputicks()
+}
+
+// opStatsDone counts 'flushes' flushed ranges of 'n' bytes in total, and
+// 'fences' fences, done by an operation that started at 'start'. The counters
+// of the current P are updated, so that concurrent operations do not contend.
+func opStatsDone(start int64, flushes, n uintptr, fences uint64) {
+	if start == 0 {
+		return
+	}
+	cycles := cputicks() - start
+	mp := acquirem()
+	c := &pmemOpStats.dead
+	if pp := mp.p.ptr(); pp != nil {
+		c = &pp.pmemOps
+	}
+	atomic.Xadd64(&c.flushes, int64(flushes))
+	atomic.Xadd64(&c.fences, int64(fences))
+	atomic.Xadd64(&c.bytesFlushed, int64(n))
+	atomic.Xadd64(&c.flushCycles, cycles)
+	releasem(mp)
+}
+
+// sumPmemOpCounters returns the sum of the counters of all Ps and the
+// counters of the operations done without a P
+func sumPmemOpCounters() pmemOpCounters {
+	var sum pmemOpCounters
+	lock(&allpLock)
+	for _, pp := range allp {
+		sum.add(&pp.pmemOps)
+	}
+	sum.add(&pmemOpStats.dead)
+	unlock(&allpLock)
+	return sum
+}
+
+// ReadPmemOpStats populates 'ps' with the flush and fence statistics collected
+// since the last ResetPmemOpStats() call. The counters of all Ps are summed,
+// so operations that are done concurrently may or may not be included.
+func ReadPmemOpStats(ps *PmemOpStats) {
+	sum := sumPmemOpCounters()
+	lock(&pmemOpStats.lock)
+	base := pmemOpStats.base
+	unlock(&pmemOpStats.lock)
+	*ps = PmemOpStats{
+		FlushCount:   sum.flushes - base.flushes,
+		FenceCount:   sum.fences - base.fences,
+		BytesFlushed: sum.bytesFlushed - base.bytesFlushed,
+		FlushCycles:  sum.flushCycles - base.flushCycles,
+	}
+}
+
+// ResetPmemOpStats resets the flush and fence statistics reported by
+// ReadPmemOpStats() to zero. This can be used to measure the operations done
+// by a region of code.
+func ResetPmemOpStats() {
+	sum := sumPmemOpCounters()
+	lock(&pmemOpStats.lock)
+	pmemOpStats.base = sum
+	unlock(&pmemOpStats.lock)
+}
@@ -0,0 +1,125 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+)
+
+// PmemOptions configures how PmemInitOpts() opens a persistent memory file.
+// The zero value of each field other than Fname selects the same behavior as
+// PmemInit(), so that fields can be added without affecting existing callers.
+type PmemOptions struct {
+	// Fname is the path to the persistent memory file
+	Fname string
+
+	// ReservedSize is the size of the application reserved region created at
+	// the beginning of a new file. If it is not 0, it must match the size of
+	// the reserved region of an existing file. See SetPmemReservedSize().
+	ReservedSize uintptr
+
+	// MaxSize is the size up to which the file can grow. Allocations that
+	// need the file to grow beyond it fail as if the device the file is on
+	// was full. 0 lets the file grow until the device is full.
+	MaxSize uintptr
+
+	// ShortArenas lets the file grow by an arena that is smaller than the
+	// size the heap asks for, if the file cannot grow by that size before it
+	// reaches MaxSize. The arena uses the rest of the file, and is used only
+	// if it is at least 64 MB long and can hold the allocation. Otherwise the
+	// file grows by whole 64 MB arenas, and the space left below MaxSize that
+	// is smaller than the next arena is not used.
+	ShortArenas bool
+
+	// SyncMode is one of PmemSyncAuto, PmemSyncNone, or PmemSyncForce. See
+	// PmemSetSyncMode().
+	SyncMode int
+
+	// FixedAddr requires each arena to be mapped at the address it was mapped
+	// at in the previous run, instead of swizzling the pointers into an arena
+	// that is mapped elsewhere. See SetPmemRelocation().
+	FixedAddr bool
+
+	// ReadOnly opens an existing file without ever modifying it. See
+	// PmemOpenReadOnly().
+	ReadOnly bool
+
+	// HugePages asks the kernel to map the arenas of the file using 2 MB huge
+	// pages, to reduce the number of page table entries and TLB misses for a
+	// large file. The arenas are mapped using the base page size if the kernel
+	// or the file system does not support it. See PmemStats.MapPageSize.
+	HugePages bool
+
+	// LogSlots is the number of entries of the minimal undo log used by the
+	// runtime that are stored in the header of each arena of a new file. The
+	// entries that do not fit in the arena header are stored in a spill
+	// buffer that is allocated in persistent memory, which is slower. Each
+	// slot takes 64 bytes in each arena. It can be at most 64. If it is not
+	// 0, it must match the count of an existing file, see ErrPmemLogSlots. 0
+	// selects 2 slots for a new file.
+	LogSlots int
+}
+
+// validate checks that the options can be used together
+func (o *PmemOptions) validate() error {
+	if len(o.Fname) == 0 {
+		return errorString("Persistent memory file name is not set")
+	}
+	if o.SyncMode < PmemSyncAuto || o.SyncMode > PmemSyncForce {
+		return errorString("Invalid persistent memory sync mode")
+	}
+	if o.LogSlots < 0 || o.LogSlots > maxLogSlots {
+		return errorString("Invalid persistent memory log slot count")
+	}
+	slots := uintptr(o.LogSlots)
+	if slots == 0 {
+		slots = defaultLogSlots
+	}
+	hdrSize := pArenaHeaderSize + slots*logEntrySize
+	if !reservedRegionFits(o.ReservedSize, o.MaxSize, hdrSize, o.ShortArenas) {
+		return ErrPmemReservedTooLarge
+	}
+	if !o.ReadOnly {
+		return nil
+	}
+	// A read-only file is never created, extended, or written back
+	switch {
+	case o.ReservedSize != 0:
+		return errorString("ReservedSize cannot be set for a read-only file")
+	case o.MaxSize != 0:
+		return errorString("MaxSize cannot be set for a read-only file")
+	case o.ShortArenas:
+		return errorString("ShortArenas cannot be set for a read-only file")
+	case o.SyncMode != PmemSyncAuto:
+		return errorString("SyncMode cannot be set for a read-only file")
+	}
+	return nil
+}
+
+// PmemInitOpts initializes persistent memory using the file and the options
+// set in 'opts', and returns the region for the file. The options are
+// validated, and an error is returned without opening the file if they cannot
+// be used together. As with PmemInit(), only one persistent memory file can be
+// used by a process, so PmemInitOpts fails if persistent memory is already
+// initialized. The options are applied only if this call initializes
+// persistent memory, and they stay applied if the initialization fails.
+func PmemInitOpts(opts PmemOptions) (*PmemRegion, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := pmemInit(opts.Fname, opts.ReadOnly, opts.apply); err != nil {
+		return nil, err
+	}
+	return &PmemRegion{fname: opts.Fname}, nil
+}
+
+// apply applies the options other than Fname and ReadOnly
+func (o *PmemOptions) apply() {
+	SetPmemReservedSize(o.ReservedSize)
+	SetPmemRelocation(!o.FixedAddr)
+	PmemSetSyncMode(o.SyncMode)
+	pmemInfo.sizeLimit = o.MaxSize
+	pmemInfo.shortArenas = o.ShortArenas
+	pmemInfo.logSlots = uintptr(o.LogSlots)
+	if o.HugePages {
+		atomic.Store(&pmemInfo.hugePages, 1)
+	}
+}
@@ -0,0 +1,206 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Implementation of a persistent append-only log.
+//
+// The head of a log is a persistent memory object that is stored as a named
+// root, so that the log can be found after a restart. It points to a linked
+// list of chunks. Each chunk has a buffer that holds records appended one
+// after the other, and the number of bytes of valid records in the buffer. A
+// record starts with an intSize field that stores the length of its data,
+// followed by the data padded to intSize:
+//
+//	| len | data (padded to intSize) |
+//
+// A record is appended by first writing and persisting it after the valid
+// records of the last chunk, and then updating and persisting the number of
+// valid bytes of the chunk. So a crash while appending never exposes a
+// partially written record. When the last chunk is full, a new empty chunk is
+// persisted and then linked after it.
+
+const (
+	// The size of the record buffer of a chunk, unless a record of the
+	// maximum size of the log does not fit in it
+	plogChunkBytes = 64 << 10
+
+	// The size of the field at the beginning of each record that stores the
+	// length of its data
+	plogRecordHeaderSize = intSize
+
+	// The maximum record size of a log
+	maxPlogRecord = 1 << 30
+)
+
+// plogHead is the persistent head of an append-only log
+type plogHead struct {
+	recordMax uintptr
+	first     *plogChunk
+}
+
+// plogChunk is a persistent chunk of records of an append-only log
+type plogChunk struct {
+	next *plogChunk
+	used uintptr // Number of bytes of valid records in data
+	data []byte
+}
+
+// PLog is a persistent append-only log of records. Records are appended using
+// Append(), and are never modified or removed. Each record is identified by a
+// sequence number, which is its index in the log starting at 0. Append and
+// Iterate can be called concurrently.
+type PLog struct {
+	lock mutex
+	head *plogHead
+	last *plogChunk // The last chunk of the log
+	seq  uint64     // The sequence number of the next record
+}
+
+// NewPmemLog returns the append-only log stored as the named root 'name',
+// creating an empty log if no such root exists. 'recordMax' is the maximum
+// size of a record, and must match the maximum record size of an existing log.
+// Only one PLog must be used for a log at a time. If the log was written by a
+// previous run that crashed, the records whose Append() calls returned are
+// found, and records that were being appended are not.
+func NewPmemLog(name string, recordMax int) (*PLog, error) {
+	if pmemHeader == nil {
+		return nil, errorString("Persistent memory is not initialized")
+	}
+	if recordMax <= 0 || recordMax > maxPlogRecord {
+		return nil, errorString("Invalid maximum record size passed to NewPmemLog")
+	}
+
+	h := (*plogHead)(GetNamedRoot(name))
+	if h == nil {
+		if pmemInfo.readOnly {
+			return nil, ErrPmemReadOnly
+		}
+		var x interface{} = plogHead{}
+		h = (*plogHead)(mallocgc(unsafe.Sizeof(plogHead{}), efaceOf(&x)._type,
+			needZeroed, isPersistent))
+		if h == nil {
+			return nil, ErrPmemOutOfSpace
+		}
+		h.recordMax = uintptr(recordMax)
+		h.first = newPlogChunk(h.recordMax)
+		if h.first == nil {
+			return nil, ErrPmemOutOfSpace
+		}
+		PersistRange(unsafe.Pointer(h), unsafe.Sizeof(*h))
+		if err := SetNamedRoot(name, unsafe.Pointer(h)); err != nil {
+			return nil, err
+		}
+	} else if h.recordMax != uintptr(recordMax) {
+		return nil, errorString("Log exists with a different maximum record size")
+	}
+
+	l := &PLog{head: h}
+	for c := h.first; c != nil; c = c.next {
+		for off := uintptr(0); off < c.used; {
+			off += plogRecordSize(*(*uintptr)(unsafe.Pointer(&c.data[off])))
+			l.seq++
+		}
+		l.last = c
+	}
+	return l, nil
+}
+
+// newPlogChunk allocates and persists an empty chunk that can hold at least
+// one record of 'recordMax' bytes. It returns nil if there is no space left
+// for the chunk in the persistent memory file.
+func newPlogChunk(recordMax uintptr) *plogChunk {
+	size := uintptr(plogChunkBytes)
+	if n := plogRecordSize(recordMax); n > size {
+		size = n
+	}
+	data := mallocgc(size, nil, needZeroed, isPersistent)
+	if data == nil {
+		return nil
+	}
+	var x interface{} = plogChunk{}
+	c := (*plogChunk)(mallocgc(unsafe.Sizeof(plogChunk{}), efaceOf(&x)._type,
+		needZeroed, isPersistent))
+	if c == nil {
+		return nil
+	}
+	c.data = (*[maxPlogRecord]byte)(data)[:size:size]
+	PersistRange(unsafe.Pointer(c), unsafe.Sizeof(*c))
+	return c
+}
+
+// plogRecordSize returns the number of bytes used by a record with 'n' bytes
+// of data
+func plogRecordSize(n uintptr) uintptr {
+	return plogRecordHeaderSize + alignUp(n, intSize)
+}
+
+// Append appends a record holding a copy of 'data' to the log, and returns its
+// sequence number. The record is persistent when Append returns. If the
+// application crashes before that, the record is not found after a restart.
+func (l *PLog) Append(data []byte) (seq uint64, err error) {
+	if pmemInfo.readOnly {
+		return 0, ErrPmemReadOnly
+	}
+	n := uintptr(len(data))
+	if n > l.head.recordMax {
+		return 0, errorString("Record passed to Append is too large")
+	}
+	size := plogRecordSize(n)
+
+	lock(&l.lock)
+	defer unlock(&l.lock)
+	c := l.last
+	if c.used+size > uintptr(len(c.data)) {
+		next := newPlogChunk(l.head.recordMax)
+		if next == nil {
+			return 0, ErrPmemOutOfSpace
+		}
+		c.next = next
+		PersistRange(unsafe.Pointer(&c.next), intSize)
+		c = next
+		l.last = c
+	}
+
+	rec := unsafe.Pointer(&c.data[c.used])
+	*(*uintptr)(rec) = n
+	copy(c.data[c.used+plogRecordHeaderSize:], data)
+	PersistRange(rec, size)
+
+	c.used += size
+	PersistRange(unsafe.Pointer(&c.used), intSize)
+	seq = l.seq
+	l.seq++
+	return seq, nil
+}
+
+// Iterate calls 'fn' for each record in the log in the order they were
+// appended, until 'fn' returns false. 'data' points to the record in
+// persistent memory, and must not be modified or retained after 'fn' returns.
+// Records appended after Iterate is called are not visited.
+func (l *PLog) Iterate(fn func(seq uint64, data []byte) bool) {
+	lock(&l.lock)
+	last, used := l.last, l.last.used
+	unlock(&l.lock)
+
+	seq := uint64(0)
+	for c := l.head.first; ; c = c.next {
+		end := c.used
+		if c == last {
+			end = used
+		}
+		for off := uintptr(0); off < end; {
+			n := *(*uintptr)(unsafe.Pointer(&c.data[off]))
+			start := off + plogRecordHeaderSize
+			if !fn(seq, c.data[start:start+n:start+n]) {
+				return
+			}
+			off += plogRecordSize(n)
+			seq++
+		}
+		if c == last {
+			return
+		}
+	}
+}
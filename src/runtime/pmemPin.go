@@ -0,0 +1,248 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Pinned persistent memory objects. An object pinned using PmemPin() is never
+// moved by the runtime, so its address can be stored outside the persistent
+// memory heap, e.g. in another file or sent to another process. The runtime
+// does not move individual objects, but an arena that cannot be mapped at the
+// address it was mapped at in the previous run is relocated, and the pointers
+// into it are swizzled (see SetPmemRelocation()). An arena that holds pinned
+// objects is never relocated; PmemInit returns ErrPmemPinned instead.
+//
+// The pin table records the file offset of each pinned object:
+//
+//	| off |
+//
+// The table is a persistent side table (see sideTable) whose first entry
+// stores the number of entries that follow it, and an entry is used if its
+// offset is not 0. Each
+// pinned object has a special record that holds the index of its entry, so
+// that the entry is cleared when the garbage collector frees the object.
+//
+// The arena header counts the pinned objects in the arena, so that the count
+// is known before the pin table can be read during reconstruction. The count
+// is persisted before a new entry, and after an entry is cleared. A crash can
+// therefore only leave the count too high, which at worst prevents the arena
+// from being relocated once. The counts are recomputed from the pin table
+// during reconstruction.
+
+// A volatile data-structure that tracks the pin table
+var pmemPins struct {
+	// The pin table. Its lock also protects the pinned object counts of the
+	// arenas. It is taken when a special record is freed by the garbage
+	// collector, so no allocation must be done while holding it.
+	sideTable
+}
+
+// The described object is a pinned persistent memory object
+//
+//go:notinheap
+type specialpin struct {
+	special special
+	index   uintptr // Index of the entry of the object in the pin table
+}
+
+// pinEntries returns the entries of the pin table 'table'
+func pinEntries(table unsafe.Pointer) []uintptr {
+	if table == nil {
+		return nil
+	}
+	n := *(*uintptr)(table)
+	return (*[1 << 27]uintptr)(table)[1 : n+1 : n+1]
+}
+
+// PmemPin pins the persistent memory object that starts at 'ptr', so that it
+// is never moved by the runtime. The pin is persistent when PmemPin returns,
+// and lasts until the object is unpinned using PmemUnpin() or is freed by the
+// garbage collector. Pinning an object that is already pinned does nothing.
+// PmemPin returns ErrPmemOutOfSpace if there is no space left in the
+// persistent memory file to record the pin.
+func PmemPin(ptr unsafe.Pointer) error {
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+	if !inpmem(uintptr(ptr)) || !IsObjectStart(ptr) {
+		return errorString("Pointer is not the start of a persistent memory object")
+	}
+
+	lock(&pmemPins.lock)
+	for {
+		if pinIndex(uintptr(ptr)) >= 0 {
+			unlock(&pmemPins.lock)
+			return nil
+		}
+		entries := pinEntries(pmemPins.table)
+		for i := range entries {
+			if e := &entries[i]; *e == 0 {
+				pa := pArenaOf(uintptr(ptr))
+				pa.pinned++
+				PersistRange(unsafe.Pointer(&pa.pinned), intSize)
+				*e = fileOffsetOf(uintptr(ptr))
+				PersistRange(unsafe.Pointer(e), intSize)
+				addPinSpecial(ptr, uintptr(i))
+				unlock(&pmemPins.lock)
+				return nil
+			}
+		}
+
+		if !pmemPins.grow(uintptr(0), 0, &pmemHeader.pinTable) {
+			unlock(&pmemPins.lock)
+			return ErrPmemOutOfSpace
+		}
+	}
+}
+
+// PmemUnpin unpins the persistent memory object that starts at 'ptr', which
+// was pinned using PmemPin(). The object is no longer pinned when PmemUnpin
+// returns, even if the application crashes.
+func PmemUnpin(ptr unsafe.Pointer) error {
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+	lock(&pmemPins.lock)
+	defer unlock(&pmemPins.lock)
+	if pinIndex(uintptr(ptr)) < 0 {
+		return errorString("Object is not pinned")
+	}
+	sp := (*specialpin)(unsafe.Pointer(removespecial(ptr, _KindSpecialPin)))
+	clearPin(sp.index, uintptr(ptr))
+	lock(&mheap_.speciallock)
+	mheap_.specialpinalloc.free(unsafe.Pointer(sp))
+	unlock(&mheap_.speciallock)
+	return nil
+}
+
+// PmemIsPinned reports whether the persistent memory object that starts at
+// 'ptr' is pinned.
+func PmemIsPinned(ptr unsafe.Pointer) bool {
+	if !inpmem(uintptr(ptr)) {
+		return false
+	}
+	return pinIndex(uintptr(ptr)) >= 0
+}
+
+// addPinSpecial adds a special record to the pinned object 'p' whose entry in
+// the pin table is at 'index'
+func addPinSpecial(p unsafe.Pointer, index uintptr) {
+	lock(&mheap_.speciallock)
+	s := (*specialpin)(mheap_.specialpinalloc.alloc())
+	unlock(&mheap_.speciallock)
+	s.special.kind = _KindSpecialPin
+	s.index = index
+	if !addspecial(p, &s.special) {
+		throw("addPinSpecial: pin already set")
+	}
+}
+
+// pinIndex returns the index of the entry of the persistent memory object 'p'
+// in the pin table, or -1 if the object is not pinned
+func pinIndex(p uintptr) int {
+	span := spanOfHeap(p)
+	if span == nil {
+		return -1
+	}
+	offset := p - span.base()
+	index := -1
+	lock(&span.speciallock)
+	for s := span.specials; s != nil; s = s.next {
+		if uintptr(s.offset) == offset && s.kind == _KindSpecialPin {
+			index = int((*specialpin)(unsafe.Pointer(s)).index)
+			break
+		}
+	}
+	unlock(&span.speciallock)
+	return index
+}
+
+// clearPin clears the pin table entry at 'index' of the object 'p', and then
+// decrements the pinned object count of its arena. The pin table lock must be
+// held.
+func clearPin(index, p uintptr) {
+	e := &pinEntries(pmemPins.table)[index]
+	*e = 0
+	PersistRange(unsafe.Pointer(e), intSize)
+	pa := pArenaOf(p)
+	pa.pinned--
+	PersistRange(unsafe.Pointer(&pa.pinned), intSize)
+}
+
+// freePin clears the pin table entry at 'index' of the object 'p' that was
+// freed by the garbage collector
+func freePin(index uintptr, p unsafe.Pointer) {
+	if pmemInfo.readOnly {
+		return
+	}
+	lock(&pmemPins.lock)
+	clearPin(index, uintptr(p))
+	unlock(&pmemPins.lock)
+}
+
+// pinnedCounts returns the number of pinned objects, and the number of spans
+// that hold them. The heap lock must be held.
+func pinnedCounts() (objects, spans uint64) {
+	lock(&pmemPins.lock)
+	entries := pinEntries(pmemPins.table)
+	for i, off := range entries {
+		if off == 0 {
+			continue
+		}
+		objects++
+		s := spanOfHeap(addrOfFileOffset(off))
+		counted := false
+		for _, o := range entries[:i] {
+			if o != 0 && spanOfHeap(addrOfFileOffset(o)) == s {
+				counted = true
+				break
+			}
+		}
+		if !counted {
+			spans++
+		}
+	}
+	unlock(&pmemPins.lock)
+	return
+}
+
+// restorePinTable finds the pin table after a restart, and adds a special
+// record to each pinned object. Entries of objects that are no longer
+// allocated are cleared, and the pinned object counts of the arenas are
+// corrected. This is called during reconstruction.
+func restorePinTable(arenas []*arenaInfo) {
+	if !pmemPins.restore(pmemHeader.pinTable, arenas, "pin") {
+		return
+	}
+	entries := pinEntries(pmemPins.table)
+	counts := make([]uintptr, len(arenas))
+	for i := range entries {
+		e := &entries[i]
+		if *e == 0 {
+			continue
+		}
+		p := computeRootAddr(*e, arenas)
+		if p == nil || !IsObjectStart(p) {
+			if !pmemInfo.readOnly {
+				*e = 0
+				PersistRange(unsafe.Pointer(e), intSize)
+			}
+			continue
+		}
+		for j, ar := range arenas {
+			if pArenaOf(uintptr(p)) == ar.pa {
+				counts[j]++
+			}
+		}
+		addPinSpecial(p, uintptr(i))
+	}
+	if pmemInfo.readOnly {
+		return
+	}
+	for j, ar := range arenas {
+		if pa := ar.pa; pa.pinned != counts[j] {
+			pa.pinned = counts[j]
+			PersistRange(unsafe.Pointer(&pa.pinned), intSize)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Persistent memory object pools. The runtime caches up to maxCacheTypes - 2
+// frequently allocated types separately in the mcache (see typeProfileThread()).
+// Objects of such a type are allocated from spans that hold only objects of
+// that type. Instead of logging the heap type bits of each object, only the
+// type index is logged for such a span (see logHeapBits()), and the type is
+// described once in the type descriptor table in the persistent memory header.
+// During reconstruction, the type bits of every object in the span are restored
+// from the type descriptor.
+//
+// A PmemPool makes a type use these dedicated spans right away, instead of
+// waiting for the type profiler to promote it.
+//
+// A pool also keeps the objects released using Put() on a durable free list,
+// so that Get() can reuse them without allocating. Each free list is a
+// persistent side table (see sideTable) of object pointers. The header entry
+// of a free list stores the type descriptor of its objects, the file offset
+// of its table, and the number of objects in the list, which are held by the
+// first entries of the table. The table is a persistent memory object with
+// pointers, so it keeps the free objects alive, and is swizzled with the rest
+// of the heap. A pointer is persisted in the table before the count of the
+// list is incremented, and the count is decremented before an object is
+// returned by Get(). A crash can therefore only lose an object that was being
+// put or got, which is then freed by the garbage collector if the application
+// does not refer to it.
+
+// PmemPool allocates persistent memory objects of a single type from spans
+// that hold only objects of that type.
+type PmemPool struct {
+	typ *_type
+
+	// The index of the durable free list of the pool in the header, or -1 if
+	// the pool does not have one
+	free int
+}
+
+// The maximum number of durable free lists. Each type of pool objects uses one
+// free list.
+const maxPoolFreeLists = 16
+
+// poolEntry is an entry in the table of a durable free list. The n field is
+// only used by the first entry of the table, to store the number of entries
+// that follow it.
+type poolEntry struct {
+	obj unsafe.Pointer
+	n   uintptr
+}
+
+// poolFreeList is the persistent memory header entry of a durable free list
+type poolFreeList struct {
+	// The type of the objects in the free list. The entry is unused if the
+	// size of the type is 0.
+	desc typeDesc
+
+	// The file offset of the table of the free list, or 0 if it is not
+	// allocated
+	table uintptr
+
+	// The number of objects in the free list
+	n uintptr
+}
+
+// A volatile data-structure that tracks the durable free lists
+var poolLists struct {
+	// A lock to protect the assignment of the free lists to types
+	lock mutex
+
+	// The table of each free list. The lock of a table also protects the
+	// object count of its free list.
+	tables [maxPoolFreeLists]sideTable
+}
+
+// poolEntries returns the entries of the free list table 'table'
+func poolEntries(table unsafe.Pointer) []poolEntry {
+	if table == nil {
+		return nil
+	}
+	n := (*poolEntry)(table).n
+	return (*[1 << 26]poolEntry)(table)[1 : n+1 : n+1]
+}
+
+// PnewPool returns a pool that allocates persistent memory objects whose type
+// is the dynamic type of 'typ'. The value of 'typ' is not used. E.g.:
+//
+//	pool := runtime.PnewPool(T{})
+//	p := (*T)(pool.New())
+//
+// Each pool uses at least one span for each P that allocates from it, even if
+// the span is only partially full, so a pool should be used only for types
+// with many objects. Types without pointers, types larger than 32 KB, and types
+// with more than 4 KB of pointer data are not cached, and are allocated as
+// usual. If all the type slots have been assigned, objects are also allocated
+// as usual. The assignment of a type to a slot is stored in the persistent
+// memory file, so a pool created after a restart uses the same slot.
+func PnewPool(typ interface{}) *PmemPool {
+	t := efaceOf(&typ)._type
+	if t == nil {
+		panic(plainError("runtime: PnewPool called with a nil type"))
+	}
+	if pmemHeader == nil {
+		panic(plainError("runtime: PnewPool called before PmemInit"))
+	}
+	promoteType(t)
+	return &PmemPool{typ: t, free: poolFreeListOf(t)}
+}
+
+// New allocates a zeroed object of the pool type and returns a pointer to it.
+// It returns nil if there is no space left for the object in the persistent
+// memory file.
+func (p *PmemPool) New() unsafe.Pointer {
+	return mallocgc(p.typ.size, p.typ, needZeroed, isPersistent)
+}
+
+// Get returns an object that was released to the pool using Put(), or a new
+// zeroed object allocated using New() if there is none. Unlike New(), an
+// object released to the pool is returned as it was when it was put, and is
+// not cleared. The objects in the pool are kept across restarts, by any pool
+// of a type with the same size and pointer layout. Get returns nil if there is
+// no object in the pool and no space left in the persistent memory file.
+func (p *PmemPool) Get() unsafe.Pointer {
+	if p.free < 0 {
+		return p.New()
+	}
+	t := &poolLists.tables[p.free]
+	l := &pmemHeader.poolLists[p.free]
+	lock(&t.lock)
+	if l.n == 0 {
+		unlock(&t.lock)
+		return p.New()
+	}
+	l.n--
+	PersistRange(unsafe.Pointer(&l.n), intSize)
+	e := &poolEntries(t.table)[l.n]
+	x := e.obj
+	e.obj = nil
+	unlock(&t.lock)
+	return x
+}
+
+// Put releases the object 'ptr' to the pool, so that it is returned by a later
+// Get() call, even after a restart. The object must have been allocated by a
+// pool of the same type, and must no longer be used by the application. The
+// object is not cleared. A pool keeps its objects only if its type does not
+// have more than 4 KB of pointer data, and if there are at most 16 types of
+// pool objects in the file. Otherwise, Put does nothing, and the object is
+// freed by the garbage collector. Put returns ErrPmemOutOfSpace if the free
+// list of the pool is full and there is no space left in the persistent
+// memory file to grow it. The object is then not released to the pool, and is
+// freed by the garbage collector once the application no longer refers to it.
+func (p *PmemPool) Put(ptr unsafe.Pointer) error {
+	s := spanOfHeap(uintptr(ptr))
+	if s == nil || s.memtype != isPersistent || !IsObjectStart(ptr) || s.elemsize < p.typ.size {
+		panic(plainError("runtime: PmemPool.Put called with a pointer that is not the start of a persistent memory object"))
+	}
+	if p.free < 0 {
+		return nil
+	}
+	t := &poolLists.tables[p.free]
+	l := &pmemHeader.poolLists[p.free]
+	lock(&t.lock)
+	for {
+		entries := poolEntries(t.table)
+		if l.n < uintptr(len(entries)) {
+			e := &entries[l.n]
+			e.obj = ptr
+			PersistRange(unsafe.Pointer(&e.obj), intSize)
+			l.n++
+			PersistRange(unsafe.Pointer(&l.n), intSize)
+			unlock(&t.lock)
+			return nil
+		}
+		if !t.grow(poolEntry{}, unsafe.Offsetof(poolEntry{}.n), &l.table) {
+			unlock(&t.lock)
+			return ErrPmemOutOfSpace
+		}
+	}
+}
+
+// poolFreeListOf returns the index of the durable free list of the objects of
+// type 'typ', and assigns a free list to the type if it does not have one. It
+// returns -1 if the type cannot have a free list.
+func poolFreeListOf(typ *_type) int {
+	if pmemInfo.readOnly || typ.size == 0 || typ.kind&kindGCProg != 0 ||
+		typeMaskBytes(typ) > maxTypeMaskBytes {
+		return -1
+	}
+	lock(&poolLists.lock)
+	defer unlock(&poolLists.lock)
+	free := -1
+	for i := range pmemHeader.poolLists {
+		l := &pmemHeader.poolLists[i]
+		if l.desc.size == 0 {
+			if free < 0 {
+				free = i
+			}
+			continue
+		}
+		if l.desc.matches(typ) {
+			return i
+		}
+	}
+	if free >= 0 {
+		pmemHeader.poolLists[free].desc.set(typ)
+	}
+	return free
+}
+
+// restorePoolLists finds the table of each durable free list after a restart.
+// The entries past the count of a list, which can still refer to an object if
+// a crash interrupted Get(), are cleared. This is called during
+// reconstruction after the pointers in the tables are swizzled.
+func restorePoolLists(arenas []*arenaInfo) {
+	for i := range pmemHeader.poolLists {
+		t := &poolLists.tables[i]
+		l := &pmemHeader.poolLists[i]
+		if !t.restore(l.table, arenas, "pool free list") || pmemInfo.readOnly {
+			continue
+		}
+		entries := poolEntries(t.table)
+		if l.n > uintptr(len(entries)) {
+			throw("Invalid pool free list count")
+		}
+		for j := l.n; j < uintptr(len(entries)); j++ {
+			if e := &entries[j]; e.obj != nil {
+				e.obj = nil
+				PersistRange(unsafe.Pointer(&e.obj), intSize)
+			}
+		}
+	}
+}
+
+// typeOffset returns the index of the type 'typ' in the type profiling arrays
+func typeOffset(typ *_type) uintptr {
+	tu := uintptr(unsafe.Pointer(typ))
+	offset := (tu - typeBase) / 32
+	if offset >= 50000 || tu%32 != 0 {
+		throw("Index overflow or type address not a multiple of 32")
+	}
+	return offset
+}
+
+// The maximum number of bytes of the pointer mask of a cached type. This
+// limits the cached types to those with up to 4 KB of pointer data.
+const maxTypeMaskBytes = 64
+
+// typeDesc is the persistent description of a cached type. It holds the fields
+// of the _type structure that are needed to set the heap type bits of an
+// object of the type, as _type pointers are not valid across runs.
+type typeDesc struct {
+	kind    uint8
+	size    uintptr
+	ptrdata uintptr
+	mask    [maxTypeMaskBytes]byte
+}
+
+// typeMaskBytes returns the number of bytes of the pointer mask of 'typ'
+func typeMaskBytes(typ *_type) uintptr {
+	return (typ.ptrdata/intSize + 7) / 8
+}
+
+func (d *typeDesc) set(typ *_type) {
+	d.kind = typ.kind
+	d.size = typ.size
+	d.ptrdata = typ.ptrdata
+	memmove(unsafe.Pointer(&d.mask[0]), unsafe.Pointer(typ.gcdata), typeMaskBytes(typ))
+	PersistRange(unsafe.Pointer(d), unsafe.Sizeof(*d))
+}
+
+func (d *typeDesc) matches(typ *_type) bool {
+	if d.kind != typ.kind || d.size != typ.size || d.ptrdata != typ.ptrdata {
+		return false
+	}
+	n := typeMaskBytes(typ)
+	return n <= maxTypeMaskBytes &&
+		memequal(unsafe.Pointer(&d.mask[0]), unsafe.Pointer(typ.gcdata), n)
+}
+
+// cacheableType reports whether objects of type 'typ' can be allocated from
+// spans dedicated to the type.
+func cacheableType(typ *_type) bool {
+	return typ.ptrdata != 0 && typ.size <= maxSmallSize &&
+		typ.kind&kindMask != kindSlice && typ.kind&kindGCProg == 0 &&
+		typeMaskBytes(typ) <= maxTypeMaskBytes
+}
+
+// promoteType assigns the type 'typ' a slot in the mcache if it can be cached,
+// and stores the assignment and the type descriptor in the persistent memory
+// header. The descriptor is persisted before the type offset, as the offset
+// marks the slot as assigned.
+func promoteType(typ *_type) {
+	if !cacheableType(typ) {
+		return
+	}
+	off := typeOffset(typ)
+	lock(&typLock)
+	if typAssigns[off] == 0 && numAssigned < maxCacheTypes-1 {
+		numAssigned++
+		i := numAssigned - 2
+		pmemHeader.typeDescs[i].set(typ)
+		// store the mapping persistently
+		pmemHeader.typeMap[i] = off
+		PersistRange(unsafe.Pointer(&pmemHeader.typeMap[i]), intSize)
+		typAssigns[off] = numAssigned
+	}
+	unlock(&typLock)
+}
+
+// restoreTypeMap restores the assignment of cached types to mcache slots from
+// the persistent memory header. A type gets its previous slot only if the type
+// at the stored offset in this binary matches the stored type descriptor, as
+// the offset of a type can change when the application is rebuilt. Otherwise
+// the slot is left unused, since spans dedicated to the type stored in it may
+// still be in use.
+func restoreTypeMap() {
+	for i := 0; i < maxCacheTypes-2; i++ {
+		off := pmemHeader.typeMap[i]
+		if off == 0 {
+			break
+		}
+		numAssigned++
+		if typ := typeAtOffset(off); typ != nil && pmemHeader.typeDescs[i].matches(typ) {
+			typAssigns[off] = i + 2
+		}
+	}
+}
+
+// clearTypeMap undoes restoreTypeMap() if persistent memory initialization
+// fails. No type is assigned before persistent memory is initialized.
+func clearTypeMap() {
+	numAssigned = 1
+	typAssigns = [len(typAssigns)]int{}
+}
+
+// typeAtOffset returns the type at index 'off' of the type profiling arrays, or
+// nil if there cannot be a type at that index in this binary.
+func typeAtOffset(off uintptr) *_type {
+	md := &firstmoduledata
+	p := typeBase + off*32
+	if off >= 50000 || p < md.types || p+unsafe.Sizeof(_type{}) > md.etypes {
+		return nil
+	}
+	typ := (*_type)(unsafe.Pointer(p))
+	// The pointer mask of a type is in the read-only data of the binary
+	if g := uintptr(unsafe.Pointer(typ.gcdata)); g < md.etext || g >= md.noptrdata {
+		return nil
+	}
+	return typ
+}
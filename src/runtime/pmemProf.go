@@ -0,0 +1,130 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+)
+
+// Persistent memory allocation profiling. Persistent memory allocations are
+// also recorded in the memory profile (see MemProfile()), but that profile is
+// aggregated by allocation site and mixes persistent and volatile allocations.
+// The persistent memory profile records each sampled persistent memory
+// allocation individually, so that the objects that fill the persistent
+// memory file can be attributed to the code that allocated them.
+
+// PmemProfileRecord describes a sampled persistent memory allocation whose
+// object is still allocated.
+type PmemProfileRecord struct {
+	Base   uintptr     // address of the allocated object
+	Size   uintptr     // number of bytes allocated, rounded up to the size class
+	Stack0 [32]uintptr // stack trace of the allocation; ends at first 0 entry
+}
+
+// Stack returns the stack trace associated with the record, a prefix of
+// r.Stack0.
+func (r *PmemProfileRecord) Stack() []uintptr {
+	for i, v := range r.Stack0 {
+		if v == 0 {
+			return r.Stack0[0:i]
+		}
+	}
+	return r.Stack0[0:]
+}
+
+var pmemProf struct {
+	// The profiling rate set using SetPmemProfileRate(). Accessed atomically.
+	rate uint32
+
+	// The number of bytes to be allocated before the next allocation is
+	// sampled, stored as an int64. Accessed atomically.
+	next uint64
+
+	lock    mutex
+	records map[uintptr]*PmemProfileRecord // object address -> record
+}
+
+// SetPmemProfileRate sets the rate at which persistent memory allocations are
+// recorded in the persistent memory profile. As with MemProfileRate, one
+// allocation is sampled for about every 'rate' bytes allocated. A rate of 1
+// records every persistent memory allocation, and a rate of 0 (the default)
+// disables the profile. Disabling the profile discards the records collected.
+func SetPmemProfileRate(rate int) {
+	if rate < 0 || rate > 1<<30 {
+		panic(plainError("SetPmemProfileRate: invalid rate"))
+	}
+	atomic.Store(&pmemProf.rate, uint32(rate))
+	atomic.Store64(&pmemProf.next, uint64(fastexprand(rate)))
+	if rate == 0 {
+		lock(&pmemProf.lock)
+		pmemProf.records = nil
+		unlock(&pmemProf.lock)
+	}
+}
+
+// pmemProfileAlloc is called by mallocgc() after a persistent memory object of
+// 'size' bytes is allocated at 'x', if the persistent memory profile is
+// enabled. It records the allocation if it is sampled.
+func pmemProfileAlloc(x uintptr, size uintptr, rate uint32) {
+	if rate != 1 {
+		if int64(atomic.Xadd64(&pmemProf.next, -int64(size))) > 0 {
+			return
+		}
+		atomic.Store64(&pmemProf.next, uint64(fastexprand(int(rate))))
+	}
+
+	r := new(PmemProfileRecord)
+	r.Base, r.Size = x, size
+	// Skip pmemProfileAlloc and mallocgc
+	callers(3, r.Stack0[:])
+
+	lock(&pmemProf.lock)
+	if atomic.Load(&pmemProf.rate) != 0 {
+		if pmemProf.records == nil {
+			pmemProf.records = make(map[uintptr]*PmemProfileRecord)
+		}
+		// A record of an earlier object at the same address is replaced
+		pmemProf.records[x] = r
+	}
+	unlock(&pmemProf.lock)
+}
+
+// PmemProfile returns the records of the sampled persistent memory allocations
+// whose objects are still allocated. Records of objects that were reclaimed by
+// the garbage collector are discarded. An object is only known to be reclaimed
+// after its span is swept, so the profile can include objects that became
+// unreachable in the last garbage collection cycle. If the profile is sampled,
+// the record of a reclaimed object is reported for an object that was
+// allocated at the same address without being sampled. This does not happen
+// if every allocation is recorded, see SetPmemProfileRate().
+func PmemProfile() []PmemProfileRecord {
+	lock(&pmemProf.lock)
+	for x := range pmemProf.records {
+		if !pmemObjectAllocated(x) {
+			delete(pmemProf.records, x)
+		}
+	}
+	n := len(pmemProf.records)
+	unlock(&pmemProf.lock)
+
+	// The slice is allocated without holding the lock. Records added in
+	// between are not included.
+	p := make([]PmemProfileRecord, 0, n)
+	lock(&pmemProf.lock)
+	for _, r := range pmemProf.records {
+		if len(p) == cap(p) {
+			break
+		}
+		p = append(p, *r)
+	}
+	unlock(&pmemProf.lock)
+	return p
+}
+
+// pmemObjectAllocated reports whether the persistent memory object containing
+// 'x' is allocated
+func pmemObjectAllocated(x uintptr) bool {
+	s := spanOfHeap(x)
+	if s == nil || s.memtype != isPersistent {
+		return false
+	}
+	return !s.isFree(s.objIndex(x))
+}
@@ -0,0 +1,60 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Set to 1 if the pointers in persisted ranges are checked. See
+// PmemCheckPointers().
+var pmemPtrCheck uint32
+
+// PmemCheckPointers enables or disables checking the pointers that are made
+// persistent. When enabled, PersistRange(), PersistRanges(), FlushRange(),
+// PersistObject(), and PersistField() check each pointer in the persistent
+// memory objects that overlap the flushed ranges, and throw if a pointer
+// points into volatile memory, i.e. the volatile heap or a goroutine stack.
+// Only pointers into the persistent memory heap are valid after a restart, as
+// the runtime maps a single persistent memory file, and every arena of the
+// file is swizzled along with the pointers into it if it is relocated.
+// Pointers to global variables are not checked, as interface values can hold
+// pointers to read-only data in the binary.
+//
+// The check walks the heap type bits of the objects on every flush, so it is
+// disabled by default and is meant for testing applications.
+func PmemCheckPointers(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.Store(&pmemPtrCheck, v)
+}
+
+// checkPersistedPointers throws if a persistent memory object that overlaps
+// the range of 'n' bytes starting at 'p' holds a pointer to volatile memory,
+// and the check is enabled
+func checkPersistedPointers(p, n uintptr) {
+	if atomic.Load(&pmemPtrCheck) == 0 || n == 0 || !inpmem(p) {
+		return
+	}
+	forEachPointerIn(p, n, func(addr uintptr) bool {
+		target := *(*uintptr)(unsafe.Pointer(addr))
+		if s := spanOf(target); s != nil && s.memtype != isPersistent {
+			print("runtime: persistent memory at ", hex(addr), " points to volatile memory at ",
+				hex(target), "\n")
+			throw("pointer to volatile memory made persistent")
+		}
+		return true
+	})
+}
+
+// checkPersistedRanges calls checkPersistedPointers() for each range in
+// 'ranges'
+func checkPersistedRanges(ranges []MemRange) {
+	if atomic.Load(&pmemPtrCheck) == 0 {
+		return
+	}
+	for i := range ranges {
+		checkPersistedPointers(uintptr(ranges[i].Addr), ranges[i].Len)
+	}
+}
@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// A read-only persistent memory file is opened read-only and mapped
+// copy-on-write (MAP_PRIVATE). Reconstruction, pointer swizzling, and garbage
+// collection run unchanged, but any page they write to becomes a private copy
+// that is discarded when the process exits, so the file is never modified. The
+// mapping is not PROT_READ, as reconstruction has to update the heap type bits
+// and span bitmap of arenas that are relocated, and the garbage collector
+// writes to the heap even if the application does not.
+
+// PmemRegion is a persistent memory file opened using PmemOpenReadOnly() or
+// PmemInitOpts().
+type PmemRegion struct {
+	fname string
+}
+
+// PmemOpenReadOnly opens the persistent memory file 'fname' for inspection. The
+// file has to be a persistent memory file that was initialized by a previous
+// call to PmemInit(). It is reconstructed as in PmemInit(), but the file is
+// never modified. All persistent memory allocations fail; Pnew and PmakeSlice
+// return nil and the pnew and pmake builtins panic with ErrPmemReadOnly.
+// SetRoot, SetNamedRoot, and PTxBegin return ErrPmemReadOnly. The file is
+// mapped copy-on-write rather than read-only, so objects in the file can be
+// written to, but the writes are not stored in the file.
+// PmemOpenReadOnly cannot be used together with PmemInit() in a process.
+func PmemOpenReadOnly(fname string) (*PmemRegion, error) {
+	if _, err := pmemInit(fname, true, nil); err != nil {
+		return nil, err
+	}
+	return &PmemRegion{fname: fname}, nil
+}
+
+// Name returns the name of the persistent memory file
+func (r *PmemRegion) Name() string {
+	return r.fname
+}
+
+// Root returns the application root pointer of the file. See GetRoot().
+func (r *PmemRegion) Root() unsafe.Pointer {
+	return GetRoot()
+}
+
+// NamedRoot returns the application root identified by 'name'. See
+// GetNamedRoot().
+func (r *PmemRegion) NamedRoot(name string) unsafe.Pointer {
+	return GetNamedRoot(name)
+}
+
+// ReadStats populates 'ps' with statistics about the persistent memory heap of
+// the file. See ReadPmemStats().
+func (r *PmemRegion) ReadStats(ps *PmemStats) {
+	ReadPmemStats(ps)
+}
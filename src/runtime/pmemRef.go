@@ -0,0 +1,199 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Reference counted persistent memory objects. An object allocated using
+// PnewRC() has a reference count that is stored in the persistent memory
+// reference table. Each entry of the table records the address of an object
+// and its reference count:
+//
+//	| obj | count |
+//
+// The table is a persistent side table (see sideTable) whose first entry
+// stores the number of entries that follow it in its count field. The table
+// is a persistent memory object with pointers, so it keeps the objects it
+// refers to alive, and their addresses are swizzled along with the rest of
+// the heap if an arena is relocated.
+//
+// An entry is used if its object address is not nil. When the count of an
+// object drops to zero, the count is persisted first, then the object address
+// is cleared, and the object is released using Pfree() last. An entry with an
+// object address and a zero count therefore records a release that was
+// interrupted by a crash, and the release is completed during reconstruction.
+// The object address is cleared before the object is released, as its slot
+// can be reused once it is released, so the release is never repeated for a
+// new object. A crash in between leaves an object that the table no longer
+// refers to, which is reclaimed by the garbage collector. An entry is filled
+// in the reverse order by PnewRC(), so a crash before its count is persisted
+// leaves an entry whose new object is released during reconstruction.
+
+// pmemRef is an entry in the persistent memory reference table
+type pmemRef struct {
+	obj   unsafe.Pointer
+	count uintptr
+}
+
+// A volatile data-structure that tracks the reference table
+var pmemRefs struct {
+	// The reference table. Its lock also protects the index.
+	sideTable
+
+	// index maps the address of each reference counted object to its index in
+	// the table
+	index map[uintptr]int
+}
+
+// refEntries returns the entries of the reference table 'table'
+func refEntries(table unsafe.Pointer) []pmemRef {
+	if table == nil {
+		return nil
+	}
+	n := (*pmemRef)(table).count
+	return (*[1 << 26]pmemRef)(table)[1 : n+1 : n+1]
+}
+
+// PnewRC allocates a zeroed, reference counted object in persistent memory
+// whose type is the dynamic type of 'typ', and returns a pointer to it. The
+// value of 'typ' is not used. The reference count of the object is 1. It is
+// incremented using PmemIncRef() and decremented using PmemDecRef(), and the
+// object is released using Pfree() when it drops to zero. The reference count
+// is persistent, so an object that is shared by several persistent data
+// structures is released only after all of them have dropped it, even across
+// restarts. PnewRC returns nil if there is no space left for the object in
+// the persistent memory file.
+func PnewRC(typ interface{}) unsafe.Pointer {
+	t := efaceOf(&typ)._type
+	if t == nil {
+		panic(plainError("runtime: PnewRC called with a nil type"))
+	}
+	// The slot of the object is cleared as a whole when it is released
+	p := pnewSlot(t)
+	if p == nil {
+		return nil
+	}
+
+	lock(&pmemRefs.lock)
+	for {
+		refs := refEntries(pmemRefs.table)
+		for i := range refs {
+			if r := &refs[i]; r.obj == nil {
+				r.obj = p
+				PersistRange(unsafe.Pointer(&r.obj), intSize)
+				r.count = 1
+				PersistRange(unsafe.Pointer(&r.count), intSize)
+				if pmemRefs.index == nil {
+					pmemRefs.index = make(map[uintptr]int)
+				}
+				pmemRefs.index[uintptr(p)] = i
+				unlock(&pmemRefs.lock)
+				return p
+			}
+		}
+
+		if !pmemRefs.grow(pmemRef{}, unsafe.Offsetof(pmemRef{}.count), &pmemHeader.refTable) {
+			unlock(&pmemRefs.lock)
+			return nil
+		}
+	}
+}
+
+// refOf returns the reference table entry of the object 'ptr'. The reference
+// table lock must be held.
+func refOf(ptr unsafe.Pointer) (*pmemRef, error) {
+	if pmemInfo.readOnly {
+		return nil, ErrPmemReadOnly
+	}
+	i, ok := pmemRefs.index[uintptr(ptr)]
+	if !ok {
+		return nil, errorString("Object is not reference counted")
+	}
+	return &refEntries(pmemRefs.table)[i], nil
+}
+
+// PmemIncRef increments the reference count of the object 'ptr' allocated
+// using PnewRC(). The new count is persistent when PmemIncRef returns.
+func PmemIncRef(ptr unsafe.Pointer) error {
+	lock(&pmemRefs.lock)
+	defer unlock(&pmemRefs.lock)
+	r, err := refOf(ptr)
+	if err != nil {
+		return err
+	}
+	r.count++
+	PersistRange(unsafe.Pointer(&r.count), intSize)
+	return nil
+}
+
+// PmemDecRef decrements the reference count of the object 'ptr' allocated
+// using PnewRC(). If the count drops to zero, the object is released using
+// Pfree() and is no longer reference counted, and PmemDecRef reports true. The
+// new count is persistent when PmemDecRef returns, and if the application
+// crashes while the object is being released, the release is completed by the
+// next PmemInit() call.
+func PmemDecRef(ptr unsafe.Pointer) (bool, error) {
+	lock(&pmemRefs.lock)
+	r, err := refOf(ptr)
+	if err != nil {
+		unlock(&pmemRefs.lock)
+		return false, err
+	}
+	r.count--
+	PersistRange(unsafe.Pointer(&r.count), intSize)
+	if r.count != 0 {
+		unlock(&pmemRefs.lock)
+		return false, nil
+	}
+	obj := releaseRef(r)
+	delete(pmemRefs.index, uintptr(ptr))
+	unlock(&pmemRefs.lock)
+	// Pfree() cannot be called while holding the lock
+	Pfree(obj)
+	return true, nil
+}
+
+// releaseRef frees the reference table entry 'r' whose count is zero, and
+// returns its object, which the caller releases using Pfree()
+func releaseRef(r *pmemRef) unsafe.Pointer {
+	obj := r.obj
+	r.obj = nil
+	PersistRange(unsafe.Pointer(&r.obj), intSize)
+	return obj
+}
+
+// PmemRefCount returns the reference count of the object 'ptr' allocated using
+// PnewRC(), or 0 if the object is not reference counted.
+func PmemRefCount(ptr unsafe.Pointer) int {
+	lock(&pmemRefs.lock)
+	defer unlock(&pmemRefs.lock)
+	i, ok := pmemRefs.index[uintptr(ptr)]
+	if !ok {
+		return 0
+	}
+	return int(refEntries(pmemRefs.table)[i].count)
+}
+
+// restoreRefTable finds the reference table after a restart, completes the
+// releases that were interrupted by a crash, and indexes the reference
+// counted objects. This is called during reconstruction after the pointers in
+// the table are swizzled.
+func restoreRefTable(arenas []*arenaInfo) {
+	if !pmemRefs.restore(pmemHeader.refTable, arenas, "reference") {
+		return
+	}
+	pmemRefs.index = make(map[uintptr]int)
+	refs := refEntries(pmemRefs.table)
+	for i := range refs {
+		r := &refs[i]
+		switch {
+		case r.obj == nil:
+		case r.count == 0:
+			if !pmemInfo.readOnly {
+				Pfree(releaseRef(r))
+			}
+		default:
+			pmemRefs.index[uintptr(r.obj)] = i
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Named application roots. In addition to the single application root pointer
+// set using SetRoot(), applications can register up to maxNamedRoots roots,
+// each identified by a string name. This allows independent components of an
+// application to find their persistent data after a restart without sharing a
+// common root object.
+//
+// A named root can be registered as ephemeral using SetEphemeralRoot(). The
+// ephemeral roots are removed by PmemClose() when the application shuts down
+// cleanly, but are preserved if the process exits without calling it. An
+// ephemeral root found after a restart therefore indicates that the previous
+// run did not shut down cleanly.
+//
+// An application can register a validator for a root using SetRootValidator()
+// before persistent memory is initialized. Each root found during
+// reconstruction is passed to its validator, and a root that is rejected is
+// hidden from GetRoot() and GetNamedRoot(). The root entry and the object are
+// kept as is, so that a rejected root is found again by the next run, unless
+// the application replaces or removes it.
+
+const (
+	// The maximum number of named roots that can be registered
+	maxNamedRoots = 64
+
+	// The maximum length of the name of a named root. This keeps the size of
+	// each entry in the named root table at 64 bytes.
+	maxRootNameLen = 55
+
+	// The bit set in namedRoot.nameLen of an ephemeral root. A root name is
+	// at most maxRootNameLen bytes long, so this bit is not used by the name
+	// length.
+	rootEphemeral = 1 << 7
+)
+
+// namedRoot is an entry in the named root table stored in the persistent
+// memory header. An entry is in use only if nameLen is non-zero. nameLen holds
+// the length of the name, and the rootEphemeral bit for an ephemeral root.
+type namedRoot struct {
+	name    [maxRootNameLen]byte
+	nameLen uint8
+
+	// The offset from the beginning of the file of the root object
+	offset uintptr
+}
+
+func (nr *namedRoot) matches(name string) bool {
+	n := nr.nameLen &^ rootEphemeral
+	return int(n) == len(name) && string(nr.name[:n]) == name
+}
+
+func (nr *namedRoot) ephemeral() bool {
+	return nr.nameLen&rootEphemeral != 0
+}
+
+// SetNamedRoot stores 'addr' as the application root identified by 'name'.
+// If a root with the same name exists, it is replaced. Passing a nil 'addr'
+// removes the root. Like SetRoot(), the object pointed to by 'addr' must be in
+// persistent memory, and it is not garbage collected while it is registered as
+// a root. SetNamedRoot returns an error if persistent memory is not
+// initialized.
+func SetNamedRoot(name string, addr unsafe.Pointer) error {
+	return setNamedRoot(name, addr, 0)
+}
+
+// SetEphemeralRoot is like SetNamedRoot(), but the root is removed when
+// PmemClose() is called. If the process exits without calling PmemClose(), the
+// root is found after a restart, and PmemEphemeralRootsFound() reports true.
+// Setting an existing root of the same name makes it ephemeral.
+func SetEphemeralRoot(name string, addr unsafe.Pointer) error {
+	return setNamedRoot(name, addr, rootEphemeral)
+}
+
+// setNamedRoot stores 'addr' as the root identified by 'name'. 'flags' is 0 or
+// rootEphemeral.
+func setNamedRoot(name string, addr unsafe.Pointer, flags uint8) error {
+	if len(name) == 0 || len(name) > maxRootNameLen {
+		return errorString("Invalid root name")
+	}
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return errorString("Persistent memory is not initialized")
+	}
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+	if addr != nil {
+		s := spanOfHeap(uintptr(addr))
+		if s == nil || s.memtype != isPersistent {
+			return errorString("Invalid address passed to SetNamedRoot")
+		}
+	}
+
+	lock(&pmemInfo.rootLock)
+	defer unlock(&pmemInfo.rootLock)
+
+	free := -1
+	for i := range pmemHeader.namedRoots {
+		nr := &pmemHeader.namedRoots[i]
+		if nr.nameLen == 0 {
+			if free == -1 {
+				free = i
+			}
+			continue
+		}
+		if !nr.matches(name) {
+			continue
+		}
+		if addr == nil {
+			// Clearing nameLen atomically removes the entry
+			nr.nameLen = 0
+			PersistRange(unsafe.Pointer(&nr.nameLen), unsafe.Sizeof(nr.nameLen))
+		} else {
+			nr.offset = fileOffsetOf(uintptr(addr))
+			PersistRange(unsafe.Pointer(&nr.offset), intSize)
+			if n := uint8(len(name)) | flags; nr.nameLen != n {
+				nr.nameLen = n
+				PersistRange(unsafe.Pointer(&nr.nameLen), unsafe.Sizeof(nr.nameLen))
+			}
+		}
+		pmemInfo.namedRoots[i] = addr
+		pmemInfo.namedRootsRejected[i] = false
+		return nil
+	}
+
+	if addr == nil {
+		return nil
+	}
+	if free == -1 {
+		return errorString("No more space to store named roots")
+	}
+
+	// The entry becomes valid only when nameLen is set. So the name and the
+	// offset have to be persisted before that.
+	nr := &pmemHeader.namedRoots[free]
+	copy(nr.name[:], name)
+	nr.offset = fileOffsetOf(uintptr(addr))
+	PersistRange(unsafe.Pointer(nr), unsafe.Offsetof(nr.nameLen))
+	PersistRange(unsafe.Pointer(&nr.offset), intSize)
+	nr.nameLen = uint8(len(name)) | flags
+	PersistRange(unsafe.Pointer(&nr.nameLen), unsafe.Sizeof(nr.nameLen))
+	pmemInfo.namedRoots[free] = addr
+	pmemInfo.namedRootsRejected[free] = false
+	return nil
+}
+
+// GetNamedRoot returns the application root identified by 'name', or nil if no
+// such root exists or if it was rejected by its validator. After a restart, it
+// returns the address of the root object in the new mapping of the persistent
+// memory file.
+func GetNamedRoot(name string) unsafe.Pointer {
+	if pmemHeader == nil {
+		return nil
+	}
+
+	lock(&pmemInfo.rootLock)
+	defer unlock(&pmemInfo.rootLock)
+	for i := range pmemHeader.namedRoots {
+		if pmemHeader.namedRoots[i].matches(name) {
+			if pmemInfo.namedRootsRejected[i] {
+				return nil
+			}
+			return pmemInfo.namedRoots[i]
+		}
+	}
+	return nil
+}
+
+// PmemClose records that the application is shutting down cleanly by removing
+// all ephemeral roots (see SetEphemeralRoot()). Each root is removed by
+// clearing its entry in the named root table, which is persisted before
+// PmemClose returns. Persistent memory can still be used after PmemClose
+// returns, so it is typically called just before the application exits.
+func PmemClose() error {
+	if pmemHeader == nil {
+		return errorString("Persistent memory is not initialized")
+	}
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+
+	lock(&pmemInfo.rootLock)
+	for i := range pmemHeader.namedRoots {
+		nr := &pmemHeader.namedRoots[i]
+		if nr.ephemeral() {
+			nr.nameLen = 0
+			FlushRange(unsafe.Pointer(&nr.nameLen), unsafe.Sizeof(nr.nameLen))
+			pmemInfo.namedRoots[i] = nil
+			pmemInfo.namedRootsRejected[i] = false
+		}
+	}
+	Fence()
+	unlock(&pmemInfo.rootLock)
+	return nil
+}
+
+// PmemEphemeralRootsFound reports whether any ephemeral root was found when
+// the persistent memory file was reopened. This means that the previous run
+// registered an ephemeral root and did not call PmemClose() afterwards, e.g.
+// because it crashed.
+func PmemEphemeralRootsFound() bool {
+	return pmemInfo.ephemeralFound
+}
+
+// rootValidator is a validator registered using SetRootValidator()
+type rootValidator struct {
+	name string
+	fn   func(ptr unsafe.Pointer) bool
+}
+
+// SetRootValidator registers 'fn' to validate the application root identified
+// by 'name' when the persistent memory file is reopened. An empty 'name'
+// identifies the root set using SetRoot(). During reconstruction, after the
+// pointers in the file are swizzled, 'fn' is called with the address of the
+// root object if the root exists. If 'fn' returns false, e.g. because a magic
+// field of the object does not match, GetRoot() or GetNamedRoot() returns nil
+// for the root, and PmemRejectedRoots() reports it. Registering a validator
+// for a name replaces the previous one, and a nil 'fn' removes it.
+//
+// Validators must be registered before PmemInit is called, and
+// SetRootValidator returns ErrPmemAlreadyInit otherwise. They are called while
+// persistent memory is being initialized, so they must not allocate
+// persistent memory, or get or set roots. If a validator panics, persistent
+// memory cannot be used by the process.
+func SetRootValidator(name string, fn func(ptr unsafe.Pointer) bool) error {
+	if len(name) > maxRootNameLen {
+		return errorString("Invalid root name")
+	}
+	lock(&pmemInfo.rootLock)
+	defer unlock(&pmemInfo.rootLock)
+	if atomic.Load(&pmemInfo.initState) != initNotDone {
+		return ErrPmemAlreadyInit
+	}
+	vs := pmemInfo.rootValidators
+	for i := range vs {
+		if vs[i].name != name {
+			continue
+		}
+		if fn == nil {
+			pmemInfo.rootValidators = append(vs[:i:i], vs[i+1:]...)
+		} else {
+			vs[i].fn = fn
+		}
+		return nil
+	}
+	if fn != nil {
+		pmemInfo.rootValidators = append(vs, rootValidator{name, fn})
+	}
+	return nil
+}
+
+// PmemRejectedRoots returns the names of the roots that were rejected by their
+// validators when the persistent memory file was reopened, and that were not
+// replaced or removed since. The root set using SetRoot() is reported as an
+// empty name.
+func PmemRejectedRoots() []string {
+	if pmemHeader == nil {
+		return nil
+	}
+	lock(&pmemInfo.rootLock)
+	defer unlock(&pmemInfo.rootLock)
+	var names []string
+	if pmemInfo.rootRejected {
+		names = append(names, "")
+	}
+	for i, rejected := range pmemInfo.namedRootsRejected {
+		if rejected {
+			nr := &pmemHeader.namedRoots[i]
+			names = append(names, string(nr.name[:nr.nameLen&^rootEphemeral]))
+		}
+	}
+	return names
+}
+
+// validateRoots passes each root found during reconstruction to its
+// validator, and records the roots that are rejected. The validators are
+// called before the other roots are validated, so they must not use them. If
+// a validator panics, the initialization fails for good, as the arenas of the
+// file are already in the heap, and PmemInit returns ErrPmemInitFailed if it
+// is called again.
+func validateRoots() {
+	done := false
+	defer func() {
+		if !done {
+			pmemHeader = nil
+			atomic.Store(&pmemInfo.initState, initFailed)
+		}
+	}()
+	for _, v := range pmemInfo.rootValidators {
+		if v.name == "" {
+			if p := pmemInfo.root; p != nil && !v.fn(p) {
+				pmemInfo.rootRejected = true
+			}
+			continue
+		}
+		for i := range pmemHeader.namedRoots {
+			if !pmemHeader.namedRoots[i].matches(v.name) {
+				continue
+			}
+			if p := pmemInfo.namedRoots[i]; p != nil && !v.fn(p) {
+				pmemInfo.namedRootsRejected[i] = true
+			}
+			break
+		}
+	}
+	done = true
+}
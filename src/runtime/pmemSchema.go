@@ -0,0 +1,73 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// ErrPmemSchemaNewer is returned by PmemReopen if the schema version stored in
+// the persistent memory file is newer than the version the application
+// expects, i.e. the file was written by a newer version of the application.
+var ErrPmemSchemaNewer error = errorString("Persistent memory file has a newer schema version than expected")
+
+// PmemReopen opens the persistent memory file 'fname', creating it if it does
+// not exist, and checks the version of the format of the application data in
+// the file against 'expectedSchema'. The schema version is chosen by the
+// application and is stored in the persistent memory header. It is unrelated
+// to the format version of the runtime metadata. 'size' is the size of the
+// application reserved region, as in PmemOptions.ReservedSize.
+//
+// If the file is created, its schema version is set to 'expectedSchema'. If
+// the stored version is older, 'needsMigration' is true; the application then
+// converts its data and records the new version using PmemSetSchema(). If the
+// stored version is newer, PmemReopen returns ErrPmemSchemaNewer. As
+// persistent memory cannot be closed, the file remains open in that case, and
+// the application must not modify it.
+func PmemReopen(fname string, size int, expectedSchema uint32) (region *PmemRegion, needsMigration bool, err error) {
+	if size < 0 {
+		return nil, false, errorString("Invalid reserved region size passed to PmemReopen")
+	}
+	region, err = PmemInitOpts(PmemOptions{Fname: fname, ReservedSize: uintptr(size)})
+	if err != nil {
+		return nil, false, err
+	}
+	if pmemInfo.created {
+		if err := PmemSetSchema(region, expectedSchema); err != nil {
+			return nil, false, err
+		}
+		return region, false, nil
+	}
+	switch stored := region.Schema(); {
+	case stored > expectedSchema:
+		return nil, false, ErrPmemSchemaNewer
+	case stored < expectedSchema:
+		needsMigration = true
+	}
+	return region, needsMigration, nil
+}
+
+// PmemSetSchema records 'version' as the schema version of the application
+// data in the persistent memory file of 'region'. The version is persistent
+// when PmemSetSchema returns. An application that migrates its data should
+// make the migrated data persistent before it sets the new version, so that a
+// crash during the migration is detected by the next PmemReopen() call.
+func PmemSetSchema(region *PmemRegion, version uint32) error {
+	if region == nil || pmemHeader == nil {
+		return errorString("Persistent memory is not initialized")
+	}
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+	atomic.Store(&pmemHeader.schemaVersion, version)
+	PersistRange(unsafe.Pointer(&pmemHeader.schemaVersion), unsafe.Sizeof(version))
+	return nil
+}
+
+// Schema returns the schema version of the application data in the file, or 0
+// if it was never set. See PmemSetSchema().
+func (r *PmemRegion) Schema() uint32 {
+	if pmemHeader == nil {
+		return 0
+	}
+	return atomic.Load(&pmemHeader.schemaVersion)
+}
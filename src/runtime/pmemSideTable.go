@@ -0,0 +1,99 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Persistent side tables. The runtime stores the state that it keeps for some
+// persistent memory objects in tables that are persistent memory objects
+// themselves: the reference table (see PnewRC()), the checksum table (see
+// PnewChecked()), the pin table (see PmemPin()), the timestamp table (see
+// PnewTimed()), and the durable free lists of the pools (see PmemPool). The
+// file offset of each table is stored in the persistent memory header, so the
+// tables are persistent roots, like the application root.
+//
+// The first entry of a table stores the number of entries that follow it. A
+// full table is replaced by a table that is twice as large. The new table is
+// allocated without holding the table lock, as mallocgc() can invoke the grow
+// callbacks, and is used only if the table did not change meanwhile. The
+// entries are copied to the new table, and the new table is persisted before
+// its offset is stored in the header, so a crash leaves one of the two tables
+// in use. The old table is then freed by the garbage collector. A table keeps
+// the index of each entry when it grows.
+
+// The number of entries in a new side table
+const minSideTableEntries = 64
+
+// sideTable is the volatile state of a persistent side table
+type sideTable struct {
+	// A lock to protect the table
+	lock mutex
+
+	// The table. This also ensures that the table is not garbage collected.
+	table unsafe.Pointer
+}
+
+// sideTableLen returns the number of entries of the side table 'table', whose
+// first entry stores it at byte offset 'countOff'
+func sideTableLen(table unsafe.Pointer, countOff uintptr) int {
+	if table == nil {
+		return 0
+	}
+	return int(*(*uintptr)(add(table, countOff)))
+}
+
+// grow replaces the full table 't' with a table twice as large. The entries of
+// the table are of the dynamic type of 'entry', and the first entry stores
+// their number at byte offset 'countOff'. 'hdr' is the field of the
+// persistent memory header that stores the file offset of the table. The
+// table lock must be held. It is released while the new table is allocated,
+// so the caller has to look for a free entry again. grow returns false if
+// there is no space left for the new table in the persistent memory file. The
+// table lock is held again when grow returns.
+func (t *sideTable) grow(entry interface{}, countOff uintptr, hdr *uintptr) bool {
+	elem := efaceOf(&entry)._type
+	n := sideTableLen(t.table, countOff)
+	unlock(&t.lock)
+	m := 2 * n
+	if m < minSideTableEntries {
+		m = minSideTableEntries
+	}
+	table := newarray(elem, m+1, isPersistent)
+	lock(&t.lock)
+	if table == nil {
+		return false
+	}
+	if sideTableLen(t.table, countOff) != n {
+		return true
+	}
+
+	*(*uintptr)(add(table, countOff)) = uintptr(m)
+	if n > 0 {
+		dst, src := add(table, elem.size), add(t.table, elem.size)
+		if elem.ptrdata != 0 {
+			typedslicecopy(elem, dst, n, src, n)
+		} else {
+			memmove(dst, src, uintptr(n)*elem.size)
+		}
+	}
+	PersistRange(table, uintptr(m+1)*elem.size)
+	*hdr = fileOffsetOf(uintptr(table))
+	PersistRange(unsafe.Pointer(hdr), intSize)
+	t.table = table
+	return true
+}
+
+// restore finds the table 't' after a restart, using the file offset 'off'
+// stored in the persistent memory header. It reports whether the table is
+// allocated. 'what' names the table if the offset is invalid.
+func (t *sideTable) restore(off uintptr, arenas []*arenaInfo, what string) bool {
+	if off == 0 {
+		return false
+	}
+	table := computeRootAddr(off, arenas)
+	if table == nil {
+		throw("Invalid " + what + " table offset")
+	}
+	t.table = table
+	return true
+}
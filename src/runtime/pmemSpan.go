@@ -0,0 +1,85 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+)
+
+// pmemSpanInfo describes an in-use persistent memory span recorded in a span
+// bitmap
+type pmemSpanInfo struct {
+	base   uintptr
+	npages uintptr
+	spc    spanClass
+	large  bool
+}
+
+// PmemForEachSpan calls 'fn' for each in-use span in the persistent memory
+// heap, in the order of the span bitmaps of the arenas, until 'fn' returns
+// false. 'base' is the address of the span and 'npages' is its size in
+// runtime pages. 'spc' is the spanclass of the span, which is its size class
+// shifted left by one, with the lowest bit set if the objects in the span
+// hold no pointers. 'large' reports whether the span holds a single large
+// object, in which case its size class is 0. The spans are collected while
+// the heap lock is held, and 'fn' is called without holding it, so 'fn' can
+// allocate. Spans that are allocated or freed after PmemForEachSpan is called
+// may or may not be visited.
+func PmemForEachSpan(fn func(base, npages uintptr, spc uint8, large bool) bool) {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return
+	}
+	for _, s := range pmemSpans() {
+		if !fn(s.base, s.npages, uint8(s.spc), s.large) {
+			return
+		}
+	}
+}
+
+// pmemSpans returns the in-use spans recorded in the span bitmaps of all
+// persistent memory arenas. As in pmemArenas(), the slice is allocated before
+// the heap lock is taken. Spans allocated in between are not included.
+func pmemSpans() []pmemSpanInfo {
+	n := 0
+	systemstack(func() {
+		lock(&mheap_.lock)
+		forEachPArena(func(pa *pArena) {
+			forEachBitmapSpan(pa, func(s pmemSpanInfo) bool {
+				n++
+				return true
+			})
+		})
+		unlock(&mheap_.lock)
+	})
+	spans := make([]pmemSpanInfo, 0, n)
+	systemstack(func() {
+		lock(&mheap_.lock)
+		forEachPArena(func(pa *pArena) {
+			forEachBitmapSpan(pa, func(s pmemSpanInfo) bool {
+				if len(spans) == cap(spans) {
+					return false
+				}
+				spans = append(spans, s)
+				return true
+			})
+		})
+		unlock(&mheap_.lock)
+	})
+	return spans
+}
+
+// forEachBitmapSpan calls 'fn' for each valid entry in the span bitmap of the
+// persistent memory arena 'pa', until 'fn' returns false
+func forEachBitmapSpan(pa *pArena, fn func(s pmemSpanInfo) bool) {
+	spanBase := pa.dataStart()
+	for i, sVal := range pa.spanBitmap() {
+		if sVal == 0 {
+			continue
+		}
+		spc, npages, large, _, _ := spanLogDecode(sVal)
+		if !validSpanLog(spc, npages, large) {
+			continue
+		}
+		if !fn(pmemSpanInfo{spanBase + uintptr(i)<<pageShift, npages, spc, large}) {
+			return
+		}
+	}
+}
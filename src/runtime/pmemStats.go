@@ -0,0 +1,255 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+)
+
+// PmemStats records statistics about the persistent memory heap.
+// See ReadPmemStats().
+type PmemStats struct {
+	// TotalBytes is the size of all persistent memory arenas mapped by the
+	// runtime. This is the same as the size of the persistent memory file
+	// that is in use.
+	TotalBytes uint64
+
+	// MetadataBytes is the number of bytes in the persistent memory arenas
+	// that store the file header and the arena metadata.
+	MetadataBytes uint64
+
+	// UsedBytes is the number of bytes in in-use persistent memory spans.
+	UsedBytes uint64
+
+	// FreeBytes is the number of bytes in the persistent memory arenas that
+	// are not used by spans or metadata.
+	// TotalBytes = MetadataBytes + UsedBytes + FreeBytes
+	FreeBytes uint64
+
+	// LargestFreeBytes is the size of the largest run of contiguous free
+	// pages in an arena. A large object that does not fit in it can only be
+	// allocated by growing the persistent memory file, even if FreeBytes is
+	// larger. Objects are never moved, so the free space only becomes
+	// contiguous again when the objects between the free runs are freed.
+	LargestFreeBytes uint64
+
+	// AllocFailures is the number of persistent memory allocations that
+	// failed because the persistent memory file could not grow. See
+	// ErrPmemOutOfSpace.
+	AllocFailures uint64
+
+	// MapPageSize is the page size that the persistent memory arenas are
+	// mapped with. It is the huge page size if PmemOptions.HugePages is set
+	// and the kernel accepted the huge page advice for every arena, and the
+	// base page size otherwise. A file that is not on a persistent memory
+	// device can still be mapped using base pages if its file system does not
+	// support huge pages.
+	MapPageSize uint64
+
+	// NumSpans is the number of in-use persistent memory spans, and
+	// NumLargeSpans is the number of them that hold a single large object.
+	NumSpans      uint64
+	NumLargeSpans uint64
+
+	// PinnedObjects is the number of objects pinned using PmemPin(), and
+	// PinnedSpans is the number of in-use spans that hold them. A pinned
+	// object is never moved, so the pages of these spans cannot be reclaimed
+	// by moving their objects elsewhere.
+	PinnedObjects uint64
+	PinnedSpans   uint64
+
+	// BySize reports per-size class allocation statistics of small objects.
+	// BySize[0] is not used, as large objects do not have a size class.
+	BySize [_NumSizeClasses]struct {
+		// Size is the maximum byte size of an object in this size class.
+		Size uint32
+
+		// Spans is the number of in-use spans of this size class.
+		Spans uint64
+
+		// Objects is the number of allocated objects in these spans.
+		Objects uint64
+	}
+}
+
+// ReadPmemStats populates 'ps' with statistics about the persistent memory
+// heap. All statistics are zero if persistent memory is not initialized.
+// The heap lock is held while the spans are walked, so the statistics are
+// consistent with respect to span allocation. The object counts of spans
+// that are being allocated from concurrently may be slightly out of date.
+func ReadPmemStats(ps *PmemStats) {
+	*ps = PmemStats{}
+	for i := range ps.BySize {
+		ps.BySize[i].Size = uint32(class_to_size[i])
+	}
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return
+	}
+
+	systemstack(func() {
+		lock(&mheap_.lock)
+		readPmemStats(ps)
+		unlock(&mheap_.lock)
+	})
+}
+
+// readPmemStats computes the persistent memory heap statistics. The heap lock
+// must be held.
+func readPmemStats(ps *PmemStats) {
+	forEachPArena(func(pa *pArena) {
+		mdSize, _ := pa.layout()
+		ps.TotalBytes += uint64(pa.size)
+		ps.MetadataBytes += uint64(mdSize)
+		bitmap := pa.spanBitmap()
+		for i := uintptr(0); i < uintptr(len(bitmap)); {
+			npages, free := nextSpanRun(bitmap, i)
+			if n := uint64(npages * pageSize); free && n > ps.LargestFreeBytes {
+				ps.LargestFreeBytes = n
+			}
+			i += npages
+		}
+	})
+
+	for _, s := range mheap_.allspans {
+		if s.state.get() != mSpanInUse || s.memtype != isPersistent {
+			continue
+		}
+		ps.NumSpans++
+		ps.UsedBytes += uint64(s.npages * pageSize)
+		sc := s.spanclass.sizeclass()
+		if sc == 0 {
+			ps.NumLargeSpans++
+			continue
+		}
+		ps.BySize[sc].Spans++
+		ps.BySize[sc].Objects += uint64(s.allocCount)
+	}
+	ps.FreeBytes = ps.TotalBytes - ps.MetadataBytes - ps.UsedBytes
+	ps.PinnedObjects, ps.PinnedSpans = pinnedCounts()
+	ps.AllocFailures = atomic.Load64(&pmemInfo.allocFailures)
+	ps.MapPageSize = uint64(mapPageSize())
+}
+
+// PmemFileSizeFor returns the size of a persistent memory file that provides at
+// least 'usableBytes' bytes of allocator usable space, when it is created with
+// an application reserved region of 'reservedSize' bytes (see
+// PmemOptions.ReservedSize). The file grows by whole arenas, and each arena
+// stores an arena header, a heap type bitmap and a span bitmap before its
+// usable space. The first arena also holds the file header and the reserved
+// region. The size is computed as the file grows when allocations are smaller
+// than an arena: the first allocation maps the first arena, and each later
+// arena is 64 MB. The arena headers are assumed to have the log slots of the
+// open file, or the default number of log slots if persistent memory is not
+// initialized (see PmemOptions.LogSlots). The result can be used as
+// PmemOptions.MaxSize. Some of the usable space may not be usable for large
+// objects due to fragmentation, see PmemStats.LargestFreeBytes. It returns 0
+// if 'usableBytes' is not positive, or if 'reservedSize' is negative or too
+// large to be mapped.
+func PmemFileSizeFor(usableBytes, reservedSize int) int {
+	if usableBytes <= 0 || reservedSize < 0 || uintptr(reservedSize) > maxAlloc {
+		return 0
+	}
+	slots := pmemInfo.logSlots
+	if slots == 0 {
+		slots = defaultLogSlots
+	}
+	hdrSize := pArenaHeaderSize + slots*logEntrySize
+
+	offset := headerRegionSize(uintptr(reservedSize))
+	var size, usable uintptr
+	for usable < uintptr(usableBytes) {
+		n := arenaGrowthSize(offset, hdrSize)
+		_, u := arenaLayout(n, offset, hdrSize)
+		size += n
+		usable += u
+		offset = 0
+	}
+	return int(size)
+}
+
+// PmemGrow extends the persistent memory file by at least 'additionalBytes'
+// bytes, and adds the new space to the persistent memory heap as free pages.
+// The file grows through the same path as when an allocation needs more
+// space: new arenas are mapped at addresses reserved for them, so the arenas
+// that are already mapped, and the pointers into them, are not moved. As for
+// any arena, the metadata of a new arena is initialized before the mapped
+// size in the header is persisted. This lets an application grow the file
+// ahead of its allocations, e.g. to find out early that the device is full.
+// PmemGrow returns ErrPmemOutOfSpace if the file cannot grow by
+// 'additionalBytes', e.g. because of PmemOptions.MaxSize, in which case the
+// arenas that were added are kept.
+func PmemGrow(additionalBytes int) error {
+	if additionalBytes <= 0 {
+		return errorString("Invalid size passed to PmemGrow")
+	}
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return errorString("Persistent memory is not initialized")
+	}
+	if pmemInfo.readOnly {
+		return ErrPmemReadOnly
+	}
+
+	h := &mheap_
+	var err error
+	systemstack(func() {
+		lock(&h.lock)
+		target := pmemInfo.nextMapOffset + uintptr(additionalBytes)
+		for pmemInfo.nextMapOffset < target {
+			// Grow by at most the size of the largest span, as the heap grows
+			// when a span is allocated
+			npages := (target - pmemInfo.nextMapOffset + pageSize - 1) / pageSize
+			if npages > maxLargeSpanPages {
+				npages = maxLargeSpanPages
+			}
+			if !h.grow(npages, isPersistent) {
+				err = ErrPmemOutOfSpace
+				break
+			}
+		}
+		unlock(&h.lock)
+	})
+	pmemGrowNotify()
+	return err
+}
+
+// PmemAvailable returns an estimate of the number of bytes that can still be
+// allocated in persistent memory. This is the free space in the persistent
+// memory arenas, and the space that new arenas can use if the file grows on
+// the device it is on. The file grows by whole arenas, so device space that is
+// smaller than an arena is not counted. Some of the free space in the arenas
+// may not be usable for large objects due to fragmentation, see
+// PmemStats.LargestFreeBytes.
+func PmemAvailable() uintptr {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return 0
+	}
+	var ps PmemStats
+	var mapped uintptr
+	systemstack(func() {
+		lock(&mheap_.lock)
+		readPmemStats(&ps)
+		mapped = pmemInfo.nextMapOffset
+		unlock(&mheap_.lock)
+	})
+
+	room := getFreeSpace(pmemInfo.fname)
+	if pmemInfo.devDaxAlign != 0 {
+		// A device dax is not on a file system, and cannot grow beyond the
+		// size of the device
+		room = getFileSize(pmemInfo.fname) - int(mapped)
+	}
+	if room < 0 {
+		room = 0
+	}
+	grow := uintptr(room)
+	if l := pmemInfo.sizeLimit; l != 0 {
+		if l < mapped {
+			grow = 0
+		} else if l-mapped < grow {
+			grow = l - mapped
+		}
+	}
+	grow = alignDown(grow, heapArenaBytes)
+	if grow != 0 {
+		grow -= alignUp(metadataSize(grow), pageSize)
+	}
+	return uintptr(ps.FreeBytes) + grow
+}
@@ -5,14 +5,20 @@ package runtime
 import "unsafe"
 
 const (
-	fileCreate = 0
-	hdrMagic   = 0x7376213E
+	fileCreate    = 0
+	fileNoReplace = 0
+	fileReadOnly  = 0
+	hdrMagic      = 0x7376213E
 )
 
 func PersistRange(addr unsafe.Pointer, len uintptr) {
 	throw("Not implemented")
 }
 
+func PersistRanges(ranges []MemRange) {
+	throw("Not implemented")
+}
+
 func FlushRange(addr unsafe.Pointer, len uintptr) {
 	throw("Not implemented")
 }
@@ -21,18 +27,57 @@ func Fence() {
 	throw("Not implemented")
 }
 
+func PmemSync() error {
+	throw("Not implemented")
+	return nil
+}
+
+func PmemFlushKind() string {
+	return ""
+}
+
+func PmemHasEADR() bool {
+	return false
+}
+
 func mapFile(path string, len, flags, mode int, off uintptr,
 	mapAddr unsafe.Pointer) (addr unsafe.Pointer, isPmem bool, err int) {
 	throw("Not implemented")
 	return
 }
 
+func adviseHugePages(addr unsafe.Pointer, n uintptr) bool {
+	throw("Not implemented")
+	return false
+}
+
 func getFileSize(fname string) (size int) {
 	throw("Not implemented")
 	return
 }
 
+func getFreeSpace(fname string) int {
+	throw("Not implemented")
+	return -1
+}
+
+func getDevDaxAlign(path string) uintptr {
+	return 0
+}
+
 func platformInit() {
 	throw("Not implemented")
 	return
 }
+
+func PmemMemmove(dst, src unsafe.Pointer, n uintptr) {
+	throw("Not implemented")
+}
+
+func memsetPersist(d uintptr, c byte, n uintptr) {
+	throw("Not implemented")
+}
+
+func SetPmemMemmoveThreshold(n uintptr) {
+	throw("Not implemented")
+}
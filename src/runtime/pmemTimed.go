@@ -0,0 +1,175 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Timestamped persistent memory objects. The allocation time of an object
+// allocated using PnewTimed() is stored in the persistent memory timestamp
+// table. Each entry of the table records the address of an object and its
+// allocation time, in nanoseconds since the Unix epoch:
+//
+//	| obj | ns |
+//
+// The table is a persistent side table (see sideTable) whose first entry
+// stores the number of entries that follow it in its ns field. The table is a
+// persistent memory object with pointers, so it keeps the objects it refers
+// to alive until they are evicted using PmemEvictOlderThan(), and their
+// addresses are swizzled along with the rest of the heap if an arena is
+// relocated. An entry is used if its object address is not nil. The time of a
+// new entry is persisted before its object address.
+//
+// Only PnewTimed() writes to the table, so the other allocation functions do
+// not pay for the timestamps.
+
+// pmemTimestamp is an entry in the persistent memory timestamp table
+type pmemTimestamp struct {
+	obj unsafe.Pointer
+	ns  int64
+}
+
+// A volatile data-structure that tracks the timestamp table
+var pmemTimes struct {
+	// The timestamp table. Its lock also protects the index.
+	sideTable
+
+	// index maps the address of each timestamped object to its index in the
+	// table
+	index map[uintptr]int
+}
+
+// timeEntries returns the entries of the timestamp table 'table'
+func timeEntries(table unsafe.Pointer) []pmemTimestamp {
+	if table == nil {
+		return nil
+	}
+	n := (*pmemTimestamp)(table).ns
+	return (*[1 << 26]pmemTimestamp)(table)[1 : n+1 : n+1]
+}
+
+// wallNanos returns the wall-clock time in nanoseconds since the Unix epoch
+func wallNanos() int64 {
+	sec, nsec := walltime()
+	return sec*1e9 + int64(nsec)
+}
+
+// PnewTimed allocates a zeroed object in persistent memory whose type is the
+// dynamic type of 'typ', and returns a pointer to it. The value of 'typ' is
+// not used. The wall-clock time of the allocation is stored in persistent
+// memory along with the object, and is persistent when PnewTimed returns.
+// PmemObjectAge() returns the age of the object, even after a restart. The
+// object is kept alive by its timestamp until it is evicted using
+// PmemEvictOlderThan(). PnewTimed returns nil if there is no space left for
+// the object in the persistent memory file.
+func PnewTimed(typ interface{}) unsafe.Pointer {
+	t := efaceOf(&typ)._type
+	if t == nil {
+		panic(plainError("runtime: PnewTimed called with a nil type"))
+	}
+	p := pnewSlot(t)
+	if p == nil {
+		return nil
+	}
+
+	lock(&pmemTimes.lock)
+	for {
+		entries := timeEntries(pmemTimes.table)
+		for i := range entries {
+			if e := &entries[i]; e.obj == nil {
+				e.ns = wallNanos()
+				PersistRange(unsafe.Pointer(&e.ns), unsafe.Sizeof(e.ns))
+				e.obj = p
+				PersistRange(unsafe.Pointer(&e.obj), intSize)
+				if pmemTimes.index == nil {
+					pmemTimes.index = make(map[uintptr]int)
+				}
+				pmemTimes.index[uintptr(p)] = i
+				unlock(&pmemTimes.lock)
+				return p
+			}
+		}
+
+		if !pmemTimes.grow(pmemTimestamp{}, unsafe.Offsetof(pmemTimestamp{}.ns),
+			&pmemHeader.timeTable) {
+			unlock(&pmemTimes.lock)
+			return nil
+		}
+	}
+}
+
+// PmemObjectAge returns the time in nanoseconds since the object 'ptr' was
+// allocated using PnewTimed(), based on the wall clock. It returns false if
+// the object was not allocated using PnewTimed(), or was evicted. The age is
+// 0 if the wall clock was set back since the allocation.
+func PmemObjectAge(ptr unsafe.Pointer) (int64, bool) {
+	lock(&pmemTimes.lock)
+	i, ok := pmemTimes.index[uintptr(ptr)]
+	var ns int64
+	if ok {
+		ns = timeEntries(pmemTimes.table)[i].ns
+	}
+	unlock(&pmemTimes.lock)
+	if !ok {
+		return 0, false
+	}
+	if age := wallNanos() - ns; age > 0 {
+		return age, true
+	}
+	return 0, true
+}
+
+// PmemEvictOlderThan calls 'free' for each object allocated using PnewTimed()
+// whose age is at least 'age' nanoseconds, and then removes its timestamp, so
+// that the garbage collector reclaims the object once the application no
+// longer refers to it. 'free' is typically used to remove the object from the
+// data structures of the application. It is called without holding any lock.
+// The timestamp is removed only after 'free' returns, so if the application
+// crashes in between, or if PmemEvictOlderThan is called concurrently, 'free'
+// can be called again for the same object. PmemEvictOlderThan returns the
+// number of objects evicted.
+func PmemEvictOlderThan(age int64, free func(ptr unsafe.Pointer)) (int, error) {
+	if pmemInfo.readOnly {
+		return 0, ErrPmemReadOnly
+	}
+	now := wallNanos()
+	evicted := 0
+	for i := 0; ; i++ {
+		lock(&pmemTimes.lock)
+		entries := timeEntries(pmemTimes.table)
+		if i >= len(entries) {
+			unlock(&pmemTimes.lock)
+			return evicted, nil
+		}
+		p, ns := entries[i].obj, entries[i].ns
+		unlock(&pmemTimes.lock)
+		if p == nil || now-ns < age {
+			continue
+		}
+
+		free(p)
+		// A growing table keeps the index of each entry
+		lock(&pmemTimes.lock)
+		if e := &timeEntries(pmemTimes.table)[i]; e.obj == p {
+			e.obj = nil
+			PersistRange(unsafe.Pointer(&e.obj), intSize)
+			delete(pmemTimes.index, uintptr(p))
+			evicted++
+		}
+		unlock(&pmemTimes.lock)
+	}
+}
+
+// restoreTimeTable finds the timestamp table after a restart, and indexes the
+// timestamped objects. This is called during reconstruction after the
+// pointers in the table are swizzled.
+func restoreTimeTable(arenas []*arenaInfo) {
+	if !pmemTimes.restore(pmemHeader.timeTable, arenas, "timestamp") {
+		return
+	}
+	pmemTimes.index = make(map[uintptr]int)
+	for i, e := range timeEntries(pmemTimes.table) {
+		if e.obj != nil {
+			pmemTimes.index[uintptr(e.obj)] = i
+		}
+	}
+}
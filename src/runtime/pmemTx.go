@@ -0,0 +1,305 @@
+package runtime
+
+import (
+	"unsafe"
+)
+
+// Implementation of a minimal undo log based transaction API for applications.
+//
+// Each transaction uses an undo log buffer that is allocated in persistent
+// memory. The file offsets of the log buffers are stored in the persistent
+// memory header so that they can be found after a restart. A log buffer starts
+// with an intSize field that stores the number of bytes of valid log entries
+// that follow it. Each log entry stores a copy of the logged range followed by
+// a trailer:
+//
+//	| data (padded to intSize) | addr | off | len |
+//
+// where addr is the address of the logged range, off is its offset from the
+// beginning of the persistent memory file, and len is its length in bytes.
+// Placing the trailer after the data allows the log to be walked backwards,
+// which is the order in which entries are reverted.
+//
+// An entry is appended by first writing and persisting it after the valid
+// entries, and then updating and persisting the number of valid bytes. So a
+// crash while logging never exposes a partially written entry.
+//
+// The log buffer is not scanned by the garbage collector, so the pointers in
+// the logged ranges are also kept in the volatile PTx until the transaction
+// completes. Otherwise the objects they point to could be freed once the
+// application overwrites the pointers, and Abort would restore dangling
+// pointers. For the same reason, Abort restores the pointers using write
+// barriers.
+
+const (
+	// The maximum number of transactions that can be active at a time
+	maxTransactions = 16
+
+	// The size of the undo log buffer used by each transaction
+	txLogBytes = 64 << 10
+
+	// The size of the field at the beginning of the log buffer that stores
+	// the number of bytes of valid log entries
+	txLogHeaderSize = intSize
+
+	// The size of the trailer of each log entry
+	txEntryTrailerSize = 3 * intSize
+)
+
+// A volatile data-structure that tracks the undo log buffers
+var txInfo struct {
+	// A lock to protect the allocation of log buffers to transactions
+	lock mutex
+
+	// logs[i] is the undo log buffer whose file offset is stored in entry i of
+	// pmemHeader.txLogs. This also ensures that the log buffers are not garbage
+	// collected.
+	logs [maxTransactions]unsafe.Pointer
+
+	// Set if the log buffer is used by an active transaction
+	busy [maxTransactions]bool
+}
+
+// ErrTxTooLarge is returned by Log if there is no more space in the undo log of
+// the transaction to log a range. The transaction can still be committed or
+// aborted, so the remaining updates can be made in a new transaction.
+var ErrTxTooLarge error = errorString("No more space in the transaction log")
+
+// PTx is a transaction that makes a set of updates to persistent memory crash
+// consistent. The old contents of each persistent memory range have to be
+// logged using Log() before it is modified. If the application crashes before
+// the transaction is committed, all logged ranges are restored on the next
+// PmemInit() call. A transaction can log ranges in any persistent memory arena,
+// as its undo log is separate from the undo logs of the arenas. Different
+// transactions can be used concurrently, but a transaction must not be used by
+// more than one goroutine at a time.
+type PTx struct {
+	slot int
+	log  uintptr // Address of the undo log buffer
+	used uintptr // Number of bytes of valid log entries
+	done bool
+
+	// The pointers in the logged ranges at the time they were logged
+	ptrs []unsafe.Pointer
+}
+
+// PTxBegin starts a new transaction.
+func PTxBegin() (*PTx, error) {
+	if pmemHeader == nil {
+		return nil, errorString("Persistent memory is not initialized")
+	}
+	if pmemInfo.readOnly {
+		return nil, ErrPmemReadOnly
+	}
+
+	lock(&txInfo.lock)
+	slot := -1
+	for i := range txInfo.busy {
+		if txInfo.busy[i] {
+			continue
+		}
+		// Prefer a slot that already has a log buffer allocated
+		if txInfo.logs[i] != nil {
+			slot = i
+			break
+		}
+		if slot == -1 {
+			slot = i
+		}
+	}
+	if slot != -1 {
+		txInfo.busy[slot] = true
+	}
+	unlock(&txInfo.lock)
+
+	if slot == -1 {
+		return nil, errorString("Too many active transactions")
+	}
+
+	if txInfo.logs[slot] == nil {
+		// Allocate the log buffer. This is done without holding the lock as
+		// it is not held by anyone else once the slot is marked as busy. The
+		// buffer is zeroed, so it contains no valid log entries.
+		log := mallocgc(txLogBytes, nil, true, isPersistent)
+		txInfo.logs[slot] = log
+		pmemHeader.txLogs[slot] = fileOffsetOf(uintptr(log))
+		PersistRange(unsafe.Pointer(&pmemHeader.txLogs[slot]), intSize)
+	}
+	return &PTx{slot: slot, log: uintptr(txInfo.logs[slot])}, nil
+}
+
+// Log records the current contents of the persistent memory range of 'size'
+// bytes starting at 'ptr'. It must be called before the range is modified
+// within the transaction.
+func (tx *PTx) Log(ptr unsafe.Pointer, size uintptr) error {
+	if tx.done {
+		return errorString("Transaction already completed")
+	}
+	p := uintptr(ptr)
+	if size == 0 || !inpmem(p) || !inpmem(p+size-1) {
+		return errorString("Invalid range passed to Log")
+	}
+	entrySize := alignUp(size, intSize) + txEntryTrailerSize
+	if txLogHeaderSize+tx.used+entrySize > txLogBytes {
+		return ErrTxTooLarge
+	}
+
+	forEachPointerIn(p, size, func(addr uintptr) bool {
+		tx.ptrs = append(tx.ptrs, *(*unsafe.Pointer)(unsafe.Pointer(addr)))
+		return true
+	})
+	entry := tx.log + txLogHeaderSize + tx.used
+	memmove(unsafe.Pointer(entry), ptr, size)
+	trailer := (*[3]uintptr)(unsafe.Pointer(entry + entrySize - txEntryTrailerSize))
+	trailer[0] = p
+	trailer[1] = fileOffsetOf(p)
+	trailer[2] = size
+	PersistRange(unsafe.Pointer(entry), entrySize)
+
+	tx.used += entrySize
+	*(*uintptr)(unsafe.Pointer(tx.log)) = tx.used
+	PersistRange(unsafe.Pointer(tx.log), intSize)
+	return nil
+}
+
+// Clear logs the persistent memory range of 'size' bytes starting at 'ptr', and
+// zeroes it. Unlike PmemClear(), the range may hold pointers, as they are
+// restored if the application crashes before the transaction is committed.
+// Clear returns an error without modifying the range if it starts or ends in
+// the middle of a non-nil pointer.
+func (tx *PTx) Clear(ptr unsafe.Pointer, size uintptr) error {
+	p := uintptr(ptr)
+	if size != 0 && !forEachPointerIn(p, size, func(addr uintptr) bool {
+		return addr >= p && addr+intSize <= p+size
+	}) {
+		return errorString("Range passed to Clear partially overlaps a pointer")
+	}
+	if err := tx.Log(ptr, size); err != nil {
+		return err
+	}
+	// Clear the pointers using write barriers, so that the garbage collector
+	// does not miss the objects they pointed to if it is marking.
+	forEachPointerIn(p, size, func(addr uintptr) bool {
+		*(*unsafe.Pointer)(unsafe.Pointer(addr)) = nil
+		return true
+	})
+	memsetPersist(p, 0, size)
+	return nil
+}
+
+// Commit makes all the updates done within the transaction persistent and
+// discards the undo log.
+func (tx *PTx) Commit() {
+	tx.finish()
+	for end := tx.log + txLogHeaderSize + tx.used; end > tx.log+txLogHeaderSize; {
+		addr, _, size, start := txLogEntry(end)
+		FlushRange(unsafe.Pointer(addr), size)
+		end = start
+	}
+	Fence()
+	tx.reset()
+}
+
+// Abort restores all the ranges logged within the transaction to their
+// contents at the time they were logged, and discards the undo log.
+func (tx *PTx) Abort() {
+	tx.finish()
+	revertTxLog(tx.log, true, func(addr, off uintptr) uintptr {
+		return addr
+	})
+	tx.reset()
+}
+
+func (tx *PTx) finish() {
+	if tx.done {
+		panic(plainError("runtime: transaction already completed"))
+	}
+	tx.done = true
+}
+
+// reset discards the log entries and releases the log buffer
+func (tx *PTx) reset() {
+	*(*uintptr)(unsafe.Pointer(tx.log)) = 0
+	PersistRange(unsafe.Pointer(tx.log), intSize)
+	tx.ptrs = nil
+	lock(&txInfo.lock)
+	txInfo.busy[tx.slot] = false
+	unlock(&txInfo.lock)
+}
+
+// txLogEntry decodes the log entry that ends at address 'end'. It returns the
+// address, file offset and length of the logged range, and the start address
+// of the entry.
+func txLogEntry(end uintptr) (addr, off, size, start uintptr) {
+	trailer := (*[3]uintptr)(unsafe.Pointer(end - txEntryTrailerSize))
+	addr, off, size = trailer[0], trailer[1], trailer[2]
+	start = end - txEntryTrailerSize - alignUp(size, intSize)
+	return
+}
+
+// revertTxLog copies the data in all entries of the undo log buffer 'log' back
+// to the ranges they were logged from, and then discards the log entries. The
+// entries are reverted from the last to the first, so that a range that was
+// logged more than once is restored to its oldest contents. If 'barriers' is
+// set, the pointers in the ranges are restored using write barriers. The
+// function 'addrOf' returns the current address of a logged range given its
+// address and file offset at the time it was logged.
+func revertTxLog(log uintptr, barriers bool, addrOf func(addr, off uintptr) uintptr) {
+	used := *(*uintptr)(unsafe.Pointer(log))
+	if used == 0 {
+		return
+	}
+	for end := log + txLogHeaderSize + used; end > log+txLogHeaderSize; {
+		addr, off, size, start := txLogEntry(end)
+		dst := unsafe.Pointer(addrOf(addr, off))
+		if barriers {
+			restoreTxPointers(uintptr(dst), start, size)
+		}
+		memmove(dst, unsafe.Pointer(start), size)
+		FlushRange(dst, size)
+		end = start
+	}
+	Fence()
+	*(*uintptr)(unsafe.Pointer(log)) = 0
+	PersistRange(unsafe.Pointer(log), intSize)
+}
+
+// restoreTxPointers writes the pointer words that overlap the range of 'size'
+// bytes at 'dst' using write barriers, with the contents they will have once
+// the logged data at 'src' is copied to the range. Bytes of a pointer word
+// outside the range keep their current value.
+func restoreTxPointers(dst, src, size uintptr) {
+	forEachPointerWordIn(dst, size, func(addr uintptr) bool {
+		v := *(*uintptr)(unsafe.Pointer(addr))
+		for i := uintptr(0); i < intSize; i++ {
+			if b := addr + i; b >= dst && b < dst+size {
+				*(*byte)(add(unsafe.Pointer(&v), i)) = *(*byte)(unsafe.Pointer(src + b - dst))
+			}
+		}
+		*(*unsafe.Pointer)(unsafe.Pointer(addr)) = *(*unsafe.Pointer)(unsafe.Pointer(&v))
+		return true
+	})
+}
+
+// recoverTxLogs reverts the transactions that were not completed before the
+// application last exited. This is called during reconstruction before
+// pointers are swizzled, so that the restored ranges are swizzled as well.
+func recoverTxLogs(arenas []*arenaInfo) {
+	for i, off := range pmemHeader.txLogs {
+		if off == 0 {
+			continue
+		}
+		log := computeRootAddr(off, arenas)
+		if log == nil {
+			throw("Invalid transaction log offset")
+		}
+		revertTxLog(uintptr(log), false, func(addr, off uintptr) uintptr {
+			dst := computeRootAddr(off, arenas)
+			if dst == nil {
+				throw("Invalid transaction log entry")
+			}
+			return uintptr(dst)
+		})
+		txInfo.logs[i] = log
+	}
+}
@@ -0,0 +1,206 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"runtime/internal/math"
+	"unsafe"
+)
+
+// The following variables and functions are used to track the persistent
+// memory heap usage and to notify applications when the usage crosses a
+// registered threshold, or when the persistent memory heap grows.
+
+const (
+	// The maximum number of usage thresholds that can be registered
+	maxUsageThresholds = 8
+)
+
+// Possible states of a usage threshold
+const (
+	thresholdArmed   = iota // Usage is below the threshold
+	thresholdPending        // Usage crossed the threshold, callback not yet run
+	thresholdFired          // Callback was run, waiting for usage to drop
+)
+
+// usageThreshold stores the information about one registered threshold.
+type usageThreshold struct {
+	// The callback is invoked when the usage reaches 'level' bytes. It is
+	// invoked again only after the usage drops below 'rearm' bytes and then
+	// reaches 'level' bytes again.
+	level uint64
+	rearm uint64
+
+	capacity uintptr
+	fn       func(used, capacity uintptr)
+
+	state uint32
+}
+
+var pmemUsage struct {
+	// The number of bytes in in-use persistent memory spans. This is updated
+	// whenever a persistent memory span is allocated or freed.
+	inUse uint64
+
+	// Set to a non-zero value if the callback of any threshold needs to run
+	pending uint32
+
+	// Number of valid entries in thresholds
+	n uint32
+
+	// A lock to serialize threshold registrations
+	lock mutex
+
+	thresholds [maxUsageThresholds]usageThreshold
+}
+
+// PmemAddUsageThreshold registers a callback 'fn' that is invoked when the
+// persistent memory heap usage crosses 'percent' percent of the capacity of
+// the heap. The capacity is computed when the threshold is registered, as the
+// bytes in use plus PmemAvailable(), so it is bounded by PmemOptions.MaxSize
+// if it is set, and by the space left on the device the file is on otherwise.
+// To avoid invoking the callback repeatedly when the usage hovers around the
+// threshold, the callback is invoked again only after the usage drops below
+// (percent - hysteresis) percent of the capacity.
+//
+// The usage only grows when the allocator allocates a persistent memory span,
+// so the usage is checked on the allocation path, and the callback is invoked
+// only after the allocator releases all its locks. So it is safe for 'fn' to
+// allocate memory. Pfree() and the garbage collector only lower the usage,
+// which re-arms a threshold without invoking any callback.
+func PmemAddUsageThreshold(percent, hysteresis int, fn func(used, capacity uintptr)) error {
+	if fn == nil || percent <= 0 || percent > 100 {
+		return errorString("Invalid usage threshold")
+	}
+	if hysteresis < 0 || hysteresis > percent {
+		return errorString("Invalid usage threshold hysteresis")
+	}
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return errorString("Persistent memory is not initialized")
+	}
+	capacity := uintptr(atomic.Load64(&pmemUsage.inUse)) + PmemAvailable()
+	if capacity == 0 {
+		return errorString("Invalid usage threshold")
+	}
+
+	lock(&pmemUsage.lock)
+	n := pmemUsage.n
+	if n == maxUsageThresholds {
+		unlock(&pmemUsage.lock)
+		return errorString("No more space to register usage thresholds")
+	}
+	t := &pmemUsage.thresholds[n]
+	t.level = percentOf(capacity, percent)
+	t.rearm = percentOf(capacity, percent-hysteresis)
+	t.capacity = capacity
+	t.fn = fn
+	t.state = thresholdArmed
+	// Publish the threshold only after it is completely initialized
+	atomic.Store(&pmemUsage.n, n+1)
+	unlock(&pmemUsage.lock)
+	return nil
+}
+
+// percentOf returns 'percent' percent of 'n', rounded down. 'percent' must be
+// between 0 and 100.
+func percentOf(n uintptr, percent int) uint64 {
+	if v, overflow := math.MulUintptr(n, uintptr(percent)); !overflow {
+		return uint64(v / 100)
+	}
+	return uint64(n/100*uintptr(percent) + n%100*uintptr(percent)/100)
+}
+
+var pmemGrowth struct {
+	// The number of persistent memory arenas mapped by the runtime
+	arenas uint64
+
+	// The number of bytes mapped since the grow callback was last invoked
+	pending uintptr
+
+	// The callback registered using SetPmemGrowCallback(), or nil. This is a
+	// *func(newBytes uintptr), so that it can be loaded atomically.
+	fn unsafe.Pointer
+}
+
+// PmemArenasMapped returns the number of persistent memory arenas mapped by
+// the runtime. This includes the arenas found in the persistent memory file
+// when it was opened, and the arenas added as the persistent memory heap grew.
+func PmemArenasMapped() uint64 {
+	return atomic.Load64(&pmemGrowth.arenas)
+}
+
+// SetPmemGrowCallback registers a callback 'fn' that is invoked with the number
+// of bytes newly mapped whenever the persistent memory heap extends its
+// mapping, or removes the callback if 'fn' is nil. The arenas of an existing
+// file are mapped by PmemInit, so a callback registered before PmemInit is
+// also invoked once for them. As for usage thresholds, the callback is invoked
+// only after the allocator releases all its locks, so it is safe for 'fn' to
+// allocate memory. Mappings made concurrently may be reported by a single
+// call.
+func SetPmemGrowCallback(fn func(newBytes uintptr)) {
+	var p *func(newBytes uintptr)
+	if fn != nil {
+		p = new(func(newBytes uintptr))
+		*p = fn
+	}
+	atomicstorep(unsafe.Pointer(&pmemGrowth.fn), unsafe.Pointer(p))
+}
+
+// pmemGrowAdd records that 'n' arenas of 'size' bytes in total were mapped. It
+// runs within the allocator critical section and hence must not invoke the
+// grow callback.
+func pmemGrowAdd(n int, size uintptr) {
+	atomic.Xadd64(&pmemGrowth.arenas, int64(n))
+	atomic.Xadduintptr(&pmemGrowth.pending, size)
+}
+
+// pmemGrowNotify invokes the grow callback with the number of bytes mapped
+// since it was last invoked. This is called from mallocgc() after the
+// allocator has released its locks, and at the end of PmemInit. The pending
+// bytes are discarded if no callback is registered, so that later allocations
+// do not take this path again.
+func pmemGrowNotify() {
+	n := atomic.Xchguintptr(&pmemGrowth.pending, 0)
+	fn := (*func(newBytes uintptr))(atomic.Loadp(unsafe.Pointer(&pmemGrowth.fn)))
+	if n != 0 && fn != nil {
+		(*fn)(n)
+	}
+}
+
+// pmemUsageAdd updates the persistent memory usage by 'delta' bytes and checks
+// whether any registered threshold was crossed. It runs within the allocator
+// critical section and hence must not invoke any callbacks.
+func pmemUsageAdd(delta int64) {
+	used := atomic.Xadd64(&pmemUsage.inUse, delta)
+	n := atomic.Load(&pmemUsage.n)
+	for i := uint32(0); i < n; i++ {
+		t := &pmemUsage.thresholds[i]
+		switch atomic.Load(&t.state) {
+		case thresholdArmed:
+			if used >= t.level && atomic.Cas(&t.state, thresholdArmed, thresholdPending) {
+				atomic.Store(&pmemUsage.pending, 1)
+			}
+		case thresholdFired:
+			if used < t.rearm {
+				atomic.Cas(&t.state, thresholdFired, thresholdArmed)
+			}
+		}
+	}
+}
+
+// pmemUsageNotify invokes the callbacks of all thresholds that were crossed.
+// This is called from mallocgc() after the allocator has released its locks.
+// A threshold can only be crossed when a persistent memory span is allocated,
+// so the paths that free persistent memory do not need to call it.
+func pmemUsageNotify() {
+	if !atomic.Cas(&pmemUsage.pending, 1, 0) {
+		return
+	}
+	used := uintptr(atomic.Load64(&pmemUsage.inUse))
+	n := atomic.Load(&pmemUsage.n)
+	for i := uint32(0); i < n; i++ {
+		t := &pmemUsage.thresholds[i]
+		if atomic.Cas(&t.state, thresholdPending, thresholdFired) {
+			t.fn(used, t.capacity)
+		}
+	}
+}
@@ -11,6 +11,9 @@ const (
 	__MAP_SHARED         = 0x1
 	_MAP_SHARED_VALIDATE = 0x03
 	_MAP_SYNC            = 0x80000
+	_MAP_FIXED_NOREPLACE = 0x100000
+	_EEXIST              = 17
+	_ENOSPC              = 28
 	_EOPNOTSUPP          = 95
 	S_IFMT               = 0xf000
 	S_IFCHR              = 0x2000
@@ -41,6 +44,24 @@ type stat_t struct {
 	x__unused [3]int64
 }
 
+// definitions from syscall/ztypes_linux_amd64.go
+type statfs_t struct {
+	typ     int64
+	bsize   int64
+	blocks  uint64
+	bfree   uint64
+	bavail  uint64
+	files   uint64
+	ffree   uint64
+	fsid    [2]int32
+	namelen int64
+	frsize  int64
+	flags   int64
+	spare   [4]int64
+}
+
+func fstatfs(fd, buf uintptr) int32
+
 var (
 	// runtime package cannot have local variables escape to the heap. Hence
 	// pathBuf is kept as a global buffer for various APIs that need a byte
@@ -56,7 +77,8 @@ var (
 // A utility function to map a persistent memory file in the address space.
 // This function first tries to map the file with MAP_SYNC flag. This succeeds
 // only if the device the file is on supports direct-access (DAX). If this
-// fails, then a normal mapping of the file is done.
+// fails, then a normal mapping of the file is done. A private mapping is never
+// mapped with MAP_SYNC, as it does not write to the file.
 func utilMap(mapAddr unsafe.Pointer, fd int32, len, flags int, off uintptr,
 	rdonly bool) (unsafe.Pointer, bool, int) {
 	protection := _PROT_READ
@@ -64,22 +86,41 @@ func utilMap(mapAddr unsafe.Pointer, fd int32, len, flags int, off uintptr,
 		protection |= _PROT_WRITE
 	}
 
-	if mapAddr != nil {
+	noReplace := flags&_MAP_FIXED_NOREPLACE != 0
+	if mapAddr != nil && !noReplace {
 		flags |= _MAP_FIXED
 	}
 
-	p, err := mmap(mapAddr, uintptr(len), int32(protection),
-		int32(flags|_MAP_SHARED_VALIDATE|_MAP_SYNC), fd, off)
-	if err == 0 {
-		// Mapping with MAP_SYNC succeeded. Return the mapped address and a
-		// boolean value 'true' to indicate this file is indeed on a persistent
-		//  memory device.
-		return p, true, err
-	} else if err == _EOPNOTSUPP || err == _EINVAL {
+	isPmem := true
+	var p unsafe.Pointer
+	err := _EINVAL
+	if flags&_MAP_PRIVATE == 0 {
+		p, err = mmap(mapAddr, uintptr(len), int32(protection),
+			int32(flags|_MAP_SHARED_VALIDATE|_MAP_SYNC), fd, off)
+	}
+	if err == _EOPNOTSUPP || err == _EINVAL {
+		isPmem = false
 		p, err = mmap(mapAddr, uintptr(len), int32(protection), int32(flags), fd, off)
-		return p, false, err
 	}
-	return p, false, err
+	if err == 0 && noReplace && p != mapAddr {
+		// Kernels older than 4.17 do not support MAP_FIXED_NOREPLACE, and
+		// treat the address only as a hint.
+		munmap(p, uintptr(len))
+		return nil, false, _EEXIST
+	}
+	// If mapping with MAP_SYNC succeeded, isPmem is true to indicate that the
+	// file is indeed on a persistent memory device.
+	return p, isPmem && err == 0, err
+}
+
+// adviseHugePages asks the kernel to back the 'n' bytes of the persistent
+// memory file mapped at 'addr' with transparent huge pages. A file on a device
+// that supports direct access (DAX) is mapped using huge pages whenever the
+// mapping is suitably aligned, whereas other files are mapped using huge pages
+// only if the file system supports it. It returns false if the kernel does not
+// support the advice.
+func adviseHugePages(addr unsafe.Pointer, n uintptr) bool {
+	return madvise(addr, n, _MADV_HUGEPAGE) == 0
 }
 
 func getFileSize(fname string) int {
@@ -94,6 +135,23 @@ func getFileSize(fname string) int {
 	return fsize
 }
 
+// getFreeSpace returns the number of bytes that can still be allocated on the
+// file system that the file 'fname' is on, or -1 on error.
+func getFreeSpace(fname string) int {
+	var st statfs_t
+	pathArray := []byte(fname)
+	fd := open(&pathArray[0], _O_RDONLY, 0)
+	if fd < 0 {
+		return -1
+	}
+	ret := fstatfs(uintptr(fd), uintptr(unsafe.Pointer(&st)))
+	closefd(fd)
+	if ret < 0 {
+		return -1
+	}
+	return int(st.bavail * uint64(st.bsize))
+}
+
 func getFileSizeFd(fd int32) int {
 	devDax := utilIsFdDevDax(fd)
 	if devDax {
@@ -155,29 +213,71 @@ func utilIsFdDevDax(fd int32) bool {
 
 // A helper function to get the size of a device dax
 func utilDevDaxSize(fd int32) int {
+	sz := utilDevDaxAttr(fd, "size")
+	if sz < 0 {
+		println("Error reading device dax size file")
+	}
+	return sz
+}
+
+// utilDevDaxAlign returns the alignment of the mappings of the device dax
+// 'fd'. Older kernels only expose it as an attribute of the dax region. The
+// alignment is devDaxDefaultAlign if neither attribute can be read.
+func utilDevDaxAlign(fd int32) uintptr {
+	a := utilDevDaxAttr(fd, "device/align")
+	if a <= 0 {
+		a = utilDevDaxAttr(fd, "device/dax_region/align")
+	}
+	if a <= 0 || a&(a-1) != 0 {
+		return devDaxDefaultAlign
+	}
+	return uintptr(a)
+}
+
+// utilDevDaxAttr reads the integer attribute 'attr' of the device dax 'fd'
+// from /sys/dev/char/M:N/attr, where M and N are the major and minor number of
+// the character device. It returns -1 on error.
+func utilDevDaxAttr(fd int32, attr string) int {
 	var st stat_t
 	var mj, mn [8]byte
 
 	if fstat(uintptr(fd), uintptr(unsafe.Pointer(&st))) < 0 {
-		println("utilDevDaxSize: Error fstat of file")
+		println("utilDevDaxAttr: Error fstat of file")
 		return -1
 	}
 
 	mb := uintToBytes(majorNum(st.rdev), mj[:8])
 	m2b := uintToBytes(minorNum(st.rdev), mn[:8])
 	combineBytes(pathBuf[:], []byte("/sys/dev/char/"), mj[:mb], []byte(":"),
-		mn[:m2b], []byte("/size"))
+		mn[:m2b], []byte("/"), []byte(attr))
 
 	sFd := open(&pathBuf[0], _O_RDONLY, 0)
 	if sFd < 0 {
-		println("Error opening device dax size file")
 		return -1
 	}
 
 	n := read(sFd, unsafe.Pointer(&pathBuf[0]), PATH_MAX)
-	sz := bytesToInt(pathBuf[:n])
 	closefd(sFd)
-	return sz
+	if n <= 0 {
+		return -1
+	}
+	return bytesToInt(pathBuf[:n])
+}
+
+// getDevDaxAlign returns the alignment of the mappings of the device dax
+// 'path', or 0 if 'path' is not a device dax
+func getDevDaxAlign(path string) uintptr {
+	pathArray := []byte(path)
+	fd := open(&pathArray[0], _O_RDONLY, 0)
+	if fd < 0 {
+		return 0
+	}
+	align := uintptr(0)
+	if utilIsFdDevDax(fd) {
+		align = utilDevDaxAlign(fd)
+	}
+	closefd(fd)
+	return align
 }
 
 // combineBytes appends all the contents in args array into the 'result' buffer,
@@ -0,0 +1,208 @@
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Implementation of PmemVerify. It cross-checks the span bitmap and the logged
+// heap type bits of each persistent memory arena against each other, and
+// against the spans of the persistent memory heap. Unlike the checks done
+// during reconstruction (see validateSpanBitmap()), all inconsistencies are
+// reported instead of only the first one.
+
+// PmemError describes an inconsistency in the persistent memory metadata found
+// by PmemVerify().
+type PmemError struct {
+	// Addr is the address of the span or page the inconsistency was found at
+	Addr uintptr
+
+	// Desc describes the inconsistency
+	Desc string
+}
+
+func (e PmemError) Error() string {
+	b := make([]byte, 0, 128)
+	b = append(b, e.Desc...)
+	b = append(b, " at 0x"...)
+	b = appendHexStr(b, uint64(e.Addr))
+	return string(b)
+}
+
+// The descriptions of the inconsistencies reported by PmemVerify()
+const (
+	verifyBadSpanLog    = "span bitmap entry cannot be decoded"
+	verifySpanBeyond    = "span extends beyond the end of its arena"
+	verifySpanOverlap   = "span bitmap entry is within another span"
+	verifySpanMismatch  = "span bitmap entry does not match the heap span"
+	verifySpanNotLogged = "heap span is not recorded in the span bitmap"
+	verifyOptLarge      = "optimized type log flag is set for a large span"
+	verifyOptNoscan     = "optimized type log flag is set for a span without pointers"
+	verifyOptMissing    = "heap span has a type index but its type bits are not logged by type"
+	verifyBadTypIndex   = "logged type index is invalid"
+	verifyTypIndex      = "logged type index does not match the heap span"
+	verifyNoTypeDesc    = "logged type index has no type descriptor"
+	verifyTypeSize      = "logged type size is zero or larger than the span element size"
+	verifyTypePtrdata   = "logged type pointer data is larger than the type size"
+	verifyTypeMask      = "logged type pointer mask does not fit in the span heap type bits"
+)
+
+// PmemVerify checks the consistency of the persistent memory metadata, and
+// returns each inconsistency found. It checks that:
+//  - every non-zero span bitmap entry decodes to a valid span, which is within
+//    its arena and does not overlap another span, and matches the span of the
+//    persistent memory heap at that address
+//  - every in-use persistent memory span is recorded in the span bitmap
+//  - the optimized type log flag of a span is set only for a small span with
+//    pointers, and agrees with the type index of the heap span
+//  - the type logged for a span with the optimized type log flag, or the type
+//    descriptor it refers to, is consistent with the span
+// The world is stopped while the metadata is checked. PmemVerify returns nil if
+// persistent memory is not initialized or no inconsistency is found.
+func PmemVerify() []PmemError {
+	if atomic.Load(&pmemInfo.initState) != initDone {
+		return nil
+	}
+
+	stopTheWorld("pmem verify")
+	// The heap lock is not held, as reporting an inconsistency allocates. The
+	// arenas and spans cannot change while the world is stopped.
+	var v pmemVerifier
+	forEachPArena(v.verifyArena)
+	v.verifySpans()
+	startTheWorld()
+
+	return v.errs
+}
+
+type pmemVerifier struct {
+	errs []PmemError
+
+	// If set, the first inconsistency is printed and the runtime throws,
+	// instead of collecting the inconsistencies in errs. This is used on
+	// the allocation path, which cannot allocate (see pmemCheckAlloc()).
+	throwOnError bool
+}
+
+func (v *pmemVerifier) report(addr uintptr, desc string) {
+	if v.throwOnError {
+		pmemCheckFailed(addr, desc)
+	}
+	v.errs = append(v.errs, PmemError{addr, desc})
+}
+
+// verifyArena walks the span bitmap of the persistent memory arena 'pa'
+func (v *pmemVerifier) verifyArena(pa *pArena) {
+	spanBase := pa.dataStart()
+	bitmap := pa.spanBitmap()
+	for i := uintptr(0); i < uintptr(len(bitmap)); {
+		sVal := bitmap[i]
+		if sVal == 0 {
+			i++
+			continue
+		}
+		addr := spanBase + i<<pageShift
+		spc, npages, large, _, _ := spanLogDecode(sVal)
+		if !validSpanLog(spc, npages, large) {
+			v.report(addr, verifyBadSpanLog)
+			i++
+			continue
+		}
+		if npages > uintptr(len(bitmap))-i {
+			v.report(addr, verifySpanBeyond)
+			i++
+			continue
+		}
+		for j := i + 1; j < i+npages; j++ {
+			if bitmap[j] != 0 {
+				v.report(spanBase+j<<pageShift, verifySpanOverlap)
+			}
+		}
+		v.verifySpan(pa, sVal, addr)
+		i += npages
+	}
+}
+
+// verifySpan checks the span logged as 'sVal' at address 'addr' of the
+// persistent memory arena 'pa' against the heap span at that address, and
+// checks the type logged for it.
+func (v *pmemVerifier) verifySpan(pa *pArena, sVal uint32, addr uintptr) {
+	spc, npages, large, _, optLog := spanLogDecode(sVal)
+	s := spanOfHeap(addr)
+	if s == nil || s.memtype != isPersistent || s.base() != addr ||
+		s.npages != npages || s.spanclass != spc {
+		v.report(addr, verifySpanMismatch)
+		s = nil
+	}
+
+	if large {
+		// Bit 1 is not used by a large span, see spanLogEncode()
+		if sVal>>1&1 != 0 {
+			v.report(addr, verifyOptLarge)
+		}
+		return
+	}
+	if !optLog {
+		if s != nil && s.typIndex != 0 {
+			v.report(addr, verifyOptMissing)
+		}
+		return
+	}
+	if spc.noscan() {
+		v.report(addr, verifyOptNoscan)
+		return
+	}
+
+	tl := (*spanTypeLog)(pmemHeapBitsAddr(addr, pa))
+	typIndex := tl.typIndex
+	if typIndex <= 0 || typIndex >= maxCacheTypes {
+		v.report(addr, verifyBadTypIndex)
+		return
+	}
+	if s != nil && s.typIndex != typIndex {
+		v.report(addr, verifyTypIndex)
+	}
+
+	// The logged type is laid out as described by spanTypeLog
+	var size, ptrdata uintptr
+	if typIndex >= 2 {
+		if pmemHeader.typeMap[typIndex-2] == 0 {
+			v.report(addr, verifyNoTypeDesc)
+			return
+		}
+		d := &pmemHeader.typeDescs[typIndex-2]
+		size, ptrdata = d.size, d.ptrdata
+	} else {
+		size, ptrdata = tl.size, tl.ptrdata
+	}
+
+	if size == 0 || size > uintptr(class_to_size[spc.sizeclass()]) {
+		v.report(addr, verifyTypeSize)
+	}
+	if ptrdata > size {
+		v.report(addr, verifyTypePtrdata)
+		return
+	}
+	maskBytes := (ptrdata/intSize + 7) / 8
+	if typIndex >= 2 {
+		if maskBytes > maxTypeMaskBytes {
+			v.report(addr, verifyTypeMask)
+		}
+	} else if unsafe.Sizeof(*tl)+maskBytes > (npages<<pageShift)/bytesPerBitmapByte {
+		v.report(addr, verifyTypeMask)
+	}
+}
+
+// verifySpans checks that every in-use persistent memory span is recorded in
+// the span bitmap. Whether the recorded value matches the span is checked by
+// verifySpan().
+func (v *pmemVerifier) verifySpans() {
+	for _, s := range mheap_.allspans {
+		if s.state.get() != mSpanInUse || s.memtype != isPersistent {
+			continue
+		}
+		if *spanLogAddr(s) == 0 {
+			v.report(s.base(), verifySpanNotLogged)
+		}
+	}
+}
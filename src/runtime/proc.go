@@ -4318,6 +4318,7 @@ func (pp *p) destroy() {
 	})
 	freemcache(pp.mcache)
 	pp.mcache = nil
+	pmemOpStats.dead.take(&pp.pmemOps)
 	gfpurge(pp)
 	traceProcFree(pp)
 	if raceenabled {
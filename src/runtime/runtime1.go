@@ -318,6 +318,9 @@ var debug struct {
 	schedtrace         int32
 	tracebackancestors int32
 	asyncpreemptoff    int32
+	pmemcheck          int32
+	pmemfence          int32
+	pmemverbose        int32
 }
 
 var dbgvars = []dbgVar{
@@ -339,12 +342,16 @@ var dbgvars = []dbgVar{
 	{"schedtrace", &debug.schedtrace},
 	{"tracebackancestors", &debug.tracebackancestors},
 	{"asyncpreemptoff", &debug.asyncpreemptoff},
+	{"pmemcheck", &debug.pmemcheck},
+	{"pmemfence", &debug.pmemfence},
+	{"pmemverbose", &debug.pmemverbose},
 }
 
 func parsedebugvars() {
 	// defaults
 	debug.cgocheck = 1
 	debug.invalidptr = 1
+	debug.pmemfence = 1
 
 	for p := gogetenv("GODEBUG"); p != ""; {
 		field := ""
@@ -575,6 +575,10 @@ type m struct {
 	// Accessed atomically.
 	signalPending uint32
 
+	// Persistent memory ranges written by the allocator during the current
+	// persistent memory allocation. See pmemDirtyList.
+	pmemDirty pmemDirtyList
+
 	dlogPerM
 
 	mOS
@@ -657,6 +661,10 @@ type p struct {
 	// This is 0 if the timer heap is empty.
 	timer0When uint64
 
+	// Counters of the persistent memory flush and fence operations done on
+	// this P. These are updated using atomic functions.
+	pmemOps pmemOpCounters
+
 	// Per-P GC state
 	gcAssistTime         int64    // Nanoseconds in assistAlloc
 	gcFractionalMarkTime int64    // Nanoseconds in fractional mark worker (atomic)
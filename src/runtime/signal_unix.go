@@ -700,6 +700,9 @@ func sighandler(sig uint32, info *siginfo, ctxt unsafe.Pointer, gp *g) {
 func sigpanic() {
 	g := getg()
 	if !canpanic(g) {
+		if g.sig == _SIGBUS {
+			printPmemMediaError(g.sigcode1)
+		}
 		throw("unexpected signal during runtime execution")
 	}
 
@@ -708,6 +711,10 @@ func sigpanic() {
 		if g.sigcode0 == _BUS_ADRERR && g.sigcode1 < 0x1000 {
 			panicmem()
 		}
+		// Bad blocks of a persistent memory device are reported as SIGBUS
+		if e := pmemMediaError(g.sigcode1); e != nil {
+			panic(e)
+		}
 		// Support runtime/debug.SetPanicOnFault.
 		if g.paniconfault {
 			panicmemAddr(g.sigcode1)
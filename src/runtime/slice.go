@@ -83,6 +83,17 @@ func makeslicecopy(et *_type, tolen int, fromlen int, from unsafe.Pointer) unsaf
 // The memtype parameter indicates if memory has to be allocated from volatile
 // memory or persistent memory.
 func makeslice(et *_type, len, cap int, memtype int) unsafe.Pointer {
+	p := mallocgc(makesliceMem(et, len, cap), et, needZeroed, memtype)
+	if p == nil {
+		// Only persistent memory allocations fail
+		panic(pmemAllocError())
+	}
+	return p
+}
+
+// makesliceMem returns the size of the backing array of a slice of 'cap'
+// elements of type 'et'. It panics if 'len' or 'cap' is out of range.
+func makesliceMem(et *_type, len, cap int) uintptr {
 	mem, overflow := math.MulUintptr(et.size, uintptr(cap))
 	if overflow || mem > maxAlloc || len < 0 || len > cap {
 		// NOTE: Produce a 'len out of range' error instead of a
@@ -96,8 +107,25 @@ func makeslice(et *_type, len, cap int, memtype int) unsafe.Pointer {
 		}
 		panicmakeslicecap()
 	}
+	return mem
+}
 
-	return mallocgc(mem, et, needZeroed, memtype)
+// PmakeSlice allocates the backing array of a slice of length 'len' and
+// capacity 'cap' in persistent memory and returns a pointer to it. The element
+// type of the slice is the dynamic type of 'elemType'. The value of 'elemType'
+// is not used. E.g.:
+//
+//	s := (*[1 << 20]T)(runtime.PmakeSlice(T{}, n, n))[:n:n]
+//
+// PmakeSlice returns nil if there is no space left for the array in the
+// persistent memory file, whereas the pmake builtin panics with
+// ErrPmemOutOfSpace.
+func PmakeSlice(elemType interface{}, len, cap int) unsafe.Pointer {
+	et := efaceOf(&elemType)._type
+	if et == nil {
+		panic(plainError("runtime: PmakeSlice called with a nil element type"))
+	}
+	return mallocgc(makesliceMem(et, len, cap), et, needZeroed, isPersistent)
 }
 
 func makeslice64(et *_type, len64, cap64 int64, memtype int) unsafe.Pointer {
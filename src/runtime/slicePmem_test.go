@@ -3,7 +3,9 @@
 package runtime_test
 
 import (
+	"runtime"
 	"testing"
+	"unsafe"
 )
 
 func TestPmemSideEffectOrder(t *testing.T) {
@@ -13,3 +15,77 @@ func TestPmemSideEffectOrder(t *testing.T) {
 		t.Error("append failed: ", x[0], x[1])
 	}
 }
+
+func TestPmemPmakeSlice(t *testing.T) {
+	type elem struct {
+		val int
+		ptr *int
+	}
+	// The pointer in the last element is at offset 8 from the element start
+	const ptrEnd = 16
+
+	for _, n := range []int{16, 1 << 16} {
+		p := runtime.PmakeSlice(elem{}, n, n)
+		if !runtime.InPmem(uintptr(p)) {
+			t.Fatalf("backing array of %d elements is not in persistent memory", n)
+		}
+		s := (*[1 << 20]elem)(p)[:n:n]
+		for i := range s {
+			s[i].val = i
+			s[i].ptr = pnew(int)
+			*s[i].ptr = i
+		}
+		runtime.GC()
+		for i := range s {
+			if s[i].val != i || *s[i].ptr != i {
+				t.Fatalf("element %d of backing array of %d elements corrupted", i, n)
+			}
+		}
+		size := uintptr(n-1)*unsafe.Sizeof(elem{}) + ptrEnd
+		if !runtime.PmemHeapBitsLogged(p, size) {
+			t.Fatalf("heap type bits not logged for backing array of %d elements", n)
+		}
+	}
+}
+
+// TestPmemPmakeSliceArenaBoundary allocates a backing array that is larger
+// than a heap arena, so its span begins in one heap arena and ends in the next.
+// The heap type bits of the array are logged in the metadata of the persistent
+// memory arena that holds the span, and must be found at the same offset
+// whichever heap arena an address is in.
+func TestPmemPmakeSliceArenaBoundary(t *testing.T) {
+	type elem struct {
+		val int
+		ptr *int
+	}
+	const (
+		heapArenaBytes = 64 << 20
+		ptrEnd         = 16
+		n              = heapArenaBytes/16 + 1<<16
+	)
+	p := runtime.PmakeSlice(elem{}, n, n)
+	s := (*[n]elem)(p)[:n:n]
+	boundary := (uintptr(p) + heapArenaBytes - 1) &^ (heapArenaBytes - 1)
+	first := int((boundary - uintptr(p)) / unsafe.Sizeof(elem{}))
+	if first <= 0 || first >= n {
+		t.Fatalf("backing array at %p does not cross a heap arena boundary", p)
+	}
+	// Set the pointers in the elements on either side of the boundary
+	for i := first - 1024; i < first+1024; i++ {
+		s[i].val = i
+		s[i].ptr = pnew(int)
+		*s[i].ptr = i
+	}
+	runtime.GC()
+	for i := first - 1024; i < first+1024; i++ {
+		if s[i].val != i || *s[i].ptr != i {
+			t.Fatalf("element %d of backing array corrupted", i)
+		}
+	}
+	if !runtime.PmemHeapBitsLogged(p, uintptr(n-1)*unsafe.Sizeof(elem{})+ptrEnd) {
+		t.Fatal("heap type bits not logged for backing array crossing a heap arena")
+	}
+	if errs := runtime.PmemVerify(); errs != nil {
+		t.Fatalf("PmemVerify reported %v", errs)
+	}
+}
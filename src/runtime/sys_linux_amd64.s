@@ -52,6 +52,7 @@
 #define SYS_faccessat		269
 #define SYS_epoll_pwait		281
 #define SYS_fallocate		285
+#define SYS_fstatfs		138
 #define SYS_epoll_create1	291
 #define SYS_pipe2		293
 
@@ -167,6 +168,17 @@ TEXT runtime·fstat(SB),NOSPLIT,$0-20
 	MOVL	AX, ret+16(FP)
 	RET
 
+TEXT runtime·fstatfs(SB),NOSPLIT,$0-20
+	MOVQ	fd+0(FP), DI
+	MOVQ	buf+8(FP), SI
+	MOVL	$SYS_fstatfs, AX
+	SYSCALL
+	CMPQ	AX, $0xfffffffffffff001
+	JLS	2(PC)
+	MOVL	$-1, AX
+	MOVL	AX, ret+16(FP)
+	RET
+
 TEXT runtime·unlinkat(SB),NOSPLIT,$0-28
 	MOVQ	fd+0(FP), DI
 	MOVQ	path+8(FP), SI
@@ -68,7 +68,9 @@ const (
 	traceEvUserTaskEnd       = 46 // end of a task [timestamp, internal task id, stack]
 	traceEvUserRegion        = 47 // trace.WithRegion [timestamp, internal task id, mode(0:start, 1:end), stack, name string]
 	traceEvUserLog           = 48 // trace.Log [timestamp, internal task id, key string id, stack, value string]
-	traceEvCount             = 49
+	traceEvPmemAlloc         = 49 // persistent memory allocation [timestamp, size, new span, stack]
+	traceEvPmemFree          = 50 // persistent memory free [timestamp, size, whole span, stack]
+	traceEvCount             = 51
 	// Byte is used but only 6 bits are available for event type.
 	// The remaining 2 bits are used to specify the number of arguments.
 	// That means, the max event type value is 63.
@@ -1154,6 +1156,28 @@ func traceNextGC() {
 	}
 }
 
+// tracePmemAlloc records the allocation of a persistent memory object of
+// 'size' bytes. newSpan is true if a span had to be allocated and logged for
+// the object.
+func tracePmemAlloc(size uintptr, newSpan bool) {
+	var n uint64
+	if newSpan {
+		n = 1
+	}
+	traceEvent(traceEvPmemAlloc, 1, uint64(size), n)
+}
+
+// tracePmemFree records the release of 'size' bytes of persistent memory.
+// span is true if a whole span is returned to the heap, in which case no stack
+// is recorded, as spans are freed by the sweeper.
+func tracePmemFree(size uintptr, span bool) {
+	if span {
+		traceEvent(traceEvPmemFree, 0, uint64(size), 1)
+		return
+	}
+	traceEvent(traceEvPmemFree, 1, uint64(size), 0)
+}
+
 // To access runtime functions from runtime/trace.
 // See runtime/trace/annotation.go
 
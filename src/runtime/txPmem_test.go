@@ -0,0 +1,346 @@
+// +build pmemTest
+
+package runtime_test
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestPmemTxAbort(t *testing.T) {
+	type T struct {
+		a   int
+		buf [37]byte
+		p   *int
+	}
+	x := pnew(T)
+	// Prevent the compiler from allocating 'x' on the stack.
+	t.Logf("%p", x)
+	x.a = 1
+	for i := range x.buf {
+		x.buf[i] = byte(i)
+	}
+	x.p = pnew(int)
+	old := x.p
+
+	tx, err := runtime.PTxBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Log(unsafe.Pointer(&x.a), unsafe.Sizeof(x.a)); err != nil {
+		t.Fatal(err)
+	}
+	x.a = 2
+	if err := tx.Log(unsafe.Pointer(&x.buf), unsafe.Sizeof(x.buf)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range x.buf {
+		x.buf[i] = 0xff
+	}
+	// Log a range that was already logged. Abort must restore the contents
+	// at the time the range was first logged.
+	if err := tx.Log(unsafe.Pointer(x), unsafe.Sizeof(*x)); err != nil {
+		t.Fatal(err)
+	}
+	x.a = 3
+	x.p = nil
+	tx.Abort()
+
+	if x.a != 1 || x.p != old {
+		t.Fatal("Abort did not restore the logged fields")
+	}
+	for i := range x.buf {
+		if x.buf[i] != byte(i) {
+			t.Fatalf("Abort did not restore byte %d of the logged array", i)
+		}
+	}
+}
+
+func TestPmemTxAbortPointer(t *testing.T) {
+	type node struct {
+		v    int
+		next *node
+	}
+	x := pnew(node)
+	t.Logf("%p", x)
+	x.next = pnew(node)
+	x.next.v = 42
+
+	tx, err := runtime.PTxBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Log(unsafe.Pointer(&x.next), unsafe.Sizeof(x.next)); err != nil {
+		t.Fatal(err)
+	}
+	// Drop the only other reference to the logged object, and reuse its
+	// memory if the garbage collector frees it.
+	x.next = nil
+	runtime.GC()
+	reuse := make([]*node, 1024)
+	for i := range reuse {
+		reuse[i] = pnew(node)
+		reuse[i].v = -1
+	}
+	tx.Abort()
+	runtime.GC()
+
+	if x.next == nil || x.next.v != 42 {
+		t.Fatal("Abort restored a pointer to a freed object")
+	}
+	runtime.KeepAlive(reuse)
+}
+
+func TestPmemTxCommit(t *testing.T) {
+	x := pmake([]int, 1024)
+	t.Logf("%p", x)
+	tx, err := runtime.PTxBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Log(unsafe.Pointer(&x[0]), 8*1024); err != nil {
+		t.Fatal(err)
+	}
+	for i := range x {
+		x[i] = i
+	}
+	tx.Commit()
+	for i := range x {
+		if x[i] != i {
+			t.Fatal("Commit did not retain the updates")
+		}
+	}
+
+	tx, err = runtime.PTxBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Abort()
+	if tx.Log(unsafe.Pointer(new(int)), 8) == nil {
+		t.Error("volatile memory range accepted by Log")
+	}
+	big := pmake([]byte, 1<<20)
+	if err := tx.Log(unsafe.Pointer(&big[0]), uintptr(len(big))); !errors.Is(err, runtime.ErrTxTooLarge) {
+		t.Errorf("Log of a range larger than the log returned %v, expected %v", err,
+			runtime.ErrTxTooLarge)
+	}
+	// The transaction is still usable after a range does not fit in the log
+	if err := tx.Log(unsafe.Pointer(&big[0]), 8); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPmemArenaLogInvalidRange(t *testing.T) {
+	x := pnew([64]byte)
+	// Prevent the compiler from allocating 'x' on the stack.
+	t.Logf("%p", x)
+	if err := runtime.PmemArenaTryLog(unsafe.Pointer(&x[0]), 1<<62); err == nil {
+		t.Error("range beyond the end of the arena accepted")
+	}
+	if err := runtime.PmemArenaTryLog(unsafe.Pointer(&x[0]), 8); err != nil {
+		t.Error(err)
+	}
+	runtime.PmemArenaCommitLog(unsafe.Pointer(&x[0]))
+}
+
+func TestPmemArenaLogSpill(t *testing.T) {
+	const N = 100
+	x := pmake([]int, N)
+	t.Logf("%p", x)
+	for i := range x {
+		x[i] = i
+	}
+
+	for round := 0; round < 2; round++ {
+		for i := range x {
+			runtime.PmemArenaLog(unsafe.Pointer(&x[i]), 8)
+			x[i] = -1
+		}
+		// Log an address again. Reverting must restore its oldest value.
+		runtime.PmemArenaLog(unsafe.Pointer(&x[0]), 8)
+		x[0] = -2
+		runtime.PmemArenaRevertLog(unsafe.Pointer(&x[0]))
+		for i := range x {
+			if x[i] != i {
+				t.Fatalf("round %d: element %d not reverted: %d", round, i, x[i])
+			}
+		}
+	}
+
+	for i := range x {
+		runtime.PmemArenaLog(unsafe.Pointer(&x[i]), 8)
+		x[i] = 2 * i
+	}
+	runtime.PmemArenaCommitLog(unsafe.Pointer(&x[0]))
+	runtime.PmemArenaRevertLog(unsafe.Pointer(&x[0]))
+	for i := range x {
+		if x[i] != 2*i {
+			t.Fatalf("committed element %d reverted", i)
+		}
+	}
+}
+
+// TestPmemArenaLogSpillCallback checks that the spill buffer of an arena log is
+// allocated without holding the log lock, so that the callbacks invoked by the
+// allocation can use the log.
+func TestPmemArenaLogSpillCallback(t *testing.T) {
+	const N = 4096
+	x := pmake([]int, N)
+	t.Logf("%p", x)
+	entries := -1
+	runtime.SetPmemGrowCallback(func(newBytes uintptr) {
+		entries = runtime.PmemArenaLogEntries(unsafe.Pointer(&x[0]))
+	})
+	defer runtime.SetPmemGrowCallback(nil)
+
+	runtime.PmemGrowAddPending(1)
+	for i := range x {
+		if err := runtime.PmemArenaTryLog(unsafe.Pointer(&x[i]), 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.PmemArenaCommitLog(unsafe.Pointer(&x[0]))
+	if entries == -1 {
+		t.Fatal("grow callback not invoked while logging")
+	}
+}
+
+func TestPmemArenaLogRange(t *testing.T) {
+	type T struct {
+		a    [37]byte
+		b    [100]byte
+		name string
+	}
+	x := pnew(T)
+	t.Logf("%p", x)
+	for i := range x.a {
+		x.a[i] = byte(i)
+	}
+	for i := range x.b {
+		x.b[i] = byte(2 * i)
+	}
+	x.name = "persistent"
+
+	runtime.PmemArenaLog(unsafe.Pointer(&x.a), unsafe.Sizeof(x.a))
+	runtime.PmemArenaLog(unsafe.Pointer(&x.b), unsafe.Sizeof(x.b))
+	runtime.PmemArenaLog(unsafe.Pointer(&x.name), unsafe.Sizeof(x.name))
+	for i := range x.a {
+		x.a[i] = 0xff
+	}
+	for i := range x.b {
+		x.b[i] = 0xff
+	}
+	x.name = "volatile"
+
+	// Simulate a crash by reverting the log as the recovery code would
+	runtime.PmemArenaRevertLog(unsafe.Pointer(x))
+	for i := range x.a {
+		if x.a[i] != byte(i) {
+			t.Fatalf("byte %d of the 37-byte range not restored", i)
+		}
+	}
+	for i := range x.b {
+		if x.b[i] != byte(2*i) {
+			t.Fatalf("byte %d of the 100-byte range not restored", i)
+		}
+	}
+	if x.name != "persistent" {
+		t.Fatalf("string header not restored: %q", x.name)
+	}
+}
+
+func TestPmemArenaLogConcurrent(t *testing.T) {
+	const (
+		G = 8   // number of goroutines
+		M = 200 // number of words logged by each goroutine
+	)
+	x := pnew([G * M]uint64)
+	t.Logf("%p", x)
+	for i := range x {
+		x[i] = uint64(i)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < G; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := g * M; j < (g+1)*M; j++ {
+				runtime.PmemArenaLog(unsafe.Pointer(&x[j]), 8)
+				x[j] = ^uint64(0)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := runtime.PmemArenaLogEntries(unsafe.Pointer(x)); n != G*M {
+		t.Fatalf("arena log has %d entries, expected %d", n, G*M)
+	}
+	runtime.PmemArenaRevertLog(unsafe.Pointer(x))
+	for i := range x {
+		if x[i] != uint64(i) {
+			t.Fatalf("element %d not reverted", i)
+		}
+	}
+
+	// Log and commit concurrently
+	for g := 0; g < G; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := g * M; j < (g+1)*M; j++ {
+				runtime.PmemArenaLog(unsafe.Pointer(&x[j]), 8)
+				x[j] = uint64(2 * j)
+				runtime.PmemArenaCommitLog(unsafe.Pointer(x))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := runtime.PmemArenaLogEntries(unsafe.Pointer(x)); n != 0 {
+		t.Fatalf("arena log has %d entries after commit", n)
+	}
+	runtime.PmemArenaRevertLog(unsafe.Pointer(x))
+	for i := range x {
+		if x[i] != uint64(2*i) {
+			t.Fatalf("committed element %d reverted", i)
+		}
+	}
+}
+
+func TestPmemTxClear(t *testing.T) {
+	type T struct {
+		a int
+		p *int
+		q *int
+	}
+	x := pnew(T)
+	t.Logf("%p", x)
+	x.a = 1
+	x.p = pnew(int)
+	x.q = pnew(int)
+	oldP, oldQ := x.p, x.q
+
+	tx, err := runtime.PTxBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A range that ends in the middle of a pointer is not cleared
+	if err := tx.Clear(unsafe.Pointer(x), unsafe.Sizeof(x.a)+4); err == nil {
+		t.Fatal("Clear of a partial pointer succeeded")
+	}
+	if x.p != oldP {
+		t.Fatal("failed Clear modified the range")
+	}
+	if err := tx.Clear(unsafe.Pointer(x), unsafe.Sizeof(*x)); err != nil {
+		t.Fatal(err)
+	}
+	if x.a != 0 || x.p != nil || x.q != nil {
+		t.Fatal("Clear did not zero the range")
+	}
+	tx.Abort()
+	if x.a != 1 || x.p != oldP || x.q != oldQ {
+		t.Fatal("Abort did not restore the cleared range")
+	}
+}